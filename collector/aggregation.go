@@ -0,0 +1,173 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+type aggregateGroup struct {
+	// The name of the aggregated metric.
+	name        string
+	labelnames  []string
+	labelvalues []string
+	valueType   prometheus.ValueType
+	value       float64
+}
+
+// aggregator accumulates the samples of one metric for an aggregation.
+type aggregator struct {
+	*config.Aggregation
+	help string
+	// The type of the samples of each metric name, which must not mix
+	// counters and gauges.
+	types  map[string]prometheus.ValueType
+	groups map[string]*aggregateGroup
+	err    error
+}
+
+// newAggregators returns the aggregators of a module by source metric name.
+func newAggregators(aggregations []*config.Aggregation) map[string][]*aggregator {
+	aggregators := map[string][]*aggregator{}
+	for _, a := range aggregations {
+		aggregators[a.Metric] = append(aggregators[a.Metric], &aggregator{Aggregation: a, types: map[string]prometheus.ValueType{}, groups: map[string]*aggregateGroup{}})
+	}
+	return aggregators
+}
+
+// add accumulates the samples of the source metric. Samples of metrics
+// derived from it, such as the _info metric of an EnumAsInfo, are aggregated
+// separately, into the aggregation's name with the same suffix.
+func (a *aggregator) add(metric *config.Metric, samples []prometheus.Metric) {
+	without := map[string]struct{}{}
+	for _, l := range a.Without {
+		without[l] = struct{}{}
+	}
+	for _, sample := range samples {
+		name := sampleName(sample)
+		m := &dto.Metric{}
+		if err := sample.Write(m); err != nil {
+			continue
+		}
+		var value float64
+		var valueType prometheus.ValueType
+		switch {
+		case m.Counter != nil:
+			value, valueType = m.Counter.GetValue(), prometheus.CounterValue
+		case m.Gauge != nil:
+			value, valueType = m.Gauge.GetValue(), prometheus.GaugeValue
+		default:
+			continue
+		}
+		if t, ok := a.types[name]; !ok {
+			a.types[name] = valueType
+		} else if t != valueType {
+			a.err = fmt.Errorf("metric %s has both counter and gauge samples", name)
+			continue
+		}
+		a.help = fmt.Sprintf("%s (%s without %s)", metric.Help, a.Op, strings.Join(a.Without, ","))
+
+		// Label pairs are sorted by name.
+		group := &aggregateGroup{name: a.Name + strings.TrimPrefix(name, metric.Name), valueType: valueType, value: value}
+		for _, l := range m.Label {
+			if _, ok := without[l.GetName()]; ok {
+				continue
+			}
+			group.labelnames = append(group.labelnames, l.GetName())
+			group.labelvalues = append(group.labelvalues, l.GetValue())
+		}
+		key := group.name + "\xfe" + strings.Join(group.labelnames, "\xff") + "\xfe" + strings.Join(group.labelvalues, "\xff")
+		existing, ok := a.groups[key]
+		if !ok {
+			a.groups[key] = group
+			continue
+		}
+		switch a.Op {
+		case "sum":
+			existing.value += value
+		case "min":
+			if value < existing.value {
+				existing.value = value
+			}
+		case "max":
+			if value > existing.value {
+				existing.value = value
+			}
+		}
+	}
+}
+
+// metrics returns the aggregated samples.
+func (a *aggregator) metrics() []prometheus.Metric {
+	if a.err != nil {
+		return []prometheus.Metric{prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error aggregating metric", nil, nil),
+			fmt.Errorf("error for aggregated metric %s: %w", a.Name, a.err))}
+	}
+	keys := make([]string, 0, len(a.groups))
+	for k := range a.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := make([]prometheus.Metric, 0, len(keys))
+	for _, k := range keys {
+		group := a.groups[k]
+		// Sums of counters are counters, anything else a gauge.
+		valueType := prometheus.GaugeValue
+		if a.Op == "sum" && group.valueType == prometheus.CounterValue {
+			valueType = prometheus.CounterValue
+		}
+		sample, err := prometheus.NewConstMetric(prometheus.NewDesc(group.name, a.help, group.labelnames, nil),
+			valueType, group.value, group.labelvalues...)
+		if err != nil {
+			sample = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for aggregation", nil, nil),
+				fmt.Errorf("error for aggregated metric %s with labels %v: %v", group.name, group.labelvalues, err))
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// sampleName returns the name of the metric of the sample, which its Desc
+// only exposes through String.
+func sampleName(sample prometheus.Metric) string {
+	_, rest, ok := strings.Cut(sample.Desc().String(), `fqName: "`)
+	if !ok {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, `"`)
+	return name
+}
+
+// sampleHelp returns the help of the metric of the sample, which its Desc
+// only exposes through String.
+func sampleHelp(sample prometheus.Metric) string {
+	_, rest, ok := strings.Cut(sample.Desc().String(), `help: `)
+	if !ok {
+		return ""
+	}
+	quoted, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return ""
+	}
+	help, _ := strconv.Unquote(quoted)
+	return help
+}
@@ -38,9 +38,41 @@ var (
 	// 64-bit float mantissa: https://en.wikipedia.org/wiki/Double-precision_floating-point_format
 	float64Mantissa uint64 = 9007199254740992
 	wrapCounters           = kingpin.Flag("snmp.wrap-large-counters", "Wrap 64-bit counters to avoid floating point rounding.").Default("true").Bool()
+	strictTypes            = kingpin.Flag("snmp.strict-types", "Warn and count when the type of a returned value contradicts the configured metric type.").Default("false").Bool()
 	srcAddress             = kingpin.Flag("snmp.source-address", "Source address to send snmp from in the format 'address:port' to use when connecting targets. If the port parameter is empty or '0', as in '127.0.0.1:' or '[::1]:0', a source port number is automatically (random) chosen.").Default("").String()
+	unsupportedTTL         = kingpin.Flag("snmp.unsupported-oid-ttl", "Skip OIDs of a target which returned nothing for this long, once they did so for 3 scrapes in a row. 0 disables this.").Default("0s").Duration()
+	preferredFamily        = kingpin.Flag("snmp.preferred-address-family", "Address family scraped first for targets resolving to both IPv4 and IPv6 addresses. If a scrape gets no answer, the next one uses the other family. With system, the target is scraped at the address the system resolver returns first.").Default("ipv4").Enum("ipv4", "ipv6", "system")
+	credentialsTTL         = kingpin.Flag("snmp.credentials-ttl", "How long the credentials which last worked for a target of an auth with secondary credentials or users are remembered after its last scrape, after which the first ones are tried first again.").Default("1h").Duration()
+	familyTTL              = kingpin.Flag("snmp.address-family-ttl", "How long the address family a dual-stack target was last scraped at is remembered, after which the preferred family is scraped again.").Default("1h").Duration()
+	srcPortRange           = kingpin.Flag("snmp.source-port-range", "Range of source ports such as '20000-20100' to send snmp from, so firewalls can use stable rules. Each concurrent connection uses its own port, waiting for one to become free if needed. Combined with the address of --snmp.source-address.").Default("").String()
+	counter64Exact         = kingpin.Flag("snmp.counter64-exact", "Also export Counter64 values above 2^53, which lose precision as floats, exactly: as a label of an info metric or as high and low 32 bit gauges.").Default("none").Enum("none", "info", "split")
+	icmpCheck              = kingpin.Flag("snmp.icmp-check", "Ping targets before scraping them, and fail the scrape right away if they do not answer. Needs CAP_NET_RAW, or the exporter's group in the net.ipv4.ping_group_range sysctl.").Default("false").Bool()
+	icmpTimeout            = kingpin.Flag("snmp.icmp-timeout", "How long to wait for the answer to the ping of --snmp.icmp-check.").Default("1s").Duration()
+	deviceInfo             = kingpin.Flag("snmp.device-info", "Get sysName, sysDescr and sysLocation in every scrape, and export them as labels of snmp_device_info.").Default("false").Bool()
+	deviceVendor           = kingpin.Flag("snmp.device-info-vendor", "Also get sysObjectID with --snmp.device-info, and add the vendor its IANA enterprise number is assigned to as a vendor label of snmp_device_info.").Default("false").Bool()
+	walkProgress           = kingpin.Flag("snmp.walk-progress-interval", "Log the current OID, rows and bytes of walks at debug level at this interval while they run, to see where long walks are stuck. 0 disables this.").Default("0s").Duration()
+	walkSample             = kingpin.Flag("snmp.walk-progress-sample", "Fraction of walks whose progress is logged with --snmp.walk-progress-interval, from 0 to 1.").Default("1").Float64()
+	scrapeLabels           = kingpin.Flag("snmp.scrape-labels", "Add the module and auth each sample was scraped with as module and auth labels, so that modules scraped together can be told apart.").Default("false").Bool()
+	engineInfo             = kingpin.Flag("snmp.engine-info", "Export the SNMP engine ID of targets as a label of snmp_engine_info, taken from the SNMPv3 discovery or from snmpEngineID, so that devices behind the same address can be told apart.").Default("false").Bool()
+	adaptiveSize           = kingpin.Flag("snmp.adaptive-message-size", "Halve the size of the responses requested from a target, by lowering max_repetitions, when a walk times out after the target answered, as large responses may be dropped on the way. The size is doubled back after 10 successful scrapes.").Default("false").Bool()
+	countUnexpected        = kingpin.Flag("snmp.unexpected-varbinds", "Count the varbinds targets return which no metric of the module covers, such as extra rows, in snmp_unexpected_varbinds_total by module and walked subtree, rather than silently discarding them.").Default("false").Bool()
+	walkPageTTL            = kingpin.Flag("snmp.walk-page-ttl", "How long the pages of walks with a page_size are kept after the last scrape of their target, after which the walk starts over.").Default("1h").Duration()
+	fastCodec              = kingpin.Flag("snmp.fast-codec", "Encode and decode the requests of SNMPv1 and SNMPv2c targets over UDP with the exporter's own pooled codec rather than gosnmp's, which allocates far less per varbind. Packet traces of --snmp.debug-packets always use gosnmp's.").Default("false").Bool()
+	collectionCost         = kingpin.Flag("snmp.collection-cost", "Measure the CPU time and allocations of processing the PDUs of each module into samples, in snmp_collection_cpu_seconds_total and snmp_collection_allocated_bytes_total. The CPU time is only measured on Linux.").Default("true").Bool()
+	watchdogGrace          = kingpin.Flag("snmp.watchdog-grace", "Abandon scrapes still running this long after their deadline passed or their request was canceled, such as ones wedged in a read, logging the stacks of the scrape goroutines and counting them in snmp_scrapes_abandoned_total. 0 disables this.").Default("30s").Duration()
 )
 
+// RFC 2579 RowStatus values. Agents only report the first three, the others
+// being actions which can only be written.
+var rowStatusValues = map[int]string{
+	1: "active",
+	2: "notInService",
+	3: "notReady",
+	4: "createAndGo",
+	5: "createAndWait",
+	6: "destroy",
+}
+
 // Types preceded by an enum with their actual type.
 var combinedTypeMapping = map[string]map[int]string{
 	"InetAddress": {
@@ -60,28 +92,54 @@ var combinedTypeMapping = map[string]map[int]string{
 	},
 }
 
+// oidToList parses an OID, once per PDU, so without splitting it first.
 func oidToList(oid string) []int {
-	result := []int{}
-	for _, x := range strings.Split(oid, ".") {
-		o, _ := strconv.Atoi(x)
+	result := make([]int, 0, strings.Count(oid, ".")+1)
+	for {
+		i := strings.IndexByte(oid, '.')
+		if i < 0 {
+			break
+		}
+		o, _ := strconv.Atoi(oid[:i])
 		result = append(result, o)
+		oid = oid[i+1:]
 	}
-	return result
+	o, _ := strconv.Atoi(oid)
+	return append(result, o)
 }
 
 func listToOid(l []int) string {
-	var result []string
-	for _, o := range l {
-		result = append(result, strconv.Itoa(o))
+	result := make([]byte, 0, 4*len(l))
+	for i, o := range l {
+		if i > 0 {
+			result = append(result, '.')
+		}
+		result = strconv.AppendInt(result, int64(o), 10)
 	}
-	return strings.Join(result, ".")
+	return string(result)
 }
 
 type ScrapeResults struct {
 	pdus []gosnmp.SnmpPDU
+	// OIDs not requested as the target didn't support them recently.
+	skipped int
+	// Whether each walk completed, for modules with walk priorities.
+	walks []walkResult
+	// max_repetitions lowered to fit the message size, 0 if it was not.
+	repetitions int
 }
 
-func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, module *config.Module, logger log.Logger, metrics Metrics) (ScrapeResults, error) {
+type walkResult struct {
+	oid       string
+	completed bool
+}
+
+// PDUs returns the PDUs returned by the target.
+func (r ScrapeResults) PDUs() []gosnmp.SnmpPDU {
+	return r.pdus
+}
+
+func ScrapeTarget(ctx context.Context, snmp scraper.SNMPScraper, target string, auth *config.Auth, module *config.Module, logger log.Logger, metrics Metrics) (ScrapeResults, error) {
 	results := ScrapeResults{}
 	// Evaluate rules.
 	newGet := module.Get
@@ -109,6 +167,21 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 		newGet = newCfg
 	}
 
+	if needsSysUpTime(module, newGet, newWalk) {
+		newGet = append(newGet[:len(newGet):len(newGet)], sysUpTimeOid)
+	}
+
+	now := time.Now()
+	learn := *unsupportedTTL > 0
+	var view string
+	if learn {
+		view = viewKey(snmp, target)
+		var skippedGet, skippedWalk int
+		newGet, skippedGet = unsupported.filter(view, newGet, now)
+		newWalk, skippedWalk = unsupported.filter(view, newWalk, now)
+		results.skipped = skippedGet + skippedWalk
+	}
+
 	version := auth.Version
 	getOids := newGet
 	maxOids := int(module.WalkParams.MaxRepetitions)
@@ -116,6 +189,22 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 	if maxOids == 0 || version == 1 {
 		maxOids = 1
 	}
+	if getOnly(module) && version != 1 && module.WalkParams.MaxRepetitions == config.DefaultWalkParams.MaxRepetitions {
+		// Modules of a few gets are scraped often, so use as few requests as
+		// possible unless max_repetitions was set for agents which can't
+		// cope. Agents answer tooBig if the response doesn't fit.
+		maxOids = gosnmp.MaxOids
+	}
+	// Responses must fit the message size of the module, and that learnt
+	// from dropped responses.
+	sizeKey, sizeModule := messageSizeKey(target, auth), moduleSizeKey(module)
+	repetitions := targetSizes.maxRepetitions(sizeKey, sizeModule, module.WalkParams.MaxMessageSize, now)
+	if repetitions > 0 && repetitions < maxOids {
+		maxOids = repetitions
+	}
+	if repetitions > 0 && repetitions < int(module.WalkParams.MaxRepetitions) {
+		results.repetitions = repetitions
+	}
 	for len(getOids) > 0 {
 		oids := len(getOids)
 		if oids > maxOids {
@@ -126,19 +215,30 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 		if err != nil {
 			return results, err
 		}
+		if packet.Error == gosnmp.TooBig && oids > 1 {
+			maxOids = oids / 2
+			level.Debug(logger).Log("msg", "Response too big, retrying with fewer OIDs per request", "oids", maxOids)
+			continue
+		}
 		// SNMPv1 will return packet error for unsupported OIDs.
 		if packet.Error == gosnmp.NoSuchName && version == 1 {
 			level.Debug(logger).Log("msg", "OID not supported by target", "oids", getOids[0])
+			if learn {
+				unsupported.record(view, getOids[0], false, now, *unsupportedTTL)
+			}
 			getOids = getOids[oids:]
 			continue
 		}
 		// Response received with errors.
-		// TODO: "stringify" gosnmp errors instead of showing error code.
 		if packet.Error != gosnmp.NoError {
-			return results, fmt.Errorf("error reported by target %s: Error Status %d", target, packet.Error)
+			return results, &AgentError{Target: target, Status: packet.Error}
 		}
 		for _, v := range packet.Variables {
-			if v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance {
+			supported := v.Type != gosnmp.NoSuchObject && v.Type != gosnmp.NoSuchInstance
+			if learn {
+				unsupported.record(view, strings.TrimPrefix(v.Name, "."), supported, now, *unsupportedTTL)
+			}
+			if !supported {
 				level.Debug(logger).Log("msg", "OID not supported by target", "oids", v.Name)
 				continue
 			}
@@ -147,16 +247,136 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 		getOids = getOids[oids:]
 	}
 
-	for _, subtree := range newWalk {
-		pdus, err := snmp.WalkAll(subtree)
+	priority := len(newWalk)
+	if len(module.WalkPriority) > 0 {
+		newWalk, priority = prioritizeWalks(newWalk, module.WalkPriority)
+	}
+	deadline, hasDeadline := scrapeDeadline(ctx)
+	for i, subtree := range newWalk {
+		override := module.WalkOverride(subtree)
+		timeout := module.WalkParams.Timeout
+		if override != nil && override.Timeout != 0 {
+			timeout = override.Timeout
+		}
+		if i >= priority && hasDeadline && time.Until(deadline) < timeout {
+			level.Info(logger).Log("msg", "Skipping low priority walk as the scrape deadline approaches", "oid", subtree)
+			results.walks = append(results.walks, walkResult{oid: subtree})
+			continue
+		}
+		restore := overrideWalkParams(snmp, override)
+		var walkRepetitions uint32
+		snmp.SetOptions(func(g *gosnmp.GoSNMP) {
+			if repetitions > 0 && g.MaxRepetitions > uint32(repetitions) {
+				g.MaxRepetitions = uint32(repetitions)
+			}
+			walkRepetitions = g.MaxRepetitions
+		})
+		var pdus []gosnmp.SnmpPDU
+		var err error
+		if override != nil && override.PageSize > 0 {
+			pdus, err = pages.walk(snmp, target+" "+auth.ContextName+" "+subtree, subtree, override.PageSize, now)
+		} else {
+			pdus, err = snmp.WalkAll(subtree)
+		}
+		restore()
 		if err != nil {
+			// A timeout of a target which answered is likely a large
+			// response being dropped.
+			answered := len(results.pdus)+len(pdus) > 0
+			if *adaptiveSize && answered && walkRepetitions > 1 && ctx.Err() == nil && ClassifyError(err) == ErrorTypeTimeout {
+				size := targetSizes.dropped(sizeKey, sizeModule, walkRepetitions, now)
+				level.Warn(logger).Log("msg", "Walk timed out after the target answered, reducing the size of its responses", "oid", subtree, "max_repetitions", walkRepetitions, "message_size", size)
+			}
 			return results, err
 		}
+		if learn {
+			unsupported.record(view, subtree, len(pdus) > 0, now, *unsupportedTTL)
+		}
 		results.pdus = append(results.pdus, pdus...)
+		if len(module.WalkPriority) > 0 {
+			results.walks = append(results.walks, walkResult{oid: subtree, completed: true})
+		}
 	}
+	targetSizes.succeeded(sizeKey, sizeModule, results.pdus, now)
 	return results, nil
 }
 
+// overrideWalkParams applies the override of a walk to the client. It returns
+// a function restoring the parameters of the module.
+func overrideWalkParams(snmp scraper.SNMPScraper, override *config.WalkOverride) func() {
+	if override == nil {
+		return func() {}
+	}
+	var (
+		timeout        time.Duration
+		retries        int
+		maxRepetitions uint32
+		version        gosnmp.SnmpVersion
+	)
+	snmp.SetOptions(func(g *gosnmp.GoSNMP) {
+		timeout, retries, maxRepetitions, version = g.Timeout, g.Retries, g.MaxRepetitions, g.Version
+		if override.Timeout != 0 {
+			g.Timeout = override.Timeout
+		}
+		if override.Retries != nil {
+			g.Retries = *override.Retries
+		}
+		if override.MaxRepetitions != 0 {
+			g.MaxRepetitions = override.MaxRepetitions
+		}
+		// SNMPv3 has no community to downgrade with.
+		if override.Version == 1 && g.Version == gosnmp.Version2c {
+			g.Version = gosnmp.Version1
+		}
+	})
+	return func() {
+		snmp.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.Timeout, g.Retries, g.MaxRepetitions, g.Version = timeout, retries, maxRepetitions, version
+		})
+	}
+}
+
+type scrapeDeadlineKey struct{}
+
+// WithScrapeDeadline returns a context carrying the deadline of the scrape,
+// which low priority walks are skipped near. Unlike a context deadline, it
+// doesn't cancel requests.
+func WithScrapeDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, scrapeDeadlineKey{}, deadline)
+}
+
+// scrapeDeadline returns the deadline of WithScrapeDeadline, or else the one
+// of the context.
+func scrapeDeadline(ctx context.Context) (time.Time, bool) {
+	if deadline, ok := ctx.Value(scrapeDeadlineKey{}).(time.Time); ok {
+		return deadline, true
+	}
+	return ctx.Deadline()
+}
+
+// prioritizeWalks orders the walks overlapping the priority subtrees first,
+// in the order of the priorities, followed by the others. It also returns
+// how many walks have priority.
+func prioritizeWalks(walks, priorities []string) ([]string, int) {
+	ordered := make([]string, 0, len(walks))
+	done := make(map[string]bool, len(walks))
+	for _, p := range priorities {
+		for _, w := range walks {
+			if !done[w] && (w == p || strings.HasPrefix(w, p+".") || strings.HasPrefix(p, w+".")) {
+				ordered = append(ordered, w)
+				done[w] = true
+			}
+		}
+	}
+	priority := len(ordered)
+	for _, w := range walks {
+		if !done[w] {
+			ordered = append(ordered, w)
+		}
+	}
+	return ordered, priority
+}
+
 func configureTarget(g *gosnmp.GoSNMP, target string) error {
 	if s := strings.SplitN(target, "://", 2); len(s) == 2 {
 		g.Transport = s[0]
@@ -272,10 +492,22 @@ func buildMetricTree(metrics []*config.Metric) *MetricNode {
 type Metrics struct {
 	SNMPCollectionDuration *prometheus.HistogramVec
 	SNMPUnexpectedPduType  prometheus.Counter
+	SNMPPduTypeMismatches  *prometheus.CounterVec
 	SNMPDuration           prometheus.Histogram
 	SNMPPackets            prometheus.Counter
 	SNMPRetries            prometheus.Counter
 	SNMPInflight           prometheus.Gauge
+	SNMPModuleScrapes      *prometheus.CounterVec
+	SNMPModuleScrapeErrors *prometheus.CounterVec
+	SNMPModulePdus         *prometheus.CounterVec
+	SNMPResyncs            prometheus.Counter
+	SNMPWalkAnomalies      *prometheus.CounterVec
+	SNMPScrapesAbandoned   prometheus.Counter
+	SNMPUnexpectedVarbinds *prometheus.CounterVec
+	SNMPOutOfRangeSamples  *prometheus.CounterVec
+	SNMPLabelLimitSamples  *prometheus.CounterVec
+	SNMPCollectionCPU      *prometheus.CounterVec
+	SNMPCollectionAllocs   *prometheus.CounterVec
 }
 
 type NamedModule struct {
@@ -301,6 +533,9 @@ type Collector struct {
 	concurrency int
 	snmpContext string
 	debugSNMP   bool
+	errors      *scrapeErrors
+	// OIDs exported by the raw modules of the scrape.
+	rawOIDs *oidSet
 }
 
 func New(ctx context.Context, target, authName, snmpContext string, auth *config.Auth, modules []*NamedModule, logger log.Logger, metrics Metrics, conc int, debugSNMP bool) *Collector {
@@ -315,7 +550,40 @@ func New(ctx context.Context, target, authName, snmpContext string, auth *config
 		metrics:     metrics,
 		concurrency: conc,
 		debugSNMP:   debugSNMP,
+		errors:      &scrapeErrors{},
+		rawOIDs:     &oidSet{},
+	}
+}
+
+// ErrorType returns the type of the first error encountered during
+// collection, or an empty string if the scrape succeeded.
+func (c Collector) ErrorType() string {
+	return c.errors.first()
+}
+
+// Partial reports whether the scrape failed for only some of the modules,
+// others being scraped.
+func (c Collector) Partial() bool {
+	return c.errors.partial()
+}
+
+// scrapeError records a failed scrape and returns the metrics describing it.
+func (c Collector) scrapeError(help string, moduleLabel prometheus.Labels, typ string, err error) []prometheus.Metric {
+	results := []prometheus.Metric{
+		prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", help, nil, moduleLabel), err),
 	}
+	labels := prometheus.Labels{"type": typ}
+	for k, v := range moduleLabel {
+		labels[k] = v
+	}
+	// Several workers can fail in the same way, only report each series once.
+	if c.errors.add(typ, moduleLabel["module"]) {
+		results = append(results, prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_error", "Type of error that caused the scrape to fail.", nil, labels),
+			prometheus.GaugeValue,
+			1))
+	}
+	return results
 }
 
 // Describe implements Prometheus.Collector.
@@ -323,6 +591,29 @@ func (c Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
 }
 
+// applyRetryPolicy sets the retries, backoff and pacing of the named retry
+// policy, if any. The client is reused across modules, so the backoff and
+// pacing of a previous module are reset.
+func applyRetryPolicy(g *gosnmp.GoSNMP, name string) {
+	g.ExponentialTimeout = false
+	g.PreSend = nil
+	policy, ok := config.RetryPolicies[name]
+	if !ok {
+		return
+	}
+	g.Retries = policy.Retries
+	g.ExponentialTimeout = policy.Backoff
+	if policy.Pacing > 0 {
+		var last time.Time
+		g.PreSend = func(*gosnmp.GoSNMP) {
+			if wait := policy.Pacing - time.Since(last); !last.IsZero() && wait > 0 {
+				time.Sleep(wait)
+			}
+			last = time.Now()
+		}
+	}
+}
+
 func (c Collector) collect(ch chan<- prometheus.Metric, logger log.Logger, client scraper.SNMPScraper, module *NamedModule) {
 	var (
 		packets uint64
@@ -356,18 +647,36 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger log.Logger, clien
 					"c": true,
 				}
 			}
+			applyRetryPolicy(g, module.WalkParams.RetryPolicy)
 		},
 	)
 	start := time.Now()
 	moduleLabel := prometheus.Labels{"module": module.name}
+	// The labels all samples of the module get, with --snmp.scrape-labels.
+	var sampleLabels prometheus.Labels
+	if *scrapeLabels {
+		moduleLabel["auth"] = c.authName
+		sampleLabels = moduleLabel
+	}
 	c.metrics.SNMPInflight.Inc()
-	results, err := ScrapeTarget(client, c.target, c.auth, module.Module, logger, c.metrics)
+	c.metrics.SNMPModuleScrapes.WithLabelValues(module.name).Inc()
+	results, err := ScrapeTarget(c.ctx, client, c.target, c.auth, module.Module, logger, c.metrics)
 	c.metrics.SNMPInflight.Dec()
 	if err != nil {
+		c.metrics.SNMPModuleScrapeErrors.WithLabelValues(module.name).Inc()
 		level.Info(logger).Log("msg", "Error scraping target", "err", err)
-		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error scraping target", nil, moduleLabel), err)
+		for _, m := range c.scrapeError("Error scraping target", moduleLabel, ClassifyError(err), err) {
+			ch <- m
+		}
 		return
 	}
+	c.errors.moduleScraped()
+	if *srcAddress != "" || *srcPortRange != "" {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_source_info", "Local address SNMP requests were sent from.", []string{"source_address"}, moduleLabel),
+			prometheus.GaugeValue,
+			1, client.LocalAddr())
+	}
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_walk_duration_seconds", "Time SNMP walk/bulkwalk took.", nil, moduleLabel),
 		prometheus.GaugeValue,
@@ -384,17 +693,135 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger log.Logger, clien
 		prometheus.NewDesc("snmp_scrape_pdus_returned", "PDUs returned from get, bulkget, and walk.", nil, moduleLabel),
 		prometheus.GaugeValue,
 		float64(len(results.pdus)))
+	if *unsupportedTTL > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_oids_skipped", "OIDs not requested as they recently returned nothing.", nil, moduleLabel),
+			prometheus.GaugeValue,
+			float64(results.skipped))
+	}
+	for _, walk := range results.walks {
+		completed := 0.0
+		if walk.completed {
+			completed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_walk_completed", "Whether a walk of a module with walk priorities completed, rather than being skipped as the scrape deadline approached.", []string{"oid"}, moduleLabel),
+			prometheus.GaugeValue,
+			completed, walk.oid)
+	}
+	if results.repetitions > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_max_repetitions", "max_repetitions the module was scraped with, when lowered to fit max_message_size or after dropped responses.", nil, moduleLabel),
+			prometheus.GaugeValue,
+			float64(results.repetitions))
+	}
+	c.metrics.SNMPModulePdus.WithLabelValues(module.name).Add(float64(len(results.pdus)))
+	if module.Strictness == config.StrictnessParanoid {
+		if err := checkPduTypes(module.Module, results.pdus); err != nil {
+			c.metrics.SNMPModuleScrapeErrors.WithLabelValues(module.name).Inc()
+			level.Info(logger).Log("msg", "Varbind of the wrong type", "err", err)
+			for _, m := range c.scrapeError("Varbind of the wrong type", moduleLabel, ClassifyError(err), err) {
+				ch <- m
+			}
+			return
+		}
+	}
+
+	if *countUnexpected {
+		for subtree, n := range uncoveredVarbinds(module.Module, results.pdus) {
+			level.Debug(logger).Log("msg", "Varbinds no metric of the module covers", "subtree", subtree, "varbinds", n)
+			c.metrics.SNMPUnexpectedVarbinds.WithLabelValues(module.name, subtree).Add(float64(n))
+		}
+	}
+
+	observeCost := c.measureCost(module.name)
+	samples, overValues, aggregated := limitLabels(pdusToMetrics(module.Module, results.pdus, c.target, time.Now(), logger, c.metrics, sampleLabels, c.rawOIDs, nil), module.LabelLimits)
+	observeCost()
+	for _, sample := range samples {
+		ch <- sample
+	}
+	for label, n := range overValues {
+		if n > 0 {
+			level.Debug(logger).Log("msg", "Aggregated samples with label values beyond the limit", "label", label, "limit", module.LabelLimits[label], "values", n, "samples", aggregated[label])
+			c.metrics.SNMPLabelLimitSamples.WithLabelValues(module.name, label).Add(float64(aggregated[label]))
+		}
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_label_values_aggregated", "Distinct values of a label beyond its limit in label_limits, whose samples were aggregated.", []string{"label"}, moduleLabel),
+			prometheus.GaugeValue,
+			float64(n), label)
+	}
+	if module.Topology {
+		neighbors, err := c.topology(client)
+		if err != nil {
+			level.Info(logger).Log("msg", "Error walking neighbors of target", "err", err)
+			for _, m := range c.scrapeError("Error walking neighbors of target", moduleLabel, ClassifyError(err), err) {
+				ch <- m
+			}
+			return
+		}
+		for _, m := range topologyMetrics(neighbors, sampleLabels) {
+			ch <- m
+		}
+	}
+	if module.EntitySensors {
+		sensors, err := c.entitySensors(client, sampleLabels)
+		if err != nil {
+			level.Info(logger).Log("msg", "Error walking entity sensors of target", "err", err)
+			for _, m := range c.scrapeError("Error walking entity sensors of target", moduleLabel, ClassifyError(err), err) {
+				ch <- m
+			}
+			return
+		}
+		for _, m := range sensors {
+			ch <- m
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_duration_seconds", "Total SNMP time scrape took (walk and processing).", nil, moduleLabel),
+		prometheus.GaugeValue,
+		time.Since(start).Seconds())
+}
+
+// PdusToMetrics converts the PDUs returned for a module to metrics, as is
+// done after each scrape of a target. Utilizations are left out, as they
+// need the previous scrape of the target.
+func PdusToMetrics(module *config.Module, pdus []gosnmp.SnmpPDU, logger log.Logger, metrics Metrics) []prometheus.Metric {
+	return pdusToMetrics(module, pdus, "", time.Time{}, logger, metrics, nil, nil, nil)
+}
 
-	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(results.pdus))
-	for _, pdu := range results.pdus {
+// CoveredOIDs returns the OIDs of the PDUs which the module turns into
+// samples when converting them as after a scrape, either as the value of a
+// metric or through one of its lookups.
+func CoveredOIDs(module *config.Module, pdus []gosnmp.SnmpPDU, logger log.Logger, metrics Metrics) map[string]struct{} {
+	covered := map[string]struct{}{}
+	pdusToMetrics(module, pdus, "", time.Time{}, logger, metrics, nil, nil, covered)
+	return covered
+}
+
+// pdusToMetrics converts the PDUs of a scrape of the target at now to
+// metrics, all with the extra labels. Utilizations are only derived for a
+// target. Raw samples are only exported for OIDs not yet in rawOIDs, if not
+// nil, as modules of a scrape may walk the same subtrees. The OIDs of the
+// PDUs turned into samples are added to covered, if not nil.
+func pdusToMetrics(module *config.Module, pdus []gosnmp.SnmpPDU, target string, now time.Time, logger log.Logger, metrics Metrics, extraLabels prometheus.Labels, rawOIDs *oidSet, covered map[string]struct{}) []prometheus.Metric {
+	samples := []prometheus.Metric{}
+	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(pdus))
+	for _, pdu := range pdus {
 		oidToPdu[pdu.Name[1:]] = pdu
 	}
 
 	metricTree := buildMetricTree(module.Metrics)
+	aggregators := newAggregators(module.Aggregations)
+	histograms := newHistogramBuilders(module.Histograms)
+	utilizations := newUtilizationBuilders(module.Utilizations)
+	counterPairs := newCounterPairBuilders(module.CounterPairs)
+	rollups, tableRollups := newRollupBuilders(module.Rollups, module.Metrics)
+	rawDesc := newRawDesc(extraLabels)
 	// Look for metrics that match each pdu.
 	for oid, pdu := range oidToPdu {
 		head := metricTree
 		oidList := oidToList(oid)
+		matched := false
 		for i, o := range oidList {
 			var ok bool
 			head, ok = head.children[o]
@@ -403,42 +830,206 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger log.Logger, clien
 			}
 			if head.metric != nil {
 				// Found a match.
-				samples := pduToSamples(oidList[i+1:], &pdu, head.metric, oidToPdu, logger, c.metrics)
-				for _, sample := range samples {
-					ch <- sample
+				matched = true
+				// Checked before the value is converted to the configured type.
+				if *strictTypes && !pduTypeMatches(head.metric.Type, pdu.Type) {
+					level.Warn(logger).Log("msg", "Returned value type contradicts the configured metric type", "metric", head.metric.Name, "oid", pdu.Name, "type", head.metric.Type, "pdu_type", pdu.Type)
+					metrics.SNMPPduTypeMismatches.WithLabelValues(head.metric.Name).Inc()
+				}
+				if !decodePdu(module.Strictness, head.metric.Type, &pdu) {
+					level.Debug(logger).Log("msg", "Unable to decode value as the configured type", "oid", oid, "metric", head.metric.Name, "type", head.metric.Type, "value", pdu.Value, "strictness", module.Strictness)
+					break
+				}
+				pduSamples := pduToSamples(oidList[i+1:], &pdu, head.metric, oidToPdu, extraLabels, logger, metrics)
+				if covered != nil && len(pduSamples) > 0 {
+					covered[oid] = struct{}{}
+					indexLabels(oidList[i+1:], head.metric, oidToPdu, metrics, func(oid string) {
+						covered[oid] = struct{}{}
+					})
+				}
+				dropSource := false
+				for _, a := range aggregators[head.metric.Name] {
+					a.add(head.metric, pduSamples)
+					dropSource = dropSource || a.DropSource
+				}
+				for _, h := range histograms[head.metric.Name] {
+					h.add(head.metric, pduSamples)
+					dropSource = dropSource || h.DropSource
+				}
+				for _, u := range utilizations[head.metric.Name] {
+					u.add(head.metric, pduSamples)
+				}
+				for _, r := range tableRollups[head.metric.Name] {
+					r.add(head.metric, oidList[i+1:], pduSamples)
+					dropSource = dropSource || r.DropSource
+				}
+				for _, p := range counterPairs[head.metric.Name] {
+					pduSamples = p.add(head.metric, pduSamples)
+				}
+				if !dropSource {
+					samples = append(samples, pduSamples...)
 				}
 				break
 			}
 		}
+		if !matched && module.Raw {
+			if sample := rawSample(rawDesc, oid, &pdu); sample != nil && (rawOIDs == nil || rawOIDs.add(oid)) {
+				samples = append(samples, sample)
+				if covered != nil {
+					covered[oid] = struct{}{}
+				}
+			}
+		}
 	}
-	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc("snmp_scrape_duration_seconds", "Total SNMP time scrape took (walk and processing).", nil, moduleLabel),
-		prometheus.GaugeValue,
-		time.Since(start).Seconds())
+	for _, aggs := range aggregators {
+		for _, a := range aggs {
+			samples = append(samples, a.metrics()...)
+		}
+	}
+	for _, h := range module.Histograms {
+		for _, b := range histograms[h.Count] {
+			if b.Histogram == h {
+				samples = append(samples, b.metrics()...)
+			}
+		}
+	}
+	for _, p := range module.CounterPairs {
+		for _, b := range counterPairs[p.Counter64] {
+			if b.CounterPair == p {
+				samples = append(samples, b.metrics()...)
+			}
+		}
+	}
+	for _, r := range rollups {
+		samples = append(samples, r.metrics(extraLabels)...)
+	}
+	if target != "" {
+		for _, u := range module.Utilizations {
+			for _, b := range utilizations[u.Octets] {
+				if b.Utilization == u {
+					samples = append(samples, b.metrics(target, now)...)
+				}
+			}
+		}
+	}
+	return samples
 }
 
 // Collect implements Prometheus.Collector.
 func (c Collector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	c.watch(ctx, ch, func(ch chan<- prometheus.Metric) {
+		c.collectTarget(ctx, cancel, ch)
+	})
+}
+
+// collectTarget scrapes the modules of the target with the workers.
+func (c Collector) collectTarget(ctx context.Context, cancel context.CancelFunc, ch chan<- prometheus.Metric) {
 	wg := sync.WaitGroup{}
 	workerCount := c.concurrency
 	if workerCount < 1 {
 		workerCount = 1
 	}
-	ctx, cancel := context.WithCancel(c.ctx)
-	defer cancel()
+	if *icmpCheck {
+		if reachable, ok := c.icmpReachable(ctx, c.logger); ok {
+			value := 0.0
+			if reachable {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc("snmp_target_icmp_reachable", "Whether the target answered a ping before the scrape.", nil, nil),
+				prometheus.GaugeValue,
+				value)
+			if !reachable {
+				for _, m := range c.scrapeError("Target did not answer ping", nil, ErrorTypeUnreachable, fmt.Errorf("no answer to ping within %s", *icmpTimeout)) {
+					ch <- m
+				}
+				return
+			}
+		}
+	}
+	target := c.target
+	// Whether a target which does not answer is scraped at its other
+	// address family next.
+	nextFamily := false
+	if candidates := c.selectAddress(ctx); len(candidates) > 0 {
+		defer c.recordAddress(c.logger, target, candidates)
+		nextFamily = candidates[0].family == *preferredFamily
+		c.target = candidates[0].target
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_address_info", "Address a target resolving to both IPv4 and IPv6 addresses was scraped at.", []string{"address", "family"}, nil),
+			prometheus.GaugeValue,
+			1, candidates[0].target, candidates[0].family)
+	}
+	if c.auth.Secondary != nil || len(c.auth.Users) > 0 {
+		// Scraped with the credentials which last worked, or the first ones.
+		key := target + "\xff" + c.authName
+		configured := credentialsOf(c.auth)
+		cred := lastCredentials.order(key, configured, time.Now())[0]
+		defer c.recordCredentials(c.logger, key, configured, cred.name, nextFamily)
+		c.auth = cred.auth
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_credentials_info", "Credentials of an auth with secondary credentials or users the target was scraped with.", []string{"credentials"}, nil),
+			prometheus.GaugeValue,
+			1, cred.name)
+	}
+	if c.getOnly() {
+		c.collectGetOnly(ctx, ch)
+		return
+	}
+	// Modules of a scrape often walk the same tables, such as the ifTable.
+	var walks *sharedWalks
+	if len(c.modules) > 1 {
+		walks = newSharedWalks()
+	}
 	workerChan := make(chan *NamedModule)
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
 			logger := log.With(c.logger, "worker", i)
-			client, err := scraper.NewGoSNMP(logger, c.target, *srcAddress, c.debugSNMP)
+			localAddr := *srcAddress
+			if *srcPortRange != "" {
+				pool, err := getSourcePorts()
+				if err != nil {
+					level.Info(logger).Log("msg", err)
+					cancel()
+					for _, m := range c.scrapeError("Error during initialisation of the Worker", nil, ErrorTypeBadRequest, err) {
+						ch <- m
+					}
+					return
+				}
+				port, err := pool.acquire(ctx)
+				if err != nil {
+					level.Info(logger).Log("msg", err)
+					cancel()
+					for _, m := range c.scrapeError("Error during initialisation of the Worker", nil, ClassifyError(err), err) {
+						ch <- m
+					}
+					return
+				}
+				defer pool.release(port)
+				localAddr = withSourcePort(*srcAddress, port)
+			}
+			client, err := scraper.NewGoSNMP(logger, c.target, localAddr, c.debugSNMP)
 			if err != nil {
 				level.Info(logger).Log("msg", err)
 				cancel()
-				ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error during initialisation of the Worker", nil, nil), err)
+				for _, m := range c.scrapeError("Error during initialisation of the Worker", nil, ErrorTypeBadRequest, err) {
+					ch <- m
+				}
 				return
 			}
+			useRoute(client, c.auth)
+			client.OnResync(c.metrics.SNMPResyncs.Inc)
+			client.OnAnomaly(func(kind string) {
+				c.metrics.SNMPWalkAnomalies.WithLabelValues(kind).Inc()
+			})
+			client.LogWalkProgress(*walkProgress, *walkSample)
+			if *fastCodec {
+				client.UseFastCodec()
+			}
 			// Set the options.
 			client.SetOptions(func(g *gosnmp.GoSNMP) {
 				g.Context = ctx
@@ -446,20 +1037,36 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 			})
 			if err = client.Connect(); err != nil {
 				level.Info(logger).Log("msg", "Error connecting to target", "err", err)
-				ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error connecting to target", nil, nil), err)
+				for _, m := range c.scrapeError("Error connecting to target", nil, ClassifyError(err), err) {
+					ch <- m
+				}
 				cancel()
 				return
 			}
 			defer client.Close()
+			var moduleClient scraper.SNMPScraper = client
+			if walks != nil {
+				moduleClient = walks.scraper(client)
+			}
 			for m := range workerChan {
 				_logger := log.With(logger, "module", m.name)
 				level.Debug(_logger).Log("msg", "Starting scrape")
 				start := time.Now()
-				c.collect(ch, _logger, client, m)
+				c.collect(ch, _logger, moduleClient, m)
 				duration := time.Since(start).Seconds()
 				level.Debug(_logger).Log("msg", "Finished scrape", "duration_seconds", duration)
 				c.metrics.SNMPCollectionDuration.WithLabelValues(m.name).Observe(duration)
 			}
+			if *deviceInfo && i == 0 && ctx.Err() == nil {
+				if m := c.deviceInfo(client, logger); m != nil {
+					ch <- m
+				}
+			}
+			if *engineInfo && i == 0 && ctx.Err() == nil {
+				if m := c.engineInfo(client, logger); m != nil {
+					ch <- m
+				}
+			}
 		}(i)
 	}
 
@@ -480,21 +1087,206 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 	wg.Wait()
 }
 
+// newRawDesc returns the descriptor of the samples of raw modules, with the
+// extra labels of the scrape.
+func newRawDesc(extraLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc("snmp_raw", "Value of a varbind of a raw module, exported without MIB knowledge.", []string{"oid", "type"}, extraLabels)
+}
+
+// oidSet is a set of OIDs safe for concurrent use.
+type oidSet struct {
+	mu   sync.Mutex
+	oids map[string]struct{}
+}
+
+// add adds the OID, returning false if it was already in the set.
+func (s *oidSet) add(oid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.oids == nil {
+		s.oids = map[string]struct{}{}
+	}
+	if _, ok := s.oids[oid]; ok {
+		return false
+	}
+	s.oids[oid] = struct{}{}
+	return true
+}
+
+// rawSample exports a numeric varbind of a raw module, or returns nil for
+// other varbinds.
+func rawSample(rawDesc *prometheus.Desc, oid string, pdu *gosnmp.SnmpPDU) prometheus.Metric {
+	switch pdu.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Counter64, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Uinteger32, gosnmp.OpaqueFloat, gosnmp.OpaqueDouble:
+	default:
+		return nil
+	}
+	return prometheus.MustNewConstMetric(rawDesc, prometheus.GaugeValue, getPduValue(pdu), oid, pdu.Type.String())
+}
+
+// getOnly reports whether all modules of the scrape only get OIDs. Source
+// port ranges need a port per connection, so their connections are not kept.
+func (c Collector) getOnly() bool {
+	if *srcPortRange != "" {
+		return false
+	}
+	for _, m := range c.modules {
+		if !getOnly(m.Module) {
+			return false
+		}
+	}
+	return true
+}
+
+// pduTypeMatches reports whether a PDU of the given ASN.1 type can be
+// what was intended by the configured metric type.
+func pduTypeMatches(metricType string, pduType gosnmp.Asn1BER) bool {
+	switch pduType {
+	case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		// No value, nothing to compare.
+		return true
+	}
+	numeric := false
+	switch pduType {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Counter64, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Uinteger32, gosnmp.OpaqueFloat, gosnmp.OpaqueDouble:
+		numeric = true
+	}
+	switch metricType {
+	case "counter":
+		return pduType == gosnmp.Counter32 || pduType == gosnmp.Counter64
+	case "gauge", "Float", "Double", "EnumAsInfo", "EnumAsStateSet", "TimeStamp":
+		return numeric
+	case "Bits":
+		return pduType == gosnmp.OctetString || pduType == gosnmp.BitString
+	default:
+		// Some form of string.
+		return !numeric
+	}
+}
+
+// coercePdu converts a value returned with the wrong numeric type, or as a
+// string holding a number, to the configured metric type. It reports false
+// if the value can't be used for the metric.
+func coercePdu(metricType string, pdu *gosnmp.SnmpPDU) bool {
+	switch metricType {
+	case "counter":
+		switch pdu.Type {
+		case gosnmp.Counter32, gosnmp.Counter64:
+		case gosnmp.Integer:
+			// Reinterpret negative values as the unsigned counter.
+			pdu.Type, pdu.Value = gosnmp.Counter32, uint(uint32(gosnmp.ToBigInt(pdu.Value).Int64()))
+		case gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Uinteger32:
+			pdu.Type = gosnmp.Counter32
+		case gosnmp.OctetString:
+			return coerceString(pdu)
+		}
+	case "gauge", "Float", "Double":
+		switch pdu.Type {
+		case gosnmp.Counter64:
+			// Don't wrap a gauge.
+			pdu.Type, pdu.Value = gosnmp.OpaqueDouble, float64(gosnmp.ToBigInt(pdu.Value).Uint64())
+		case gosnmp.OctetString:
+			return coerceString(pdu)
+		}
+	}
+	return true
+}
+
+// coerceString parses a number sent as an OctetString.
+func coerceString(pdu *gosnmp.SnmpPDU) bool {
+	b, ok := pdu.Value.([]byte)
+	if !ok {
+		return false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if err != nil {
+		return false
+	}
+	pdu.Type, pdu.Value = gosnmp.OpaqueDouble, v
+	return true
+}
+
 func getPduValue(pdu *gosnmp.SnmpPDU) float64 {
 	switch pdu.Type {
 	case gosnmp.Counter64:
+		v, ok := pdu.Value.(uint64)
+		if !ok {
+			v = gosnmp.ToBigInt(pdu.Value).Uint64()
+		}
 		if *wrapCounters {
 			// Wrap by 2^53.
-			return float64(gosnmp.ToBigInt(pdu.Value).Uint64() % float64Mantissa)
+			return float64(v % float64Mantissa)
 		}
-		return float64(gosnmp.ToBigInt(pdu.Value).Uint64())
+		return float64(v)
 	case gosnmp.OpaqueFloat:
 		return float64(pdu.Value.(float32))
 	case gosnmp.OpaqueDouble:
 		return pdu.Value.(float64)
 	default:
-		return float64(gosnmp.ToBigInt(pdu.Value).Int64())
+		return float64(pduInt64(pdu.Value))
+	}
+}
+
+// pduInt64 returns the value of an integer PDU as gosnmp.ToBigInt does,
+// without allocating for the types gosnmp decodes integers to.
+func pduInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	}
+	return gosnmp.ToBigInt(value).Int64()
+}
+
+// timeStampToUnix converts an RFC 2579 TimeStamp, the sysUpTime at which
+// something happened, to a UNIX timestamp using the sysUpTime returned by the
+// scrape. Zero means it happened before the agent started, so its start time
+// is returned.
+func timeStampToUnix(ticks float64, oidToPdu map[string]gosnmp.SnmpPDU, now time.Time) (float64, error) {
+	upPdu, ok := oidToPdu[sysUpTimeOid]
+	if !ok {
+		return 0, fmt.Errorf("sysUpTime was not returned")
+	}
+	upTime := getPduValue(&upPdu)
+	if ticks > upTime {
+		return 0, fmt.Errorf("TimeStamp %v is after sysUpTime %v", ticks, upTime)
 	}
+	return float64(now.UnixMilli())/1000 - (upTime-ticks)/100, nil
+}
+
+// needsSysUpTime reports whether sysUpTime must be fetched for the metrics of
+// the module, as it is not already walked or requested.
+func needsSysUpTime(module *config.Module, get, walk []string) bool {
+	needed := false
+	for _, metric := range module.Metrics {
+		if metric.Type == "TimeStamp" {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return false
+	}
+	for _, oid := range get {
+		if oid == sysUpTimeOid {
+			return false
+		}
+	}
+	for _, oid := range walk {
+		if strings.HasPrefix(sysUpTimeOid, oid+".") {
+			return false
+		}
+	}
+	return true
 }
 
 // parseDateAndTime extracts a UNIX timestamp from an RFC 2579 DateAndTime.
@@ -544,12 +1336,27 @@ func parseDateAndTime(pdu *gosnmp.SnmpPDU) (float64, error) {
 	return float64(t.Unix()), nil
 }
 
-func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, logger log.Logger, metrics Metrics) []prometheus.Metric {
+func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, extraLabels prometheus.Labels, logger log.Logger, metrics Metrics) []prometheus.Metric {
 	var err error
 	// The part of the OID that is the indexes.
 	labels := indexesToLabels(indexOids, metric, oidToPdu, metrics)
+	for name, value := range extraLabels {
+		// An index or lookup of the same name keeps its value.
+		if _, ok := labels[name]; !ok {
+			labels[name] = value
+		}
+	}
 
 	value := getPduValue(pdu)
+	if len(metric.ValueMap) > 0 {
+		var keep bool
+		// Validated on config load.
+		value, keep, _ = metric.ValueMap.Map(value)
+		if !keep {
+			level.Debug(logger).Log("msg", "Dropping sample by value_map", "metric", metric.Name, "oid", pdu.Name)
+			return []prometheus.Metric{}
+		}
+	}
 
 	labelnames := make([]string, 0, len(labels)+1)
 	labelvalues := make([]string, 0, len(labels)+1)
@@ -573,6 +1380,13 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 			level.Debug(logger).Log("msg", "Error parsing DateAndTime", "err", err)
 			return []prometheus.Metric{}
 		}
+	case "TimeStamp":
+		t = prometheus.GaugeValue
+		value, err = timeStampToUnix(value, oidToPdu, time.Now())
+		if err != nil {
+			level.Debug(logger).Log("msg", "Error converting TimeStamp", "metric", metric.Name, "err", err)
+			return []prometheus.Metric{}
+		}
 	case "EnumAsInfo":
 		return enumAsInfo(metric, int(value), labelnames, labelvalues)
 	case "EnumAsStateSet":
@@ -609,7 +1423,11 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 		// If the name is already an index, we do not need to set it again.
 		if _, ok := labels[metric.Name]; !ok {
 			labelnames = append(labelnames, metric.Name)
-			labelvalues = append(labelvalues, pduValueAsString(pdu, metricType, metrics))
+			value := pduValueAsString(pdu, metricType, metrics)
+			if metricType == "PhysAddress48" {
+				value = formatMAC(value, metric.MACFormat)
+			}
+			labelvalues = append(labelvalues, value)
 		}
 	}
 
@@ -617,6 +1435,16 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 		value *= metric.Scale
 	}
 	value += metric.Offset
+	if metric.Min != nil || metric.Max != nil {
+		switch metric.Type {
+		case "counter", "gauge", "Float", "Double":
+			var keep bool
+			if value, keep = applyBounds(value, metric, metrics); !keep {
+				level.Debug(logger).Log("msg", "Dropping sample out of range", "metric", metric.Name, "oid", pdu.Name, "value", value)
+				return []prometheus.Metric{}
+			}
+		}
+	}
 
 	sample, err := prometheus.NewConstMetric(prometheus.NewDesc(metric.Name, metric.Help, labelnames, nil),
 		t, value, labelvalues...)
@@ -625,9 +1453,62 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 			fmt.Errorf("error for metric %s with labels %v from indexOids %v: %v", metric.Name, labelvalues, indexOids, err))
 	}
 
+	if pdu.Type == gosnmp.Counter64 && *counter64Exact != "none" {
+		return append(exactCounter64(metric, pdu, *counter64Exact, labelnames, labelvalues), sample)
+	}
 	return []prometheus.Metric{sample}
 }
 
+// applyBounds checks the value against the min and max of the metric,
+// returning it clamped to them or whether to drop it if it's out of them.
+func applyBounds(value float64, metric *config.Metric, metrics Metrics) (float64, bool) {
+	var bound float64
+	switch {
+	case metric.Min != nil && value < *metric.Min:
+		bound = *metric.Min
+	case metric.Max != nil && value > *metric.Max:
+		bound = *metric.Max
+	default:
+		return value, true
+	}
+	if metric.OutOfRange == "clamp" {
+		metrics.SNMPOutOfRangeSamples.WithLabelValues(metric.Name, "clamped").Inc()
+		return bound, true
+	}
+	metrics.SNMPOutOfRangeSamples.WithLabelValues(metric.Name, "dropped").Inc()
+	return value, false
+}
+
+// exactCounter64 returns the metrics holding a Counter64 value too large to
+// be represented exactly as a float, if it is.
+func exactCounter64(metric *config.Metric, pdu *gosnmp.SnmpPDU, mode string, labelnames, labelvalues []string) []prometheus.Metric {
+	v := gosnmp.ToBigInt(pdu.Value).Uint64()
+	if v <= float64Mantissa {
+		return nil
+	}
+	newMetric := func(name, help string, value float64, labelvalues []string) prometheus.Metric {
+		m, err := prometheus.NewConstMetric(prometheus.NewDesc(name, help, labelnames, nil),
+			prometheus.GaugeValue, value, labelvalues...)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for an exact Counter64", nil, nil),
+				fmt.Errorf("error for metric %s with labels %v: %v", name, labelvalues, err))
+		}
+		return m
+	}
+	switch mode {
+	case "info":
+		labelnames = append(labelnames, metric.Name)
+		return []prometheus.Metric{newMetric(metric.Name+"_exact_info", metric.Help+" (exact value)", 1.0,
+			append(labelvalues, strconv.FormatUint(v, 10)))}
+	case "split":
+		return []prometheus.Metric{
+			newMetric(metric.Name+"_hi", metric.Help+" (high 32 bits)", float64(v>>32), labelvalues),
+			newMetric(metric.Name+"_lo", metric.Help+" (low 32 bits)", float64(v&0xffffffff), labelvalues),
+		}
+	}
+	return nil
+}
+
 func applyRegexExtracts(metric *config.Metric, pduValue string, labelnames, labelvalues []string, logger log.Logger) []prometheus.Metric {
 	results := []prometheus.Metric{}
 	for name, strMetricSlice := range metric.RegexpExtracts {
@@ -738,7 +1619,7 @@ func bits(metric *config.Metric, value interface{}, labelnames, labelvalues []st
 // Some routers exclude trailing 0s in responses.
 func splitOid(oid []int, count int) ([]int, []int) {
 	head := make([]int, count)
-	tail := []int{}
+	tail := make([]int, 0, max(len(oid)-count, 0))
 	for i, v := range oid {
 		if i < count {
 			head[i] = v
@@ -753,6 +1634,11 @@ func splitOid(oid []int, count int) ([]int, []int) {
 func pduValueAsString(pdu *gosnmp.SnmpPDU, typ string, metrics Metrics) string {
 	switch pdu.Value.(type) {
 	case int:
+		if typ == "RowStatus" {
+			if status, ok := rowStatusValues[pdu.Value.(int)]; ok {
+				return status
+			}
+		}
 		return strconv.Itoa(pdu.Value.(int))
 	case uint:
 		return strconv.FormatUint(uint64(pdu.Value.(uint)), 10)
@@ -821,7 +1707,7 @@ func indexOidsAsString(indexOids []int, typ string, fixedSize int, implied bool,
 	case "Integer32", "Integer", "gauge", "counter":
 		// Extract the oid for this index, and keep the remainder for the next index.
 		subOid, indexOids := splitOid(indexOids, 1)
-		return fmt.Sprintf("%d", subOid[0]), subOid, indexOids
+		return strconv.Itoa(subOid[0]), subOid, indexOids
 	case "PhysAddress48":
 		subOid, indexOids := splitOid(indexOids, 6)
 		parts := make([]string, 6)
@@ -840,6 +1726,11 @@ func indexOidsAsString(indexOids []int, typ string, fixedSize int, implied bool,
 		if length == 0 {
 			subOid, indexOids = splitOid(indexOids, 1)
 			length = subOid[0]
+			// A length beyond the remaining sub-identifiers is bogus, don't
+			// make up content for it.
+			if length > len(indexOids) {
+				length = len(indexOids)
+			}
 		}
 		content, indexOids := splitOid(indexOids, length)
 		subOid = append(subOid, content...)
@@ -860,6 +1751,11 @@ func indexOidsAsString(indexOids []int, typ string, fixedSize int, implied bool,
 		if length == 0 {
 			subOid, indexOids = splitOid(indexOids, 1)
 			length = subOid[0]
+			// A length beyond the remaining sub-identifiers is bogus, don't
+			// make up content for it.
+			if length > len(indexOids) {
+				length = len(indexOids)
+			}
 		}
 		content, indexOids := splitOid(indexOids, length)
 		subOid = append(subOid, content...)
@@ -895,6 +1791,92 @@ func indexOidsAsString(indexOids []int, typ string, fixedSize int, implied bool,
 	}
 }
 
+// displayIndex renders the bytes of an OctetString or DisplayString index
+// as set by its display. For "both" the text form is returned along with the
+// hex one, for "auto" the text form is used if all bytes are printable.
+func displayIndex(content []int, display string) (string, string) {
+	if len(content) == 0 {
+		return "", ""
+	}
+	b := make([]byte, len(content))
+	printable := true
+	for i, o := range content {
+		b[i] = byte(o)
+		if b[i] < 0x20 || b[i] > 0x7e {
+			printable = false
+		}
+	}
+	hexStr := fmt.Sprintf("0x%X", b)
+	text := strings.ToValidUTF8(string(b), "�")
+	switch {
+	case display == "hex", display == "auto" && !printable:
+		return hexStr, ""
+	case display == "both":
+		return text, hexStr
+	default:
+		return text, ""
+	}
+}
+
+// formatMAC renders a MAC address rendered as PhysAddress48, such as
+// 00:1B:21:3C:4D:5E, in the format. Values which aren't 6 bytes are left as
+// they are.
+func formatMAC(mac, format string) string {
+	if format == "" || format == config.MACFormatColon {
+		return mac
+	}
+	parts := strings.Split(mac, ":")
+	if len(parts) != 6 {
+		return mac
+	}
+	switch format {
+	case config.MACFormatDash:
+		return strings.Join(parts, "-")
+	case config.MACFormatDot:
+		hex := strings.ToLower(strings.Join(parts, ""))
+		return hex[:4] + "." + hex[4:8] + "." + hex[8:]
+	case config.MACFormatHex:
+		return strings.Join(parts, "")
+	}
+	return mac
+}
+
+// transformIndex derives a label value from an index rendered as str, with
+// the sub-identifiers subOid, as configured by the transform.
+func transformIndex(str string, subOid []int, t *config.IndexTransform) string {
+	if t.Arithmetic() {
+		if len(subOid) == 0 {
+			return ""
+		}
+		v := uint64(subOid[0]) >> t.ShiftRight
+		if t.Divide != 0 {
+			v /= t.Divide
+		}
+		if t.Modulo != 0 {
+			v %= t.Modulo
+		}
+		str = strconv.FormatUint(v, 10)
+	}
+	if len(t.Slice) == 0 {
+		return str
+	}
+	runes := []rune(str)
+	bound := func(i int) int {
+		if i < 0 {
+			i += len(runes)
+		}
+		return min(max(i, 0), len(runes))
+	}
+	start, end := bound(t.Slice[0]), len(runes)
+	if len(t.Slice) == 2 {
+		end = bound(t.Slice[1])
+	}
+	if start >= end {
+		return ""
+	}
+	return string(runes[start:end])
+}
+
 func getPrevOid(oid string) string {
 	oids := strings.Split(oid, ".")
 	i, _ := strconv.Atoi(oids[len(oids)-1])
@@ -903,14 +1885,38 @@ func getPrevOid(oid string) string {
 }
 
 func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics) map[string]string {
-	labels := map[string]string{}
-	labelOids := map[string][]int{}
+	return indexLabels(indexOids, metric, oidToPdu, metrics, nil)
+}
+
+// indexLabels returns the labels of the indexes and lookups of the metric,
+// calling used, if not nil, with the OID of each PDU looked up.
+func indexLabels(indexOids []int, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics, used func(string)) map[string]string {
+	labels := make(map[string]string, len(metric.Indexes)+len(metric.Lookups))
+	labelOids := make(map[string][]int, len(metric.Indexes)+len(metric.Lookups))
 
 	// Covert indexes to useful strings.
 	for _, index := range metric.Indexes {
 		str, subOid, remainingOids := indexOidsAsString(indexOids, index.Type, index.FixedSize, index.Implied, index.EnumValues)
+		if index.Display != "" {
+			content := subOid
+			if index.FixedSize == 0 && !index.Implied && len(content) > 0 {
+				// Without the length.
+				content = content[1:]
+			}
+			var hexStr string
+			str, hexStr = displayIndex(content, index.Display)
+			if index.Display == "both" {
+				labels[index.Labelname+"_hex"] = hexStr
+			}
+		}
+		if index.Type == "PhysAddress48" {
+			str = formatMAC(str, index.MACFormat)
+		}
 		// The labelvalue is the text form of the index oids.
 		labels[index.Labelname] = str
+		for _, t := range index.Transforms {
+			labels[t.Labelname] = transformIndex(str, subOid, t)
+		}
 		// Save its oid in case we need it for lookups.
 		labelOids[index.Labelname] = subOid
 		// For the next iteration.
@@ -923,31 +1929,72 @@ func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string
 			delete(labels, lookup.Labelname)
 			continue
 		}
-		oid := lookup.Oid
-		for _, label := range lookup.Labels {
-			oid = fmt.Sprintf("%s.%s", oid, listToOid(labelOids[label]))
-		}
-		if pdu, ok := oidToPdu[oid]; ok {
-			t := lookup.Type
-			if typeMapping, ok := combinedTypeMapping[lookup.Type]; ok {
-				// Lookup associated sub type in previous object.
-				prevOid := getPrevOid(lookup.Oid)
-				for _, label := range lookup.Labels {
-					prevOid = fmt.Sprintf("%s.%s", prevOid, listToOid(labelOids[label]))
-				}
-				if prevPdu, ok := oidToPdu[prevOid]; ok {
-					val := int(getPduValue(&prevPdu))
-					if ty, ok := typeMapping[val]; ok {
-						t = ty
-					}
-				}
+		if lookup.MappingFile != "" {
+			values := make([]string, 0, len(lookup.Labels))
+			for _, label := range lookup.Labels {
+				values = append(values, labels[label])
 			}
-			labels[lookup.Labelname] = pduValueAsString(&pdu, t, metrics)
-			labelOids[lookup.Labelname] = []int{int(gosnmp.ToBigInt(pdu.Value).Int64())}
-		} else {
-			labels[lookup.Labelname] = ""
+			labels[lookup.Labelname] = mappingValue(lookup.MappingFile, strings.Join(values, ","))
+			continue
+		}
+		pdu, t, ok := lookupPdu(lookup.Oid, lookup.Type, lookup.Labels, labelOids, oidToPdu, used)
+		value := ""
+		if ok {
+			value = pduValueAsString(&pdu, t, metrics)
+		}
+		// Fall back to the next lookups while the value is empty, such as to
+		// ifName and then ifDescr for interfaces without an ifAlias.
+		for _, fallback := range lookup.Fallback {
+			if value != "" {
+				break
+			}
+			if fallbackPdu, fallbackType, found := lookupPdu(fallback.Oid, fallback.Type, lookup.Labels, labelOids, oidToPdu, used); found {
+				pdu, t, ok = fallbackPdu, fallbackType, true
+				value = pduValueAsString(&pdu, t, metrics)
+			}
+		}
+		if t == "PhysAddress48" {
+			value = formatMAC(value, lookup.MACFormat)
+		}
+		labels[lookup.Labelname] = value
+		if ok {
+			labelOids[lookup.Labelname] = []int{int(pduInt64(pdu.Value))}
 		}
 	}
 
 	return labels
 }
+
+// lookupPdu returns the PDU of the lookup object for the values of the
+// labels, and the type to render it as. used, if not nil, is called with the
+// OIDs of the PDUs found.
+func lookupPdu(lookupOid, typ string, labels []string, labelOids map[string][]int, oidToPdu map[string]gosnmp.SnmpPDU, used func(string)) (gosnmp.SnmpPDU, string, bool) {
+	oid := lookupOid
+	for _, label := range labels {
+		oid += "." + listToOid(labelOids[label])
+	}
+	pdu, ok := oidToPdu[oid]
+	if !ok {
+		return pdu, typ, false
+	}
+	if used != nil {
+		used(oid)
+	}
+	if typeMapping, ok := combinedTypeMapping[typ]; ok {
+		// Lookup associated sub type in previous object.
+		prevOid := getPrevOid(lookupOid)
+		for _, label := range labels {
+			prevOid = fmt.Sprintf("%s.%s", prevOid, listToOid(labelOids[label]))
+		}
+		if prevPdu, ok := oidToPdu[prevOid]; ok {
+			if used != nil {
+				used(prevOid)
+			}
+			val := int(getPduValue(&prevPdu))
+			if ty, ok := typeMapping[val]; ok {
+				typ = ty
+			}
+		}
+	}
+	return pdu, typ, true
+}
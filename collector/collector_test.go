@@ -14,16 +14,32 @@
 package collector
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
 	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	io_prometheus_client "github.com/prometheus/client_model/go"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	yaml "gopkg.in/yaml.v2"
 
 	"github.com/prometheus/snmp_exporter/config"
 	"github.com/prometheus/snmp_exporter/scraper"
@@ -568,10 +584,105 @@ func TestPduToSample(t *testing.T) {
 				`Desc{fqName: "test_metric", help: "Help string (Bits)", constLabels: {}, variableLabels: {test_metric}} label:{name:"test_metric" value:"missing"} gauge:{value:0}`,
 			},
 		},
+		{
+			pdu: &gosnmp.SnmpPDU{
+				Name:  "1.1.2.7",
+				Type:  gosnmp.Integer,
+				Value: 3,
+			},
+			indexOids: []int{7},
+			metric: &config.Metric{
+				Name:    "test_metric",
+				Oid:     "1.1.2",
+				Type:    "gauge",
+				Help:    "Help string",
+				Indexes: []*config.Index{{Labelname: "l", Type: "gauge"}},
+				Lookups: []*config.Lookup{
+					{Labels: []string{"l"}, Labelname: "row_status", Oid: "1.1.5", Type: "RowStatus"},
+					{Labelname: "l"},
+				},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{"1.1.5.7": gosnmp.SnmpPDU{Value: 1}},
+			expectedMetrics: []string{
+				`Desc{fqName: "test_metric", help: "Help string", constLabels: {}, variableLabels: {row_status}} label:{name:"row_status" value:"active"} gauge:{value:3}`,
+			},
+		},
+		{
+			pdu: &gosnmp.SnmpPDU{
+				Name:  "1.1.2.7",
+				Type:  gosnmp.Integer,
+				Value: 3,
+			},
+			indexOids: []int{7},
+			metric: &config.Metric{
+				Name:    "test_metric",
+				Oid:     "1.1.2",
+				Type:    "gauge",
+				Help:    "Help string",
+				Indexes: []*config.Index{{Labelname: "l", Type: "gauge"}},
+				Lookups: []*config.Lookup{
+					{Labels: []string{"l"}, Labelname: "row_status", Oid: "1.1.5", Type: "RowStatus"},
+					{Labelname: "l"},
+				},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{"1.1.5.7": gosnmp.SnmpPDU{Value: 3}},
+			expectedMetrics: []string{
+				`Desc{fqName: "test_metric", help: "Help string", constLabels: {}, variableLabels: {row_status}} label:{name:"row_status" value:"notReady"} gauge:{value:3}`,
+			},
+		},
+		{
+			pdu: &gosnmp.SnmpPDU{
+				Name:  "1.1.1.1.1",
+				Type:  gosnmp.Integer,
+				Value: 65535,
+			},
+			indexOids: []int{},
+			metric: &config.Metric{
+				Name:     "test_metric",
+				Oid:      "1.1.1.1.1",
+				Type:     "gauge",
+				Help:     "Help string",
+				ValueMap: config.ValueMap{65535: "NaN", -1: "drop"},
+			},
+			expectedMetrics: []string{`Desc{fqName: "test_metric", help: "Help string", constLabels: {}, variableLabels: {}} gauge:{value:nan}`},
+		},
+		{
+			pdu: &gosnmp.SnmpPDU{
+				Name:  "1.1.1.1.1",
+				Type:  gosnmp.Integer,
+				Value: -1,
+			},
+			indexOids: []int{},
+			metric: &config.Metric{
+				Name:     "test_metric",
+				Oid:      "1.1.1.1.1",
+				Type:     "gauge",
+				Help:     "Help string",
+				ValueMap: config.ValueMap{65535: "NaN", -1: "drop"},
+			},
+			expectedMetrics: []string{},
+		},
+		{
+			pdu: &gosnmp.SnmpPDU{
+				Name:  "1.1.1.1.1",
+				Type:  gosnmp.Integer,
+				Value: 255,
+			},
+			indexOids: []int{},
+			metric: &config.Metric{
+				Name:     "test_metric",
+				Oid:      "1.1.1.1.1",
+				Type:     "gauge",
+				Help:     "Help string",
+				Scale:    2,
+				ValueMap: config.ValueMap{255: "10"},
+			},
+			expectedMetrics: []string{`Desc{fqName: "test_metric", help: "Help string", constLabels: {}, variableLabels: {}} gauge:{value:20}`},
+		},
 	}
 
 	for _, c := range cases {
-		metrics := pduToSamples(c.indexOids, c.pdu, c.metric, c.oidToPdu, log.NewNopLogger(), Metrics{})
+		metrics := pduToSamples(c.indexOids, c.pdu, c.metric, c.oidToPdu, nil, log.NewNopLogger(), Metrics{})
 		metric := &io_prometheus_client.Metric{}
 		expected := map[string]struct{}{}
 		for _, e := range c.expectedMetrics {
@@ -603,6 +714,48 @@ func TestPduToSample(t *testing.T) {
 	}
 }
 
+func TestPduToSamplesBounds(t *testing.T) {
+	min, max := 0.0, 150.0
+	metrics := Metrics{SNMPOutOfRangeSamples: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "or"}, []string{"metric", "action"})}
+	for _, c := range []struct {
+		value      int
+		outOfRange string
+		expected   []float64
+	}{
+		{value: 450, expected: []float64{45}},
+		{value: 2000, expected: []float64{}},
+		{value: 2000, outOfRange: "drop", expected: []float64{}},
+		{value: 2000, outOfRange: "clamp", expected: []float64{150}},
+		{value: -10, outOfRange: "clamp", expected: []float64{0}},
+	} {
+		metric := &config.Metric{Name: "temperature", Oid: "1.1", Type: "gauge", Scale: 0.1, Min: &min, Max: &max, OutOfRange: c.outOfRange}
+		pdu := &gosnmp.SnmpPDU{Name: "1.1.1", Type: gosnmp.Integer, Value: c.value}
+		got := []float64{}
+		for _, m := range pduToSamples([]int{1}, pdu, metric, map[string]gosnmp.SnmpPDU{}, nil, log.NewNopLogger(), metrics) {
+			dtoMetric := &io_prometheus_client.Metric{}
+			if err := m.Write(dtoMetric); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, dtoMetric.GetGauge().GetValue())
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%d %q: expected %v, got %v", c.value, c.outOfRange, c.expected, got)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.SNMPOutOfRangeSamples.WithLabelValues("temperature", "dropped")); got != 2 {
+		t.Errorf("Expected 2 samples dropped, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.SNMPOutOfRangeSamples.WithLabelValues("temperature", "clamped")); got != 2 {
+		t.Errorf("Expected 2 samples clamped, got %v", got)
+	}
+
+	// Bounds don't apply to strings, whose value is always 1.
+	metric := &config.Metric{Name: "sysName", Oid: "1.2", Type: "DisplayString", Min: &max}
+	if samples := pduToSamples([]int{}, &gosnmp.SnmpPDU{Name: "1.2", Type: gosnmp.OctetString, Value: []byte("sw1")}, metric, map[string]gosnmp.SnmpPDU{}, nil, log.NewNopLogger(), metrics); len(samples) != 1 {
+		t.Errorf("Expected the string sample kept, got %v", samples)
+	}
+}
+
 func TestGetPduValue(t *testing.T) {
 	pdu := &gosnmp.SnmpPDU{
 		Value: uint64(1 << 63),
@@ -614,6 +767,14 @@ func TestGetPduValue(t *testing.T) {
 	}
 }
 
+func TestPduInt64(t *testing.T) {
+	for _, v := range []interface{}{-5, uint(4294967295), uint32(7), uint64(1 << 63), int64(-1), int32(3), int8(-2), "42", nil} {
+		if got, want := pduInt64(v), gosnmp.ToBigInt(v).Int64(); got != want {
+			t.Errorf("%T %v: expected %d, got %d", v, v, want, got)
+		}
+	}
+}
+
 func TestGetPduLargeValue(t *testing.T) {
 	_, err := kingpin.CommandLine.Parse([]string{})
 	if err != nil {
@@ -663,6 +824,9 @@ func TestOidToList(t *testing.T) {
 		if !reflect.DeepEqual(got, c.result) {
 			t.Errorf("oidToList(%v): got %v, want %v", c.oid, got, c.result)
 		}
+		if back := listToOid(got); back != c.oid {
+			t.Errorf("listToOid(%v): got %v, want %v", got, back, c.oid)
+		}
 	}
 }
 
@@ -820,6 +984,55 @@ func TestParseDateAndTime(t *testing.T) {
 	}
 }
 
+func TestIndexesToLabelsMappingFile(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "circuits.csv")
+	if err := os.WriteFile(csvFile, []byte("# ifIndex,circuit\n2,CKT-0002\n3,CKT-0003\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	yamlFile := filepath.Join(dir, "sites.yml")
+	if err := os.WriteFile(yamlFile, []byte("\"1,2\": ams1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		oid    []int
+		metric config.Metric
+		result map[string]string
+	}{
+		{
+			oid: []int{3},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "circuit", MappingFile: csvFile}},
+			},
+			result: map[string]string{"ifIndex": "3", "circuit": "CKT-0003"},
+		},
+		{
+			oid: []int{4},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "circuit", MappingFile: csvFile}},
+			},
+			result: map[string]string{"ifIndex": "4", "circuit": ""},
+		},
+		{
+			oid: []int{1, 2},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "a", Type: "gauge"}, {Labelname: "b", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"a", "b"}, Labelname: "site", MappingFile: yamlFile}},
+			},
+			result: map[string]string{"a": "1", "b": "2", "site": "ams1"},
+		},
+	}
+	for _, c := range cases {
+		got := indexesToLabels(c.oid, &c.metric, map[string]gosnmp.SnmpPDU{}, Metrics{})
+		if !reflect.DeepEqual(got, c.result) {
+			t.Errorf("indexesToLabels(%v, %v): got %v, want %v", c.oid, c.metric, got, c.result)
+		}
+	}
+}
+
 func TestIndexesToLabels(t *testing.T) {
 	cases := []struct {
 		oid      []int
@@ -839,6 +1052,26 @@ func TestIndexesToLabels(t *testing.T) {
 			oidToPdu: map[string]gosnmp.SnmpPDU{},
 			result:   map[string]string{"l": "4"},
 		},
+		{
+			oid: []int{3*256 + 7},
+			metric: config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "gauge", Transforms: []*config.IndexTransform{
+				{Labelname: "slot", Divide: 256},
+				{Labelname: "port", Modulo: 256},
+				{Labelname: "slot_bits", ShiftRight: 8},
+			}}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"l": "775", "slot": "3", "port": "7", "slot_bits": "3"},
+		},
+		{
+			oid: []int{6, 65, 66, 67, 45, 48, 49},
+			metric: config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "DisplayString", Transforms: []*config.IndexTransform{
+				{Labelname: "site", Slice: []int{0, 3}},
+				{Labelname: "rack", Slice: []int{-2}},
+				{Labelname: "none", Slice: []int{4, 2}},
+			}}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"l": "ABC-01", "site": "ABC", "rack": "01", "none": ""},
+		},
 		{
 			oid: []int{3, 4},
 			metric: config.Metric{
@@ -848,6 +1081,46 @@ func TestIndexesToLabels(t *testing.T) {
 			oidToPdu: map[string]gosnmp.SnmpPDU{"1.2.3.4": gosnmp.SnmpPDU{Value: "eth0"}},
 			result:   map[string]string{"a": "3", "b": "4", "l": "eth0"},
 		},
+		{
+			oid: []int{4},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "interface", Oid: "1.18", Type: "DisplayString",
+					Fallback: []*config.LookupFallback{{Oid: "1.1", Type: "DisplayString"}, {Oid: "1.2", Type: "DisplayString"}}}},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{"1.18.4": gosnmp.SnmpPDU{Value: "uplink"}, "1.1.4": gosnmp.SnmpPDU{Value: "Gi0/4"}},
+			result:   map[string]string{"ifIndex": "4", "interface": "uplink"},
+		},
+		{
+			oid: []int{4},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "interface", Oid: "1.18", Type: "DisplayString",
+					Fallback: []*config.LookupFallback{{Oid: "1.1", Type: "DisplayString"}, {Oid: "1.2", Type: "DisplayString"}}}},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{"1.18.4": gosnmp.SnmpPDU{Value: ""}, "1.1.4": gosnmp.SnmpPDU{Value: "Gi0/4"}, "1.2.4": gosnmp.SnmpPDU{Value: "GigabitEthernet0/4"}},
+			result:   map[string]string{"ifIndex": "4", "interface": "Gi0/4"},
+		},
+		{
+			oid: []int{4},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "interface", Oid: "1.18", Type: "DisplayString",
+					Fallback: []*config.LookupFallback{{Oid: "1.1", Type: "DisplayString"}, {Oid: "1.2", Type: "DisplayString"}}}},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{"1.1.4": gosnmp.SnmpPDU{Value: ""}, "1.2.4": gosnmp.SnmpPDU{Value: "GigabitEthernet0/4"}},
+			result:   map[string]string{"ifIndex": "4", "interface": "GigabitEthernet0/4"},
+		},
+		{
+			oid: []int{4},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "interface", Oid: "1.18", Type: "DisplayString",
+					Fallback: []*config.LookupFallback{{Oid: "1.1", Type: "DisplayString"}, {Oid: "1.2", Type: "DisplayString"}}}},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"ifIndex": "4", "interface": ""},
+		},
 		{
 			oid: []int{4},
 			metric: config.Metric{
@@ -914,6 +1187,21 @@ func TestIndexesToLabels(t *testing.T) {
 			oidToPdu: map[string]gosnmp.SnmpPDU{},
 			result:   map[string]string{"l": "01:FF:00:00:00:10"},
 		},
+		{
+			oid:      []int{1, 255, 0, 0, 0, 16},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "PhysAddress48", MACFormat: "dot"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"l": "01ff.0000.0010"},
+		},
+		{
+			oid: []int{7},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifPhysAddress", Oid: "1.1", Type: "PhysAddress48", MACFormat: "dash"}},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{"1.1.7": {Type: gosnmp.OctetString, Value: []byte{0x00, 0x1b, 0x21, 0x3c, 0x4d, 0x5e}}},
+			result:   map[string]string{"ifIndex": "7", "ifPhysAddress": "00-1B-21-3C-4D-5E"},
+		},
 		{
 			oid:      []int{3, 65, 32, 255},
 			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "OctetString"}}},
@@ -1082,6 +1370,57 @@ func TestIndexesToLabels(t *testing.T) {
 			},
 			result: map[string]string{"lldpRemTimeMark": "1", "lldpRemLocalPortNum": "8", "lldpRemIndex": "1", "lldpLocPortId": "04:05:06:07:08:09"},
 		},
+		{
+			oid: []int{3},
+			metric: config.Metric{
+				Indexes: []*config.Index{{Labelname: "l", Type: "gauge"}},
+				Lookups: []*config.Lookup{{Labels: []string{"l"}, Labelname: "row_status", Oid: "1.1.5", Type: "RowStatus"}},
+			},
+			oidToPdu: map[string]gosnmp.SnmpPDU{"1.1.5.3": gosnmp.SnmpPDU{Value: 2}},
+			result:   map[string]string{"l": "3", "row_status": "notInService"},
+		},
+		{
+			oid:      []int{2, 65, 66, 7},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "s", Type: "DisplayString"}, {Labelname: "i", Type: "gauge"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"s": "AB", "i": "7"},
+		},
+		{
+			oid:      []int{5, 65, 66},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "s", Type: "DisplayString"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"s": "AB"},
+		},
+		{
+			oid:      []int{5, 1, 2},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "s", Type: "OctetString"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"s": "0x0102"},
+		},
+		{
+			oid:      []int{3, 65, 66, 67},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "OctetString", Display: "auto"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"l": "ABC"},
+		},
+		{
+			oid:      []int{3, 128, 0, 9},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "OctetString", Display: "auto"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"l": "0x800009"},
+		},
+		{
+			oid:      []int{65, 66, 67},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "DisplayString", Implied: true, Display: "hex"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"l": "0x414243"},
+		},
+		{
+			oid:      []int{65, 66, 2},
+			metric:   config.Metric{Indexes: []*config.Index{{Labelname: "l", Type: "OctetString", FixedSize: 2, Display: "both"}, {Labelname: "i", Type: "gauge"}}},
+			oidToPdu: map[string]gosnmp.SnmpPDU{},
+			result:   map[string]string{"l": "AB", "l_hex": "0x4142", "i": "2"},
+		},
 	}
 	for _, c := range cases {
 		got := indexesToLabels(c.oid, &c.metric, c.oidToPdu, Metrics{})
@@ -1486,7 +1825,7 @@ func TestScrapeTarget(t *testing.T) {
 		tt := c
 		t.Run(tt.name, func(t *testing.T) {
 			mock := scraper.NewMockSNMPScraper(tt.getResponse, tt.walkResponses)
-			results, err := ScrapeTarget(mock, "someTarget", auth, tt.module, log.NewNopLogger(), Metrics{})
+			results, err := ScrapeTarget(context.Background(), mock, "someTarget", auth, tt.module, log.NewNopLogger(), Metrics{})
 			if err != nil {
 				t.Errorf("ScrapeTarget returned an error: %v", err)
 			}
@@ -1509,3 +1848,1796 @@ func TestScrapeTarget(t *testing.T) {
 		})
 	}
 }
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{err: nil, expected: ""},
+		{err: fmt.Errorf("scrape canceled after 5s (possible timeout) walking target foo: %w", context.Canceled), expected: ErrorTypeTimeout},
+		{err: fmt.Errorf("error walking target foo: %w", errors.New("request timeout (after 3 retries)")), expected: ErrorTypeTimeout},
+		{err: fmt.Errorf("error getting target foo: %w", gosnmp.ErrWrongDigest), expected: ErrorTypeAuth},
+		{err: fmt.Errorf("error getting target foo: %w", gosnmp.ErrUnknownUsername), expected: ErrorTypeAuth},
+		{err: fmt.Errorf("error connecting to target foo: %w", &net.DNSError{Err: "no such host", Name: "foo"}), expected: ErrorTypeUnreachable},
+		{err: fmt.Errorf("error walking target foo: %w", errors.New("unable to decode packet body: bad")), expected: ErrorTypeDecode},
+		{err: &AgentError{Target: "foo", Status: gosnmp.GenErr}, expected: ErrorTypeAgent},
+		{err: errors.New("something else"), expected: ErrorTypeUnknown},
+	}
+	for _, c := range cases {
+		if got := ClassifyError(c.err); got != c.expected {
+			t.Errorf("ClassifyError(%v): got %q, want %q", c.err, got, c.expected)
+		}
+	}
+}
+
+func TestPartialScrape(t *testing.T) {
+	c := Collector{errors: &scrapeErrors{}}
+	c.errors.moduleScraped()
+	if c.Partial() {
+		t.Error("Expected a scrape without errors not to be partial")
+	}
+	c.errors.add(ErrorTypeTimeout, "if_mib")
+	if !c.Partial() {
+		t.Error("Expected a scrape with a module scraped and a failed one to be partial")
+	}
+	c = Collector{errors: &scrapeErrors{}}
+	c.errors.add(ErrorTypeTimeout, "if_mib")
+	if c.Partial() || c.ErrorType() != ErrorTypeTimeout {
+		t.Error("Expected a scrape without any module scraped to fail")
+	}
+}
+
+func TestPduTypeMatches(t *testing.T) {
+	cases := []struct {
+		metricType string
+		pduType    gosnmp.Asn1BER
+		result     bool
+	}{
+		{metricType: "counter", pduType: gosnmp.Counter32, result: true},
+		{metricType: "counter", pduType: gosnmp.Counter64, result: true},
+		{metricType: "counter", pduType: gosnmp.Gauge32, result: false},
+		{metricType: "counter", pduType: gosnmp.OctetString, result: false},
+		{metricType: "gauge", pduType: gosnmp.Integer, result: true},
+		{metricType: "gauge", pduType: gosnmp.OctetString, result: false},
+		{metricType: "EnumAsInfo", pduType: gosnmp.Integer, result: true},
+		{metricType: "Float", pduType: gosnmp.OpaqueFloat, result: true},
+		{metricType: "Bits", pduType: gosnmp.OctetString, result: true},
+		{metricType: "Bits", pduType: gosnmp.Integer, result: false},
+		{metricType: "DisplayString", pduType: gosnmp.OctetString, result: true},
+		{metricType: "InetAddressIPv4", pduType: gosnmp.IPAddress, result: true},
+		{metricType: "DisplayString", pduType: gosnmp.Counter32, result: false},
+		{metricType: "counter", pduType: gosnmp.NoSuchInstance, result: true},
+	}
+	for _, c := range cases {
+		if got := pduTypeMatches(c.metricType, c.pduType); got != c.result {
+			t.Errorf("pduTypeMatches(%s, %s): got %v, want %v", c.metricType, c.pduType, got, c.result)
+		}
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	metric := &config.Metric{
+		Name: "drops",
+		Oid:  "1.1",
+		Type: "counter",
+		Help: "Drops",
+		Indexes: []*config.Index{
+			{Labelname: "ifIndex", Type: "gauge"},
+			{Labelname: "queue", Type: "gauge"},
+		},
+	}
+	pdus := []struct {
+		index []int
+		value uint
+	}{
+		{index: []int{1, 1}, value: 5},
+		{index: []int{1, 2}, value: 7},
+		{index: []int{2, 1}, value: 3},
+	}
+	cases := []struct {
+		op       string
+		expected []string
+	}{
+		{
+			op: "sum",
+			expected: []string{
+				`Desc{fqName: "drops_sum", help: "Drops (sum without queue)", constLabels: {}, variableLabels: {ifIndex}} label:{name:"ifIndex" value:"1"} counter:{value:12}`,
+				`Desc{fqName: "drops_sum", help: "Drops (sum without queue)", constLabels: {}, variableLabels: {ifIndex}} label:{name:"ifIndex" value:"2"} counter:{value:3}`,
+			},
+		},
+		{
+			op: "max",
+			expected: []string{
+				`Desc{fqName: "drops_max", help: "Drops (max without queue)", constLabels: {}, variableLabels: {ifIndex}} label:{name:"ifIndex" value:"1"} gauge:{value:7}`,
+				`Desc{fqName: "drops_max", help: "Drops (max without queue)", constLabels: {}, variableLabels: {ifIndex}} label:{name:"ifIndex" value:"2"} gauge:{value:3}`,
+			},
+		},
+	}
+	for _, c := range cases {
+		a := newAggregators([]*config.Aggregation{{Metric: "drops", Name: "drops_" + c.op, Op: c.op, Without: []string{"queue"}}})["drops"][0]
+		for _, p := range pdus {
+			pdu := &gosnmp.SnmpPDU{Type: gosnmp.Counter32, Value: p.value}
+			a.add(metric, pduToSamples(p.index, pdu, metric, map[string]gosnmp.SnmpPDU{}, nil, log.NewNopLogger(), Metrics{}))
+		}
+		got := []string{}
+		for _, m := range a.metrics() {
+			pb := &io_prometheus_client.Metric{}
+			if err := m.Write(pb); err != nil {
+				t.Fatalf("Error writing metric: %v", err)
+			}
+			got = append(got, strings.ReplaceAll(m.Desc().String()+" "+pb.String(), "  ", " "))
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.op, got, c.expected)
+		}
+	}
+
+	// Metrics derived from the source are aggregated by name.
+	defer func(mode string) { *counter64Exact = mode }(*counter64Exact)
+	*counter64Exact = "split"
+	a := newAggregators([]*config.Aggregation{{Metric: "drops", Name: "drops_sum", Op: "sum", Without: []string{"queue"}}})["drops"][0]
+	for _, p := range pdus {
+		pdu := &gosnmp.SnmpPDU{Type: gosnmp.Counter64, Value: uint64(p.value) << 54}
+		a.add(metric, pduToSamples(p.index, pdu, metric, map[string]gosnmp.SnmpPDU{}, nil, log.NewNopLogger(), Metrics{}))
+	}
+	got := []string{}
+	for _, m := range a.metrics() {
+		pb := &io_prometheus_client.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf("Error writing metric: %v", err)
+		}
+		got = append(got, sampleName(m)+" "+pb.GetLabel()[0].GetValue())
+	}
+	expected := []string{"drops_sum_hi 1", "drops_sum_hi 2", "drops_sum_lo 1", "drops_sum_lo 2", "drops_sum 1", "drops_sum 2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong derived aggregations: got %v, want %v", got, expected)
+	}
+
+	// A counter and a gauge of the same name can't be aggregated.
+	a = newAggregators([]*config.Aggregation{{Metric: "drops", Name: "drops_sum", Op: "sum", Without: []string{"queue"}}})["drops"][0]
+	gauge := *metric
+	gauge.Type = "gauge"
+	for i, m := range []*config.Metric{metric, &gauge} {
+		pdu := &gosnmp.SnmpPDU{Type: gosnmp.Counter32, Value: uint(1)}
+		a.add(m, pduToSamples(pdus[i].index, pdu, m, map[string]gosnmp.SnmpPDU{}, nil, log.NewNopLogger(), Metrics{}))
+	}
+	if samples := a.metrics(); len(samples) != 1 || samples[0].Write(&io_prometheus_client.Metric{}) == nil {
+		t.Errorf("Expected an error for mixed counter and gauge samples, got %v", samples)
+	}
+}
+
+func TestSourcePortPool(t *testing.T) {
+	cases := []struct {
+		portRange  string
+		srcAddress string
+		shouldErr  bool
+	}{
+		{portRange: "20000-20001", srcAddress: ""},
+		{portRange: "20000", srcAddress: "10.0.0.1"},
+		{portRange: "20000-20001", srcAddress: "10.0.0.1:0"},
+		{portRange: "20001-20000", shouldErr: true},
+		{portRange: "0-10", shouldErr: true},
+		{portRange: "20000-70000", shouldErr: true},
+		{portRange: "20000-20001", srcAddress: "10.0.0.1:161", shouldErr: true},
+	}
+	for _, c := range cases {
+		_, err := newSourcePortPool(c.portRange, c.srcAddress)
+		if (err != nil) != c.shouldErr {
+			t.Errorf("newSourcePortPool(%q, %q): unexpected error %v", c.portRange, c.srcAddress, err)
+		}
+	}
+
+	p, err := newSourcePortPool("20000-20001", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a, _ := p.acquire(ctx)
+	b, _ := p.acquire(ctx)
+	if a == b {
+		t.Errorf("got port %d twice", a)
+	}
+	cancel()
+	if _, err := p.acquire(ctx); err == nil {
+		t.Error("expected error acquiring from an exhausted pool")
+	}
+	p.release(a)
+	if got, _ := p.acquire(context.Background()); got != a {
+		t.Errorf("got port %d after release, want %d", got, a)
+	}
+
+	for addr, want := range map[string]string{"": ":20000", "10.0.0.1": "10.0.0.1:20000", "10.0.0.1:": "10.0.0.1:20000", "[::1]:0": "[::1]:20000", "::1": "[::1]:20000"} {
+		if got := withSourcePort(addr, 20000); got != want {
+			t.Errorf("withSourcePort(%q): got %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestCoercePdu(t *testing.T) {
+	cases := []struct {
+		metricType string
+		pdu        gosnmp.SnmpPDU
+		value      float64
+		ok         bool
+	}{
+		{metricType: "counter", pdu: gosnmp.SnmpPDU{Type: gosnmp.Gauge32, Value: uint(7)}, value: 7, ok: true},
+		{metricType: "counter", pdu: gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: -1}, value: 4294967295, ok: true},
+		{metricType: "counter", pdu: gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("12345 ")}, value: 12345, ok: true},
+		{metricType: "gauge", pdu: gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("23.5")}, value: 23.5, ok: true},
+		{metricType: "gauge", pdu: gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("n/a")}, ok: false},
+		{metricType: "gauge", pdu: gosnmp.SnmpPDU{Type: gosnmp.Counter64, Value: uint64(1 << 60)}, value: 1 << 60, ok: true},
+		{metricType: "DisplayString", pdu: gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("n/a")}, ok: true},
+	}
+	for _, c := range cases {
+		pdu := c.pdu
+		ok := coercePdu(c.metricType, &pdu)
+		if ok != c.ok {
+			t.Errorf("coercePdu(%s, %v): got %v, want %v", c.metricType, c.pdu, ok, c.ok)
+			continue
+		}
+		if ok && c.value != 0 {
+			if got := getPduValue(&pdu); got != c.value {
+				t.Errorf("coercePdu(%s, %v): got value %v, want %v", c.metricType, c.pdu, got, c.value)
+			}
+		}
+	}
+}
+
+func TestStrictness(t *testing.T) {
+	module := &config.Module{
+		Metrics: []*config.Metric{
+			{Name: "ifInOctets", Oid: "1.1", Type: "counter", Help: "Octets", Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+			{Name: "temperature", Oid: "1.2", Type: "gauge", Help: "Temperature"},
+		},
+	}
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.1.1", Type: gosnmp.Counter32, Value: uint(10)},
+		// A counter returned as a Gauge32.
+		{Name: ".1.1.2", Type: gosnmp.Gauge32, Value: uint(20)},
+		{Name: ".1.2.0", Type: gosnmp.OctetString, Value: []byte("n/a")},
+	}
+	cases := []struct {
+		strictness string
+		samples    int
+	}{
+		// The string can't be converted to a gauge.
+		{strictness: "", samples: 2},
+		{strictness: config.StrictnessLenient, samples: 2},
+		{strictness: config.StrictnessStrict, samples: 1},
+		{strictness: config.StrictnessParanoid, samples: 1},
+	}
+	for _, c := range cases {
+		module.Strictness = c.strictness
+		if samples := PdusToMetrics(module, pdus, log.NewNopLogger(), Metrics{}); len(samples) != c.samples {
+			t.Errorf("%q: expected %d samples, got %v", c.strictness, c.samples, samples)
+		}
+	}
+
+	err := checkPduTypes(module, pdus)
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) || ClassifyError(err) != ErrorTypeDecode {
+		t.Fatalf("Expected a decode error, got %v", err)
+	}
+	if err := checkPduTypes(module, pdus[:1]); err != nil {
+		t.Errorf("Expected no error for PDUs of the right type, got %v", err)
+	}
+
+	if err := config.CheckStrictness(config.StrictnessStrict, true); err == nil {
+		t.Error("Expected tolerant_decode to contradict strictness strict")
+	}
+	if err := config.CheckStrictness("loose", false); err == nil {
+		t.Error("Expected an error for an unknown strictness")
+	}
+}
+
+func TestDualStackTargets(t *testing.T) {
+	both := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("192.0.2.2")}}
+	cases := []struct {
+		target    string
+		addrs     []net.IPAddr
+		preferred string
+		result    []familyTarget
+	}{
+		{
+			target:    "switch1",
+			addrs:     both,
+			preferred: "ipv4",
+			result:    []familyTarget{{"ipv4", "192.0.2.1"}, {"ipv6", "2001:db8::1"}},
+		},
+		{
+			target:    "tcp://switch1:1161",
+			addrs:     both,
+			preferred: "ipv6",
+			result:    []familyTarget{{"ipv6", "tcp://[2001:db8::1]:1161"}, {"ipv4", "tcp://192.0.2.1:1161"}},
+		},
+		{
+			target:    "switch1",
+			addrs:     both[1:],
+			preferred: "ipv4",
+		},
+	}
+	for _, c := range cases {
+		got := dualStackTargets(c.target, c.addrs, c.preferred)
+		if !reflect.DeepEqual(got, c.result) {
+			t.Errorf("dualStackTargets(%q, %v, %q): got %v, want %v", c.target, c.addrs, c.preferred, got, c.result)
+		}
+	}
+}
+
+func TestFamilyTargets(t *testing.T) {
+	f := newFamilyTargets()
+	now := time.Now()
+	if got := f.family("switch1", now); got != "" {
+		t.Errorf("Expected no family for a new target, got %q", got)
+	}
+	f.record("switch1", "ipv6", now)
+	if got := f.family("switch1", now.Add(time.Minute)); got != "ipv6" {
+		t.Errorf("Expected the recorded family, got %q", got)
+	}
+	if got := f.family("switch2", now); got != "" {
+		t.Errorf("Expected no family for another target, got %q", got)
+	}
+	later := now.Add(*familyTTL + 2*time.Minute)
+	if got := f.family("switch1", later); got != "" {
+		t.Errorf("Expected the family to be forgotten after the TTL, got %q", got)
+	}
+	if len(f.targets) != 0 {
+		t.Errorf("Expected the target to be swept, got %v", f.targets)
+	}
+}
+
+func TestRecordAddress(t *testing.T) {
+	candidates := []familyTarget{{"ipv4", "192.0.2.1"}, {"ipv6", "2001:db8::1"}}
+	for _, c := range []struct {
+		errorType string
+		family    string
+	}{
+		{"", "ipv4"},
+		{ErrorTypeTimeout, "ipv6"},
+		{ErrorTypeUnreachable, "ipv6"},
+		{ErrorTypeAuth, "ipv4"},
+	} {
+		lastFamilies = newFamilyTargets()
+		col := Collector{errors: &scrapeErrors{}}
+		if c.errorType != "" {
+			col.errors.add(c.errorType, "if_mib")
+		}
+		col.recordAddress(log.NewNopLogger(), "switch1", candidates)
+		if got := lastFamilies.family("switch1", time.Now()); got != c.family {
+			t.Errorf("After a scrape with error %q: got family %q, want %q", c.errorType, got, c.family)
+		}
+	}
+	lastFamilies = newFamilyTargets()
+}
+
+func TestUnsupportedOids(t *testing.T) {
+	u := newUnsupportedOids()
+	now := time.Now()
+	oids := []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.4.1.9"}
+	for i := 0; i < unsupportedOidMisses; i++ {
+		if got, skipped := u.filter("t1", oids, now); skipped != 0 || len(got) != 2 {
+			t.Fatalf("Scrape %d: OIDs skipped too early: %v", i, got)
+		}
+		u.record("t1", "1.3.6.1.4.1.9", false, now, time.Hour)
+	}
+	if got, skipped := u.filter("t1", oids, now); skipped != 1 || !reflect.DeepEqual(got, oids[:1]) {
+		t.Errorf("Expected the unsupported OID to be skipped, got %v", got)
+	}
+	if _, skipped := u.filter("t2", oids, now); skipped != 0 {
+		t.Error("OIDs of another target were skipped")
+	}
+	// Tried again after the TTL, and forgotten once supported.
+	later := now.Add(time.Hour)
+	if _, skipped := u.filter("t1", oids, later); skipped != 0 {
+		t.Error("OID still skipped after the TTL")
+	}
+	// Missing again after the TTL, it takes as many misses to be skipped.
+	u.record("t1", "1.3.6.1.4.1.9", false, later, time.Hour)
+	if _, skipped := u.filter("t1", oids, later); skipped != 0 {
+		t.Error("OID skipped again after a single miss past the TTL")
+	}
+	u.record("t1", "1.3.6.1.4.1.9", true, later, time.Hour)
+	if len(u.targets) != 0 {
+		t.Errorf("Supported OID not forgotten: %v", u.targets)
+	}
+
+	// OIDs of targets no longer scraped are swept.
+	u.record("t3", "1.3.6.1.4.1.9", false, later, time.Hour)
+	u.record("t1", "1.3.6.1.4.1.9", false, later.Add(2*time.Hour), time.Hour)
+	if _, ok := u.targets["t3"]; ok {
+		t.Error("OID of a target no longer scraped not swept")
+	}
+
+	client, err := scraper.NewGoSNMP(log.NewNopLogger(), "192.0.2.1", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	views := map[string]struct{}{}
+	for _, auth := range []config.Auth{
+		{Version: 2, Community: "public"},
+		{Version: 2, Community: "private"},
+		{Version: 2, Community: "public", ContextName: "vlan-10"},
+		{Version: 3, Username: "user", SecurityLevel: "noAuthNoPriv"},
+	} {
+		client.SetOptions(func(g *gosnmp.GoSNMP) { auth.ConfigureSNMP(g, "") })
+		views[viewKey(client, "192.0.2.1")] = struct{}{}
+	}
+	if len(views) != 4 {
+		t.Errorf("Expected a view for each community, user and context, got %v", views)
+	}
+}
+
+func TestSecondaryCredentialsOrder(t *testing.T) {
+	s := newCredentialTargets()
+	now := time.Now()
+	secondary := &config.Auth{Community: "new"}
+	auth := &config.Auth{Community: "old", Secondary: secondary}
+	configured := credentialsOf(auth)
+	names := func(credentials []credential) []string {
+		n := []string{}
+		for _, c := range credentials {
+			n = append(n, c.name)
+		}
+		return n
+	}
+	if got := names(s.order("t1", configured, now)); !reflect.DeepEqual(got, []string{"primary", "secondary"}) {
+		t.Errorf("Expected primary credentials first, got %v", got)
+	}
+	s.record("t1", "secondary", configured, now)
+	got := s.order("t1", configured, now)
+	if !reflect.DeepEqual(names(got), []string{"secondary", "primary"}) || got[0].auth != secondary {
+		t.Errorf("Expected secondary credentials first once they worked, got %v", names(got))
+	}
+	if got := names(s.order("t2", configured, now)); got[0] != "primary" {
+		t.Errorf("Credentials of another target changed: %v", got)
+	}
+	s.record("t1", "primary", configured, now)
+	if len(s.targets) != 0 {
+		t.Errorf("Target not forgotten once primary credentials worked again: %v", s.targets)
+	}
+
+	// Targets not scraped within the TTL are forgotten.
+	s.record("t1", "secondary", configured, now)
+	later := now.Add(*credentialsTTL + 2*time.Minute)
+	if got := names(s.order("t2", configured, later)); got[0] != "primary" || len(s.targets) != 0 {
+		t.Errorf("Expected the credentials of t1 to be swept, got %v", s.targets)
+	}
+}
+
+func TestUserCredentialsOrder(t *testing.T) {
+	s := newCredentialTargets()
+	now := time.Now()
+	auth := &config.Auth{}
+	if err := yaml.UnmarshalStrict([]byte("version: 3\nsecurity_level: authPriv\nauth_protocol: SHA\npriv_protocol: AES\npassword: auth\npriv_password: priv\nusers:\n- username: monitor\n- username: legacy\n  security_level: authNoPriv\n  password: old\n- username: ops\n"), auth); err != nil {
+		t.Fatal(err)
+	}
+	configured := credentialsOf(auth)
+	s.record("t1", "ops", configured, now)
+	got := s.order("t1", configured, now)
+	names := []string{}
+	for _, c := range got {
+		names = append(names, c.name)
+	}
+	if want := []string{"ops", "monitor", "legacy"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected users %v, got %v", want, names)
+	}
+	if legacy := got[2].auth; legacy.SecurityLevel != "authNoPriv" || legacy.Password != "old" || legacy.AuthProtocol != "SHA" {
+		t.Errorf("Expected settings of the user over those of the auth, got %+v", legacy)
+	}
+	// Secrets changed after loading, e.g. decrypted, are those used.
+	auth.Users[1].Password = "new"
+	if legacy := credentialsOf(auth)[1].auth; legacy.Password != "new" {
+		t.Errorf("Expected the current password of the user, got %q", legacy.Password)
+	}
+
+	for _, c := range []struct {
+		err  error
+		next bool
+	}{
+		{fmt.Errorf("error getting target: %w", gosnmp.ErrUnknownUsername), true},
+		{errors.New("request timeout (after 0 retries)"), true},
+		{fmt.Errorf("error getting target: %w", syscall.EHOSTUNREACH), false},
+	} {
+		if got := tryNextCredentials(ClassifyError(c.err)); got != c.next {
+			t.Errorf("Expected trying the next user after %q to be %v, got %v", c.err, c.next, got)
+		}
+	}
+}
+
+func TestRecordCredentials(t *testing.T) {
+	auth := &config.Auth{Community: "old", Secondary: &config.Auth{Community: "new"}}
+	configured := credentialsOf(auth)
+	for _, c := range []struct {
+		used       string
+		errorType  string
+		nextFamily bool
+		next       string
+	}{
+		{"primary", "", false, "primary"},
+		{"secondary", "", false, "secondary"},
+		{"primary", ErrorTypeTimeout, false, "secondary"},
+		{"secondary", ErrorTypeAuth, false, "primary"},
+		{"primary", ErrorTypeUnreachable, false, "primary"},
+		// The other address family is tried first.
+		{"primary", ErrorTypeTimeout, true, "primary"},
+		{"primary", ErrorTypeAuth, true, "secondary"},
+	} {
+		lastCredentials = newCredentialTargets()
+		col := Collector{errors: &scrapeErrors{}}
+		if c.errorType != "" {
+			col.errors.add(c.errorType, "if_mib")
+		}
+		col.recordCredentials(log.NewNopLogger(), "t1", configured, c.used, c.nextFamily)
+		if got := lastCredentials.order("t1", configured, time.Now())[0].name; got != c.next {
+			t.Errorf("After a scrape with %s and error %q: got %s, want %s", c.used, c.errorType, got, c.next)
+		}
+	}
+	lastCredentials = newCredentialTargets()
+}
+
+func TestTimeStampToUnix(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	oidToPdu := map[string]gosnmp.SnmpPDU{
+		sysUpTimeOid: {Name: "." + sysUpTimeOid, Type: gosnmp.TimeTicks, Value: uint32(360000)},
+	}
+	cases := []struct {
+		ticks    float64
+		expected float64
+		err      bool
+	}{
+		{ticks: 360000, expected: 1700000000},
+		{ticks: 300000, expected: 1700000000 - 600},
+		// Before the agent started.
+		{ticks: 0, expected: 1700000000 - 3600},
+		{ticks: 360001, err: true},
+	}
+	for _, c := range cases {
+		got, err := timeStampToUnix(c.ticks, oidToPdu, now)
+		if c.err != (err != nil) || got != c.expected {
+			t.Errorf("TimeStamp %v: expected %v (error %v), got %v (%v)", c.ticks, c.expected, c.err, got, err)
+		}
+	}
+	if _, err := timeStampToUnix(0, map[string]gosnmp.SnmpPDU{}, now); err == nil {
+		t.Error("Expected an error without sysUpTime")
+	}
+
+	module := &config.Module{Metrics: []*config.Metric{{Name: "ifLastChange", Oid: "1.3.6.1.2.1.2.2.1.9", Type: "TimeStamp"}}}
+	if !needsSysUpTime(module, nil, []string{"1.3.6.1.2.1.2"}) {
+		t.Error("Expected sysUpTime to be needed")
+	}
+	if needsSysUpTime(module, []string{sysUpTimeOid}, nil) || needsSysUpTime(module, nil, []string{"1.3.6.1.2.1.1"}) {
+		t.Error("Expected sysUpTime to already be fetched")
+	}
+	if needsSysUpTime(&config.Module{}, nil, nil) {
+		t.Error("Expected sysUpTime not to be needed without TimeStamp metrics")
+	}
+}
+
+func TestWalkOverrides(t *testing.T) {
+	retries := 1
+	module := &config.Module{WalkOverrides: map[string]*config.WalkOverride{
+		"1.3.6.1.2.1.2":          {Timeout: 30 * time.Second},
+		"1.3.6.1.2.1.2.2.1.2":    {Retries: &retries, MaxRepetitions: 50},
+		"1.3.6.1.2.1.31.1.1.1.6": {Timeout: time.Minute},
+	}}
+	for subtree, want := range map[string]*config.WalkOverride{
+		"1.3.6.1.2.1.2":         module.WalkOverrides["1.3.6.1.2.1.2"],
+		"1.3.6.1.2.1.2.2":       module.WalkOverrides["1.3.6.1.2.1.2"],
+		"1.3.6.1.2.1.2.2.1.2":   module.WalkOverrides["1.3.6.1.2.1.2.2.1.2"],
+		"1.3.6.1.2.1.2.2.1.2.5": module.WalkOverrides["1.3.6.1.2.1.2.2.1.2"],
+		"1.3.6.1.2.1.22":        nil,
+		"1.3.6.1.2.1.31.1.1":    nil,
+	} {
+		if got := module.WalkOverride(subtree); got != want {
+			t.Errorf("Wrong override of %s: got %+v, want %+v", subtree, got, want)
+		}
+	}
+
+	client, err := scraper.NewGoSNMP(log.NewNopLogger(), "192.0.2.1", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Timeout, g.Retries, g.MaxRepetitions = 5*time.Second, 3, 25
+	})
+	params := func() (time.Duration, int, uint32) {
+		var timeout time.Duration
+		var retries int
+		var maxRepetitions uint32
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			timeout, retries, maxRepetitions = g.Timeout, g.Retries, g.MaxRepetitions
+		})
+		return timeout, retries, maxRepetitions
+	}
+	restore := overrideWalkParams(client, module.WalkOverride("1.3.6.1.2.1.2.2.1.2"))
+	if timeout, retries, maxRepetitions := params(); timeout != 5*time.Second || retries != 1 || maxRepetitions != 50 {
+		t.Errorf("Override not applied: timeout %s, retries %d, max repetitions %d", timeout, retries, maxRepetitions)
+	}
+	restore()
+	if timeout, retries, maxRepetitions := params(); timeout != 5*time.Second || retries != 3 || maxRepetitions != 25 {
+		t.Errorf("Module parameters not restored: timeout %s, retries %d, max repetitions %d", timeout, retries, maxRepetitions)
+	}
+
+	version := func() gosnmp.SnmpVersion {
+		var v gosnmp.SnmpVersion
+		client.SetOptions(func(g *gosnmp.GoSNMP) { v = g.Version })
+		return v
+	}
+	for _, c := range []struct {
+		version, during gosnmp.SnmpVersion
+	}{
+		{gosnmp.Version2c, gosnmp.Version1},
+		// SNMPv3 is never downgraded.
+		{gosnmp.Version3, gosnmp.Version3},
+	} {
+		client.SetOptions(func(g *gosnmp.GoSNMP) { g.Version = c.version })
+		restore = overrideWalkParams(client, &config.WalkOverride{Version: 1})
+		if got := version(); got != c.during {
+			t.Errorf("%s: expected the walk with %s, got %s", c.version, c.during, got)
+		}
+		restore()
+		if got := version(); got != c.version {
+			t.Errorf("%s: version not restored, got %s", c.version, got)
+		}
+	}
+}
+
+func TestPagedWalks(t *testing.T) {
+	oldTTL := *walkPageTTL
+	*walkPageTTL = time.Hour
+	t.Cleanup(func() { *walkPageTTL = oldTTL })
+	pages = newPagedWalks()
+
+	row := func(index int, value int) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.1.1.%d", index), Type: gosnmp.Integer, Value: value}
+	}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.1": {row(1, 10), row(2, 20), row(3, 30), row(10, 100), row(11, 110)},
+	})
+	module := &config.Module{
+		Walk:          []string{"1.1"},
+		WalkOverrides: map[string]*config.WalkOverride{"1.1": {PageSize: 2}},
+	}
+	scrape := func() []string {
+		results, err := ScrapeTarget(context.Background(), mock, "someTarget", &config.Auth{Version: 2}, module, log.NewNopLogger(), Metrics{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []string{}
+		for _, pdu := range results.pdus {
+			values = append(values, fmt.Sprintf("%s=%d", pdu.Name, pdu.Value))
+		}
+		return values
+	}
+	for i, want := range [][]string{
+		// The first pass only has the rows walked so far.
+		{".1.1.1.1=10", ".1.1.1.2=20"},
+		{".1.1.1.1=10", ".1.1.1.2=20", ".1.1.1.3=30", ".1.1.1.10=100"},
+		{".1.1.1.1=10", ".1.1.1.2=20", ".1.1.1.3=30", ".1.1.1.10=100", ".1.1.1.11=110"},
+		// The next pass is stitched with the rest of the previous one.
+		{".1.1.1.1=11", ".1.1.1.2=20", ".1.1.1.3=30", ".1.1.1.10=100", ".1.1.1.11=110"},
+		// Rows deleted disappear once the pass gets past them.
+		{".1.1.1.1=11", ".1.1.1.2=20", ".1.1.1.10=100", ".1.1.1.11=110"},
+	} {
+		switch i {
+		case 3:
+			mock.WalkResponses["1.1"][0].Value = 11
+		case 4:
+			mock.WalkResponses["1.1"] = append(mock.WalkResponses["1.1"][:2:2], mock.WalkResponses["1.1"][3:]...)
+		}
+		if got := scrape(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Scrape %d: got %v, want %v", i, got, want)
+		}
+	}
+
+	// Walks of targets no longer scraped are dropped.
+	pages.walk(mock, "otherTarget", "1.1", 2, time.Now().Add(2*time.Hour))
+	if _, ok := pages.walks["someTarget  1.1"]; ok || len(pages.walks) != 1 {
+		t.Errorf("Expected only the walk of otherTarget, got %v", pages.walks)
+	}
+}
+
+func TestWalkPriority(t *testing.T) {
+	walks := []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31.1.1", "1.3.6.1.2.1.47.1.1"}
+	ordered, priority := prioritizeWalks(walks, []string{"1.3.6.1.2.1.31.1.1.1.6", "1.3.6.1.2.1.2"})
+	expected := []string{"1.3.6.1.2.1.31.1.1", "1.3.6.1.2.1.2", "1.3.6.1.2.1.47.1.1"}
+	if !reflect.DeepEqual(ordered, expected) || priority != 2 {
+		t.Errorf("Wrong order: got %v with %d prioritized, want %v with 2", ordered, priority, expected)
+	}
+
+	module := &config.Module{
+		Walk:         walks,
+		WalkPriority: []string{"1.3.6.1.2.1.31.1.1"},
+		WalkParams:   config.WalkParams{Timeout: time.Second},
+	}
+	expectedWalks := []walkResult{
+		{oid: "1.3.6.1.2.1.31.1.1", completed: true},
+		{oid: "1.3.6.1.2.1.2"},
+		{oid: "1.3.6.1.2.1.47.1.1"},
+	}
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	for _, ctx := range []context.Context{
+		WithScrapeDeadline(context.Background(), time.Now().Add(time.Millisecond)),
+		timeoutCtx,
+	} {
+		mock := scraper.NewMockSNMPScraper(nil, nil)
+		results, err := ScrapeTarget(ctx, mock, "someTarget", &config.Auth{Version: 2}, module, log.NewNopLogger(), Metrics{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mock.CallWalk(), []string{"1.3.6.1.2.1.31.1.1"}) {
+			t.Errorf("Expected only the priority walk close to the deadline, got %v", mock.CallWalk())
+		}
+		if !reflect.DeepEqual(results.walks, expectedWalks) {
+			t.Errorf("Wrong walk results: got %v, want %v", results.walks, expectedWalks)
+		}
+	}
+}
+
+func TestExactCounter64(t *testing.T) {
+	defer func(mode string) { *counter64Exact = mode }(*counter64Exact)
+	metric := &config.Metric{Name: "test_metric", Oid: "1.1.1", Type: "counter", Help: "Help string"}
+	large := &gosnmp.SnmpPDU{Name: ".1.1.1.0", Type: gosnmp.Counter64, Value: uint64(1)<<60 + 3}
+	small := &gosnmp.SnmpPDU{Name: ".1.1.1.0", Type: gosnmp.Counter64, Value: uint64(42)}
+	cases := []struct {
+		mode     string
+		pdu      *gosnmp.SnmpPDU
+		expected []string
+	}{
+		{mode: "none", pdu: large, expected: []string{"test_metric"}},
+		{mode: "split", pdu: small, expected: []string{"test_metric"}},
+		{mode: "split", pdu: large, expected: []string{"test_metric_hi gauge:{value:2.68435456e+08}", "test_metric_lo gauge:{value:3}", "test_metric"}},
+		{mode: "info", pdu: large, expected: []string{`test_metric_exact_info label:{name:"test_metric" value:"1152921504606846979"} gauge:{value:1}`, "test_metric"}},
+	}
+	for _, c := range cases {
+		*counter64Exact = c.mode
+		got := []string{}
+		for _, m := range pduToSamples([]int{}, c.pdu, metric, map[string]gosnmp.SnmpPDU{}, nil, log.NewNopLogger(), Metrics{}) {
+			dtoMetric := &io_prometheus_client.Metric{}
+			if err := m.Write(dtoMetric); err != nil {
+				t.Fatal(err)
+			}
+			name := strings.TrimSuffix(strings.SplitN(m.Desc().String(), `"`, 3)[1], `"`)
+			if name == "test_metric" {
+				// The float value is covered by other tests.
+				got = append(got, name)
+			} else {
+				got = append(got, strings.ReplaceAll(name+" "+dtoMetric.String(), "  ", " "))
+			}
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Mode %s with %v: expected %v, got %v", c.mode, c.pdu.Value, c.expected, got)
+		}
+	}
+
+	// Invalid labels are reported rather than panicking.
+	for _, mode := range []string{"info", "split"} {
+		results := exactCounter64(metric, large, mode, []string{"ifIndex"}, nil)
+		if len(results) == 0 {
+			t.Errorf("Mode %s: expected metrics", mode)
+		}
+		for _, m := range results {
+			if err := m.Write(&io_prometheus_client.Metric{}); err == nil {
+				t.Errorf("Mode %s: expected an invalid metric, got %s", mode, m.Desc())
+			}
+		}
+	}
+}
+
+func TestICMP(t *testing.T) {
+	addrs := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}}
+	if ip := icmpAddress(addrs, "ipv4"); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Wrong IPv4 address: %s", ip)
+	}
+	if ip := icmpAddress(addrs, "ipv6"); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Wrong IPv6 address: %s", ip)
+	}
+	if ip := icmpAddress(addrs[1:], "ipv6"); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Wrong fallback address: %s", ip)
+	}
+
+	payload := []byte("snmp_exporter1")
+	cases := []struct {
+		msg      icmp.Message
+		protocol int
+		reply    bool
+	}{
+		{icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 7, Seq: 1, Data: payload}}, protocolICMP, true},
+		{icmp.Message{Type: ipv6.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 7, Seq: 1, Data: payload}}, protocolIPv6ICMP, true},
+		// Our own request, as seen on raw sockets of the loopback interface.
+		{icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 7, Seq: 1, Data: payload}}, protocolICMP, false},
+		{icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 7, Seq: 2, Data: payload}}, protocolICMP, false},
+		{icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 7, Seq: 1, Data: []byte("other")}}, protocolICMP, false},
+	}
+	for i, c := range cases {
+		b, err := c.msg.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isEchoReply(b, c.protocol, 1, payload); got != c.reply {
+			t.Errorf("Case %d: got %v, want %v", i, got, c.reply)
+		}
+	}
+
+	reachable, err := ping(context.Background(), net.ParseIP("127.0.0.1"), time.Second)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("Not allowed to open ICMP sockets")
+	}
+	if err != nil || !reachable {
+		t.Errorf("Expected localhost to answer ping, got %v, %v", reachable, err)
+	}
+}
+
+func TestApplyRetryPolicy(t *testing.T) {
+	g := &gosnmp.GoSNMP{Retries: 3}
+	applyRetryPolicy(g, "gentle")
+	if g.Retries != 2 || !g.ExponentialTimeout || g.PreSend == nil {
+		t.Fatalf("Gentle policy not applied: retries %d, backoff %v", g.Retries, g.ExponentialTimeout)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		g.PreSend(g)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Requests not paced: 3 requests sent within %s", elapsed)
+	}
+
+	// The client is reused by the next module.
+	g.Retries = 3
+	applyRetryPolicy(g, "")
+	if g.Retries != 3 || g.ExponentialTimeout || g.PreSend != nil {
+		t.Errorf("Previous policy not reset: retries %d, backoff %v", g.Retries, g.ExponentialTimeout)
+	}
+	applyRetryPolicy(g, "aggressive")
+	if g.Retries != 5 || g.ExponentialTimeout || g.PreSend != nil {
+		t.Errorf("Aggressive policy not applied: retries %d, backoff %v", g.Retries, g.ExponentialTimeout)
+	}
+}
+
+func TestRawModule(t *testing.T) {
+	module := &config.Module{
+		Raw:     true,
+		Metrics: []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge", Help: "Uptime"}},
+	}
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(100)},
+		{Name: ".1.3.6.1.4.1.9.2.1.58.0", Type: gosnmp.Integer, Value: 12},
+		{Name: ".1.3.6.1.4.1.9.9.1.1.5", Type: gosnmp.Counter64, Value: uint64(1 << 40)},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: []byte("switch1")},
+	}
+	expected := []string{
+		`Desc{fqName: "snmp_raw", help: "Value of a varbind of a raw module, exported without MIB knowledge.", constLabels: {}, variableLabels: {oid,type}} label:{name:"oid" value:"1.3.6.1.4.1.9.2.1.58.0"} label:{name:"type" value:"Integer"} gauge:{value:12}`,
+		`Desc{fqName: "snmp_raw", help: "Value of a varbind of a raw module, exported without MIB knowledge.", constLabels: {}, variableLabels: {oid,type}} label:{name:"oid" value:"1.3.6.1.4.1.9.9.1.1.5"} label:{name:"type" value:"Counter64"} gauge:{value:1.099511627776e+12}`,
+		`Desc{fqName: "sysUpTime", help: "Uptime", constLabels: {}, variableLabels: {}} gauge:{value:100}`,
+	}
+	for _, raw := range []bool{true, false} {
+		module.Raw = raw
+		got := []string{}
+		for _, m := range PdusToMetrics(module, pdus, log.NewNopLogger(), Metrics{}) {
+			pb := &io_prometheus_client.Metric{}
+			if err := m.Write(pb); err != nil {
+				t.Fatalf("Error writing metric: %v", err)
+			}
+			got = append(got, strings.ReplaceAll(m.Desc().String()+" "+pb.String(), "  ", " "))
+		}
+		sort.Strings(got)
+		want := expected
+		if !raw {
+			want = expected[2:]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("raw %v: got %v, want %v", raw, got, want)
+		}
+	}
+
+	// Modules of a scrape walking the same subtree export its varbinds once.
+	module.Raw = true
+	rawOIDs := &oidSet{}
+	for i, want := range []int{3, 1} {
+		if got := pdusToMetrics(module, pdus, "", time.Time{}, log.NewNopLogger(), Metrics{}, nil, rawOIDs, nil); len(got) != want {
+			t.Errorf("module %d: got %d samples, want %d", i, len(got), want)
+		}
+	}
+}
+
+func TestLimitLabels(t *testing.T) {
+	desc := prometheus.NewDesc("lldpRemSysName", "Name of the neighbor", []string{"lldpRemIndex", "lldpRemSysName", "module"}, nil)
+	upDesc := prometheus.NewDesc("sysUpTime", "", nil, nil)
+	samples := []prometheus.Metric{prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1)}
+	for i, name := range []string{"sw3", "sw1", "sw4", "sw2", "sw1"} {
+		samples = append(samples, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, strconv.Itoa(i), name, "lldp"))
+	}
+	samples = append(samples, prometheus.MustNewConstHistogram(prometheus.NewDesc("lldpRemSysNameHistogram", "", []string{"lldpRemSysName"}, nil), 1, 1, nil, "sw4"))
+	type sample struct {
+		desc   string
+		labels map[string]string
+		value  float64
+	}
+	written := func(samples []prometheus.Metric) []sample {
+		got := []sample{}
+		for _, s := range samples {
+			m := &io_prometheus_client.Metric{}
+			if err := s.Write(m); err != nil {
+				t.Fatalf("Error writing metric: %v", err)
+			}
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			got = append(got, sample{s.Desc().String(), labels, m.GetGauge().GetValue()})
+		}
+		return got
+	}
+
+	kept, overValues, aggregated := limitLabels(samples, map[string]int{"lldpRemSysName": 2, "ifDescr": 10})
+	expected := []sample{
+		{upDesc.String(), map[string]string{}, 1},
+		{desc.String(), map[string]string{"lldpRemIndex": "1", "lldpRemSysName": "sw1", "module": "lldp"}, 1},
+		{desc.String(), map[string]string{"lldpRemIndex": "3", "lldpRemSysName": "sw2", "module": "lldp"}, 1},
+		{desc.String(), map[string]string{"lldpRemIndex": "4", "lldpRemSysName": "sw1", "module": "lldp"}, 1},
+		// The values beyond the limit are summed, with the labels they share.
+		{prometheus.NewDesc("lldpRemSysName", "Name of the neighbor", []string{"lldpRemSysName", "module"}, nil).String(), map[string]string{"lldpRemSysName": "__other__", "module": "lldp"}, 2},
+	}
+	if got := written(kept); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong samples kept, want %v got %v", expected, got)
+	}
+	if expected := map[string]int{"lldpRemSysName": 2, "ifDescr": 0}; !reflect.DeepEqual(overValues, expected) {
+		t.Errorf("Wrong values beyond the limit, want %v got %v", expected, overValues)
+	}
+	if expected := map[string]int{"lldpRemSysName": 2, "ifDescr": 0}; !reflect.DeepEqual(aggregated, expected) {
+		t.Errorf("Wrong samples aggregated, want %v got %v", expected, aggregated)
+	}
+
+	kept, overValues, aggregated = limitLabels(samples, nil)
+	if len(kept) != len(samples) || len(overValues) != 0 || len(aggregated) != 0 {
+		t.Errorf("Nothing should be aggregated without limits, got %d samples, %v and %v", len(kept), overValues, aggregated)
+	}
+}
+
+// tooBigScraper answers tooBig to gets of more than max OIDs.
+type tooBigScraper struct {
+	scraper.SNMPScraper
+	max      int
+	requests []int
+}
+
+func (s *tooBigScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	s.requests = append(s.requests, len(oids))
+	if len(oids) > s.max {
+		return &gosnmp.SnmpPacket{Error: gosnmp.TooBig}, nil
+	}
+	return s.SNMPScraper.Get(oids)
+}
+
+func TestScrapeTargetGetBatches(t *testing.T) {
+	get := []string{}
+	for i := 1; i <= 70; i++ {
+		get = append(get, fmt.Sprintf("1.3.6.1.4.1.1.%d.0", i))
+	}
+	cases := []struct {
+		name           string
+		walk           []string
+		maxRepetitions uint32
+		requests       []int
+	}{
+		// As many OIDs as allowed, then halved until the response fits.
+		{name: "get only", maxRepetitions: 25, requests: []int{60, 30, 30, 10}},
+		{name: "get only with max_repetitions", maxRepetitions: 20, requests: []int{20, 20, 20, 10}},
+		{name: "with walks", walk: []string{"1.3.6.1.2.1.2"}, maxRepetitions: 25, requests: []int{25, 25, 20}},
+	}
+	for _, c := range cases {
+		module := &config.Module{Get: get, Walk: c.walk, WalkParams: config.WalkParams{MaxRepetitions: c.maxRepetitions}}
+		s := &tooBigScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, nil), max: 40}
+		if _, err := ScrapeTarget(context.Background(), s, "target", &config.Auth{Version: 2}, module, log.NewNopLogger(), Metrics{}); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(s.requests, c.requests) {
+			t.Errorf("%s: wrong OIDs per request, want %v got %v", c.name, c.requests, s.requests)
+		}
+	}
+	if getOnly(&config.Module{Get: get, Filters: []config.DynamicFilter{{Oid: "1.3.6.1.2.1.2.2.1.2"}}}) {
+		t.Error("Modules with filters walk the filtered OIDs")
+	}
+}
+
+// droppingScraper times out walks of a subtree with more than max
+// repetitions, as if their responses were dropped.
+type droppingScraper struct {
+	scraper.SNMPScraper
+	g           gosnmp.GoSNMP
+	subtree     string
+	max         uint32
+	repetitions []uint32
+}
+
+func (s *droppingScraper) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
+	for _, fn := range fns {
+		fn(&s.g)
+	}
+}
+
+func (s *droppingScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	if oid == s.subtree {
+		s.repetitions = append(s.repetitions, s.g.MaxRepetitions)
+		if s.g.MaxRepetitions > s.max {
+			return nil, errors.New("request timeout (after 3 retries)")
+		}
+	}
+	return s.SNMPScraper.WalkAll(oid)
+}
+
+func TestMessageSize(t *testing.T) {
+	targetSizes = newMessageSizes()
+	adaptive := *adaptiveSize
+	*adaptiveSize = true
+	t.Cleanup(func() {
+		targetSizes = newMessageSizes()
+		*adaptiveSize = adaptive
+	})
+
+	ifDescr := []gosnmp.SnmpPDU{}
+	for i := 1; i <= 5; i++ {
+		// 21 bytes each.
+		ifDescr = append(ifDescr, gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.2.%d", i), Type: gosnmp.OctetString, Value: []byte("eth0")})
+	}
+	s := &droppingScraper{
+		SNMPScraper: scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{"1.3.6.1.2.1.2.2.1.2": ifDescr}),
+		subtree:     "1.3.6.1.2.1.31.1.1",
+		max:         20,
+	}
+	module := &config.Module{Walk: []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.31.1.1"}, WalkParams: config.WalkParams{MaxRepetitions: 50}}
+	scrape := func() (ScrapeResults, error) {
+		s.g.MaxRepetitions = module.WalkParams.MaxRepetitions
+		return ScrapeTarget(context.Background(), s, "target", &config.Auth{Version: 2}, module, log.NewNopLogger(), Metrics{})
+	}
+	// Halved twice from 2100 bytes of 40 byte varbinds, then from the size
+	// of the varbinds returned.
+	for _, want := range []struct {
+		repetitions int
+		err         bool
+	}{{0, true}, {23, true}, {10, false}} {
+		results, err := scrape()
+		if (err != nil) != want.err {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if results.repetitions != want.repetitions {
+			t.Errorf("Wrong max repetitions, got %d want %d", results.repetitions, want.repetitions)
+		}
+	}
+	for i := 1; i < messageSizeRecovery; i++ {
+		if _, err := scrape(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Doubled back after enough successful scrapes, dropped again.
+	if _, err := scrape(); err == nil {
+		t.Fatal("Expected the walk to time out")
+	}
+	expected := []uint32{50, 23, 10, 19, 19, 19, 19, 19, 19, 19, 19, 19, 43}
+	if !reflect.DeepEqual(s.repetitions, expected) {
+		t.Errorf("Wrong repetitions, got %v want %v", s.repetitions, expected)
+	}
+
+	*adaptiveSize = false
+	s.max = 1
+	key := messageSizeKey("target", &config.Auth{Version: 2})
+	before := targetSizes.targets[key].limit
+	if _, err := scrape(); err == nil || targetSizes.targets[key].limit != before {
+		t.Errorf("The size must not be reduced without --snmp.adaptive-message-size, got %d want %d", targetSizes.targets[key].limit, before)
+	}
+	// Sizes are kept apart for other auths of the target and other modules.
+	if got := targetSizes.maxRepetitions(messageSizeKey("target", &config.Auth{Version: 3}), moduleSizeKey(module), 2100, time.Now()); got != 50 {
+		t.Errorf("Expected the default size for another auth, got %d repetitions", got)
+	}
+	if got := targetSizes.targets[key].varbindSize("other"); got != defaultVarbindSize {
+		t.Errorf("Expected the default varbind size for another module, got %v", got)
+	}
+
+	// Gets are batched to fit max_message_size too.
+	get := []string{}
+	for i := 1; i <= 30; i++ {
+		get = append(get, fmt.Sprintf("1.3.6.1.4.1.1.%d.0", i))
+	}
+	module = &config.Module{Get: get, WalkParams: config.WalkParams{MaxRepetitions: 25, MaxMessageSize: 600}}
+	tooBig := &tooBigScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, nil), max: 100}
+	if _, err := ScrapeTarget(context.Background(), tooBig, "other", &config.Auth{Version: 2}, module, log.NewNopLogger(), Metrics{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{12, 12, 6}; !reflect.DeepEqual(tooBig.requests, expected) {
+		t.Errorf("Wrong OIDs per request, got %v want %v", tooBig.requests, expected)
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	pool := &sessionPool{idle: map[sessionKey][]idleSession{}}
+	key := sessionKey{target: "192.0.2.1", auth: authKey(&config.Auth{Community: "public"})}
+	if pool.get(key) != nil {
+		t.Fatal("Expected no session in an empty pool")
+	}
+	client, err := scraper.NewGoSNMP(log.NewNopLogger(), "192.0.2.1", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	pool.put(key, client, time.Now())
+	if pool.get(sessionKey{target: "192.0.2.1", auth: authKey(&config.Auth{Community: "private"})}) != nil {
+		t.Error("Sessions must not be shared between auths")
+	}
+	// Auths with the same settings, such as after a reload, share sessions.
+	if pool.get(sessionKey{target: "192.0.2.1", auth: authKey(&config.Auth{Community: "public"})}) != client {
+		t.Error("Expected the idle session to be reused")
+	}
+	if pool.get(key) != nil {
+		t.Error("A session must only be used by one scrape at a time")
+	}
+
+	// Idle sessions are closed by the timer.
+	now := time.Now()
+	pool.put(key, client, now)
+	pool.closeIdle(now.Add(sessionIdleTimeout / 2))
+	if len(pool.idle) != 1 || pool.prune == nil {
+		t.Error("Session closed before the idle timeout")
+	}
+	pool.closeIdle(now.Add(2 * sessionIdleTimeout))
+	if len(pool.idle) != 0 || pool.prune != nil {
+		t.Errorf("Expected the idle session to be closed, got %v", pool.idle)
+	}
+}
+
+func TestSharedWalks(t *testing.T) {
+	ifTable := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")},
+		{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(10)},
+		{Name: ".1.3.6.1.2.1.2.2.1.100.1", Type: gosnmp.Counter32, Value: uint(100)},
+	}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{"1.3.6.1.2.1.2": ifTable})
+	walks := newSharedWalks()
+	first, second := walks.scraper(mock), walks.scraper(mock)
+
+	pdus, err := first.WalkAll("1.3.6.1.2.1.2")
+	if err != nil || len(pdus) != 3 {
+		t.Fatalf("Expected the 3 PDUs of the walk, got %v: %v", pdus, err)
+	}
+	if pdus, _ = second.WalkAll("1.3.6.1.2.1.2"); len(pdus) != 3 {
+		t.Errorf("Expected the 3 PDUs of the shared walk, got %v", pdus)
+	}
+	if pdus, _ = second.WalkAll("1.3.6.1.2.1.2.2.1.10"); len(pdus) != 1 || pdus[0].Name != ".1.3.6.1.2.1.2.2.1.10.1" {
+		t.Errorf("Expected the ifInOctets PDU of the shared walk, got %v", pdus)
+	}
+	second.WalkAll("1.3.6.1.2.1.31")
+	if got, want := mock.CallWalk(), []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected walks %v, got %v", want, got)
+	}
+
+	// Walks with other parameters, such as a walk_overrides version, are
+	// not shared.
+	walks.walk("1.3.6.1.2.1.2.2.1.10", "1 25 false", mock.WalkAll)
+	if got, want := mock.CallWalk(), []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31", "1.3.6.1.2.1.2.2.1.10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected walks %v, got %v", want, got)
+	}
+}
+
+func TestDeviceInfo(t *testing.T) {
+	mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+		sysNameOid:  {Name: "." + sysNameOid, Type: gosnmp.OctetString, Value: []byte("switch1")},
+		sysDescrOid: {Name: "." + sysDescrOid, Type: gosnmp.OctetString, Value: []byte("Switch OS 1.0")},
+	}, nil)
+	c := Collector{target: "192.0.2.1"}
+	m := c.deviceInfo(mock, log.NewNopLogger())
+	if m == nil {
+		t.Fatal("Expected snmp_device_info")
+	}
+	pb := &io_prometheus_client.Metric{}
+	if err := m.Write(pb); err != nil {
+		t.Fatalf("Error writing metric: %v", err)
+	}
+	labels := map[string]string{}
+	for _, l := range pb.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	// sysLocation is not set on the agent.
+	want := map[string]string{"sys_name": "switch1", "sys_descr": "Switch OS 1.0", "sys_location": ""}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("Expected labels %v, got %v", want, labels)
+	}
+}
+
+func TestDeviceInfoVendor(t *testing.T) {
+	vendor := *deviceVendor
+	*deviceVendor = true
+	t.Cleanup(func() { *deviceVendor = vendor })
+	mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+		sysNameOid:     {Name: "." + sysNameOid, Type: gosnmp.OctetString, Value: []byte("switch1")},
+		sysObjectIDOid: {Name: "." + sysObjectIDOid, Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.2636.1.1.1.2.29"},
+	}, nil)
+	c := Collector{target: "192.0.2.1"}
+	pb := &io_prometheus_client.Metric{}
+	if err := c.deviceInfo(mock, log.NewNopLogger()).Write(pb); err != nil {
+		t.Fatalf("Error writing metric: %v", err)
+	}
+	labels := map[string]string{}
+	for _, l := range pb.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["vendor"] != "Juniper Networks" {
+		t.Errorf("Expected vendor Juniper Networks, got %v", labels)
+	}
+
+	registry := `Decimal
+| Organization
+| | Contact
+| | | Email
+| | | |
+0
+  Reserved
+    Internet Assigned Numbers Authority
+      iana&iana.org
+9
+  ciscoSystems
+    Dave Jones
+      davej&cisco.com
+99999
+  Example Widgets
+    Jane Doe
+      jane&example.com
+99998
+  ---none---
+`
+	path := filepath.Join(t.TempDir(), "enterprise-numbers.txt")
+	if err := os.WriteFile(path, []byte(registry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { enterpriseVendors = builtinVendors })
+	if err := LoadEnterpriseNumbers(path); err != nil {
+		t.Fatal(err)
+	}
+	for oid, want := range map[string]string{
+		// Built in names take precedence.
+		"1.3.6.1.4.1.9.1.1208":  "Cisco",
+		".1.3.6.1.4.1.99999.1":  "Example Widgets",
+		"1.3.6.1.4.1.99998.1":   "",
+		"1.3.6.1.4.1.12345.1":   "",
+		"1.3.6.1.2.1.1":         "",
+		"1.3.6.1.4.1.2636":      "Juniper Networks",
+		"1.3.6.1.4.1.not.a.pen": "",
+	} {
+		if got := vendorName(oid); got != want {
+			t.Errorf("Expected vendor %q for %s, got %q", want, oid, got)
+		}
+	}
+}
+
+func TestEngineInfo(t *testing.T) {
+	engineID := func(m prometheus.Metric) string {
+		if m == nil {
+			return ""
+		}
+		pb := &io_prometheus_client.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf("Error writing metric: %v", err)
+		}
+		return pb.Label[0].GetValue()
+	}
+	c := Collector{target: "192.0.2.1"}
+	mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+		snmpEngineIDOid: {Name: "." + snmpEngineIDOid, Type: gosnmp.OctetString, Value: []byte("\x80\x00\x1f\x88\x04switch1")},
+	}, nil)
+	if got := engineID(c.engineInfo(mock, log.NewNopLogger())); got != "80001f880473776974636831" {
+		t.Errorf("Wrong engine ID from snmpEngineID: %q", got)
+	}
+	if m := c.engineInfo(scraper.NewMockSNMPScraper(nil, nil), log.NewNopLogger()); m != nil {
+		t.Error("Expected no snmp_engine_info without an engine ID")
+	}
+
+	// SNMPv3 targets are not asked again.
+	v3 := &droppingScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, nil)}
+	v3.g.Version = gosnmp.Version3
+	v3.g.SecurityParameters = &gosnmp.UsmSecurityParameters{AuthoritativeEngineID: "\x80\x00\x00\x09\x03\x00\x1b\x21\x3c\x4d\x5e"}
+	if got := engineID(c.engineInfo(v3, log.NewNopLogger())); got != "8000000903001b213c4d5e" {
+		t.Errorf("Wrong engine ID from SNMPv3 discovery: %q", got)
+	}
+	if gets := v3.SNMPScraper.(interface{ CallGet() []string }).CallGet(); len(gets) != 0 {
+		t.Errorf("Expected no get of SNMPv3 targets, got %v", gets)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	indexes := []*config.Index{{Labelname: "op", Type: "gauge"}, {Labelname: "bucket", Type: "gauge"}}
+	module := &config.Module{
+		Metrics: []*config.Metric{
+			{Name: "latencyCount", Oid: "1.1", Type: "counter", Help: "Operations per latency bucket", Indexes: indexes},
+			{Name: "latencyBound", Oid: "1.2", Type: "gauge", Help: "Upper bound of the bucket", Indexes: indexes},
+		},
+		Histograms: []*config.Histogram{
+			{Name: "latency_seconds", Count: "latencyCount", Bound: "latencyBound", BucketLabel: "bucket", BoundScale: 0.001, DropSource: true},
+		},
+	}
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.1.1.1", Type: gosnmp.Counter32, Value: uint(5)},
+		{Name: ".1.1.1.2", Type: gosnmp.Counter32, Value: uint(3)},
+		{Name: ".1.1.1.3", Type: gosnmp.Counter32, Value: uint(1)},
+		{Name: ".1.2.1.1", Type: gosnmp.Gauge32, Value: uint(10)},
+		{Name: ".1.2.1.2", Type: gosnmp.Gauge32, Value: uint(100)},
+		{Name: ".1.2.1.3", Type: gosnmp.Gauge32, Value: uint(1000)},
+		// No bound, so left out.
+		{Name: ".1.1.2.1", Type: gosnmp.Counter32, Value: uint(2)},
+	}
+	samples := PdusToMetrics(module, pdus, log.NewNopLogger(), Metrics{})
+	if len(samples) != 1 {
+		t.Fatalf("Expected only the histogram of op 1, got %v", samples)
+	}
+	pb := &io_prometheus_client.Metric{}
+	if err := samples[0].Write(pb); err != nil {
+		t.Fatal(err)
+	}
+	if got := samples[0].Desc().String(); !strings.Contains(got, `fqName: "latency_seconds"`) {
+		t.Errorf("Unexpected desc %s", got)
+	}
+	if len(pb.Label) != 1 || pb.Label[0].GetName() != "op" || pb.Label[0].GetValue() != "1" {
+		t.Errorf("Expected label op=1, got %v", pb.Label)
+	}
+	h := pb.Histogram
+	if h.GetSampleCount() != 9 || !math.IsNaN(h.GetSampleSum()) {
+		t.Errorf("Expected count 9 and sum NaN, got %d and %v", h.GetSampleCount(), h.GetSampleSum())
+	}
+	got := map[float64]uint64{}
+	for _, b := range h.Bucket {
+		got[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	want := map[float64]uint64{0.01: 5, 0.1: 8, 1: 9}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected buckets %v, got %v", want, got)
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	indexes := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	module := &config.Module{
+		Metrics: []*config.Metric{
+			{Name: "ifHCInOctets", Oid: "1.1", Type: "counter", Help: "Octets received", Indexes: indexes},
+			{Name: "ifHighSpeed", Oid: "1.2", Type: "gauge", Help: "Speed in Mbit/s", Indexes: indexes},
+		},
+		Utilizations: []*config.Utilization{
+			{Name: "ifHCInOctets_utilization", Octets: "ifHCInOctets", Speed: "ifHighSpeed", SpeedScale: 1e6},
+		},
+	}
+	scrape := func(octets1, octets2 uint64) []gosnmp.SnmpPDU {
+		return []gosnmp.SnmpPDU{
+			{Name: ".1.1.1", Type: gosnmp.Counter64, Value: octets1},
+			{Name: ".1.1.2", Type: gosnmp.Counter64, Value: octets2},
+			{Name: ".1.1.3", Type: gosnmp.Counter64, Value: uint64(0)},
+			{Name: ".1.2.1", Type: gosnmp.Gauge32, Value: uint(1000)},
+			{Name: ".1.2.2", Type: gosnmp.Gauge32, Value: uint(1000)},
+			// Interface 3 has no speed, interface 4 no counter.
+			{Name: ".1.2.4", Type: gosnmp.Gauge32, Value: uint(10)},
+		}
+	}
+	utilizations := func(samples []prometheus.Metric) map[string]float64 {
+		got := map[string]float64{}
+		for _, sample := range samples {
+			if !strings.Contains(sample.Desc().String(), `fqName: "ifHCInOctets_utilization"`) {
+				continue
+			}
+			pb := &io_prometheus_client.Metric{}
+			if err := sample.Write(pb); err != nil {
+				t.Fatal(err)
+			}
+			got[pb.Label[0].GetValue()] = pb.Gauge.GetValue()
+		}
+		return got
+	}
+
+	start := time.Unix(1700000000, 0)
+	if got := utilizations(pdusToMetrics(module, scrape(1000, 1000), "utilization1", start, log.NewNopLogger(), Metrics{}, nil, nil, nil)); len(got) != 0 {
+		t.Errorf("Expected no utilization on the first scrape, got %v", got)
+	}
+	// 250 Mbit/s on interface 1, and a counter reset on interface 2.
+	got := utilizations(pdusToMetrics(module, scrape(1000+1875000000, 500), "utilization1", start.Add(time.Minute), log.NewNopLogger(), Metrics{}, nil, nil, nil))
+	if want := map[string]float64{"1": 0.25}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected utilizations %v, got %v", want, got)
+	}
+	if got := utilizations(PdusToMetrics(module, scrape(5000000000, 5000), log.NewNopLogger(), Metrics{})); len(got) != 0 {
+		t.Errorf("Expected no utilization without a target, got %v", got)
+	}
+}
+
+func TestCounterPairs(t *testing.T) {
+	indexes := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	module := &config.Module{
+		Metrics: []*config.Metric{
+			{Name: "ifInOctets", Oid: "1.1", Type: "counter", Help: "Octets received", Indexes: indexes},
+			{Name: "ifHCInOctets", Oid: "1.2", Type: "counter", Help: "Octets received (64-bit)", Indexes: indexes},
+			{Name: "ifSpeed", Oid: "1.3", Type: "gauge", Help: "Speed", Indexes: indexes},
+		},
+		CounterPairs: []*config.CounterPair{
+			{Name: "ifInOctets_total", Counter32: "ifInOctets", Counter64: "ifHCInOctets"},
+		},
+	}
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.1.1", Type: gosnmp.Counter32, Value: uint(10)},
+		{Name: ".1.1.2", Type: gosnmp.Counter32, Value: uint(20)},
+		// Interface 1 has both counters, interface 2 only the 32-bit one and
+		// interface 3 only the 64-bit one.
+		{Name: ".1.2.1", Type: gosnmp.Counter64, Value: uint64(5000000000)},
+		{Name: ".1.2.3", Type: gosnmp.Counter64, Value: uint64(30)},
+		{Name: ".1.3.1", Type: gosnmp.Gauge32, Value: uint(1000)},
+	}
+	got := map[string]float64{}
+	for _, sample := range PdusToMetrics(module, pdus, log.NewNopLogger(), Metrics{}) {
+		desc := sample.Desc().String()
+		if strings.Contains(desc, `fqName: "ifSpeed"`) {
+			continue
+		}
+		if !strings.Contains(desc, `fqName: "ifInOctets_total"`) || !strings.Contains(desc, `help: "Octets received (64-bit)"`) {
+			t.Fatalf("Unexpected sample %s", desc)
+		}
+		pb := &io_prometheus_client.Metric{}
+		if err := sample.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		if pb.Counter == nil {
+			t.Fatalf("Expected a counter, got %v", pb)
+		}
+		got[pb.Label[0].GetValue()] = pb.Counter.GetValue()
+	}
+	want := map[string]float64{"1": 5000000000, "2": 20, "3": 30}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	grace := *watchdogGrace
+	*watchdogGrace = 10 * time.Millisecond
+	t.Cleanup(func() { *watchdogGrace = grace })
+	abandoned := prometheus.NewCounter(prometheus.CounterOpts{Name: "a"})
+	c := Collector{logger: log.NewNopLogger(), metrics: Metrics{SNMPScrapesAbandoned: abandoned}}
+	desc := prometheus.NewDesc("test", "", nil, nil)
+
+	// Scrapes ending in time are waited for.
+	ch := make(chan prometheus.Metric, 10)
+	c.watch(context.Background(), ch, func(ch chan<- prometheus.Metric) {
+		time.Sleep(20 * time.Millisecond)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)
+	})
+	if len(ch) != 1 || testutil.ToFloat64(abandoned) != 0 {
+		t.Fatalf("Expected the sample of the scrape, got %d samples and %v abandoned", len(ch), testutil.ToFloat64(abandoned))
+	}
+
+	// Wedged scrapes are abandoned after the deadline and grace.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ch = make(chan prometheus.Metric, 10)
+	release, ended := make(chan struct{}), make(chan struct{})
+	c.watch(ctx, ch, func(ch chan<- prometheus.Metric) {
+		defer close(ended)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)
+		<-release
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2)
+	})
+	close(ch)
+	if testutil.ToFloat64(abandoned) != 1 {
+		t.Fatalf("Expected an abandoned scrape, got %v", testutil.ToFloat64(abandoned))
+	}
+	if len(ch) != 1 {
+		t.Errorf("Expected the sample sent before the deadline, got %d samples", len(ch))
+	}
+	// Samples of the abandoned scrape are discarded instead of sent to the
+	// closed channel.
+	close(release)
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("Abandoned scrape blocked sending a sample")
+	}
+}
+
+func TestTopology(t *testing.T) {
+	integer := func(oid string, v int) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: "." + oid, Type: gosnmp.Integer, Value: v}
+	}
+	octets := func(oid string, v string) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: "." + oid, Type: gosnmp.OctetString, Value: []byte(v)}
+	}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		lldpLocalSystemDataOid: {
+			integer(lldpLocalSystemDataOid+".1.0", lldpChassisMAC),
+			octets(lldpLocalSystemDataOid+".2.0", "\x00\x1b\x21\x3c\x4d\x5e"),
+			// Port 1 is named, port 2 has the MAC of ifIndex 10, port 3
+			// neither.
+			integer(lldpLocalSystemDataOid+".7.1.2.1", lldpPortName),
+			integer(lldpLocalSystemDataOid+".7.1.2.2", lldpPortMAC),
+			integer(lldpLocalSystemDataOid+".7.1.2.3", 7),
+			octets(lldpLocalSystemDataOid+".7.1.3.1", "Gi0/1"),
+			octets(lldpLocalSystemDataOid+".7.1.3.2", "\x00\x1b\x21\x00\x00\x0a"),
+			octets(lldpLocalSystemDataOid+".7.1.3.3", "3"),
+			octets(lldpLocalSystemDataOid+".7.1.4.3", "uplink"),
+		},
+		lldpRemEntryOid: {
+			integer(lldpRemEntryOid+".4.0.1.1", lldpChassisMAC),
+			integer(lldpRemEntryOid+".4.0.2.1", lldpChassisNetwork),
+			integer(lldpRemEntryOid+".4.0.3.1", 7),
+			octets(lldpRemEntryOid+".5.0.1.1", "\xaa\xbb\xcc\x00\x11\x22"),
+			octets(lldpRemEntryOid+".5.0.2.1", "\x01\xc0\x00\x02\x01"),
+			octets(lldpRemEntryOid+".5.0.3.1", "chassis3"),
+			integer(lldpRemEntryOid+".6.0.1.1", lldpPortName),
+			integer(lldpRemEntryOid+".6.0.2.1", lldpPortMAC),
+			integer(lldpRemEntryOid+".6.0.3.1", 7),
+			octets(lldpRemEntryOid+".7.0.1.1", "eth0"),
+			octets(lldpRemEntryOid+".7.0.2.1", "\xaa\xbb\xcc\x00\x00\x01"),
+			octets(lldpRemEntryOid+".7.0.3.1", "\x01\x02"),
+			octets(lldpRemEntryOid+".9.0.1.1", "server1"),
+			octets(lldpRemEntryOid+".9.0.2.1", "switch2"),
+		},
+		cdpCacheEntryOid: {
+			octets(cdpCacheEntryOid+".6.10.1", "router1"),
+			octets(cdpCacheEntryOid+".7.10.1", "GigabitEthernet0/0/1"),
+		},
+		ifNameOid:         {octets(ifNameOid+".10", "Gi0/10")},
+		ifPhysAddressOid:  {octets(ifPhysAddressOid+".10", "\x00\x1b\x21\x00\x00\x0a")},
+		sysNameSubtreeOid: {octets(sysNameSubtreeOid+".0", "switch1")},
+	})
+	c := Collector{metrics: Metrics{}}
+	neighbors, err := c.topology(mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := "00:1B:21:3C:4D:5E"
+	expected := []topologyNeighbor{
+		{"cdp", local, "Gi0/10", "router1", "GigabitEthernet0/0/1", "router1"},
+		{"lldp", local, "Gi0/10", "192.0.2.1", "AA:BB:CC:00:00:01", "switch2"},
+		{"lldp", local, "Gi0/1", "AA:BB:CC:00:11:22", "eth0", "server1"},
+		{"lldp", local, "uplink", "chassis3", "0x0102", ""},
+	}
+	if !reflect.DeepEqual(neighbors, expected) {
+		t.Errorf("Wrong neighbors:\ngot  %+v\nwant %+v", neighbors, expected)
+	}
+	if samples := topologyMetrics(append(neighbors, neighbors[0]), nil); len(samples) != len(expected) {
+		t.Errorf("Expected duplicate neighbors to be exported once, got %d samples", len(samples))
+	}
+}
+
+func TestPdusToMetricsExtraLabels(t *testing.T) {
+	module := &config.Module{
+		Raw: true,
+		Metrics: []*config.Metric{
+			{Name: "ifInOctets", Oid: "1.1.1", Type: "counter", Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+			{Name: "userEntry", Oid: "1.1.2", Type: "gauge", Indexes: []*config.Index{{Labelname: "auth", Type: "gauge"}}},
+		},
+	}
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.1.1.1", Type: gosnmp.Counter32, Value: uint(1)},
+		{Name: ".1.1.2.7", Type: gosnmp.Integer, Value: 2},
+		{Name: ".1.2.0", Type: gosnmp.Integer, Value: 3},
+	}
+	got := map[float64]map[string]string{}
+	for _, m := range pdusToMetrics(module, pdus, "", time.Time{}, log.NewNopLogger(), Metrics{}, prometheus.Labels{"module": "if_mib", "auth": "public_v2"}, nil, nil) {
+		pb := &io_prometheus_client.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf("Error writing metric: %v", err)
+		}
+		labels := map[string]string{}
+		for _, l := range pb.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		got[pb.GetCounter().GetValue()+pb.GetGauge().GetValue()] = labels
+	}
+	want := map[float64]map[string]string{
+		1: {"ifIndex": "1", "module": "if_mib", "auth": "public_v2"},
+		// The index keeps its value.
+		2: {"auth": "7", "module": "if_mib"},
+		3: {"oid": "1.2.0", "type": "Integer", "module": "if_mib", "auth": "public_v2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected labels %v, got %v", want, got)
+	}
+}
+
+func TestUncoveredVarbinds(t *testing.T) {
+	module := &config.Module{
+		Walk: []string{"1.1", "1.1.9", "1.3"},
+		Get:  []string{"1.2.0"},
+		Metrics: []*config.Metric{
+			{Name: "a", Oid: "1.1.1", Type: "gauge", Lookups: []*config.Lookup{{Labels: []string{"a"}, Labelname: "b", Oid: "1.1.2"}}},
+		},
+	}
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.1.1.5", Type: gosnmp.Integer, Value: 1},
+		{Name: ".1.1.2.5", Type: gosnmp.OctetString, Value: []byte("lookup")},
+		{Name: ".1.1.8.5", Type: gosnmp.Integer, Value: 1},
+		{Name: ".1.1.9.5", Type: gosnmp.Integer, Value: 1},
+		{Name: ".1.1.9.6", Type: gosnmp.Integer, Value: 1},
+		{Name: ".1.2.0", Type: gosnmp.Integer, Value: 1},
+		{Name: ".1.3.1", Type: gosnmp.Integer, Value: 1},
+		{Name: "." + sysUpTimeOid, Type: gosnmp.TimeTicks, Value: uint32(1)},
+	}
+	expected := map[string]int{"1.1": 1, "1.1.9": 2, "1.2.0": 1, "1.3": 1}
+	if got := uncoveredVarbinds(module, pdus); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong uncovered varbinds: got %v, want %v", got, expected)
+	}
+
+	module.Raw = true
+	if got := uncoveredVarbinds(module, pdus); len(got) != 0 {
+		t.Errorf("Expected no uncovered varbinds for a raw module, got %v", got)
+	}
+}
+
+func BenchmarkPdusToMetrics(b *testing.B) {
+	module := &config.Module{Metrics: []*config.Metric{
+		{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter",
+			Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+			Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"}}},
+		{Name: "ifHCInOctets", Oid: "1.3.6.1.2.1.31.1.1.1.6", Type: "counter",
+			Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+		{Name: "ifOperStatus", Oid: "1.3.6.1.2.1.2.2.1.8", Type: "gauge",
+			Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+	}}
+	pdus := []gosnmp.SnmpPDU{}
+	for i := 1; i <= 2000; i++ {
+		pdus = append(pdus,
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.2.%d", i), Type: gosnmp.OctetString, Value: []byte(fmt.Sprintf("eth%d", i))},
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.10.%d", i), Type: gosnmp.Counter32, Value: uint(i * 1000)},
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.31.1.1.1.6.%d", i), Type: gosnmp.Counter64, Value: uint64(i) << 40},
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.8.%d", i), Type: gosnmp.Integer, Value: 1},
+		)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		PdusToMetrics(module, pdus, log.NewNopLogger(), Metrics{})
+	}
+}
+
+func TestMeasureCost(t *testing.T) {
+	c := Collector{metrics: Metrics{
+		SNMPCollectionCPU:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cc"}, []string{"module"}),
+		SNMPCollectionAllocs: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ca"}, []string{"module"}),
+	}}
+	observeCost := c.measureCost("if_mib")
+	// Busy until the thread used some CPU time. Large allocations are
+	// accounted for right away, small ones once their span is full.
+	buffers := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		buffers = append(buffers, make([]byte, 64<<10))
+	}
+	for start := threadCPUSeconds(); threadCPU && threadCPUSeconds()-start < 0.01; {
+	}
+	observeCost()
+	got := testutil.ToFloat64(c.metrics.SNMPCollectionCPU.WithLabelValues("if_mib"))
+	if threadCPU && got < 0.01 {
+		t.Errorf("Expected at least 10ms of CPU time, got %v", got)
+	}
+	if !threadCPU && got != 0 {
+		t.Errorf("Expected no CPU time without thread CPU times, got %v", got)
+	}
+	if got := testutil.ToFloat64(c.metrics.SNMPCollectionAllocs.WithLabelValues("if_mib")); got < float64(len(buffers)*len(buffers[0])) {
+		t.Errorf("Expected at least %d bytes allocated, got %v", len(buffers)*len(buffers[0]), got)
+	}
+}
+
+func TestEntitySensors(t *testing.T) {
+	integer := func(column, index, v int) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: fmt.Sprintf(".%s.%d.%d", entPhySensorEntryOid, column, index), Type: gosnmp.Integer, Value: v}
+	}
+	octets := func(oid string, v string) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: "." + oid, Type: gosnmp.OctetString, Value: []byte(v)}
+	}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		entPhySensorEntryOid: {
+			// 23.5 °C, 12 V in millivolts, a fan without status, an
+			// unavailable sensor, a true sensor and one of other units.
+			integer(entPhySensorType, 1, 8), integer(entPhySensorScale, 1, 9), integer(entPhySensorPrecision, 1, 1),
+			integer(entPhySensorValue, 1, 235), integer(entPhySensorOperStatus, 1, 1),
+			integer(entPhySensorType, 2, 4), integer(entPhySensorScale, 2, 8), integer(entPhySensorPrecision, 2, 0),
+			integer(entPhySensorValue, 2, 12000), integer(entPhySensorOperStatus, 2, 1),
+			integer(entPhySensorType, 3, 10), integer(entPhySensorScale, 3, 10), integer(entPhySensorPrecision, 3, -2),
+			integer(entPhySensorValue, 3, 5),
+			integer(entPhySensorType, 4, 6), integer(entPhySensorValue, 4, 0), integer(entPhySensorOperStatus, 4, 2),
+			integer(entPhySensorType, 5, 12), integer(entPhySensorValue, 5, 1), integer(entPhySensorOperStatus, 5, 1),
+			integer(entPhySensorType, 6, 1), integer(entPhySensorScale, 6, 9), integer(entPhySensorValue, 6, 42),
+			octets(fmt.Sprintf("%s.%d.6", entPhySensorEntryOid, entPhySensorUnitsDisplay), "dBm"),
+		},
+		entPhysicalNameOid: {
+			octets(entPhysicalNameOid+".1", "CPU"),
+			octets(entPhysicalNameOid+".2", "PSU 1"),
+		},
+	})
+	c := Collector{metrics: Metrics{}}
+	samples, err := c.entitySensors(mock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, m := range samples {
+		dtoMetric := &io_prometheus_client.Metric{}
+		if err := m.Write(dtoMetric); err != nil {
+			t.Fatal(err)
+		}
+		sample := strings.SplitN(m.Desc().String(), `"`, 3)[1]
+		for _, label := range dtoMetric.GetLabel() {
+			sample += fmt.Sprintf(" %s=%q", label.GetName(), label.GetValue())
+		}
+		got = append(got, fmt.Sprintf("%s %g", sample, dtoMetric.GetGauge().GetValue()))
+	}
+	expected := []string{
+		`snmp_entity_sensor_oper_status entPhysicalIndex="1" entPhysicalName="CPU" 1`,
+		`snmp_entity_sensor_celsius entPhysicalIndex="1" entPhysicalName="CPU" 23.5`,
+		`snmp_entity_sensor_oper_status entPhysicalIndex="2" entPhysicalName="PSU 1" 1`,
+		`snmp_entity_sensor_volts_dc entPhysicalIndex="2" entPhysicalName="PSU 1" 12`,
+		`snmp_entity_sensor_rpm entPhysicalIndex="3" entPhysicalName="" 5000`,
+		`snmp_entity_sensor_oper_status entPhysicalIndex="4" entPhysicalName="" 2`,
+		`snmp_entity_sensor_oper_status entPhysicalIndex="5" entPhysicalName="" 1`,
+		`snmp_entity_sensor_truth entPhysicalIndex="5" entPhysicalName="" 1`,
+		`snmp_entity_sensor_value entPhysicalIndex="6" entPhysicalName="" units="dBm" 42`,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong samples:\ngot  %q\nwant %q", got, expected)
+	}
+}
+
+func TestFormatMAC(t *testing.T) {
+	for format, expected := range map[string]string{
+		"":                    "00:1B:21:3C:4D:5E",
+		config.MACFormatColon: "00:1B:21:3C:4D:5E",
+		config.MACFormatDash:  "00-1B-21-3C-4D-5E",
+		config.MACFormatDot:   "001b.213c.4d5e",
+		config.MACFormatHex:   "001B213C4D5E",
+	} {
+		if got := formatMAC("00:1B:21:3C:4D:5E", format); got != expected {
+			t.Errorf("%q: expected %s, got %s", format, expected, got)
+		}
+	}
+	// Addresses of other lengths are left as they are.
+	if got := formatMAC("00:1B:21", config.MACFormatDot); got != "00:1B:21" {
+		t.Errorf("Expected a short address left as is, got %s", got)
+	}
+}
+
+func TestRollups(t *testing.T) {
+	module := &config.Module{
+		Metrics: []*config.Metric{
+			{Name: "ifInOctets", Oid: "1.1.1.10", Type: "counter", Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+			{Name: "ifMtu", Oid: "1.1.1.4", Type: "gauge", Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+			{Name: "sysUpTime", Oid: "1.2", Type: "gauge"},
+		},
+	}
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.1.1.10.1", Type: gosnmp.Counter32, Value: uint(100)},
+		{Name: ".1.1.1.10.2", Type: gosnmp.Counter32, Value: uint(50)},
+		// A row with only some of the columns.
+		{Name: ".1.1.1.4.3", Type: gosnmp.Integer, Value: 1500},
+		{Name: ".1.2.0", Type: gosnmp.TimeTicks, Value: uint32(42)},
+	}
+	for _, dropSource := range []bool{false, true} {
+		module.Rollups = []*config.Rollup{{Table: "ifTable", Oid: "1.1", Sum: []string{"ifInOctets"}, DropSource: dropSource}}
+		got := map[string]float64{}
+		for _, m := range PdusToMetrics(module, pdus, log.NewNopLogger(), Metrics{}) {
+			dtoMetric := &io_prometheus_client.Metric{}
+			if err := m.Write(dtoMetric); err != nil {
+				t.Fatal(err)
+			}
+			name := strings.SplitN(m.Desc().String(), `"`, 3)[1]
+			for _, label := range dtoMetric.GetLabel() {
+				name += fmt.Sprintf(" %s=%s", label.GetName(), label.GetValue())
+			}
+			got[name] = dtoMetric.GetCounter().GetValue() + dtoMetric.GetGauge().GetValue()
+		}
+		expected := map[string]float64{
+			"snmp_table_rows table=ifTable":                         3,
+			"snmp_table_column_sum column=ifInOctets table=ifTable": 150,
+			"sysUpTime": 42,
+		}
+		if !dropSource {
+			expected["ifInOctets ifIndex=1"] = 100
+			expected["ifInOctets ifIndex=2"] = 50
+			expected["ifMtu ifIndex=3"] = 1500
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("drop_source %t: expected %v, got %v", dropSource, expected, got)
+		}
+	}
+}
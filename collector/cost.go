@@ -0,0 +1,57 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"runtime"
+	"runtime/metrics"
+)
+
+// heapAllocs returns the bytes allocated by the process so far.
+func heapAllocs() uint64 {
+	samples := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64()
+}
+
+// measureCost measures the cost of processing the PDUs of the module, up to
+// the call of the returned function, which adds it to the module. The
+// goroutine is locked to its thread meanwhile, so that the CPU time of the
+// thread is that of the processing alone, which must not wait on the
+// network. Allocations are those of the process, other collections running
+// at the same time included. Nothing is measured without
+// --snmp.collection-cost, and CPU time only where the CPU time of a thread
+// is known.
+func (c Collector) measureCost(module string) func() {
+	if !*collectionCost {
+		return func() {}
+	}
+	if threadCPU {
+		runtime.LockOSThread()
+	}
+	cpuBefore, allocsBefore := threadCPUSeconds(), heapAllocs()
+	return func() {
+		cpu, allocs := threadCPUSeconds()-cpuBefore, heapAllocs()-allocsBefore
+		if threadCPU {
+			runtime.UnlockOSThread()
+		}
+		if cpu > 0 {
+			c.metrics.SNMPCollectionCPU.WithLabelValues(module).Add(cpu)
+		}
+		c.metrics.SNMPCollectionAllocs.WithLabelValues(module).Add(float64(allocs))
+	}
+}
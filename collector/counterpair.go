@@ -0,0 +1,116 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+type counterPairRow struct {
+	labelnames  []string
+	labelvalues []string
+	value32     float64
+	value64     float64
+	has32       bool
+	has64       bool
+}
+
+// counterPairBuilder merges the series of a 32-bit counter and its 64-bit
+// replacement.
+type counterPairBuilder struct {
+	*config.CounterPair
+	help32 string
+	help64 string
+	rows   map[string]*counterPairRow
+}
+
+// newCounterPairBuilders returns the counter pair builders of a module by
+// the name of each of their source metrics.
+func newCounterPairBuilders(pairs []*config.CounterPair) map[string][]*counterPairBuilder {
+	builders := map[string][]*counterPairBuilder{}
+	for _, p := range pairs {
+		b := &counterPairBuilder{CounterPair: p, rows: map[string]*counterPairRow{}}
+		builders[p.Counter32] = append(builders[p.Counter32], b)
+		builders[p.Counter64] = append(builders[p.Counter64], b)
+	}
+	return builders
+}
+
+// add pairs the counter samples of one of the source metrics by their
+// labels, and returns the other samples, such as those of
+// --snmp.counter64-exact.
+func (p *counterPairBuilder) add(metric *config.Metric, samples []prometheus.Metric) []prometheus.Metric {
+	if metric.Name == p.Counter64 {
+		p.help64 = metric.Help
+	} else {
+		p.help32 = metric.Help
+	}
+	rest := []prometheus.Metric{}
+	for _, sample := range samples {
+		m := &dto.Metric{}
+		if err := sample.Write(m); err != nil || m.Counter == nil {
+			rest = append(rest, sample)
+			continue
+		}
+		// Label pairs are sorted by name.
+		var labelnames, labelvalues []string
+		for _, l := range m.Label {
+			labelnames = append(labelnames, l.GetName())
+			labelvalues = append(labelvalues, l.GetValue())
+		}
+		key := strings.Join(labelnames, "\xff") + "\xfe" + strings.Join(labelvalues, "\xff")
+		row, ok := p.rows[key]
+		if !ok {
+			row = &counterPairRow{labelnames: labelnames, labelvalues: labelvalues}
+			p.rows[key] = row
+		}
+		if metric.Name == p.Counter64 {
+			row.value64, row.has64 = m.Counter.GetValue(), true
+		} else {
+			row.value32, row.has32 = m.Counter.GetValue(), true
+		}
+	}
+	return rest
+}
+
+// metrics returns a counter for each row, with the 64-bit value if the
+// target returned it and the 32-bit value otherwise.
+func (p *counterPairBuilder) metrics() []prometheus.Metric {
+	keys := make([]string, 0, len(p.rows))
+	for k := range p.rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	help := p.help64
+	if help == "" {
+		help = p.help32
+	}
+	samples := []prometheus.Metric{}
+	for _, k := range keys {
+		row := p.rows[k]
+		value := row.value32
+		if row.has64 {
+			value = row.value64
+		}
+		samples = append(samples, prometheus.MustNewConstMetric(prometheus.NewDesc(p.Name, help, row.labelnames, nil),
+			prometheus.CounterValue, value, row.labelvalues...))
+	}
+	return samples
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+type credential struct {
+	name string
+	auth *config.Auth
+}
+
+// credentialsOf returns the credentials of an auth with secondary
+// credentials or users, in the configured order. Users are named by their
+// username.
+func credentialsOf(auth *config.Auth) []credential {
+	if len(auth.Users) == 0 {
+		return []credential{{"primary", auth}, {"secondary", auth.Secondary}}
+	}
+	credentials := make([]credential, 0, len(auth.Users))
+	for _, a := range auth.UserAuths() {
+		credentials = append(credentials, credential{a.Username, a})
+	}
+	return credentials
+}
+
+// rememberedCredentials are the credentials which last worked for a target
+// and auth.
+type rememberedCredentials struct {
+	name string
+	// When the target was last scraped with the auth.
+	used time.Time
+}
+
+// credentialTargets remembers the credentials which last worked for each
+// target and auth, unless they are the first ones, so they are tried first.
+// It's only a hint: if the target changed its mind, the other credentials
+// are tried too.
+type credentialTargets struct {
+	sync.Mutex
+	targets   map[string]rememberedCredentials
+	lastSweep time.Time
+}
+
+var lastCredentials = newCredentialTargets()
+
+func newCredentialTargets() *credentialTargets {
+	return &credentialTargets{targets: map[string]rememberedCredentials{}}
+}
+
+// order returns the credentials, the ones which last worked for the key
+// first. Those of targets not scraped for --snmp.credentials-ttl are
+// forgotten.
+func (s *credentialTargets) order(key string, credentials []credential, now time.Time) []credential {
+	s.Lock()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, r := range s.targets {
+			if now.Sub(r.used) > *credentialsTTL {
+				delete(s.targets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	r, ok := s.targets[key]
+	if ok {
+		r.used = now
+		s.targets[key] = r
+	}
+	s.Unlock()
+	if !ok {
+		return credentials
+	}
+	name := r.name
+	ordered := make([]credential, 0, len(credentials))
+	for _, cred := range credentials {
+		if cred.name == name {
+			ordered = append(ordered, cred)
+		}
+	}
+	for _, cred := range credentials {
+		if cred.name != name {
+			ordered = append(ordered, cred)
+		}
+	}
+	return ordered
+}
+
+// record remembers the credentials which worked for the key, forgetting it
+// if they are the first of the configured ones.
+func (s *credentialTargets) record(key, name string, credentials []credential, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if name != credentials[0].name {
+		s.targets[key] = rememberedCredentials{name: name, used: now}
+	} else {
+		delete(s.targets, key)
+	}
+}
+
+// recordCredentials remembers the credentials to scrape the target with next
+// from the outcome of this scrape with the ones named used: the next ones if
+// the agent rejected them or did not answer, the same ones otherwise. If the
+// scrape of a target which did not answer is retried at its other address
+// family, the credentials are only changed after that one didn't answer
+// either, so that all are tried at both families.
+func (c Collector) recordCredentials(logger log.Logger, key string, credentials []credential, used string, nextFamily bool) {
+	name := used
+	if typ := c.errors.first(); tryNextCredentials(typ) && !(nextFamily && typ == ErrorTypeTimeout) {
+		for i, cred := range credentials {
+			if cred.name == used {
+				name = credentials[(i+1)%len(credentials)].name
+			}
+		}
+		level.Info(logger).Log("msg", "Credentials failed, the next scrape tries the next ones", "credentials", used, "next", name)
+	}
+	lastCredentials.record(key, name, credentials, time.Now())
+}
+
+// tryNextCredentials reports whether other credentials may work where some
+// failed with an error of the type: when the agent rejected them, e.g. with
+// usmStatsUnknownUserNames, or ignored the request, as agents which drop the
+// requests of unknown users or communities do. Errors such as an unreachable
+// target are the same for all credentials.
+func tryNextCredentials(errorType string) bool {
+	switch errorType {
+	case ErrorTypeAuth, ErrorTypeTimeout:
+		return true
+	}
+	return false
+}
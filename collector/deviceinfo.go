@@ -0,0 +1,118 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// Objects of the system group of SNMPv2-MIB exported by --snmp.device-info.
+const (
+	sysDescrOid    = "1.3.6.1.2.1.1.1.0"
+	sysNameOid     = "1.3.6.1.2.1.1.5.0"
+	sysLocationOid = "1.3.6.1.2.1.1.6.0"
+)
+
+// snmpEngineID.0 of SNMP-FRAMEWORK-MIB, for targets scraped without SNMPv3.
+const snmpEngineIDOid = "1.3.6.1.6.3.10.2.1.1.0"
+
+var (
+	deviceInfoDesc       = prometheus.NewDesc("snmp_device_info", "Name, description and location of the target from the system group of SNMPv2-MIB.", []string{"sys_name", "sys_descr", "sys_location"}, nil)
+	deviceInfoVendorDesc = prometheus.NewDesc("snmp_device_info", "Name, description, location and vendor of the target from the system group of SNMPv2-MIB.", []string{"sys_name", "sys_descr", "sys_location", "vendor"}, nil)
+)
+
+// deviceInfo gets the system group basics of the target. Failing to do so
+// does not fail the scrape, which returns the modules' metrics as usual.
+func (c Collector) deviceInfo(client scraper.SNMPScraper, logger log.Logger) prometheus.Metric {
+	// Without a module scraped before, the client has no timeout yet.
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		if g.Timeout == 0 {
+			g.Timeout = config.DefaultWalkParams.Timeout
+			g.Retries = *config.DefaultWalkParams.Retries
+		}
+	})
+	oids := []string{sysNameOid, sysDescrOid, sysLocationOid}
+	if *deviceVendor {
+		oids = append(oids, sysObjectIDOid)
+	}
+	packet, err := client.Get(oids)
+	if err == nil && packet.Error != gosnmp.NoError {
+		err = &AgentError{Target: c.target, Status: packet.Error}
+	}
+	if err != nil {
+		level.Info(logger).Log("msg", "Error getting device info", "err", err)
+		return nil
+	}
+	values := map[string]string{}
+	for _, v := range packet.Variables {
+		switch v.Type {
+		case gosnmp.OctetString:
+			values[strings.TrimPrefix(v.Name, ".")] = pduValueAsString(&v, "DisplayString", c.metrics)
+		case gosnmp.ObjectIdentifier:
+			values[strings.TrimPrefix(v.Name, ".")] = pduValueAsString(&v, "", c.metrics)
+		}
+	}
+	if *deviceVendor {
+		return prometheus.MustNewConstMetric(deviceInfoVendorDesc, prometheus.GaugeValue, 1, values[sysNameOid], values[sysDescrOid], values[sysLocationOid], vendorName(values[sysObjectIDOid]))
+	}
+	return prometheus.MustNewConstMetric(deviceInfoDesc, prometheus.GaugeValue, 1, values[sysNameOid], values[sysDescrOid], values[sysLocationOid])
+}
+
+var engineInfoDesc = prometheus.NewDesc("snmp_engine_info", "SNMP engine ID of the target, telling apart devices behind the same address.", []string{"engine_id"}, nil)
+
+// engineInfo returns the engine ID of the target. SNMPv3 targets told it
+// during discovery, others are asked for snmpEngineID. Failing to get it
+// does not fail the scrape.
+func (c Collector) engineInfo(client scraper.SNMPScraper, logger log.Logger) prometheus.Metric {
+	var engineID string
+	v3 := false
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		if params, ok := g.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok && g.Version == gosnmp.Version3 {
+			engineID, v3 = params.AuthoritativeEngineID, true
+		}
+		if g.Timeout == 0 {
+			g.Timeout = config.DefaultWalkParams.Timeout
+			g.Retries = *config.DefaultWalkParams.Retries
+		}
+	})
+	if !v3 {
+		packet, err := client.Get([]string{snmpEngineIDOid})
+		if err == nil && packet.Error != gosnmp.NoError {
+			err = &AgentError{Target: c.target, Status: packet.Error}
+		}
+		if err != nil {
+			level.Info(logger).Log("msg", "Error getting engine ID", "err", err)
+			return nil
+		}
+		if len(packet.Variables) == 1 {
+			if b, ok := packet.Variables[0].Value.([]byte); ok {
+				engineID = string(b)
+			}
+		}
+	}
+	if engineID == "" {
+		level.Debug(logger).Log("msg", "Target has no engine ID")
+		return nil
+	}
+	return prometheus.MustNewConstMetric(engineInfoDesc, prometheus.GaugeValue, 1, hex.EncodeToString([]byte(engineID)))
+}
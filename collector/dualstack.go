@@ -0,0 +1,182 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// Requested to check which address family of a dual-stack target answers.
+const sysUpTimeOid = "1.3.6.1.2.1.1.3.0"
+
+type familyTarget struct {
+	family string
+	target string
+}
+
+// splitTarget splits a target into its transport prefix, host and port.
+func splitTarget(target string) (prefix, host, port string) {
+	host = target
+	if s := strings.SplitN(target, "://", 2); len(s) == 2 {
+		prefix, host = s[0]+"://", s[1]
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	return prefix, host, port
+}
+
+// dualStackTargets returns the target rewritten to use the first IPv4 and
+// IPv6 address of its host, preferred family first. It returns nothing if
+// the host did not resolve to both families.
+func dualStackTargets(target string, addrs []net.IPAddr, preferred string) []familyTarget {
+	prefix, _, port := splitTarget(target)
+	var v4, v6 net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if v4 == nil {
+				v4 = addr.IP
+			}
+		} else if v6 == nil {
+			v6 = addr.IP
+		}
+	}
+	if v4 == nil || v6 == nil {
+		return nil
+	}
+	join := func(ip net.IP) string {
+		if port == "" {
+			return prefix + ip.String()
+		}
+		return prefix + net.JoinHostPort(ip.String(), port)
+	}
+	targets := []familyTarget{{"ipv4", join(v4)}, {"ipv6", join(v6)}}
+	if preferred == "ipv6" {
+		targets[0], targets[1] = targets[1], targets[0]
+	}
+	return targets
+}
+
+// rememberedFamily is the address family a dual-stack target is scraped at.
+type rememberedFamily struct {
+	family string
+	// When the target was last scraped.
+	used time.Time
+}
+
+// familyTargets remembers the address family each dual-stack target answered
+// at, so that its scrapes go straight to it.
+type familyTargets struct {
+	sync.Mutex
+	targets   map[string]rememberedFamily
+	lastSweep time.Time
+}
+
+var lastFamilies = newFamilyTargets()
+
+func newFamilyTargets() *familyTargets {
+	return &familyTargets{targets: map[string]rememberedFamily{}}
+}
+
+// family returns the family to scrape the target at, or an empty string if
+// the target wasn't scraped within --snmp.address-family-ttl.
+func (f *familyTargets) family(target string, now time.Time) string {
+	f.Lock()
+	defer f.Unlock()
+	if now.Sub(f.lastSweep) > time.Minute {
+		for k, r := range f.targets {
+			if now.Sub(r.used) > *familyTTL {
+				delete(f.targets, k)
+			}
+		}
+		f.lastSweep = now
+	}
+	r, ok := f.targets[target]
+	if !ok || now.Sub(r.used) > *familyTTL {
+		return ""
+	}
+	return r.family
+}
+
+// record remembers the family to scrape the target at next.
+func (f *familyTargets) record(target, family string, now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.targets[target] = rememberedFamily{family: family, used: now}
+}
+
+// selectAddress returns the addresses of a target resolving to both IPv4
+// and IPv6 addresses, the one to scrape first: that of the family the target
+// was last scraped at, or else of the preferred family. It returns nothing
+// for other targets, or with --snmp.preferred-address-family=system.
+func (c Collector) selectAddress(ctx context.Context) []familyTarget {
+	if c.auth.Proxy != nil || *preferredFamily == "system" {
+		// The proxy or the system resolves the target.
+		return nil
+	}
+	_, host, _ := splitTarget(c.target)
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		// Connecting reports the error.
+		return nil
+	}
+	candidates := dualStackTargets(c.target, addrs, *preferredFamily)
+	if len(candidates) == 0 {
+		return nil
+	}
+	if lastFamilies.family(c.target, time.Now()) == candidates[1].family {
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+	}
+	return candidates
+}
+
+// recordAddress remembers the family of the next scrape of the target from
+// the outcome of this one at the first of the candidates: the other family
+// if it didn't answer, the same one otherwise.
+func (c Collector) recordAddress(logger log.Logger, target string, candidates []familyTarget) {
+	family := candidates[0].family
+	switch c.errors.first() {
+	case ErrorTypeTimeout, ErrorTypeUnreachable:
+		level.Info(logger).Log("msg", "No answer from address family, the next scrape tries the other one", "family", family, "address", candidates[0].target)
+		family = candidates[1].family
+	}
+	lastFamilies.record(target, family, time.Now())
+}
+
+// useRoute relays the requests of the client through the proxy of the auth,
+// if any, or sends them from its interface.
+func useRoute(client *scraper.GoSNMPWrapper, auth *config.Auth) {
+	if auth.Interface != "" {
+		client.BindToDevice(auth.Interface)
+	}
+	if auth.Proxy == nil {
+		return
+	}
+	// Validated when loading the config.
+	address, _ := auth.Proxy.Address()
+	client.UseSOCKS5(address, auth.Proxy.Username, string(auth.Proxy.Password))
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// Subtrees of ENTITY-SENSOR-MIB and ENTITY-MIB walked by entity sensor
+// modules.
+const (
+	entPhySensorEntryOid = "1.3.6.1.2.1.99.1.1.1"
+	entPhysicalNameOid   = "1.3.6.1.2.1.47.1.1.1.1.7"
+)
+
+// Columns of entPhySensorEntry.
+const (
+	entPhySensorType         = 1
+	entPhySensorScale        = 2
+	entPhySensorPrecision    = 3
+	entPhySensorValue        = 4
+	entPhySensorOperStatus   = 5
+	entPhySensorUnitsDisplay = 6
+)
+
+const (
+	entitySensorOk         = 1
+	entitySensorTruthValue = 12
+)
+
+// entitySensorUnits are the units metrics of sensors are suffixed with, by
+// EntitySensorDataType. Sensors of other types, such as other(1) and
+// unknown(2), are exported as snmp_entity_sensor_value with their units as
+// the agent displays them.
+var entitySensorUnits = map[int]string{
+	3:  "volts_ac",
+	4:  "volts_dc",
+	5:  "amperes",
+	6:  "watts",
+	7:  "hertz",
+	8:  "celsius",
+	9:  "relative_humidity_percent",
+	10: "rpm",
+	11: "cubic_meters_per_minute",
+	12: "truth",
+}
+
+// entitySensorScales are the powers of ten of EntitySensorDataScale, where
+// exa(14) comes before peta(15).
+var entitySensorScales = map[int]int{
+	1: -24, 2: -21, 3: -18, 4: -15, 5: -12, 6: -9, 7: -6, 8: -3, 9: 0,
+	10: 3, 11: 6, 12: 9, 13: 12, 14: 18, 15: 15, 16: 21, 17: 24,
+}
+
+var entitySensorLabels = []string{"entPhysicalIndex", "entPhysicalName"}
+
+// entitySensorDescs returns the descriptors of the metrics of sensors by
+// EntitySensorDataType, with the extra labels.
+func entitySensorDescs(extraLabels prometheus.Labels) map[int]*prometheus.Desc {
+	descs := map[int]*prometheus.Desc{}
+	for typ, unit := range entitySensorUnits {
+		help := "Value of ENTITY-SENSOR-MIB sensors of unit " + unit + ", scaled by their entPhySensorScale and entPhySensorPrecision."
+		if typ == entitySensorTruthValue {
+			help = "Value of ENTITY-SENSOR-MIB truth value sensors, 1 for true and 0 for false."
+		}
+		descs[typ] = prometheus.NewDesc("snmp_entity_sensor_"+unit, help, entitySensorLabels, extraLabels)
+	}
+	return descs
+}
+
+// entitySensors walks the sensors of ENTITY-SENSOR-MIB and the names of the
+// physical entities they belong to, and returns their metrics with the extra
+// labels.
+func (c Collector) entitySensors(client scraper.SNMPScraper, extraLabels prometheus.Labels) ([]prometheus.Metric, error) {
+	sensors, err := client.WalkAll(entPhySensorEntryOid)
+	if err != nil {
+		return nil, err
+	}
+	names, err := client.WalkAll(entPhysicalNameOid)
+	if err != nil {
+		return nil, err
+	}
+	return entitySensorMetrics(sensors, names, c.metrics, extraLabels), nil
+}
+
+// entitySensorMetrics returns the status and scaled value of each sensor,
+// labelled with the entPhysicalName of its entity and the extra labels.
+// Values of sensors which aren't ok are undefined, so left out.
+func entitySensorMetrics(sensors, names []gosnmp.SnmpPDU, metrics Metrics, extraLabels prometheus.Labels) []prometheus.Metric {
+	entitySensorStatusDesc := prometheus.NewDesc("snmp_entity_sensor_oper_status", "Operational status of an ENTITY-SENSOR-MIB sensor: ok(1), unavailable(2) or nonoperational(3).",
+		entitySensorLabels, extraLabels)
+	entitySensorValueDesc := prometheus.NewDesc("snmp_entity_sensor_value", "Value of an ENTITY-SENSOR-MIB sensor of no known unit, scaled by its entPhySensorScale and entPhySensorPrecision.",
+		append(entitySensorLabels, "units"), extraLabels)
+	descs := entitySensorDescs(extraLabels)
+	entityNames := map[string]string{}
+	for i, pdu := range names {
+		entityNames[strings.TrimPrefix(pdu.Name, "."+entPhysicalNameOid+".")] = pduText(&names[i], metrics)
+	}
+	columns := tableColumns(sensors, entPhySensorEntryOid)
+	indexes := make([]string, 0, len(columns[entPhySensorValue]))
+	for index := range columns[entPhySensorValue] {
+		indexes = append(indexes, index)
+	}
+	sort.Strings(indexes)
+	samples := []prometheus.Metric{}
+	for _, index := range indexes {
+		value := columns.get(entPhySensorValue, index)
+		labels := []string{index, entityNames[index]}
+		status := columns.get(entPhySensorOperStatus, index)
+		if status != nil {
+			samples = append(samples, prometheus.MustNewConstMetric(entitySensorStatusDesc, prometheus.GaugeValue, float64(pduInt(status)), labels...))
+			if pduInt(status) != entitySensorOk {
+				continue
+			}
+		}
+		typ := pduInt(columns.get(entPhySensorType, index))
+		v := entitySensorValue(pduInt(value), typ, pduInt(columns.get(entPhySensorScale, index)), pduInt(columns.get(entPhySensorPrecision, index)))
+		if desc, ok := descs[typ]; ok {
+			samples = append(samples, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...))
+			continue
+		}
+		units := pduText(columns.get(entPhySensorUnitsDisplay, index), metrics)
+		samples = append(samples, prometheus.MustNewConstMetric(entitySensorValueDesc, prometheus.GaugeValue, v, append(labels, units)...))
+	}
+	return samples
+}
+
+// entitySensorValue scales the raw value of a sensor. Precisions of 1 to 9
+// are decimal places, negative ones only tell the accurate digits.
+func entitySensorValue(raw, typ, scale, precision int) float64 {
+	if typ == entitySensorTruthValue {
+		// true(1) or false(2).
+		if raw == 1 {
+			return 1
+		}
+		return 0
+	}
+	exponent := entitySensorScales[scale]
+	if precision > 0 {
+		exponent -= precision
+	}
+	if exponent < 0 {
+		// Dividing keeps values such as 2350 at precision 2 exact.
+		return float64(raw) / math.Pow10(-exponent)
+	}
+	return float64(raw) * math.Pow10(exponent)
+}
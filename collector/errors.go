@@ -0,0 +1,142 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Types of scrape failure, exposed in the snmp_scrape_error metric and in
+// error responses from the exporter.
+const (
+	ErrorTypeTimeout       = "timeout"
+	ErrorTypeAuth          = "auth_failure"
+	ErrorTypeDecode        = "decode_error"
+	ErrorTypeUnreachable   = "unreachable"
+	ErrorTypeAgent         = "agent_error"
+	ErrorTypeConfigMissing = "config_missing"
+	ErrorTypeBadRequest    = "bad_request"
+	ErrorTypeForbidden     = "target_not_allowed"
+	ErrorTypeRateLimited   = "rate_limited"
+	ErrorTypeUnknown       = "unknown"
+)
+
+// AgentError is returned when the target answers with a non-zero error-status.
+type AgentError struct {
+	Target string
+	Status gosnmp.SNMPError
+}
+
+func (e *AgentError) Error() string {
+	return "error reported by target " + e.Target + ": Error Status " + e.Status.String()
+}
+
+// ClassifyError maps an error returned while scraping to one of the ErrorType constants.
+func ClassifyError(err error) string {
+	var agentErr *AgentError
+	var typeErr *TypeError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &agentErr):
+		return ErrorTypeAgent
+	case errors.Is(err, gosnmp.ErrUnknownUsername),
+		errors.Is(err, gosnmp.ErrWrongDigest),
+		errors.Is(err, gosnmp.ErrDecryption),
+		errors.Is(err, gosnmp.ErrUnknownSecurityLevel),
+		errors.Is(err, gosnmp.ErrUnknownSecurityModels),
+		errors.Is(err, gosnmp.ErrNotInTimeWindow),
+		errors.Is(err, gosnmp.ErrUnknownEngineID):
+		return ErrorTypeAuth
+	case errors.As(err, &dnsErr),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return ErrorTypeUnreachable
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout(),
+		// gosnmp does not wrap the final timeout after retries.
+		strings.Contains(err.Error(), "request timeout"):
+		return ErrorTypeTimeout
+	case errors.As(err, &typeErr),
+		errors.Is(err, gosnmp.ErrInvalidPacketLength),
+		errors.Is(err, gosnmp.ErrZeroByteBuffer),
+		errors.Is(err, gosnmp.ErrInvalidOidLength),
+		strings.Contains(err.Error(), "unable to decode"),
+		strings.Contains(err.Error(), "unmarshal"):
+		return ErrorTypeDecode
+	case errors.As(err, &netErr):
+		return ErrorTypeUnreachable
+	}
+	return ErrorTypeUnknown
+}
+
+// scrapeErrors records the types of errors seen during one collection.
+type scrapeErrors struct {
+	mu    sync.Mutex
+	types []string
+	seen  map[string]struct{}
+	// Whether any module was scraped.
+	scraped bool
+}
+
+// add records an error, returning false if the same type was already
+// recorded for the module.
+func (s *scrapeErrors) add(typ, module string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.types = append(s.types, typ)
+	if s.seen == nil {
+		s.seen = map[string]struct{}{}
+	}
+	key := module + "\xff" + typ
+	if _, ok := s.seen[key]; ok {
+		return false
+	}
+	s.seen[key] = struct{}{}
+	return true
+}
+
+// moduleScraped records that a module was scraped, whatever errors others
+// had.
+func (s *scrapeErrors) moduleScraped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scraped = true
+}
+
+func (s *scrapeErrors) partial() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scraped && len(s.types) > 0
+}
+
+func (s *scrapeErrors) first() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.types) == 0 {
+		return ""
+	}
+	return s.types[0]
+}
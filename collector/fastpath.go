@@ -0,0 +1,198 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// How long an unused session is kept open.
+const sessionIdleTimeout = time.Minute
+
+// getOnly reports whether the module only gets OIDs, so that it can be
+// scraped over a session reused across scrapes.
+func getOnly(m *config.Module) bool {
+	return len(m.Walk) == 0 && len(m.Filters) == 0 && len(m.Get) > 0 && !m.Topology && !m.EntitySensors
+}
+
+type sessionKey struct {
+	target string
+	// Credentials of the auth, as auths of the same name may differ
+	// between tenants, reloads and scrapes overriding them.
+	auth        string
+	snmpContext string
+	debug       bool
+}
+
+// authKey returns the settings of the auth, including its credentials.
+func authKey(auth *config.Auth) string {
+	b, _ := json.Marshal(auth)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type idleSession struct {
+	client   *scraper.GoSNMPWrapper
+	lastUsed time.Time
+}
+
+// sessionPool keeps the connections of get-only scrapes open between
+// scrapes, which for SNMPv3 also keeps the discovered engine ID, boots and
+// time. Each session is used by one scrape at a time.
+type sessionPool struct {
+	mu    sync.Mutex
+	idle  map[sessionKey][]idleSession
+	prune *time.Timer
+}
+
+var sessions = &sessionPool{idle: map[sessionKey][]idleSession{}}
+
+// get takes the most recently used idle session, or returns nil if there is
+// none.
+func (p *sessionPool) get(key sessionKey) *scraper.GoSNMPWrapper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := p.idle[key]
+	if len(idle) == 0 {
+		return nil
+	}
+	s := idle[len(idle)-1]
+	p.idle[key] = idle[:len(idle)-1]
+	if len(p.idle[key]) == 0 {
+		delete(p.idle, key)
+	}
+	return s.client
+}
+
+// put returns a session to the pool. The sessions unused for longer than the
+// idle timeout are closed by a timer running while the pool isn't empty.
+func (p *sessionPool) put(key sessionKey, client *scraper.GoSNMPWrapper, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle[key] = append(p.idle[key], idleSession{client: client, lastUsed: now})
+	if p.prune == nil {
+		p.prune = time.AfterFunc(sessionIdleTimeout, func() { p.closeIdle(time.Now()) })
+	}
+}
+
+// closeIdle closes the sessions unused for longer than the idle timeout.
+func (p *sessionPool) closeIdle(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, idle := range p.idle {
+		kept := idle[:0]
+		for _, s := range idle {
+			if now.Sub(s.lastUsed) > sessionIdleTimeout {
+				s.client.Close()
+				continue
+			}
+			kept = append(kept, s)
+		}
+		if len(kept) == 0 {
+			delete(p.idle, k)
+		} else {
+			p.idle[k] = kept
+		}
+	}
+	if len(p.idle) == 0 {
+		p.prune.Stop()
+		p.prune = nil
+		return
+	}
+	p.prune.Reset(sessionIdleTimeout)
+}
+
+// collectGetOnly scrapes modules which only get OIDs one after the other,
+// without workers and over a session reused across scrapes, as connecting
+// and SNMPv3 discovery take most of the time of such scrapes.
+func (c Collector) collectGetOnly(ctx context.Context, ch chan<- prometheus.Metric) {
+	key := sessionKey{target: c.target, auth: authKey(c.auth), snmpContext: c.snmpContext, debug: c.debugSNMP}
+	client := sessions.get(key)
+	if client == nil {
+		var err error
+		client, err = scraper.NewGoSNMP(c.logger, c.target, *srcAddress, c.debugSNMP)
+		if err != nil {
+			level.Info(c.logger).Log("msg", err)
+			for _, m := range c.scrapeError("Error during initialisation of the Worker", nil, ErrorTypeBadRequest, err) {
+				ch <- m
+			}
+			return
+		}
+		useRoute(client, c.auth)
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.Context = ctx
+			c.auth.ConfigureSNMP(g, c.snmpContext)
+		})
+		if err := client.Connect(); err != nil {
+			level.Info(c.logger).Log("msg", "Error connecting to target", "err", err)
+			for _, m := range c.scrapeError("Error connecting to target", nil, ClassifyError(err), err) {
+				ch <- m
+			}
+			return
+		}
+	}
+	client.OnResync(c.metrics.SNMPResyncs.Inc)
+	client.OnAnomaly(func(kind string) {
+		c.metrics.SNMPWalkAnomalies.WithLabelValues(kind).Inc()
+	})
+	client.LogWalkProgress(*walkProgress, *walkSample)
+	if *fastCodec {
+		client.UseFastCodec()
+	}
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Context = ctx
+	})
+	for _, m := range c.modules {
+		if ctx.Err() != nil {
+			level.Debug(c.logger).Log("msg", "Context canceled", "err", ctx.Err(), "module", m.name)
+			break
+		}
+		logger := log.With(c.logger, "module", m.name)
+		level.Debug(logger).Log("msg", "Starting scrape")
+		start := time.Now()
+		c.collect(ch, logger, client, m)
+		duration := time.Since(start).Seconds()
+		level.Debug(logger).Log("msg", "Finished scrape", "duration_seconds", duration)
+		c.metrics.SNMPCollectionDuration.WithLabelValues(m.name).Observe(duration)
+	}
+	if *deviceInfo && ctx.Err() == nil {
+		if m := c.deviceInfo(client, c.logger); m != nil {
+			ch <- m
+		}
+	}
+	if *engineInfo && ctx.Err() == nil {
+		if m := c.engineInfo(client, c.logger); m != nil {
+			ch <- m
+		}
+	}
+	// A session which failed may be broken, e.g. by an agent restart.
+	if c.errors.first() != "" || ctx.Err() != nil {
+		client.Close()
+		return
+	}
+	sessions.put(key, client, time.Now())
+}
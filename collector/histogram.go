@@ -0,0 +1,170 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+type histogramBucket struct {
+	bound, count       float64
+	hasBound, hasCount bool
+}
+
+type histogramGroup struct {
+	labelnames  []string
+	labelvalues []string
+	buckets     map[string]*histogramBucket
+	sum         float64
+	hasSum      bool
+}
+
+// histogramBuilder accumulates the rows of the bucket table of a histogram.
+type histogramBuilder struct {
+	*config.Histogram
+	help   string
+	groups map[string]*histogramGroup
+}
+
+// newHistogramBuilders returns the histogram builders of a module by the
+// name of each of their source metrics.
+func newHistogramBuilders(histograms []*config.Histogram) map[string][]*histogramBuilder {
+	builders := map[string][]*histogramBuilder{}
+	for _, h := range histograms {
+		b := &histogramBuilder{Histogram: h, groups: map[string]*histogramGroup{}}
+		for _, name := range []string{h.Count, h.Bound, h.Sum} {
+			if name != "" {
+				builders[name] = append(builders[name], b)
+			}
+		}
+	}
+	return builders
+}
+
+// add accumulates the samples of one of the source metrics.
+func (h *histogramBuilder) add(metric *config.Metric, samples []prometheus.Metric) {
+	if metric.Name == h.Count {
+		h.help = metric.Help
+	}
+	for _, sample := range samples {
+		m := &dto.Metric{}
+		if err := sample.Write(m); err != nil {
+			continue
+		}
+		var value float64
+		switch {
+		case m.Counter != nil:
+			value = m.Counter.GetValue()
+		case m.Gauge != nil:
+			value = m.Gauge.GetValue()
+		default:
+			continue
+		}
+		// Label pairs are sorted by name.
+		var labelnames, labelvalues []string
+		bucket := ""
+		for _, l := range m.Label {
+			if l.GetName() == h.BucketLabel {
+				bucket = l.GetValue()
+				continue
+			}
+			labelnames = append(labelnames, l.GetName())
+			labelvalues = append(labelvalues, l.GetValue())
+		}
+		key := strings.Join(labelnames, "\xff") + "\xfe" + strings.Join(labelvalues, "\xff")
+		group, ok := h.groups[key]
+		if !ok {
+			group = &histogramGroup{labelnames: labelnames, labelvalues: labelvalues, buckets: map[string]*histogramBucket{}}
+			h.groups[key] = group
+		}
+		if metric.Name == h.Sum {
+			group.sum += value
+			group.hasSum = true
+		}
+		if metric.Name != h.Count && metric.Name != h.Bound {
+			continue
+		}
+		b, ok := group.buckets[bucket]
+		if !ok {
+			b = &histogramBucket{}
+			group.buckets[bucket] = b
+		}
+		if metric.Name == h.Count {
+			b.count, b.hasCount = value, true
+		}
+		if metric.Name == h.Bound {
+			b.bound, b.hasBound = value, true
+			if h.BoundScale != 0 {
+				b.bound *= h.BoundScale
+			}
+		}
+	}
+}
+
+// metrics returns a histogram for each set of labels besides the bucket
+// label. Buckets missing their count or bound are left out. The sum is NaN
+// unless the histogram has a sum metric.
+func (h *histogramBuilder) metrics() []prometheus.Metric {
+	keys := make([]string, 0, len(h.groups))
+	for k := range h.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := make([]prometheus.Metric, 0, len(keys))
+	for _, k := range keys {
+		group := h.groups[k]
+		buckets := []*histogramBucket{}
+		for _, b := range group.buckets {
+			if b.hasBound && b.hasCount {
+				buckets = append(buckets, b)
+			}
+		}
+		if len(buckets) == 0 {
+			continue
+		}
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+		counts := make(map[float64]uint64, len(buckets))
+		var total float64
+		for _, b := range buckets {
+			if h.Cumulative {
+				total = b.count
+			} else {
+				total += b.count
+			}
+			if !math.IsInf(b.bound, 1) {
+				counts[b.bound] = uint64(total)
+			}
+		}
+		sum := math.NaN()
+		if group.hasSum {
+			sum = group.sum
+		}
+		sample, err := prometheus.NewConstHistogram(prometheus.NewDesc(h.Name, h.help+" (histogram)", group.labelnames, nil),
+			uint64(total), sum, counts, group.labelvalues...)
+		if err != nil {
+			sample = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstHistogram", nil, nil),
+				fmt.Errorf("error for histogram %s with labels %v: %v", h.Name, group.labelvalues, err))
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IANA protocol numbers of ICMP and ICMPv6.
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+var (
+	icmpSequence uint32
+	// Set once opening ICMP sockets was denied, after which targets are no
+	// longer checked.
+	icmpUnavailable atomic.Bool
+)
+
+// icmpAddress picks the address of the host to ping, preferring the given
+// address family.
+func icmpAddress(addrs []net.IPAddr, preferred string) net.IP {
+	if preferred == "system" {
+		return addrs[0].IP
+	}
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (preferred == "ipv4") {
+			return addr.IP
+		}
+	}
+	return addrs[0].IP
+}
+
+// icmpListen opens an ICMP socket for the family of ip. Unprivileged ping
+// sockets are tried first, which are allowed without any capability to the
+// groups in the net.ipv4.ping_group_range sysctl, then raw sockets which
+// need CAP_NET_RAW. It returns whether the socket is a raw one.
+func icmpListen(ip net.IP) (*icmp.PacketConn, bool, error) {
+	network, raw, addr := "udp4", "ip4:icmp", "0.0.0.0"
+	if ip.To4() == nil {
+		network, raw, addr = "udp6", "ip6:ipv6-icmp", "::"
+	}
+	if conn, err := icmp.ListenPacket(network, addr); err == nil {
+		return conn, false, nil
+	}
+	conn, err := icmp.ListenPacket(raw, addr)
+	return conn, true, err
+}
+
+// isEchoReply reports whether b is the reply to the echo request with the
+// sequence number and payload. The kernel replaces the identifier of
+// requests sent over unprivileged sockets, so it is not compared.
+func isEchoReply(b []byte, protocol, seq int, payload []byte) bool {
+	msg, err := icmp.ParseMessage(protocol, b)
+	if err != nil || (msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+		return false
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	return ok && echo.Seq == seq && bytes.Equal(echo.Data, payload)
+}
+
+// ping sends an echo request to ip and reports whether it was answered
+// before the timeout or the deadline of ctx.
+func ping(ctx context.Context, ip net.IP, timeout time.Duration) (bool, error) {
+	conn, raw, err := icmpListen(ip)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var request icmp.Type = ipv4.ICMPTypeEcho
+	protocol := protocolICMP
+	if ip.To4() == nil {
+		request, protocol = ipv6.ICMPTypeEchoRequest, protocolIPv6ICMP
+	}
+	seq := atomic.AddUint32(&icmpSequence, 1)
+	payload := binary.BigEndian.AppendUint32([]byte("snmp_exporter"), seq)
+	msg := icmp.Message{Type: request, Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: int(seq & 0xffff), Data: payload}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return false, err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		dst = &net.IPAddr{IP: ip}
+	}
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		// Raw sockets receive the replies to all requests of the host.
+		if isEchoReply(buf[:n], protocol, int(seq&0xffff), payload) {
+			return true, nil
+		}
+	}
+}
+
+// icmpReachable pings the target. It returns false for ok if the target
+// could not be checked, in which case it is scraped as usual. Targets behind
+// a proxy or an interface of the auth are not checked, as pings would not go
+// the same way.
+func (c Collector) icmpReachable(ctx context.Context, logger log.Logger) (reachable, ok bool) {
+	if icmpUnavailable.Load() || c.auth.Proxy != nil || c.auth.Interface != "" {
+		return false, false
+	}
+	_, host, _ := splitTarget(c.target)
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, strings.Trim(host, "[]"))
+	if err != nil || len(addrs) == 0 {
+		// The scrape reports the resolution error.
+		return false, false
+	}
+	reachable, err = ping(ctx, icmpAddress(addrs, *preferredFamily), *icmpTimeout)
+	if errors.Is(err, os.ErrPermission) {
+		if icmpUnavailable.CompareAndSwap(false, true) {
+			level.Warn(logger).Log("msg", "ICMP checks disabled, the exporter needs CAP_NET_RAW or a group in net.ipv4.ping_group_range", "err", err)
+		}
+		return false, false
+	}
+	if err != nil {
+		level.Debug(logger).Log("msg", "Error checking target with ICMP", "err", err)
+		return false, false
+	}
+	return reachable, true
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// limitOtherValue is the value of a limited label in the samples aggregating
+// its values beyond the limit.
+const limitOtherValue = "__other__"
+
+// limitGroup sums the samples of a metric with label values beyond a limit.
+type limitGroup struct {
+	help      string
+	valueType prometheus.ValueType
+	value     float64
+	// The labels all the samples have with the same value.
+	labels map[string]string
+}
+
+// limitLabels aggregates the samples with values of a label beyond its limit
+// of distinct values. The values kept are the first ones in sorted order, so
+// that the same series are kept from scrape to scrape. The samples of a
+// metric beyond a limit are summed into one sample, with the limited labels
+// beyond their limit set to __other__ and the labels the samples don't share
+// left out. Samples which can't be summed, such as histograms, are dropped.
+// It returns the number of distinct values beyond the limit and of samples
+// aggregated for each limited label.
+func limitLabels(samples []prometheus.Metric, limits map[string]int) ([]prometheus.Metric, map[string]int, map[string]int) {
+	overValues := make(map[string]int, len(limits))
+	aggregated := make(map[string]int, len(limits))
+	for label := range limits {
+		overValues[label] = 0
+		aggregated[label] = 0
+	}
+	if len(limits) == 0 {
+		return samples, overValues, aggregated
+	}
+	written := make([]*dto.Metric, len(samples))
+	values := map[string]map[string]struct{}{}
+	for i, sample := range samples {
+		m := &dto.Metric{}
+		if err := sample.Write(m); err != nil {
+			// Invalid metrics are passed on to report their error.
+			continue
+		}
+		written[i] = m
+		for _, l := range m.Label {
+			if _, ok := limits[l.GetName()]; !ok {
+				continue
+			}
+			if values[l.GetName()] == nil {
+				values[l.GetName()] = map[string]struct{}{}
+			}
+			values[l.GetName()][l.GetValue()] = struct{}{}
+		}
+	}
+
+	over := map[string]map[string]struct{}{}
+	for label, vs := range values {
+		if len(vs) <= limits[label] {
+			continue
+		}
+		sorted := make([]string, 0, len(vs))
+		for v := range vs {
+			sorted = append(sorted, v)
+		}
+		sort.Strings(sorted)
+		over[label] = map[string]struct{}{}
+		for _, v := range sorted[limits[label]:] {
+			over[label][v] = struct{}{}
+		}
+		overValues[label] = len(sorted) - limits[label]
+	}
+	if len(over) == 0 {
+		return samples, overValues, aggregated
+	}
+
+	kept := make([]prometheus.Metric, 0, len(samples))
+	groups := map[string]*limitGroup{}
+	for i, sample := range samples {
+		m := written[i]
+		var labels map[string]string
+		if m != nil {
+			for _, l := range m.Label {
+				if _, ok := over[l.GetName()][l.GetValue()]; ok {
+					labels = map[string]string{}
+					break
+				}
+			}
+		}
+		if labels == nil {
+			kept = append(kept, sample)
+			continue
+		}
+		var value float64
+		var valueType prometheus.ValueType
+		switch {
+		case m.Counter != nil:
+			value, valueType = m.Counter.GetValue(), prometheus.CounterValue
+		case m.Gauge != nil:
+			value, valueType = m.Gauge.GetValue(), prometheus.GaugeValue
+		default:
+			continue
+		}
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+			if _, ok := over[l.GetName()][l.GetValue()]; ok {
+				labels[l.GetName()] = limitOtherValue
+				aggregated[l.GetName()]++
+			}
+		}
+		name := sampleName(sample)
+		group, ok := groups[name]
+		if !ok {
+			groups[name] = &limitGroup{help: sampleHelp(sample), valueType: valueType, value: value, labels: labels}
+			continue
+		}
+		group.value += value
+		if valueType != group.valueType {
+			group.valueType = prometheus.GaugeValue
+		}
+		for k, v := range group.labels {
+			if labels[k] != v {
+				delete(group.labels, k)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		group := groups[name]
+		labelnames := make([]string, 0, len(group.labels))
+		for k := range group.labels {
+			labelnames = append(labelnames, k)
+		}
+		sort.Strings(labelnames)
+		labelvalues := make([]string, 0, len(labelnames))
+		for _, k := range labelnames {
+			labelvalues = append(labelvalues, group.labels[k])
+		}
+		sample, err := prometheus.NewConstMetric(prometheus.NewDesc(name, group.help, labelnames, nil),
+			group.valueType, group.value, labelvalues...)
+		if err != nil {
+			sample = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for label limits", nil, nil),
+				fmt.Errorf("error for metric %s with values beyond label limits: %v", name, err))
+		}
+		kept = append(kept, sample)
+	}
+	return kept, overValues, aggregated
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// How often mapping files are checked for changes.
+const mappingCheckInterval = time.Second
+
+type mappingFile struct {
+	modTime time.Time
+	size    int64
+	checked time.Time
+	values  map[string]string
+}
+
+// mappingFiles caches the mapping files of lookups, reloading them when they
+// change. A file which can't be read keeps its previous values.
+var mappingFiles = struct {
+	sync.Mutex
+	files map[string]*mappingFile
+}{files: map[string]*mappingFile{}}
+
+// mappingValue returns the value of key in the mapping file.
+func mappingValue(path, key string) string {
+	mappingFiles.Lock()
+	defer mappingFiles.Unlock()
+	f, ok := mappingFiles.files[path]
+	if !ok {
+		f = &mappingFile{}
+		mappingFiles.files[path] = f
+	}
+	if now := time.Now(); now.Sub(f.checked) >= mappingCheckInterval {
+		f.checked = now
+		if fi, err := os.Stat(path); err == nil && (!fi.ModTime().Equal(f.modTime) || fi.Size() != f.size) {
+			if values, err := config.LoadMapping(path); err == nil {
+				f.modTime, f.size, f.values = fi.ModTime(), fi.Size(), values
+			}
+		}
+	}
+	return f.values[key]
+}
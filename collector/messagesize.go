@@ -0,0 +1,186 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const (
+	// Bytes of a response besides its varbinds: the version, community or
+	// security parameters and the PDU header.
+	messageOverhead = 100
+	// Size assumed for the varbinds of targets not scraped yet.
+	defaultVarbindSize = 40
+	// The smallest message size agents must accept, from RFC 3417.
+	minMessageSize = 484
+	// Successful scrapes of a target after which a message size reduced
+	// after dropped responses is doubled back.
+	messageSizeRecovery = 10
+	// How long the message sizes of a target are kept without being scraped.
+	messageSizeRetention = time.Hour
+)
+
+type targetMessageSize struct {
+	// Average encoded size of the varbinds returned by the target for each
+	// module, as modules walking interface names and counters differ.
+	varbindSizes map[string]float64
+	// Size learnt from dropped responses, 0 if none were.
+	limit     int
+	successes int
+	seen      time.Time
+}
+
+// varbindSize returns the average size of the varbinds of the module, or
+// defaultVarbindSize if it was not scraped yet.
+func (s *targetMessageSize) varbindSize(module string) float64 {
+	if size, ok := s.varbindSizes[module]; ok {
+		return size
+	}
+	return defaultVarbindSize
+}
+
+// messageSizes learns the size of the varbinds of each target and auth, and
+// how large its responses can be before they are dropped on the way, such as
+// UDP fragments on some networks. Auths are kept apart as they may route the
+// requests differently, e.g. through a proxy, and the SNMPv3 security
+// parameters make responses larger.
+type messageSizes struct {
+	sync.Mutex
+	targets   map[string]*targetMessageSize
+	lastSweep time.Time
+}
+
+var targetSizes = newMessageSizes()
+
+func newMessageSizes() *messageSizes {
+	return &messageSizes{targets: map[string]*targetMessageSize{}}
+}
+
+// messageSizeKey returns the key of the sizes of a target scraped with the
+// auth.
+func messageSizeKey(target string, auth *config.Auth) string {
+	return target + "\xff" + authKey(auth)
+}
+
+// moduleSizeKey returns the key of the varbind sizes of a module, its
+// OIDs, which stays the same across reloads.
+func moduleSizeKey(module *config.Module) string {
+	return strings.Join(module.Walk, " ") + "\xff" + strings.Join(module.Get, " ")
+}
+
+// get returns the sizes of the key. Targets no longer scraped are forgotten
+// after messageSizeRetention.
+func (m *messageSizes) get(key string, now time.Time) *targetMessageSize {
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, s := range m.targets {
+			if now.Sub(s.seen) > messageSizeRetention {
+				delete(m.targets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	s, ok := m.targets[key]
+	if !ok {
+		s = &targetMessageSize{varbindSizes: map[string]float64{}}
+		m.targets[key] = s
+	}
+	s.seen = now
+	return s
+}
+
+// maxRepetitions returns how many varbinds of the module fit in a response of
+// the key no larger than the configured size, nor than the size learnt from
+// dropped responses. It returns 0 if neither limits the size.
+func (m *messageSizes) maxRepetitions(key, module string, configured int, now time.Time) int {
+	m.Lock()
+	defer m.Unlock()
+	s := m.get(key, now)
+	size := configured
+	if s.limit > 0 && (size == 0 || s.limit < size) {
+		size = s.limit
+	}
+	if size == 0 {
+		return 0
+	}
+	return max(int(float64(size-messageOverhead)/s.varbindSize(module)), 1)
+}
+
+// dropped halves the size of the responses of the key, after a walk of the
+// module with the repetitions timed out.
+func (m *messageSizes) dropped(key, module string, repetitions uint32, now time.Time) int {
+	m.Lock()
+	defer m.Unlock()
+	s := m.get(key, now)
+	size := messageOverhead + int(float64(repetitions)*s.varbindSize(module))
+	if s.limit > 0 && s.limit < size {
+		size = s.limit
+	}
+	s.limit, s.successes = max(size/2, minMessageSize), 0
+	return s.limit
+}
+
+// succeeded records the varbinds of a successful scrape of the module, and
+// doubles back a reduced size after messageSizeRecovery of them.
+func (m *messageSizes) succeeded(key, module string, pdus []gosnmp.SnmpPDU, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	s := m.get(key, now)
+	if len(pdus) > 0 {
+		total := 0
+		for _, pdu := range pdus {
+			total += varbindSize(pdu)
+		}
+		s.varbindSizes[module] = float64(total) / float64(len(pdus))
+	}
+	if s.limit == 0 {
+		return
+	}
+	if s.successes++; s.successes >= messageSizeRecovery {
+		s.limit, s.successes = s.limit*2, 0
+		if s.limit >= rxBufSize {
+			s.limit = 0
+		}
+	}
+}
+
+// The largest response gosnmp reads.
+const rxBufSize = 65535
+
+// varbindSize estimates the BER encoded size of a varbind.
+func varbindSize(pdu gosnmp.SnmpPDU) int {
+	// Tags and lengths of the varbind, its name and its value.
+	size := 6
+	for _, subid := range oidToList(strings.TrimPrefix(pdu.Name, ".")) {
+		for size++; subid >= 128; subid >>= 7 {
+			size++
+		}
+	}
+	switch v := pdu.Value.(type) {
+	case []byte:
+		size += len(v)
+	case string:
+		size += len(v)
+	default:
+		// Integers, counters and addresses.
+		size += 5
+	}
+	return size
+}
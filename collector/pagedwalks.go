@@ -0,0 +1,123 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// pageWalker walks subtrees a page at a time.
+type pageWalker interface {
+	WalkPage(oid, from string, limit int) ([]gosnmp.SnmpPDU, bool, error)
+}
+
+// pagedWalk is the state of the walk of a subtree of a target in pages.
+type pagedWalk struct {
+	sync.Mutex
+	// The last OID of the previous page, empty to start a new pass.
+	cursor string
+	// The PDUs of the pages of the current pass.
+	current []gosnmp.SnmpPDU
+	// The PDUs of the last complete pass.
+	previous []gosnmp.SnmpPDU
+	// When the walk was last scraped, guarded by pagedWalks.
+	used time.Time
+}
+
+// pagedWalks walks subtrees too large to walk within one scrape in pages,
+// a page per scrape, each resuming where the previous scrape of the target
+// stopped.
+type pagedWalks struct {
+	sync.Mutex
+	walks     map[string]*pagedWalk
+	lastSweep time.Time
+}
+
+var pages = newPagedWalks()
+
+func newPagedWalks() *pagedWalks {
+	return &pagedWalks{walks: map[string]*pagedWalk{}}
+}
+
+// walk walks the next page of the subtree. It returns the PDUs of the pages
+// of the current pass, followed by those of the last complete pass after
+// them, so that each scrape has the whole subtree with rows at most a pass
+// old. Walks of targets not scraped for --snmp.walk-page-ttl start over.
+func (p *pagedWalks) walk(client scraper.SNMPScraper, key, subtree string, size int, now time.Time) ([]gosnmp.SnmpPDU, error) {
+	p.Lock()
+	if now.Sub(p.lastSweep) > time.Minute {
+		for k, w := range p.walks {
+			if now.Sub(w.used) > *walkPageTTL {
+				delete(p.walks, k)
+			}
+		}
+		p.lastSweep = now
+	}
+	w, ok := p.walks[key]
+	if !ok {
+		w = &pagedWalk{}
+		p.walks[key] = w
+	}
+	w.used = now
+	p.Unlock()
+	w.Lock()
+	defer w.Unlock()
+
+	pdus, complete, err := walkPage(client, subtree, w.cursor, size)
+	if err != nil {
+		return nil, err
+	}
+	w.current = append(w.current, pdus...)
+	if complete {
+		w.previous, w.current, w.cursor = w.current, nil, ""
+		return w.previous, nil
+	}
+	if len(pdus) > 0 {
+		w.cursor = pdus[len(pdus)-1].Name
+	}
+	last := oidToList(strings.TrimPrefix(w.cursor, "."))
+	stitched := append([]gosnmp.SnmpPDU{}, w.current...)
+	for _, pdu := range w.previous {
+		if oidGreater(oidToList(strings.TrimPrefix(pdu.Name, ".")), last) {
+			stitched = append(stitched, pdu)
+		}
+	}
+	return stitched, nil
+}
+
+// walkPage walks a page of the subtree, or all of it if the client can't
+// walk in pages.
+func walkPage(client scraper.SNMPScraper, subtree, from string, size int) ([]gosnmp.SnmpPDU, bool, error) {
+	if w, ok := client.(pageWalker); ok {
+		return w.WalkPage(subtree, from, size)
+	}
+	pdus, err := client.WalkAll(subtree)
+	return pdus, true, err
+}
+
+// oidGreater reports whether the OID a sorts after b.
+func oidGreater(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return len(a) > len(b)
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// rollupBuilder accumulates the rows of a table and the sums of its columns
+// for a rollup.
+type rollupBuilder struct {
+	*config.Rollup
+	rows map[string]struct{}
+	sums map[string]float64
+}
+
+// newRollupBuilders returns the builders of the rollups of a module by the
+// name of the metrics of their tables.
+func newRollupBuilders(rollups []*config.Rollup, metrics []*config.Metric) ([]*rollupBuilder, map[string][]*rollupBuilder) {
+	builders := make([]*rollupBuilder, 0, len(rollups))
+	byMetric := map[string][]*rollupBuilder{}
+	for _, r := range rollups {
+		b := &rollupBuilder{Rollup: r, rows: map[string]struct{}{}, sums: make(map[string]float64, len(r.Sum))}
+		for _, name := range r.Sum {
+			b.sums[name] = 0
+		}
+		builders = append(builders, b)
+		for _, metric := range metrics {
+			if strings.HasPrefix(metric.Oid+".", r.Oid+".") {
+				byMetric[metric.Name] = append(byMetric[metric.Name], b)
+			}
+		}
+	}
+	return builders, byMetric
+}
+
+// add accumulates the row of the samples of a metric of the table, with the
+// sub-identifiers of its indexes.
+func (b *rollupBuilder) add(metric *config.Metric, indexOids []int, samples []prometheus.Metric) {
+	if len(indexOids) > 0 {
+		b.rows[listToOid(indexOids)] = struct{}{}
+	}
+	if _, ok := b.sums[metric.Name]; !ok {
+		return
+	}
+	for _, sample := range samples {
+		m := &dto.Metric{}
+		if err := sample.Write(m); err != nil {
+			continue
+		}
+		switch {
+		case m.Counter != nil:
+			b.sums[metric.Name] += m.Counter.GetValue()
+		case m.Gauge != nil:
+			b.sums[metric.Name] += m.Gauge.GetValue()
+		}
+	}
+}
+
+// metrics returns the rows of the table, and the sums of its columns in the
+// order of the rollup, with the extra labels.
+func (b *rollupBuilder) metrics(extraLabels prometheus.Labels) []prometheus.Metric {
+	tableRowsDesc := prometheus.NewDesc("snmp_table_rows", "Rows of a table, the distinct indexes of the metrics of its columns.",
+		[]string{"table"}, extraLabels)
+	tableColumnSumDesc := prometheus.NewDesc("snmp_table_column_sum", "Sum of a column of a table over its rows.",
+		[]string{"table", "column"}, extraLabels)
+	samples := make([]prometheus.Metric, 0, len(b.Sum)+1)
+	samples = append(samples, prometheus.MustNewConstMetric(tableRowsDesc, prometheus.GaugeValue, float64(len(b.rows)), b.Table))
+	for _, name := range b.Sum {
+		samples = append(samples, prometheus.MustNewConstMetric(tableColumnSumDesc, prometheus.GaugeValue, b.sums[name], b.Table, name))
+	}
+	return samples
+}
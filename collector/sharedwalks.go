@@ -0,0 +1,121 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// sharedWalks lets the modules of a scrape share their walks, so that a
+// subtree walked by several modules, or within a subtree another module
+// walks, is only walked once. Only walks with the same parameters are
+// shared, as modules may walk with another version, max_repetitions or
+// allow_nonincreasing_oids to work around agent bugs.
+type sharedWalks struct {
+	mu    sync.Mutex
+	walks map[sharedWalkKey]*sharedWalk
+}
+
+type sharedWalkKey struct {
+	root   string
+	params string
+}
+
+type sharedWalk struct {
+	done chan struct{}
+	pdus []gosnmp.SnmpPDU
+	err  error
+}
+
+func newSharedWalks() *sharedWalks {
+	return &sharedWalks{walks: map[sharedWalkKey]*sharedWalk{}}
+}
+
+// walkParams describes the parameters the client walks with which may change
+// what the agent returns.
+func walkParams(client scraper.SNMPScraper) string {
+	var params string
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		nonIncreasing, _ := g.AppOpts["c"].(bool)
+		params = fmt.Sprintf("%s %d %t", g.Version, g.MaxRepetitions, nonIncreasing)
+	})
+	return params
+}
+
+// walk returns the PDUs of the subtree, from a walk of it or of one of its
+// ancestors with the same parameters by another module if there is one,
+// waiting for it to finish. Failed walks are not shared, as the module which
+// walked may have had a shorter timeout.
+func (s *sharedWalks) walk(oid, params string, walkAll func(string) ([]gosnmp.SnmpPDU, error)) ([]gosnmp.SnmpPDU, error) {
+	root := strings.TrimPrefix(oid, ".")
+	s.mu.Lock()
+	for k, w := range s.walks {
+		if k.params != params || (root != k.root && !strings.HasPrefix(root, k.root+".")) {
+			continue
+		}
+		s.mu.Unlock()
+		<-w.done
+		if w.err != nil {
+			return walkAll(oid)
+		}
+		if root == k.root {
+			return w.pdus, nil
+		}
+		return pdusUnder(w.pdus, root), nil
+	}
+	w := &sharedWalk{done: make(chan struct{})}
+	s.walks[sharedWalkKey{root: root, params: params}] = w
+	s.mu.Unlock()
+	w.pdus, w.err = walkAll(oid)
+	close(w.done)
+	return w.pdus, w.err
+}
+
+// pdusUnder returns the PDUs of the subtree rooted at oid.
+func pdusUnder(pdus []gosnmp.SnmpPDU, oid string) []gosnmp.SnmpPDU {
+	var under []gosnmp.SnmpPDU
+	for _, pdu := range pdus {
+		name := strings.TrimPrefix(pdu.Name, ".")
+		if name == oid || strings.HasPrefix(name, oid+".") {
+			under = append(under, pdu)
+		}
+	}
+	return under
+}
+
+// scraper returns a scraper walking through the shared walks.
+func (s *sharedWalks) scraper(client scraper.SNMPScraper) scraper.SNMPScraper {
+	return sharedWalkScraper{SNMPScraper: client, walks: s}
+}
+
+type sharedWalkScraper struct {
+	scraper.SNMPScraper
+	walks *sharedWalks
+}
+
+func (s sharedWalkScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	return s.walks.walk(oid, walkParams(s.SNMPScraper), s.SNMPScraper.WalkAll)
+}
+
+// WalkPage walks a page of the subtree, which is not shared as each page
+// only covers part of it.
+func (s sharedWalkScraper) WalkPage(oid, from string, limit int) ([]gosnmp.SnmpPDU, bool, error) {
+	return walkPage(s.SNMPScraper, oid, from, limit)
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sourcePortPool hands out the ports of --snmp.source-port-range, so that
+// concurrent connections never share a port.
+type sourcePortPool struct {
+	ports chan int
+}
+
+var (
+	sourcePorts     *sourcePortPool
+	sourcePortsErr  error
+	sourcePortsOnce sync.Once
+)
+
+// parsePortRange parses a range such as 20000-20100.
+func parsePortRange(s string) (int, int, error) {
+	low, high, ok := strings.Cut(s, "-")
+	if !ok {
+		high = low
+	}
+	l, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid source port range %q: %w", s, err)
+	}
+	h, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid source port range %q: %w", s, err)
+	}
+	if l == 0 || l > h {
+		return 0, 0, fmt.Errorf("invalid source port range %q", s)
+	}
+	return int(l), int(h), nil
+}
+
+func newSourcePortPool(portRange, srcAddress string) (*sourcePortPool, error) {
+	if _, port, err := net.SplitHostPort(srcAddress); err == nil && port != "" && port != "0" {
+		return nil, fmt.Errorf("source address %q already has a port, can't use a source port range", srcAddress)
+	}
+	low, high, err := parsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+	p := &sourcePortPool{ports: make(chan int, high-low+1)}
+	for port := low; port <= high; port++ {
+		p.ports <- port
+	}
+	return p, nil
+}
+
+// getSourcePorts returns the pool for the configured port range.
+func getSourcePorts() (*sourcePortPool, error) {
+	sourcePortsOnce.Do(func() {
+		sourcePorts, sourcePortsErr = newSourcePortPool(*srcPortRange, *srcAddress)
+	})
+	return sourcePorts, sourcePortsErr
+}
+
+// CheckSourcePorts returns an error if --snmp.source-port-range is set but
+// can't be used, so that it's caught at startup rather than by each scrape.
+func CheckSourcePorts() error {
+	if *srcPortRange == "" {
+		return nil
+	}
+	_, err := getSourcePorts()
+	return err
+}
+
+// acquire waits for a free port.
+func (p *sourcePortPool) acquire(ctx context.Context) (int, error) {
+	select {
+	case port := <-p.ports:
+		return port, nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("waiting for a free source port: %w", ctx.Err())
+	}
+}
+
+func (p *sourcePortPool) release(port int) {
+	p.ports <- port
+}
+
+// withSourcePort sets the port of a source address, which may be empty or
+// lack a port.
+func withSourcePort(srcAddress string, port int) string {
+	host, _, err := net.SplitHostPort(srcAddress)
+	if err != nil {
+		host = strings.Trim(srcAddress, "[]")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// TypeError is returned when a module with strictness paranoid is returned
+// a varbind whose type contradicts the type of its metric.
+type TypeError struct {
+	Metric  string
+	Oid     string
+	Type    string
+	PduType gosnmp.Asn1BER
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("value of %s for metric %s of type %s has type %s", e.Oid, e.Metric, e.Type, e.PduType)
+}
+
+// decodePdu fits the PDU to the type of its metric as the strictness of the
+// module allows. It reports false if the PDU must be dropped.
+func decodePdu(strictness, metricType string, pdu *gosnmp.SnmpPDU) bool {
+	switch strictness {
+	case config.StrictnessStrict, config.StrictnessParanoid:
+		return pduTypeMatches(metricType, pdu.Type)
+	}
+	return coercePdu(metricType, pdu)
+}
+
+// checkPduTypes returns a TypeError for the first of the PDUs whose type
+// contradicts the type of the metric it matches.
+func checkPduTypes(module *config.Module, pdus []gosnmp.SnmpPDU) error {
+	metricTree := buildMetricTree(module.Metrics)
+	for _, pdu := range pdus {
+		head := metricTree
+		for _, o := range oidToList(pdu.Name[1:]) {
+			var ok bool
+			head, ok = head.children[o]
+			if !ok {
+				break
+			}
+			if head.metric != nil {
+				if !pduTypeMatches(head.metric.Type, pdu.Type) {
+					return &TypeError{Metric: head.metric.Name, Oid: pdu.Name[1:], Type: head.metric.Type, PduType: pdu.Type}
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// Subtrees of LLDP-MIB, CISCO-CDP-MIB and IF-MIB walked by topology modules.
+const (
+	lldpLocalSystemDataOid = "1.0.8802.1.1.2.1.3"
+	lldpRemEntryOid        = "1.0.8802.1.1.2.1.4.1.1"
+	cdpCacheEntryOid       = "1.3.6.1.4.1.9.9.23.1.2.1.1"
+	ifNameOid              = "1.3.6.1.2.1.31.1.1.1.1"
+	ifPhysAddressOid       = "1.3.6.1.2.1.2.2.1.6"
+	sysNameSubtreeOid      = "1.3.6.1.2.1.1.5"
+)
+
+// Subtypes of LLDP chassis and port IDs which are MAC or network addresses.
+const (
+	lldpChassisMAC     = 4
+	lldpChassisNetwork = 5
+	lldpPortMAC        = 3
+	lldpPortNetwork    = 4
+	lldpPortName       = 5
+)
+
+// topologyColumns are the values of the columns of a table by column and
+// index.
+type topologyColumns map[int]map[string]*gosnmp.SnmpPDU
+
+// tableColumns splits the PDUs of a table entry by column and index.
+func tableColumns(pdus []gosnmp.SnmpPDU, entry string) topologyColumns {
+	columns := topologyColumns{}
+	prefix := "." + entry + "."
+	for i := range pdus {
+		if !strings.HasPrefix(pdus[i].Name, prefix) {
+			continue
+		}
+		column, index, ok := strings.Cut(strings.TrimPrefix(pdus[i].Name, prefix), ".")
+		if !ok {
+			continue
+		}
+		c, err := strconv.Atoi(column)
+		if err != nil {
+			continue
+		}
+		if columns[c] == nil {
+			columns[c] = map[string]*gosnmp.SnmpPDU{}
+		}
+		columns[c][index] = &pdus[i]
+	}
+	return columns
+}
+
+func (t topologyColumns) get(column int, index string) *gosnmp.SnmpPDU {
+	return t[column][index]
+}
+
+func pduInt(pdu *gosnmp.SnmpPDU) int {
+	if pdu == nil {
+		return 0
+	}
+	return int(gosnmp.ToBigInt(pdu.Value).Int64())
+}
+
+func pduText(pdu *gosnmp.SnmpPDU, metrics Metrics) string {
+	if pdu == nil {
+		return ""
+	}
+	b, ok := pdu.Value.([]byte)
+	if !ok {
+		return pduValueAsString(pdu, "DisplayString", metrics)
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return pduValueAsString(pdu, "OctetString", metrics)
+		}
+	}
+	return string(b)
+}
+
+// lldpID renders a chassis or port ID by its subtype: MAC addresses as
+// PhysAddress48, network addresses as IP addresses, and other IDs as text
+// if printable.
+func lldpID(pdu *gosnmp.SnmpPDU, subtype, mac, network int, metrics Metrics) string {
+	if pdu == nil {
+		return ""
+	}
+	b, _ := pdu.Value.([]byte)
+	switch {
+	case subtype == mac && len(b) == 6:
+		return pduValueAsString(pdu, "PhysAddress48", metrics)
+	case subtype == network && len(b) == 5 && b[0] == 1, subtype == network && len(b) == 17 && b[0] == 2:
+		// Prefixed with the IANA address family.
+		return net.IP(b[1:]).String()
+	}
+	return pduText(pdu, metrics)
+}
+
+// topologyNeighbor is a neighbor of the target.
+type topologyNeighbor struct {
+	protocol, localChassis, localPort, remoteChassis, remotePort, remoteSystemName string
+}
+
+// topology walks the LLDP and CDP neighbor tables of the target, and returns
+// a neighbor for each of their rows. Local ports are named by their ifName,
+// found through their LLDP port ID, ifIndex or MAC address.
+func (c Collector) topology(client scraper.SNMPScraper) ([]topologyNeighbor, error) {
+	walked := map[string][]gosnmp.SnmpPDU{}
+	for _, oid := range []string{lldpLocalSystemDataOid, lldpRemEntryOid, cdpCacheEntryOid, ifNameOid, ifPhysAddressOid, sysNameSubtreeOid} {
+		pdus, err := client.WalkAll(oid)
+		if err != nil {
+			return nil, err
+		}
+		walked[oid] = pdus
+	}
+	ifNames, ifByMAC := map[string]string{}, map[string]string{}
+	for i, pdu := range walked[ifNameOid] {
+		ifNames[strings.TrimPrefix(pdu.Name, "."+ifNameOid+".")] = pduText(&walked[ifNameOid][i], c.metrics)
+	}
+	for i, pdu := range walked[ifPhysAddressOid] {
+		ifIndex := strings.TrimPrefix(pdu.Name, "."+ifPhysAddressOid+".")
+		if b, ok := pdu.Value.([]byte); ok && len(b) == 6 {
+			ifByMAC[pduValueAsString(&walked[ifPhysAddressOid][i], "PhysAddress48", c.metrics)] = ifIndex
+		}
+	}
+	sysName := ""
+	if pdus := walked[sysNameSubtreeOid]; len(pdus) > 0 {
+		sysName = pduText(&pdus[0], c.metrics)
+	}
+
+	local := tableColumns(walked[lldpLocalSystemDataOid], lldpLocalSystemDataOid)
+	localChassis := lldpID(local.get(2, "0"), pduInt(local.get(1, "0")), lldpChassisMAC, lldpChassisNetwork, c.metrics)
+	if localChassis == "" {
+		localChassis = sysName
+	}
+	// lldpLocPortTable is the 7th column of lldpLocalSystemData, and
+	// lldpLocPortEntry its first.
+	localPorts := tableColumns(walked[lldpLocalSystemDataOid], lldpLocalSystemDataOid+".7.1")
+	lldpLocalPort := func(port string) string {
+		subtype := pduInt(localPorts.get(2, port))
+		id := lldpID(localPorts.get(3, port), subtype, lldpPortMAC, lldpPortNetwork, c.metrics)
+		switch {
+		case subtype == lldpPortName && id != "":
+			return id
+		case subtype == lldpPortMAC && ifNames[ifByMAC[id]] != "":
+			return ifNames[ifByMAC[id]]
+		case ifNames[port] != "":
+			// The port number is the ifIndex on most agents.
+			return ifNames[port]
+		case pduText(localPorts.get(4, port), c.metrics) != "":
+			return pduText(localPorts.get(4, port), c.metrics)
+		}
+		return port
+	}
+
+	neighbors := []topologyNeighbor{}
+	remote := tableColumns(walked[lldpRemEntryOid], lldpRemEntryOid)
+	indexes := map[string]bool{}
+	for _, column := range []int{5, 7} {
+		for index := range remote[column] {
+			indexes[index] = true
+		}
+	}
+	for index := range indexes {
+		// Indexed by lldpRemTimeMark, lldpRemLocalPortNum and lldpRemIndex.
+		parts := strings.Split(index, ".")
+		if len(parts) != 3 {
+			continue
+		}
+		neighbors = append(neighbors, topologyNeighbor{
+			protocol:         "lldp",
+			localChassis:     localChassis,
+			localPort:        lldpLocalPort(parts[1]),
+			remoteChassis:    lldpID(remote.get(5, index), pduInt(remote.get(4, index)), lldpChassisMAC, lldpChassisNetwork, c.metrics),
+			remotePort:       lldpID(remote.get(7, index), pduInt(remote.get(6, index)), lldpPortMAC, lldpPortNetwork, c.metrics),
+			remoteSystemName: pduText(remote.get(9, index), c.metrics),
+		})
+	}
+
+	cdp := tableColumns(walked[cdpCacheEntryOid], cdpCacheEntryOid)
+	for index, deviceID := range cdp[6] {
+		// Indexed by cdpCacheIfIndex and cdpCacheDeviceIndex.
+		ifIndex, _, _ := strings.Cut(index, ".")
+		localPort := ifNames[ifIndex]
+		if localPort == "" {
+			localPort = ifIndex
+		}
+		name := pduText(deviceID, c.metrics)
+		neighbors = append(neighbors, topologyNeighbor{
+			protocol:         "cdp",
+			localChassis:     localChassis,
+			localPort:        localPort,
+			remoteChassis:    name,
+			remotePort:       pduText(cdp.get(7, index), c.metrics),
+			remoteSystemName: name,
+		})
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		a, b := neighbors[i], neighbors[j]
+		return a.protocol+"\xff"+a.localPort+"\xff"+a.remoteChassis+"\xff"+a.remotePort < b.protocol+"\xff"+b.localPort+"\xff"+b.remoteChassis+"\xff"+b.remotePort
+	})
+	return neighbors, nil
+}
+
+// topologyMetrics returns snmp_topology_neighbor_info for the neighbors,
+// once for neighbors reported several times, with the extra labels.
+func topologyMetrics(neighbors []topologyNeighbor, extraLabels prometheus.Labels) []prometheus.Metric {
+	topologyNeighborDesc := prometheus.NewDesc("snmp_topology_neighbor_info", "Neighbors of the target discovered with LLDP or CDP.",
+		[]string{"protocol", "local_chassis", "local_port", "remote_chassis", "remote_port", "remote_system_name"}, extraLabels)
+	samples := []prometheus.Metric{}
+	seen := map[topologyNeighbor]bool{}
+	for _, n := range neighbors {
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		samples = append(samples, prometheus.MustNewConstMetric(topologyNeighborDesc, prometheus.GaugeValue, 1,
+			n.protocol, n.localChassis, n.localPort, n.remoteChassis, n.remotePort, n.remoteSystemName))
+	}
+	return samples
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// uncoveredVarbinds counts the PDUs no metric of the module covers, such as
+// extra rows or columns agents return, by the walked subtree they are in, or
+// their OID for gets. The PDUs of lookups and sysUpTime are expected, and
+// modules exporting raw samples have none, as those are exported.
+func uncoveredVarbinds(module *config.Module, pdus []gosnmp.SnmpPDU) map[string]int {
+	if module.Raw {
+		return nil
+	}
+	expected := map[string]struct{}{sysUpTimeOid: {}}
+	for _, metric := range module.Metrics {
+		for _, lookup := range metric.Lookups {
+			expected[lookup.Oid] = struct{}{}
+			for _, fallback := range lookup.Fallback {
+				expected[fallback.Oid] = struct{}{}
+			}
+		}
+	}
+	metricTree := buildMetricTree(module.Metrics)
+	uncovered := map[string]int{}
+	for _, pdu := range pdus {
+		oid := strings.TrimPrefix(pdu.Name, ".")
+		if oidCovered(oid, expected) {
+			continue
+		}
+		covered := false
+		head := metricTree
+		for _, o := range oidToList(oid) {
+			var ok bool
+			head, ok = head.children[o]
+			if !ok {
+				break
+			}
+			if head.metric != nil {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			uncovered[walkedSubtree(module, oid)]++
+		}
+	}
+	return uncovered
+}
+
+// oidCovered reports whether the OID or one of its ancestors is in oids.
+func oidCovered(oid string, oids map[string]struct{}) bool {
+	for {
+		if _, ok := oids[oid]; ok {
+			return true
+		}
+		i := strings.LastIndexByte(oid, '.')
+		if i < 0 {
+			return false
+		}
+		oid = oid[:i]
+	}
+}
+
+// walkedSubtree returns the innermost walk of the module the OID is in, or
+// the OID if it was not walked.
+func walkedSubtree(module *config.Module, oid string) string {
+	subtree := oid
+	longest := -1
+	for _, walk := range module.Walk {
+		walk = strings.TrimPrefix(walk, ".")
+		if (oid == walk || strings.HasPrefix(oid, walk+".")) && len(walk) > longest {
+			subtree, longest = walk, len(walk)
+		}
+	}
+	return subtree
+}
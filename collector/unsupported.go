@@ -0,0 +1,135 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// How many scrapes in a row an OID must return nothing before it is skipped.
+const unsupportedOidMisses = 3
+
+type unsupportedOid struct {
+	misses    int
+	skipUntil time.Time
+	seen      time.Time
+}
+
+// unsupportedOids learns which OIDs of each view of a target return nothing,
+// such as noSuchObject or an empty subtree, so they can be skipped for a
+// while.
+type unsupportedOids struct {
+	sync.Mutex
+	targets   map[string]map[string]*unsupportedOid
+	lastSweep time.Time
+}
+
+var unsupported = newUnsupportedOids()
+
+func newUnsupportedOids() *unsupportedOids {
+	return &unsupportedOids{targets: map[string]map[string]*unsupportedOid{}}
+}
+
+// viewKey identifies the view of the target the client has. Agents return
+// different OIDs to different communities, users and contexts.
+func viewKey(snmp scraper.SNMPScraper, target string) string {
+	key := target
+	snmp.SetOptions(func(g *gosnmp.GoSNMP) {
+		user := g.Community
+		if usm, ok := g.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok && g.Version == gosnmp.Version3 {
+			user = usm.UserName
+		}
+		key = fmt.Sprintf("%s %s %q %q", target, g.Version, user, g.ContextName)
+	})
+	return key
+}
+
+// filter returns the OIDs which should be requested from the view, and how
+// many were skipped.
+func (u *unsupportedOids) filter(view string, oids []string, now time.Time) ([]string, int) {
+	u.Lock()
+	defer u.Unlock()
+	known := u.targets[view]
+	if len(known) == 0 {
+		return oids, 0
+	}
+	kept := make([]string, 0, len(oids))
+	for _, oid := range oids {
+		if o, ok := known[oid]; ok && now.Before(o.skipUntil) {
+			continue
+		}
+		kept = append(kept, oid)
+	}
+	return kept, len(oids) - len(kept)
+}
+
+// record notes whether the OID returned anything. Once it returned nothing
+// often enough, it is skipped for ttl before being tried again, counting its
+// misses from scratch. OIDs not recorded for ttl are forgotten.
+func (u *unsupportedOids) record(view, oid string, supported bool, now time.Time, ttl time.Duration) {
+	u.Lock()
+	defer u.Unlock()
+	if now.Sub(u.lastSweep) > time.Minute {
+		u.sweep(now, ttl)
+	}
+	known := u.targets[view]
+	if supported {
+		if known != nil {
+			delete(known, oid)
+			if len(known) == 0 {
+				delete(u.targets, view)
+			}
+		}
+		return
+	}
+	if known == nil {
+		known = map[string]*unsupportedOid{}
+		u.targets[view] = known
+	}
+	o, ok := known[oid]
+	if !ok {
+		o = &unsupportedOid{}
+		known[oid] = o
+	}
+	if !o.skipUntil.IsZero() && !now.Before(o.skipUntil) {
+		o.misses, o.skipUntil = 0, time.Time{}
+	}
+	o.seen = now
+	o.misses++
+	if o.misses >= unsupportedOidMisses {
+		o.skipUntil = now.Add(ttl)
+	}
+}
+
+// sweep forgets the OIDs which are not skipped and were not recorded for
+// ttl, such as those of targets no longer scraped.
+func (u *unsupportedOids) sweep(now time.Time, ttl time.Duration) {
+	for view, known := range u.targets {
+		for oid, o := range known {
+			if !now.Before(o.skipUntil) && now.Sub(o.seen) > ttl {
+				delete(known, oid)
+			}
+		}
+		if len(known) == 0 {
+			delete(u.targets, view)
+		}
+	}
+	u.lastSweep = now
+}
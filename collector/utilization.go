@@ -0,0 +1,163 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// How long the octet counters of a target are kept without being scraped.
+const octetsRetention = time.Hour
+
+type utilizationGroup struct {
+	labelnames  []string
+	labelvalues []string
+	octets      float64
+	speed       float64
+	hasOctets   bool
+	hasSpeed    bool
+}
+
+// utilizationBuilder pairs the octet counters and speeds of the links of a
+// utilization.
+type utilizationBuilder struct {
+	*config.Utilization
+	help   string
+	groups map[string]*utilizationGroup
+}
+
+// newUtilizationBuilders returns the utilization builders of a module by the
+// name of each of their source metrics.
+func newUtilizationBuilders(utilizations []*config.Utilization) map[string][]*utilizationBuilder {
+	builders := map[string][]*utilizationBuilder{}
+	for _, u := range utilizations {
+		b := &utilizationBuilder{Utilization: u, groups: map[string]*utilizationGroup{}}
+		builders[u.Octets] = append(builders[u.Octets], b)
+		builders[u.Speed] = append(builders[u.Speed], b)
+	}
+	return builders
+}
+
+// add pairs the samples of one of the source metrics by their labels.
+func (u *utilizationBuilder) add(metric *config.Metric, samples []prometheus.Metric) {
+	if metric.Name == u.Octets {
+		u.help = metric.Help
+	}
+	for _, sample := range samples {
+		m := &dto.Metric{}
+		if err := sample.Write(m); err != nil {
+			continue
+		}
+		var value float64
+		switch {
+		case m.Counter != nil:
+			value = m.Counter.GetValue()
+		case m.Gauge != nil:
+			value = m.Gauge.GetValue()
+		default:
+			continue
+		}
+		// Label pairs are sorted by name.
+		var labelnames, labelvalues []string
+		for _, l := range m.Label {
+			labelnames = append(labelnames, l.GetName())
+			labelvalues = append(labelvalues, l.GetValue())
+		}
+		key := strings.Join(labelnames, "\xff") + "\xfe" + strings.Join(labelvalues, "\xff")
+		group, ok := u.groups[key]
+		if !ok {
+			group = &utilizationGroup{labelnames: labelnames, labelvalues: labelvalues}
+			u.groups[key] = group
+		}
+		if metric.Name == u.Octets {
+			group.octets, group.hasOctets = value, true
+		}
+		if metric.Name == u.Speed {
+			group.speed, group.hasSpeed = value, true
+			if u.SpeedScale != 0 {
+				group.speed *= u.SpeedScale
+			}
+		}
+	}
+}
+
+// metrics returns the utilization of each link of the target, as the rate
+// of its octet counter since the previous scrape over its speed. Links
+// missing either metric, with a speed of 0, scraped for the first time or
+// whose counter went backwards are left out.
+func (u *utilizationBuilder) metrics(target string, now time.Time) []prometheus.Metric {
+	keys := make([]string, 0, len(u.groups))
+	for k := range u.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := []prometheus.Metric{}
+	for _, k := range keys {
+		group := u.groups[k]
+		if !group.hasOctets || !group.hasSpeed {
+			continue
+		}
+		previous, ok := lastOctets.swap(target+"\xfe"+u.Name+"\xfe"+k, group.octets, now)
+		elapsed := now.Sub(previous.time).Seconds()
+		if !ok || group.speed <= 0 || elapsed <= 0 || group.octets < previous.value {
+			continue
+		}
+		bits := (group.octets - previous.value) * 8 / elapsed
+		samples = append(samples, prometheus.MustNewConstMetric(prometheus.NewDesc(u.Name, u.help+" (utilization)", group.labelnames, nil),
+			prometheus.GaugeValue, bits/group.speed, group.labelvalues...))
+	}
+	return samples
+}
+
+type octetsSample struct {
+	value float64
+	time  time.Time
+}
+
+// octetCounters keeps the octet counters of the last scrape of each link of
+// each target, to derive their rates.
+type octetCounters struct {
+	sync.Mutex
+	series    map[string]octetsSample
+	lastSweep time.Time
+}
+
+var lastOctets = &octetCounters{series: map[string]octetsSample{}}
+
+// swap records the value of the counter, returning the previous one if
+// there was any. Counters of targets no longer scraped are forgotten after
+// octetsRetention.
+func (o *octetCounters) swap(key string, value float64, now time.Time) (octetsSample, bool) {
+	o.Lock()
+	defer o.Unlock()
+	if now.Sub(o.lastSweep) > time.Minute {
+		for k, s := range o.series {
+			if now.Sub(s.time) > octetsRetention {
+				delete(o.series, k)
+			}
+		}
+		o.lastSweep = now
+	}
+	previous, ok := o.series[key]
+	o.series[key] = octetsSample{value: value, time: now}
+	return previous, ok
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sysObjectID.0 of SNMPv2-MIB, whose enterprise number names the vendor of
+// the target.
+const sysObjectIDOid = "1.3.6.1.2.1.1.2.0"
+
+// The enterprises subtree, below which each IANA private enterprise number
+// is assigned.
+const enterprisesOid = "1.3.6.1.4.1."
+
+// builtinVendors names the vendors of common network equipment by their
+// IANA private enterprise number.
+var builtinVendors = map[int]string{
+	2:     "IBM",
+	9:     "Cisco",
+	11:    "HP",
+	43:    "3Com",
+	171:   "D-Link",
+	311:   "Microsoft",
+	318:   "APC",
+	674:   "Dell",
+	789:   "NetApp",
+	1588:  "Brocade",
+	1916:  "Extreme Networks",
+	1991:  "Foundry Networks",
+	2011:  "Huawei",
+	2021:  "UC Davis",
+	2620:  "Check Point",
+	2636:  "Juniper Networks",
+	3375:  "F5 Networks",
+	3902:  "ZTE",
+	4526:  "Netgear",
+	5624:  "Enterasys",
+	6027:  "Force10",
+	6486:  "Alcatel-Lucent",
+	6527:  "Nokia",
+	6574:  "Synology",
+	6876:  "VMware",
+	8072:  "Net-SNMP",
+	8741:  "SonicWall",
+	11863: "TP-Link",
+	12356: "Fortinet",
+	14179: "Cisco",
+	14823: "Aruba Networks",
+	14988: "MikroTik",
+	24681: "QNAP",
+	25053: "Ruckus Wireless",
+	25461: "Palo Alto Networks",
+	25506: "H3C",
+	30065: "Arista Networks",
+	41112: "Ubiquiti",
+}
+
+// enterpriseVendors are the built in vendors, plus those of the registry
+// loaded with LoadEnterpriseNumbers.
+var enterpriseVendors = builtinVendors
+
+// LoadEnterpriseNumbers loads the vendors of the IANA enterprise-numbers
+// registry, to name those which are not built in. The built in names take
+// precedence, so that the vendor of common targets is the same either way.
+// It must be called before scraping.
+func LoadEnterpriseNumbers(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	vendors, err := parseEnterpriseNumbers(f)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if len(vendors) == 0 {
+		return fmt.Errorf("no enterprise numbers in %s", path)
+	}
+	for pen, vendor := range builtinVendors {
+		vendors[pen] = vendor
+	}
+	enterpriseVendors = vendors
+	return nil
+}
+
+// parseEnterpriseNumbers reads the registry, in which each number is
+// followed by its organization, contact and email, indented by two more
+// spaces each.
+func parseEnterpriseNumbers(r io.Reader) (map[int]string, error) {
+	vendors := map[int]string{}
+	pen := -1
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if n, err := strconv.Atoi(line); err == nil {
+			pen = n
+			continue
+		}
+		if pen >= 0 && strings.HasPrefix(line, "  ") && !strings.HasPrefix(line, "   ") {
+			if organization := strings.TrimSpace(line); organization != "---none---" {
+				vendors[pen] = organization
+			}
+			pen = -1
+		}
+	}
+	return vendors, scanner.Err()
+}
+
+// vendorName returns the vendor of the enterprise number of a sysObjectID,
+// or an empty string if the number is unknown or the OID is not below
+// enterprises.
+func vendorName(sysObjectID string) string {
+	sub, ok := strings.CutPrefix(strings.TrimPrefix(sysObjectID, "."), enterprisesOid)
+	if !ok {
+		return ""
+	}
+	number, _, _ := strings.Cut(sub, ".")
+	pen, err := strconv.Atoi(number)
+	if err != nil {
+		return ""
+	}
+	return enterpriseVendors[pen]
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// watch runs the scrape, forwarding the samples it sends to ch. A scrape
+// still running --snmp.watchdog-grace after ctx is done, such as one wedged
+// in a read gosnmp never times out, is abandoned: watch returns, and the
+// samples the scrape sends until it ends are discarded, as ch is closed once
+// Collect returned.
+func (c Collector) watch(ctx context.Context, ch chan<- prometheus.Metric, scrape func(chan<- prometheus.Metric)) {
+	samples := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scrape(samples)
+	}()
+	ctxDone := ctx.Done()
+	var abandon <-chan time.Time
+	for {
+		select {
+		case m := <-samples:
+			ch <- m
+		case <-done:
+			return
+		case <-ctxDone:
+			ctxDone = nil
+			if *watchdogGrace > 0 {
+				timer := time.NewTimer(*watchdogGrace)
+				defer timer.Stop()
+				abandon = timer.C
+			}
+		case <-abandon:
+			c.metrics.SNMPScrapesAbandoned.Inc()
+			level.Error(c.logger).Log("msg", "Abandoning scrape still running after its deadline", "grace", *watchdogGrace, "err", ctx.Err(), "stacks", scrapeStacks())
+			go func() {
+				for {
+					select {
+					case <-samples:
+					case <-done:
+						return
+					}
+				}
+			}()
+			return
+		}
+	}
+}
+
+// scrapeStacks returns the stacks of the goroutines in the collector or in
+// gosnmp, those of the scrapes of other targets included.
+func scrapeStacks() string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var stacks []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "snmp_exporter/collector.") || strings.Contains(g, "gosnmp/gosnmp.") {
+			stacks = append(stacks, g)
+		}
+	}
+	return strings.Join(stacks, "\n\n")
+}
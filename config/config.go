@@ -14,63 +14,207 @@
 package config
 
 import (
+	"bytes"
+	"encoding/csv"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gosnmp/gosnmp"
 	"gopkg.in/yaml.v2"
 )
 
-func LoadFile(paths []string, expandEnvVars bool) (*Config, error) {
-	cfg := &Config{}
+// Files returns the files the config paths refer to, expanding globs and
+// directories.
+func Files(paths []string) ([]string, error) {
+	files := []string{}
+	loaded := map[string]struct{}{}
 	for _, p := range paths {
-		files, err := filepath.Glob(p)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			p = filepath.Join(p, "*.yml")
+		}
+		matches, err := filepath.Glob(p)
 		if err != nil {
 			return nil, err
 		}
-		for _, f := range files {
-			content, err := os.ReadFile(f)
-			if err != nil {
-				return nil, err
+		for _, f := range matches {
+			if _, ok := loaded[f]; ok {
+				// Matched by several patterns.
+				continue
 			}
-			err = yaml.UnmarshalStrict(content, cfg)
-			if err != nil {
-				return nil, err
+			loaded[f] = struct{}{}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// MappingFiles returns the mapping files of the lookups of all modules,
+// those of tenants included, sorted.
+func (c *Config) MappingFiles() []string {
+	modules := []map[string]*Module{c.Modules}
+	for _, tenant := range c.Tenants {
+		modules = append(modules, tenant.Modules)
+	}
+	mappings := map[string]struct{}{}
+	for _, m := range modules {
+		for _, module := range m {
+			for _, metric := range module.Metrics {
+				for _, lookup := range metric.Lookups {
+					if lookup.MappingFile != "" {
+						mappings[lookup.MappingFile] = struct{}{}
+					}
+				}
 			}
 		}
 	}
+	files := make([]string, 0, len(mappings))
+	for f := range mappings {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func LoadFile(paths []string, expandEnvVars bool) (*Config, error) {
+	cfg := &Config{}
+	// Where each auth, module and tenant was defined.
+	sources := map[string]string{}
+	files, err := Files(paths)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fileCfg := &Config{}
+		err = yaml.UnmarshalStrict(content, fileCfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		if err := mergeConfigMap(&cfg.Auths, fileCfg.Auths, "auth", f, sources); err != nil {
+			return nil, err
+		}
+		if err := mergeConfigMap(&cfg.Modules, fileCfg.Modules, "module", f, sources); err != nil {
+			return nil, err
+		}
+		if err := mergeConfigMap(&cfg.Tenants, fileCfg.Tenants, "tenant", f, sources); err != nil {
+			return nil, err
+		}
+		if err := mergeConfigMap(&cfg.TargetDefaults, fileCfg.TargetDefaults, "target_defaults", f, sources); err != nil {
+			return nil, err
+		}
+		if fileCfg.Version != 0 {
+			cfg.Version = fileCfg.Version
+		}
+	}
+
+	if err := parseTargetDefaults(cfg.TargetDefaults, cfg.Auths, cfg.Modules); err != nil {
+		return nil, err
+	}
+
+	// Catch broken mapping files before they are used.
+	for _, f := range cfg.MappingFiles() {
+		if _, err := LoadMapping(f); err != nil {
+			return nil, err
+		}
+	}
 
 	if expandEnvVars {
-		var err error
-		for i, auth := range cfg.Auths {
-			if auth.Username != "" {
-				cfg.Auths[i].Username, err = substituteEnvVariables(auth.Username)
-				if err != nil {
-					return nil, err
-				}
+		if err := expandAuthEnvVars(cfg.Auths); err != nil {
+			return nil, err
+		}
+		for _, tenant := range cfg.Tenants {
+			if err := expandAuthEnvVars(tenant.Auths); err != nil {
+				return nil, err
 			}
-			if auth.Password != "" {
-				password, err := substituteEnvVariables(string(auth.Password))
-				if err != nil {
-					return nil, err
-				}
-				cfg.Auths[i].Password.Set(password)
+		}
+	}
+	if err := decryptAuthSecrets(secretsKey, cfg.Auths); err != nil {
+		return nil, err
+	}
+	for _, tenant := range cfg.Tenants {
+		if err := decryptAuthSecrets(secretsKey, tenant.Auths); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// mergeConfigMap adds the entries of a config file to the loaded config,
+// rejecting any defined more than once.
+func mergeConfigMap[T any](dst *map[string]T, src map[string]T, kind, file string, sources map[string]string) error {
+	for name, v := range src {
+		key := kind + " " + name
+		if prev, ok := sources[key]; ok {
+			return fmt.Errorf("duplicate %s '%s' in %s and %s", kind, name, prev, file)
+		}
+		sources[key] = file
+		if *dst == nil {
+			*dst = map[string]T{}
+		}
+		(*dst)[name] = v
+	}
+	return nil
+}
+
+func expandAuthEnvVars(auths map[string]*Auth) error {
+	var err error
+	for i, auth := range auths {
+		if auth.Username != "" {
+			auths[i].Username, err = substituteEnvVariables(auth.Username)
+			if err != nil {
+				return err
+			}
+		}
+		if auth.Password != "" {
+			password, err := substituteEnvVariables(string(auth.Password))
+			if err != nil {
+				return err
+			}
+			auths[i].Password.Set(password)
+		}
+		if auth.PrivPassword != "" {
+			privPassword, err := substituteEnvVariables(string(auth.PrivPassword))
+			if err != nil {
+				return err
+			}
+			auths[i].PrivPassword.Set(privPassword)
+		}
+		if auth.Secondary != nil {
+			if err := expandAuthEnvVars(map[string]*Auth{i: auth.Secondary}); err != nil {
+				return err
+			}
+		}
+		for _, user := range auth.Users {
+			if user.Username, err = substituteEnvVariables(user.Username); err != nil {
+				return err
 			}
-			if auth.PrivPassword != "" {
-				privPassword, err := substituteEnvVariables(string(auth.PrivPassword))
+			for _, secret := range []*Secret{&user.Password, &user.PrivPassword} {
+				if *secret == "" {
+					continue
+				}
+				value, err := substituteEnvVariables(string(*secret))
 				if err != nil {
-					return nil, err
+					return err
 				}
-				cfg.Auths[i].PrivPassword.Set(privPassword)
+				secret.Set(value)
 			}
 		}
 	}
-
-	return cfg, nil
+	return nil
 }
 
 var (
@@ -102,7 +246,64 @@ var (
 type Config struct {
 	Auths   map[string]*Auth   `yaml:"auths,omitempty"`
 	Modules map[string]*Module `yaml:"modules,omitempty"`
+	Tenants map[string]*Tenant `yaml:"tenants,omitempty"`
 	Version int                `yaml:"version,omitempty"`
+	// Keyed by the CIDR of the targets they apply to.
+	TargetDefaults map[string]*TargetDefaults `yaml:"target_defaults,omitempty"`
+}
+
+// Tenant is an isolated namespace of auths and modules, along with the
+// targets it may scrape and how often.
+type Tenant struct {
+	Auths          map[string]*Auth   `yaml:"auths,omitempty"`
+	Modules        map[string]*Module `yaml:"modules,omitempty"`
+	AllowedTargets []string           `yaml:"allowed_targets,omitempty"`
+	// Scrapes per second, 0 means unlimited.
+	RateLimit      float64 `yaml:"rate_limit,omitempty"`
+	RateLimitBurst int     `yaml:"rate_limit_burst,omitempty"`
+	// Notified of scrape anomalies of the tenant's targets instead of the
+	// exporter's --webhook.url.
+	WebhookURL string `yaml:"webhook_url,omitempty"`
+	// Like those of the exporter, but applying to the tenant's requests
+	// and naming its auths and modules.
+	TargetDefaults map[string]*TargetDefaults `yaml:"target_defaults,omitempty"`
+
+	allowedNets []*net.IPNet
+}
+
+func (t *Tenant) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Tenant
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+	for _, cidr := range t.AllowedTargets {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid allowed target %q: %w", cidr, err)
+		}
+		t.allowedNets = append(t.allowedNets, ipNet)
+	}
+	if t.RateLimit < 0 {
+		return fmt.Errorf("rate_limit must not be negative, got %v", t.RateLimit)
+	}
+	if t.RateLimit > 0 && t.RateLimitBurst == 0 {
+		t.RateLimitBurst = 1
+	}
+	return parseTargetDefaults(t.TargetDefaults, t.Auths, t.Modules)
+}
+
+// AllowsIP reports whether the tenant may scrape the address. An empty
+// list of allowed targets allows everything.
+func (t *Tenant) AllowsIP(ip net.IP) bool {
+	if len(t.AllowedTargets) == 0 {
+		return true
+	}
+	for _, n := range t.allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 type WalkParams struct {
@@ -111,21 +312,251 @@ type WalkParams struct {
 	Timeout                 time.Duration `yaml:"timeout,omitempty"`
 	UseUnconnectedUDPSocket bool          `yaml:"use_unconnected_udp_socket,omitempty"`
 	AllowNonIncreasingOIDs  bool          `yaml:"allow_nonincreasing_oids,omitempty"`
+	TolerantDecode          bool          `yaml:"tolerant_decode,omitempty"`
+	// One of RetryPolicies, overriding Retries.
+	RetryPolicy string `yaml:"retry_policy,omitempty"`
+	// Largest response to request in bytes, such as the path MTU on networks
+	// dropping fragmented UDP. Caps MaxRepetitions.
+	MaxMessageSize int `yaml:"max_message_size,omitempty"`
+}
+
+// RetryPolicy is how hard requests are retried, so that modules can be
+// classed by their error budget rather than by tuning each knob.
+type RetryPolicy struct {
+	Retries int
+	// Whether the timeout doubles with each retry.
+	Backoff bool
+	// Minimum time between two requests to the target.
+	Pacing time.Duration
+}
+
+// RetryPolicies are the retry policies modules and scrapes can select.
+var RetryPolicies = map[string]RetryPolicy{
+	// Data which must not go missing, from agents which cope with load.
+	"aggressive": {Retries: 5},
+	// The default retries.
+	"standard": {Retries: 3},
+	// Agents with slow CPUs which drop requests when busy.
+	"gentle": {Retries: 2, Backoff: true, Pacing: 100 * time.Millisecond},
+}
+
+// CheckRetryPolicy returns an error if there is no retry policy of the name.
+func CheckRetryPolicy(name string) error {
+	if _, ok := RetryPolicies[name]; !ok && name != "" {
+		return fmt.Errorf("unknown retry policy '%s', must be aggressive, standard or gentle", name)
+	}
+	return nil
 }
 
 type Module struct {
 	// A list of OIDs.
-	Walk       []string        `yaml:"walk,omitempty"`
-	Get        []string        `yaml:"get,omitempty"`
-	Metrics    []*Metric       `yaml:"metrics"`
-	WalkParams WalkParams      `yaml:",inline"`
-	Filters    []DynamicFilter `yaml:"filters,omitempty"`
+	Walk         []string        `yaml:"walk,omitempty"`
+	Get          []string        `yaml:"get,omitempty"`
+	Metrics      []*Metric       `yaml:"metrics"`
+	WalkParams   WalkParams      `yaml:",inline"`
+	Filters      []DynamicFilter `yaml:"filters,omitempty"`
+	Aggregations []*Aggregation  `yaml:"aggregations,omitempty"`
+	Histograms   []*Histogram    `yaml:"histograms,omitempty"`
+	Utilizations []*Utilization  `yaml:"utilizations,omitempty"`
+	CounterPairs []*CounterPair  `yaml:"counter_pairs,omitempty"`
+	Rollups      []*Rollup       `yaml:"rollups,omitempty"`
+	// How often the module is expected to be scraped, for capacity planning.
+	ScrapeInterval time.Duration `yaml:"scrape_interval,omitempty"`
+	// Subtrees walked first, in this order. The other walks may be skipped
+	// when the scrape deadline approaches.
+	WalkPriority []string `yaml:"walk_priority,omitempty"`
+	// Walk parameters of subtrees, and the walks within them, overriding
+	// those of the module.
+	WalkOverrides map[string]*WalkOverride `yaml:"walk_overrides,omitempty"`
+	// What the module was generated from, if the generator recorded it.
+	Provenance *Provenance `yaml:"provenance,omitempty"`
+	// Export the numeric varbinds no metric matches as snmp_raw, to explore
+	// devices whose MIBs are not available.
+	Raw bool `yaml:"raw,omitempty"`
+	// Maximum number of distinct values of a label within a scrape. Samples
+	// with further values are dropped.
+	LabelLimits map[string]int `yaml:"label_limits,omitempty"`
+	// Walk the LLDP and CDP neighbor tables, and export the neighbors as
+	// snmp_topology_neighbor_info.
+	Topology bool `yaml:"topology,omitempty"`
+	// Walk the sensors of ENTITY-SENSOR-MIB, and export their values scaled
+	// and named by their unit, labelled with entPhysicalName.
+	EntitySensors bool `yaml:"entity_sensors,omitempty"`
+	// What happens to varbinds whose type contradicts the type of their
+	// metric: one of strict, lenient or paranoid. Defaults to lenient.
+	Strictness string `yaml:"strictness,omitempty"`
+}
+
+// Provenance records the MIBs a module was generated from, for audits.
+type Provenance struct {
+	GeneratorVersion string      `yaml:"generator_version,omitempty"`
+	GeneratedAt      string      `yaml:"generated_at"`
+	MIBs             []MIBSource `yaml:"mibs"`
+}
+
+// MIBSource is a MIB module and the file it was loaded from.
+type MIBSource struct {
+	Module string `yaml:"module"`
+	File   string `yaml:"file"`
+	SHA256 string `yaml:"sha256"`
 }
 
 func (c *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*c = DefaultModule
 	type plain Module
-	return unmarshal((*plain)(c))
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if err := CheckLabelLimits(c.LabelLimits); err != nil {
+		return err
+	}
+	for _, metric := range c.Metrics {
+		if err := CheckBounds(metric.Min, metric.Max, metric.OutOfRange); err != nil {
+			return fmt.Errorf("metric '%s': %w", metric.Name, err)
+		}
+		if err := CheckMACFormat(metric.MACFormat); err != nil {
+			return fmt.Errorf("metric '%s': %w", metric.Name, err)
+		}
+		for _, lookup := range metric.Lookups {
+			if err := CheckMACFormat(lookup.MACFormat); err != nil {
+				return fmt.Errorf("lookup '%s' of metric '%s': %w", lookup.Labelname, metric.Name, err)
+			}
+		}
+	}
+	for _, rollup := range c.Rollups {
+		if rollup.Oid == "" || strings.Trim(rollup.Oid, "0123456789.") != "" {
+			return fmt.Errorf("rollup of table '%s' requires a numeric oid, got '%s'", rollup.Table, rollup.Oid)
+		}
+	}
+	for oid, o := range c.WalkOverrides {
+		if strings.Trim(oid, "0123456789.") != "" {
+			return fmt.Errorf("walk override of '%s' must be a numeric OID", oid)
+		}
+		if o.Retries != nil && *o.Retries < 0 {
+			return fmt.Errorf("retries of walk override of '%s' must not be negative", oid)
+		}
+		if o.PageSize < 0 {
+			return fmt.Errorf("page_size of walk override of '%s' must not be negative", oid)
+		}
+		if o.Version != 0 && o.Version != 1 {
+			return fmt.Errorf("version of walk override of '%s' can only be 1, got %d", oid, o.Version)
+		}
+	}
+	if err := CheckMaxMessageSize(c.WalkParams.MaxMessageSize); err != nil {
+		return err
+	}
+	if err := CheckStrictness(c.Strictness, c.WalkParams.TolerantDecode); err != nil {
+		return err
+	}
+	return CheckRetryPolicy(c.WalkParams.RetryPolicy)
+}
+
+// Strictness levels of modules.
+const (
+	// Varbinds of the wrong type are dropped.
+	StrictnessStrict = "strict"
+	// Varbinds of the wrong type are converted to the type of their metric
+	// where that is safe, such as counters returned as Gauge32 or numbers
+	// returned as strings, and dropped if they can't be.
+	StrictnessLenient = "lenient"
+	// A varbind of the wrong type fails the scrape of the module.
+	StrictnessParanoid = "paranoid"
+)
+
+// CheckStrictness returns an error if the strictness is unknown, or if
+// tolerant_decode, which is the same as lenient, contradicts it.
+func CheckStrictness(strictness string, tolerantDecode bool) error {
+	switch strictness {
+	case "", StrictnessLenient:
+	case StrictnessStrict, StrictnessParanoid:
+		if tolerantDecode {
+			return fmt.Errorf("tolerant_decode can't be used with strictness %s", strictness)
+		}
+	default:
+		return fmt.Errorf("unknown strictness '%s', must be strict, lenient or paranoid", strictness)
+	}
+	return nil
+}
+
+// CheckMaxMessageSize returns an error if agents can't be asked for responses
+// of that size. 0 leaves the size unlimited.
+func CheckMaxMessageSize(size int) error {
+	if size != 0 && (size < 484 || size > 65535) {
+		return fmt.Errorf("max_message_size %d must be between 484 and 65535 bytes", size)
+	}
+	return nil
+}
+
+// WalkOverride overrides the walk parameters of a module for a subtree, such
+// as a large table needing a longer timeout than the scalars of the module.
+// Parameters left out are those of the module.
+type WalkOverride struct {
+	MaxRepetitions uint32        `yaml:"max_repetitions,omitempty"`
+	Retries        *int          `yaml:"retries,omitempty"`
+	Timeout        time.Duration `yaml:"timeout,omitempty"`
+	// Varbinds walked per scrape, resuming where the previous scrape of the
+	// target stopped, for tables too large to walk within one scrape.
+	PageSize int `yaml:"page_size,omitempty"`
+	// 1 to walk the subtree with SNMPv1 GetNext requests in a v2c module,
+	// for agents answering some subtrees only to v1.
+	Version int `yaml:"version,omitempty"`
+}
+
+// WalkOverride returns the override of the walk of the subtree, which is the
+// one of the innermost subtree containing it, or nil.
+func (c *Module) WalkOverride(subtree string) *WalkOverride {
+	var override *WalkOverride
+	longest := -1
+	for oid, o := range c.WalkOverrides {
+		if (subtree == oid || strings.HasPrefix(subtree, oid+".")) && len(oid) > longest {
+			override, longest = o, len(oid)
+		}
+	}
+	return override
+}
+
+// CheckLabelLimits returns an error if a label limit is not positive.
+func CheckLabelLimits(limits map[string]int) error {
+	for label, limit := range limits {
+		if limit < 1 {
+			return fmt.Errorf("label limit of '%s' must be at least 1, got %d", label, limit)
+		}
+	}
+	return nil
+}
+
+// CheckBounds returns an error if the bounds of the values of a metric are
+// inverted or what to do out of them is unknown.
+func CheckBounds(min, max *float64, outOfRange string) error {
+	if min != nil && max != nil && *min > *max {
+		return fmt.Errorf("min %v must not be greater than max %v", *min, *max)
+	}
+	switch outOfRange {
+	case "", "drop", "clamp":
+		return nil
+	}
+	return fmt.Errorf("out_of_range must be drop or clamp, got '%s'", outOfRange)
+}
+
+// Formats of MAC addresses, for labels to match those of other systems.
+const (
+	// 00:1B:21:3C:4D:5E, the default.
+	MACFormatColon = "colon"
+	// 00-1B-21-3C-4D-5E, as IEEE and Windows write them.
+	MACFormatDash = "dash"
+	// 001b.213c.4d5e, as Cisco writes them.
+	MACFormatDot = "dot"
+	// 001B213C4D5E.
+	MACFormatHex = "hex"
+)
+
+// CheckMACFormat returns an error if the format of MAC addresses is unknown.
+func CheckMACFormat(format string) error {
+	switch format {
+	case "", MACFormatColon, MACFormatDash, MACFormatDot, MACFormatHex:
+		return nil
+	}
+	return fmt.Errorf("unknown mac_format '%s', must be colon, dash, dot or hex", format)
 }
 
 // ConfigureSNMP sets the various version and auth settings.
@@ -215,6 +646,158 @@ type DynamicFilter struct {
 	Values  []string `yaml:"values,omitempty"`
 }
 
+// Aggregation collapses the series of a metric over some of its labels.
+type Aggregation struct {
+	Metric     string   `yaml:"metric"`
+	Name       string   `yaml:"name,omitempty"`
+	Op         string   `yaml:"op"`
+	Without    []string `yaml:"without"`
+	DropSource bool     `yaml:"drop_source,omitempty"`
+}
+
+func (c *Aggregation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Aggregation
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Metric == "" {
+		return fmt.Errorf("aggregation requires a metric")
+	}
+	switch c.Op {
+	case "sum", "min", "max":
+	default:
+		return fmt.Errorf("invalid aggregation op '%s' for metric '%s', must be sum, min or max", c.Op, c.Metric)
+	}
+	if len(c.Without) == 0 {
+		return fmt.Errorf("aggregation of metric '%s' requires labels to aggregate away", c.Metric)
+	}
+	if c.Name == "" {
+		c.Name = c.Metric + "_" + c.Op
+	}
+	return nil
+}
+
+// Rollup summarizes a table as snmp_table_rows, its number of rows, and
+// snmp_table_column_sum, the sum of some of its columns over the rows, such
+// as to watch tables growing out of bounds or for overview dashboards.
+type Rollup struct {
+	// The name of the table, the value of the table label.
+	Table string `yaml:"table"`
+	// The OID of the table. The rows are the distinct indexes of the
+	// metrics under it.
+	Oid string `yaml:"oid,omitempty"`
+	// Metrics of columns of the table whose values are summed.
+	Sum []string `yaml:"sum,omitempty"`
+	// Don't expose the series of the rows of the table.
+	DropSource bool `yaml:"drop_source,omitempty"`
+}
+
+func (c *Rollup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Rollup
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Table == "" {
+		return fmt.Errorf("rollup requires a table")
+	}
+	return nil
+}
+
+// Histogram folds a table with a row per bucket into a histogram, with the
+// bucket bounds of one column of the rows and the counts of another.
+type Histogram struct {
+	Name string `yaml:"name,omitempty"`
+	// Metrics with the count and the upper bound of each bucket.
+	Count string `yaml:"count"`
+	Bound string `yaml:"bound"`
+	// Label telling the buckets of a histogram apart, such as the bucket
+	// index of the table.
+	BucketLabel string `yaml:"bucket_label"`
+	// Multiplies the bounds, e.g. 0.001 for bounds in milliseconds.
+	BoundScale float64 `yaml:"bound_scale,omitempty"`
+	// The counts already include those of the buckets with lower bounds.
+	Cumulative bool `yaml:"cumulative,omitempty"`
+	// Metric with the sum of the observations, if the table has one.
+	Sum        string `yaml:"sum,omitempty"`
+	DropSource bool   `yaml:"drop_source,omitempty"`
+}
+
+func (c *Histogram) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Histogram
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Count == "" || c.Bound == "" {
+		return fmt.Errorf("histogram requires count and bound metrics")
+	}
+	if c.BucketLabel == "" {
+		return fmt.Errorf("histogram of metric '%s' requires a bucket_label", c.Count)
+	}
+	if c.BoundScale < 0 {
+		return fmt.Errorf("invalid bound_scale %v for histogram of metric '%s'", c.BoundScale, c.Count)
+	}
+	if c.Name == "" {
+		c.Name = c.Count + "_histogram"
+	}
+	return nil
+}
+
+// Utilization derives the utilization of links from the rate of an octet
+// counter since the previous scrape of the target and the speed of the
+// links in the same scrape, for backends without good rate functions.
+type Utilization struct {
+	Name   string `yaml:"name,omitempty"`
+	Octets string `yaml:"octets"`
+	Speed  string `yaml:"speed"`
+	// Multiplies the speed to get bits per second, e.g. 1000000 for the
+	// Mbit/s of ifHighSpeed.
+	SpeedScale float64 `yaml:"speed_scale,omitempty"`
+}
+
+func (c *Utilization) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Utilization
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Octets == "" || c.Speed == "" {
+		return fmt.Errorf("utilization requires octets and speed metrics")
+	}
+	if c.SpeedScale < 0 {
+		return fmt.Errorf("invalid speed_scale %v for utilization of metric '%s'", c.SpeedScale, c.Octets)
+	}
+	if c.Name == "" {
+		c.Name = c.Octets + "_utilization"
+	}
+	return nil
+}
+
+// CounterPair exports a 32-bit counter and its 64-bit replacement, such as
+// ifInOctets and ifHCInOctets, as one metric: with the 64-bit value for the
+// rows which have it, and the 32-bit value for the others, such as on agents
+// without 64-bit counters. Series of both metrics are paired by their labels.
+type CounterPair struct {
+	Name      string `yaml:"name,omitempty"`
+	Counter32 string `yaml:"counter32"`
+	Counter64 string `yaml:"counter64"`
+}
+
+func (c *CounterPair) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CounterPair
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Counter32 == "" || c.Counter64 == "" {
+		return fmt.Errorf("counter pair requires counter32 and counter64 metrics")
+	}
+	if c.Counter32 == c.Counter64 {
+		return fmt.Errorf("counter pair of metric '%s' requires two different metrics", c.Counter64)
+	}
+	if c.Name == "" {
+		c.Name = c.Counter64
+	}
+	return nil
+}
+
 type Metric struct {
 	Name           string                     `yaml:"name"`
 	Oid            string                     `yaml:"oid"`
@@ -226,6 +809,18 @@ type Metric struct {
 	EnumValues     map[int]string             `yaml:"enum_values,omitempty"`
 	Offset         float64                    `yaml:"offset,omitempty"`
 	Scale          float64                    `yaml:"scale,omitempty"`
+	ValueMap       ValueMap                   `yaml:"value_map,omitempty"`
+	// Bounds of the values, after scale and offset, such as to catch
+	// 4294967295 temperatures of glitching agents.
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
+	// Whether samples out of the bounds are dropped, the default, or
+	// clamped to them.
+	OutOfRange string `yaml:"out_of_range,omitempty"`
+	// How PhysAddress48 values are rendered, one of the MACFormat values.
+	MACFormat string `yaml:"mac_format,omitempty"`
+	// The type the MIB gives the object, when the generator overrode it.
+	OverriddenType string `yaml:"overridden_type,omitempty"`
 }
 
 type Index struct {
@@ -234,13 +829,147 @@ type Index struct {
 	FixedSize  int            `yaml:"fixed_size,omitempty"`
 	Implied    bool           `yaml:"implied,omitempty"`
 	EnumValues map[int]string `yaml:"enum_values,omitempty"`
+	// How OctetString and DisplayString indexes are rendered: hex, ascii,
+	// both, or auto to choose by content. By default OctetString indexes
+	// are rendered as hex and DisplayString ones as ascii.
+	Display string `yaml:"display,omitempty"`
+	// Labels derived from the index, added next to its own label.
+	Transforms []*IndexTransform `yaml:"transforms,omitempty"`
+	// How PhysAddress48 indexes are rendered, one of the MACFormat values.
+	MACFormat string `yaml:"mac_format,omitempty"`
+}
+
+func (c *Index) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Index
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if err := CheckIndexTransforms(c.Labelname, c.Type, c.Transforms); err != nil {
+		return err
+	}
+	if err := CheckMACFormat(c.MACFormat); err != nil {
+		return fmt.Errorf("index '%s': %w", c.Labelname, err)
+	}
+	switch c.Display {
+	case "":
+		return nil
+	case "hex", "ascii", "both", "auto":
+	default:
+		return fmt.Errorf("invalid display '%s' of index '%s', must be hex, ascii, both or auto", c.Display, c.Labelname)
+	}
+	if c.Type != "OctetString" && c.Type != "DisplayString" {
+		return fmt.Errorf("display of index '%s' requires type OctetString or DisplayString, not '%s'", c.Labelname, c.Type)
+	}
+	return nil
+}
+
+// IndexTransform derives a label from the value of an index, such as the
+// slot and port of an index encoding slot*256+port. The arithmetic applies to
+// integer indexes, shifting right, dividing and taking the modulo in that
+// order. Slice then keeps the characters of the value from its first element
+// up to its second one if any, which count from the end when negative.
+type IndexTransform struct {
+	Labelname  string `yaml:"labelname"`
+	ShiftRight uint   `yaml:"shift_right,omitempty"`
+	Divide     uint64 `yaml:"divide,omitempty"`
+	Modulo     uint64 `yaml:"modulo,omitempty"`
+	Slice      []int  `yaml:"slice,omitempty"`
+}
+
+func (c *IndexTransform) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain IndexTransform
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Labelname == "" {
+		return fmt.Errorf("index transform without labelname")
+	}
+	if len(c.Slice) > 2 {
+		return fmt.Errorf("slice of index transform '%s' must have a start and at most an end, got %v", c.Labelname, c.Slice)
+	}
+	if c.ShiftRight > 63 {
+		return fmt.Errorf("shift_right of index transform '%s' must be below 64, got %d", c.Labelname, c.ShiftRight)
+	}
+	return nil
+}
+
+// Arithmetic reports whether the transform shifts, divides or takes a modulo.
+func (c *IndexTransform) Arithmetic() bool {
+	return c.ShiftRight != 0 || c.Divide != 0 || c.Modulo != 0
+}
+
+// CheckIndexTransforms returns an error if transforms of the index of the
+// type do arithmetic on a non-integer index or reuse its label.
+func CheckIndexTransforms(labelname, indexType string, transforms []*IndexTransform) error {
+	for _, t := range transforms {
+		if t.Arithmetic() && !integerIndex(indexType) {
+			return fmt.Errorf("index transform '%s' of index '%s' needs an integer index for arithmetic, not '%s'", t.Labelname, labelname, indexType)
+		}
+		if t.Labelname == labelname {
+			return fmt.Errorf("index transform of index '%s' must not replace its label", labelname)
+		}
+	}
+	return nil
+}
+
+// integerIndex reports whether indexes of the type are a single integer
+// sub-identifier.
+func integerIndex(indexType string) bool {
+	switch indexType {
+	case "Integer32", "Integer", "gauge", "counter":
+		return true
+	}
+	return false
 }
 
 type Lookup struct {
-	Labels    []string `yaml:"labels"`
-	Labelname string   `yaml:"labelname"`
-	Oid       string   `yaml:"oid,omitempty"`
-	Type      string   `yaml:"type,omitempty"`
+	Labels      []string `yaml:"labels"`
+	Labelname   string   `yaml:"labelname"`
+	Oid         string   `yaml:"oid,omitempty"`
+	Type        string   `yaml:"type,omitempty"`
+	MappingFile string   `yaml:"mapping_file,omitempty"`
+	// Objects looked up in order while the value is empty.
+	Fallback []*LookupFallback `yaml:"fallback,omitempty"`
+	// How PhysAddress48 values are rendered, one of the MACFormat values.
+	MACFormat string `yaml:"mac_format,omitempty"`
+}
+
+// LookupFallback is an object looked up by the same labels as the lookup it
+// is a fallback of.
+type LookupFallback struct {
+	Oid  string `yaml:"oid"`
+	Type string `yaml:"type,omitempty"`
+}
+
+// LoadMapping reads the mapping file of a lookup. It is either a YAML map or
+// a CSV file, with the values of the lookup labels joined by commas as keys.
+// CSV rows hold the label values in the first columns and the value last.
+func LoadMapping(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mapping := map[string]string{}
+	if strings.HasSuffix(path, ".csv") {
+		r := csv.NewReader(bytes.NewReader(content))
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing mapping file %s: %w", path, err)
+		}
+		for _, record := range records {
+			if len(record) < 2 {
+				return nil, fmt.Errorf("error parsing mapping file %s: rows need a key and a value", path)
+			}
+			mapping[strings.Join(record[:len(record)-1], ",")] = record[len(record)-1]
+		}
+		return mapping, nil
+	}
+	if err := yaml.UnmarshalStrict(content, &mapping); err != nil {
+		return nil, fmt.Errorf("error parsing mapping file %s: %w", path, err)
+	}
+	return mapping, nil
 }
 
 // Secret is a string that must not be revealed on marshaling.
@@ -276,6 +1005,92 @@ type Auth struct {
 	PrivPassword  Secret `yaml:"priv_password,omitempty"`
 	ContextName   string `yaml:"context_name,omitempty"`
 	Version       int    `yaml:"version,omitempty"`
+	// Tried when the credentials above fail, to allow rotating them.
+	Secondary *Auth `yaml:"secondary,omitempty"`
+	// Proxy requests are tunneled through, for targets the exporter has no
+	// route to.
+	Proxy *Proxy `yaml:"proxy,omitempty"`
+	// Network interface or VRF device requests are sent from, for exporters
+	// on several management networks. Linux only.
+	Interface string `yaml:"interface,omitempty"`
+	// SNMPv3 users tried in turn, for fleets not provisioned consistently.
+	Users []*User `yaml:"users,omitempty"`
+}
+
+// User is one of the SNMPv3 users of an auth. Settings left out are taken
+// from the auth.
+type User struct {
+	Username      string `yaml:"username"`
+	SecurityLevel string `yaml:"security_level,omitempty"`
+	Password      Secret `yaml:"password,omitempty"`
+	AuthProtocol  string `yaml:"auth_protocol,omitempty"`
+	PrivProtocol  string `yaml:"priv_protocol,omitempty"`
+	PrivPassword  Secret `yaml:"priv_password,omitempty"`
+}
+
+// UserAuths returns the auth with the credentials of each of its users, in
+// order. They are built on each call, so that they have the current secrets
+// of the auth and users, e.g. once decrypted.
+func (c *Auth) UserAuths() []*Auth {
+	auths := make([]*Auth, 0, len(c.Users))
+	for _, u := range c.Users {
+		a := *c
+		a.Users = nil
+		a.Username = u.Username
+		if u.SecurityLevel != "" {
+			a.SecurityLevel = u.SecurityLevel
+		}
+		if u.Password != "" {
+			a.Password = u.Password
+		}
+		if u.AuthProtocol != "" {
+			a.AuthProtocol = u.AuthProtocol
+		}
+		if u.PrivProtocol != "" {
+			a.PrivProtocol = u.PrivProtocol
+		}
+		if u.PrivPassword != "" {
+			a.PrivPassword = u.PrivPassword
+		}
+		auths = append(auths, &a)
+	}
+	return auths
+}
+
+// Proxy is a SOCKS5 proxy supporting UDP ASSOCIATE, such as a jump host into
+// an isolated management network.
+type Proxy struct {
+	// socks5://host:port
+	URL      string `yaml:"url"`
+	Username string `yaml:"username,omitempty"`
+	Password Secret `yaml:"password,omitempty"`
+}
+
+func (c *Proxy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Proxy
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	_, err := c.Address()
+	return err
+}
+
+// Address returns the host and port of the proxy.
+func (c Proxy) Address() (string, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid proxy url %q: %w", c.URL, err)
+	}
+	if u.Scheme != "socks5" {
+		return "", fmt.Errorf("unsupported proxy scheme %q, only socks5 is supported", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return "", fmt.Errorf("proxy url %q must have a host and port", c.URL)
+	}
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return "", fmt.Errorf("proxy username and password can be at most 255 bytes")
+	}
+	return u.Host, nil
 }
 
 func (c *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -288,35 +1103,106 @@ func (c *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.Version < 1 || c.Version > 3 {
 		return fmt.Errorf("SNMP version must be 1, 2 or 3. Got: %d", c.Version)
 	}
-	if c.Version == 3 {
-		switch c.SecurityLevel {
-		case "authPriv":
-			if c.PrivPassword == "" {
-				return fmt.Errorf("priv password is missing, required for SNMPv3 with priv")
-			}
-			if c.PrivProtocol != "DES" && c.PrivProtocol != "AES" && c.PrivProtocol != "AES192" && c.PrivProtocol != "AES192C" && c.PrivProtocol != "AES256" && c.PrivProtocol != "AES256C" {
-				return fmt.Errorf("priv protocol must be DES or AES")
-			}
-			fallthrough
-		case "authNoPriv":
-			if c.Password == "" {
-				return fmt.Errorf("auth password is missing, required for SNMPv3 with auth")
-			}
-			if c.AuthProtocol != "MD5" && c.AuthProtocol != "SHA" && c.AuthProtocol != "SHA224" && c.AuthProtocol != "SHA256" && c.AuthProtocol != "SHA384" && c.AuthProtocol != "SHA512" {
-				return fmt.Errorf("auth protocol must be SHA or MD5")
-			}
-			fallthrough
-		case "noAuthNoPriv":
-			if c.Username == "" {
-				return fmt.Errorf("auth username is missing, required for SNMPv3")
+	if len(c.Users) > 0 {
+		if c.Version != 3 {
+			return fmt.Errorf("users require SNMP version 3")
+		}
+		if c.Username != "" {
+			return fmt.Errorf("username and users can't be used together")
+		}
+		if c.Secondary != nil {
+			return fmt.Errorf("users and secondary credentials can't be used together")
+		}
+		for _, a := range c.UserAuths() {
+			if err := a.checkVersion3(); err != nil {
+				return fmt.Errorf("user '%s': %w", a.Username, err)
 			}
-		default:
-			return fmt.Errorf("security level must be one of authPriv, authNoPriv or noAuthNoPriv")
+		}
+	} else if c.Version == 3 {
+		if err := c.checkVersion3(); err != nil {
+			return err
 		}
 	}
+	if c.Secondary != nil && c.Secondary.Secondary != nil {
+		return fmt.Errorf("secondary credentials can't have secondary credentials")
+	}
+	if c.Interface != "" && runtime.GOOS != "linux" {
+		return fmt.Errorf("interface is only supported on Linux")
+	}
+	if c.Interface != "" && c.Proxy != nil {
+		return fmt.Errorf("interface and proxy can't be used together")
+	}
+	// Secondary credentials reach the target the same way.
+	if c.Secondary != nil && c.Secondary.Proxy == nil && c.Secondary.Interface == "" {
+		c.Secondary.Proxy = c.Proxy
+		c.Secondary.Interface = c.Interface
+	}
 	return nil
 }
 
+// checkVersion3 validates the SNMPv3 settings of the auth.
+func (c *Auth) checkVersion3() error {
+	switch c.SecurityLevel {
+	case "authPriv":
+		if c.PrivPassword == "" {
+			return fmt.Errorf("priv password is missing, required for SNMPv3 with priv")
+		}
+		if c.PrivProtocol != "DES" && c.PrivProtocol != "AES" && c.PrivProtocol != "AES192" && c.PrivProtocol != "AES192C" && c.PrivProtocol != "AES256" && c.PrivProtocol != "AES256C" {
+			return fmt.Errorf("priv protocol must be DES or AES")
+		}
+		fallthrough
+	case "authNoPriv":
+		if c.Password == "" {
+			return fmt.Errorf("auth password is missing, required for SNMPv3 with auth")
+		}
+		if c.AuthProtocol != "MD5" && c.AuthProtocol != "SHA" && c.AuthProtocol != "SHA224" && c.AuthProtocol != "SHA256" && c.AuthProtocol != "SHA384" && c.AuthProtocol != "SHA512" {
+			return fmt.Errorf("auth protocol must be SHA or MD5")
+		}
+		fallthrough
+	case "noAuthNoPriv":
+		if c.Username == "" {
+			return fmt.Errorf("auth username is missing, required for SNMPv3")
+		}
+	default:
+		return fmt.Errorf("security level must be one of authPriv, authNoPriv or noAuthNoPriv")
+	}
+	return nil
+}
+
+// ValueMap replaces returned values of a metric, such as vendor sentinels
+// for "not supported". Targets are numbers, NaN, or drop to skip the sample.
+type ValueMap map[float64]string
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ValueMap) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ValueMap
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	for from, to := range *c {
+		if _, _, err := c.Map(from); err != nil {
+			return fmt.Errorf("invalid value_map target '%s' for %v, must be a number, NaN or drop", to, from)
+		}
+	}
+	return nil
+}
+
+// Map returns the replacement of value, and false if the sample is dropped.
+func (c ValueMap) Map(value float64) (float64, bool, error) {
+	to, ok := c[value]
+	if !ok {
+		return value, true, nil
+	}
+	if to == "drop" {
+		return 0, false, nil
+	}
+	mapped, err := strconv.ParseFloat(to, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return mapped, true, nil
+}
+
 type RegexpExtract struct {
 	Value string `yaml:"value"`
 	Regex Regexp `yaml:"regex"`
@@ -364,3 +1250,118 @@ func substituteEnvVariables(value string) (string, error) {
 	}
 	return result, nil
 }
+
+// MIBObject describes an object of a MIB index.
+type MIBObject struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help,omitempty"`
+	// The metric type the generator gives the object.
+	Type string `yaml:"type,omitempty"`
+}
+
+// MIBIndex maps OIDs to the objects of compiled MIBs, as written by the
+// generator's index command.
+type MIBIndex map[string]MIBObject
+
+var invalidMetricCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// LoadMIBIndex reads a MIB index file.
+func LoadMIBIndex(path string) (MIBIndex, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := MIBIndex{}
+	if err := yaml.UnmarshalStrict(content, &index); err != nil {
+		return nil, fmt.Errorf("error parsing MIB index %s: %w", path, err)
+	}
+	return index, nil
+}
+
+// ApplyMIBIndex names the metrics of the config which have no name, and adds the
+// description of their object to those with no help text, typically for
+// numeric OIDs added without the MIB being available to the generator.
+func (c *Config) ApplyMIBIndex(index MIBIndex) {
+	modules := []map[string]*Module{c.Modules}
+	for _, tenant := range c.Tenants {
+		modules = append(modules, tenant.Modules)
+	}
+	for _, m := range modules {
+		for _, module := range m {
+			for _, metric := range module.Metrics {
+				object, ok := index[metric.Oid]
+				if !ok {
+					continue
+				}
+				if metric.Name == "" {
+					metric.Name = invalidMetricCharRE.ReplaceAllString(object.Name, "_")
+				}
+				// The generator's help for objects without a description.
+				if metric.Help == "" || metric.Help == " - "+metric.Oid {
+					metric.Help = object.Help + " - " + metric.Oid
+				}
+			}
+		}
+	}
+}
+
+// Reasons a metric no longer matches the MIB index.
+const (
+	StaleUnresolved  = "unresolved"
+	StaleTypeChanged = "type_changed"
+)
+
+// StaleMetric is a metric of a module whose OID is not in the MIB index, or
+// whose type differs from that of its object.
+type StaleMetric struct {
+	Module string
+	Metric string
+	Oid    string
+	Reason string
+}
+
+// TypeKind groups metric types overrides commonly switch between, such as
+// OctetString and DisplayString, so that only real changes are reported.
+func TypeKind(t string) string {
+	switch t {
+	case "counter":
+		return "counter"
+	case "gauge", "Float", "Double", "EnumAsInfo", "EnumAsStateSet", "TimeStamp":
+		return "gauge"
+	}
+	return "string"
+}
+
+// metricMIBType returns the type the generator gave the metric before its
+// overrides, which is what the MIB index has.
+func metricMIBType(metric *Metric) string {
+	if metric.OverriddenType != "" {
+		return metric.OverriddenType
+	}
+	return metric.Type
+}
+
+// StaleMetrics checks the metrics of the modules against the MIB index, to
+// find modules generated from MIBs which changed since. Objects of MIBs the
+// index was not built from are reported as unresolved.
+func (c *Config) StaleMetrics(index MIBIndex) []StaleMetric {
+	stale := []StaleMetric{}
+	for name, module := range c.Modules {
+		for _, metric := range module.Metrics {
+			object, ok := index[metric.Oid]
+			switch {
+			case !ok:
+				stale = append(stale, StaleMetric{Module: name, Metric: metric.Name, Oid: metric.Oid, Reason: StaleUnresolved})
+			case object.Type != "" && TypeKind(object.Type) != TypeKind(metricMIBType(metric)):
+				stale = append(stale, StaleMetric{Module: name, Metric: metric.Name, Oid: metric.Oid, Reason: StaleTypeChanged})
+			}
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].Module != stale[j].Module {
+			return stale[i].Module < stale[j].Module
+		}
+		return stale[i].Oid < stale[j].Oid
+	})
+	return stale
+}
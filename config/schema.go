@@ -0,0 +1,150 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the schema returned by Schema. It is
+// bumped when options are removed or change meaning, so that files valid
+// under a version stay valid until the next one.
+const SchemaVersion = 1
+
+// Pattern of the durations time.ParseDuration accepts.
+const durationPattern = `^(0|-?([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+
+// schemaEnums are the values of the options taking one of a few, by type
+// and field name. Options only checked in some cases, such as the SNMPv3
+// security level, are left out.
+var schemaEnums = map[string][]string{
+	"Module.Strictness": {StrictnessStrict, StrictnessLenient, StrictnessParanoid},
+	"Index.Display":     {"hex", "ascii", "both", "auto"},
+	"Aggregation.Op":    {"sum", "min", "max"},
+	"Metric.OutOfRange": {"drop", "clamp"},
+	"Metric.MACFormat":  macFormats,
+	"Index.MACFormat":   macFormats,
+	"Lookup.MACFormat":  macFormats,
+}
+
+var macFormats = []string{MACFormatColon, MACFormatDash, MACFormatDot, MACFormatHex}
+
+func init() {
+	for name := range RetryPolicies {
+		schemaEnums["WalkParams.RetryPolicy"] = append(schemaEnums["WalkParams.RetryPolicy"], name)
+	}
+	sort.Strings(schemaEnums["WalkParams.RetryPolicy"])
+	schemaEnums["TargetDefaults.RetryPolicy"] = schemaEnums["WalkParams.RetryPolicy"]
+}
+
+type jsonSchema map[string]interface{}
+
+// Schema returns a JSON Schema of snmp.yml files, for editors and CI
+// systems to validate and complete them. It is derived from the
+// configuration types, so it can't express constraints checked on load
+// across options, such as the passwords SNMPv3 security levels need.
+func Schema() ([]byte, error) {
+	b := &schemaBuilder{defs: jsonSchema{}}
+	root := b.object(reflect.TypeOf(Config{}))
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["$id"] = fmt.Sprintf("urn:snmp-exporter:snmp.yml:v%d", SchemaVersion)
+	root["title"] = "snmp_exporter configuration"
+	root["$defs"] = b.defs
+	return json.MarshalIndent(root, "", "  ")
+}
+
+// schemaBuilder defines each struct once, so that recursive types such as
+// the secondary credentials of an Auth refer to their definition.
+type schemaBuilder struct {
+	defs jsonSchema
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) jsonSchema {
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		return jsonSchema{"type": "string", "pattern": durationPattern}
+	case reflect.TypeOf(Regexp{}):
+		// An empty regex matches everything.
+		return jsonSchema{"type": []string{"string", "null"}, "format": "regex"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice:
+		return jsonSchema{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		s := jsonSchema{"type": "object", "additionalProperties": b.schema(t.Elem())}
+		switch t.Key().Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s["propertyNames"] = jsonSchema{"pattern": "^-?[0-9]+$"}
+		}
+		return s
+	case reflect.Struct:
+		if _, ok := b.defs[t.Name()]; !ok {
+			// Defined before its fields, which may refer to it.
+			b.defs[t.Name()] = jsonSchema{}
+			b.defs[t.Name()] = b.object(t)
+		}
+		return jsonSchema{"$ref": "#/$defs/" + t.Name()}
+	}
+	return jsonSchema{}
+}
+
+// object returns the schema of a struct, which has no other options than
+// its fields as they are loaded with yaml.UnmarshalStrict.
+func (b *schemaBuilder) object(t reflect.Type) jsonSchema {
+	properties := jsonSchema{}
+	b.properties(t, properties)
+	return jsonSchema{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+func (b *schemaBuilder) properties(t reflect.Type, properties jsonSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(options, "inline") {
+			b.properties(f.Type, properties)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		s := b.schema(f.Type)
+		if enum := schemaEnums[t.Name()+"."+f.Name]; enum != nil {
+			s["enum"] = enum
+		}
+		properties[name] = s
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EncryptedPrefix marks secrets encrypted with EncryptSecret, which are
+// decrypted when the configuration is loaded.
+const EncryptedPrefix = "encrypted:"
+
+// The key of the encrypted secrets, loaded with LoadSecretsKey.
+var secretsKey []byte
+
+// LoadSecretsKey loads the key the encrypted secrets of the configuration
+// are decrypted with. It must be called before loading the configuration.
+func LoadSecretsKey(path string) error {
+	key, err := ReadSecretsKey(path)
+	if err != nil {
+		return err
+	}
+	secretsKey = key
+	return nil
+}
+
+// ReadSecretsKey reads a key file, holding 32 random bytes as base64 such
+// as written by `head -c 32 /dev/urandom | base64`.
+func ReadSecretsKey(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding secrets key %s: %w", path, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secrets key %s must be 32 bytes, got %d", path, len(key))
+	}
+	return key, nil
+}
+
+// EncryptSecret encrypts a secret with AES-256-GCM under the key, returning
+// it with EncryptedPrefix to be used as is in the configuration.
+func EncryptSecret(key []byte, secret string) (string, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret returns the secret, decrypted if it was encrypted.
+func decryptSecret(key []byte, s Secret) (Secret, error) {
+	encoded, ok := strings.CutPrefix(string(s), EncryptedPrefix)
+	if !ok {
+		return s, nil
+	}
+	if key == nil {
+		return "", fmt.Errorf("encrypted secret, but no --config.secrets-key-file given")
+	}
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("error decoding encrypted secret: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted secret is too short")
+	}
+	secret, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		// Most likely encrypted with another key.
+		return "", fmt.Errorf("error decrypting secret: %w", err)
+	}
+	return Secret(secret), nil
+}
+
+func secretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptAuthSecrets decrypts the encrypted secrets of the auths, those of
+// their secondary credentials, proxies and users included.
+func decryptAuthSecrets(key []byte, auths map[string]*Auth) error {
+	for name, auth := range auths {
+		secrets := []*Secret{&auth.Community, &auth.Password, &auth.PrivPassword}
+		if auth.Proxy != nil {
+			secrets = append(secrets, &auth.Proxy.Password)
+		}
+		for _, user := range auth.Users {
+			secrets = append(secrets, &user.Password, &user.PrivPassword)
+		}
+		for _, secret := range secrets {
+			value, err := decryptSecret(key, *secret)
+			if err != nil {
+				return fmt.Errorf("auth '%s': %w", name, err)
+			}
+			*secret = value
+		}
+		if auth.Secondary != nil {
+			if err := decryptAuthSecrets(key, map[string]*Auth{name + " secondary": auth.Secondary}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
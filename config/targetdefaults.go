@@ -0,0 +1,107 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TargetDefaults are the parameters of scrapes of the targets of a subnet
+// which don't give them, so that scrape configs can give only the target
+// and per-site policy lives in the exporter.
+type TargetDefaults struct {
+	Auth    string   `yaml:"auth,omitempty"`
+	Modules []string `yaml:"modules,omitempty"`
+	// The scrape timeout when Prometheus doesn't send one.
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	RetryPolicy string        `yaml:"retry_policy,omitempty"`
+
+	// Parsed from the key of the defaults when loaded.
+	subnet *net.IPNet
+}
+
+func (d *TargetDefaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TargetDefaults
+	if err := unmarshal((*plain)(d)); err != nil {
+		return err
+	}
+	if d.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %s", d.Timeout)
+	}
+	return CheckRetryPolicy(d.RetryPolicy)
+}
+
+// parseTargetDefaults parses the subnets keying the defaults, and returns an
+// error if one isn't a CIDR, or if the defaults name an auth or module not
+// among those they can be used with.
+func parseTargetDefaults(defaults map[string]*TargetDefaults, auths map[string]*Auth, modules map[string]*Module) error {
+	for cidr, d := range defaults {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid target_defaults subnet %q: %w", cidr, err)
+		}
+		d.subnet = subnet
+		if _, ok := auths[d.Auth]; d.Auth != "" && !ok {
+			return fmt.Errorf("unknown auth %q in target_defaults of %s", d.Auth, cidr)
+		}
+		for _, names := range d.Modules {
+			for _, name := range strings.Split(names, ",") {
+				if _, ok := modules[name]; name != "" && !ok {
+					return fmt.Errorf("unknown module %q in target_defaults of %s", name, cidr)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// TargetDefaultsFor returns the defaults of the subnets holding the
+// address, those of more specific subnets overriding the others, or nil if
+// no subnet holds it. The defaults must have been loaded.
+func TargetDefaultsFor(defaults map[string]*TargetDefaults, ip net.IP) *TargetDefaults {
+	matches := []*TargetDefaults{}
+	for _, d := range defaults {
+		if d.subnet != nil && d.subnet.Contains(ip) {
+			matches = append(matches, d)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, _ := matches[i].subnet.Mask.Size()
+		b, _ := matches[j].subnet.Mask.Size()
+		return a < b
+	})
+	merged := &TargetDefaults{}
+	for _, m := range matches {
+		if m.Auth != "" {
+			merged.Auth = m.Auth
+		}
+		if len(m.Modules) > 0 {
+			merged.Modules = m.Modules
+		}
+		if m.Timeout > 0 {
+			merged.Timeout = m.Timeout
+		}
+		if m.RetryPolicy != "" {
+			merged.RetryPolicy = m.RetryPolicy
+		}
+	}
+	return merged
+}
@@ -14,10 +14,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/config"
 )
 
 func TestHideConfigSecrets(t *testing.T) {
@@ -125,3 +139,692 @@ func TestEnvSecretsNotSpecified(t *testing.T) {
 		t.Errorf("Error loading config %v: %v", "testdata/snmp-auth-v2nocreds.yml", err)
 	}
 }
+
+func TestEncryptedSecrets(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, otherKeyFile := filepath.Join(dir, "snmp.key"), filepath.Join(dir, "other.key")
+	for file, key := range map[string]string{keyFile: strings.Repeat("k", 32), otherKeyFile: strings.Repeat("o", 32)} {
+		if err := os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString([]byte(key))+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldKey := *secretsKey
+	t.Cleanup(func() { *secretsKey = oldKey })
+	*secretsKey = keyFile
+	encrypt := func(secret string) string {
+		var out bytes.Buffer
+		if err := runEncrypt(strings.NewReader(secret+"\n"), &out); err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out.String())
+	}
+	community, password := encrypt("mysecret"), encrypt("myauthpass")
+	if !strings.HasPrefix(community, config.EncryptedPrefix) || strings.Contains(community, "mysecret") || community == encrypt("mysecret") {
+		t.Fatalf("Secret not encrypted with a random nonce: %s", community)
+	}
+	cfgFile := filepath.Join(dir, "snmp.yml")
+	content := fmt.Sprintf(`auths:
+  v2:
+    community: %s
+  v3:
+    version: 3
+    security_level: authNoPriv
+    auth_protocol: SHA
+    users:
+      - username: a
+        password: %s
+      - username: b
+        password: plainpass
+`, community, password)
+	if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.LoadFile([]string{cfgFile}, false); err == nil || !strings.Contains(err.Error(), "no --config.secrets-key-file given") {
+		t.Errorf("Expected an error without the key, got %v", err)
+	}
+	if err := config.LoadSecretsKey(otherKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.LoadFile([]string{cfgFile}, false); err == nil || !strings.Contains(err.Error(), "error decrypting secret") {
+		t.Errorf("Expected an error with the wrong key, got %v", err)
+	}
+	if err := config.LoadSecretsKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFile([]string{cfgFile}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Auths["v2"].Community != "mysecret" {
+		t.Errorf("Community not decrypted: %s", cfg.Auths["v2"].Community)
+	}
+	users := cfg.Auths["v3"].UserAuths()
+	if len(users) != 2 || users[0].Password != "myauthpass" || users[1].Password != "plainpass" {
+		t.Errorf("User passwords not decrypted: %+v", users)
+	}
+
+	if err := os.WriteFile(otherKeyFile, []byte("c2hvcnQ="), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadSecretsKey(otherKeyFile); err == nil || !strings.Contains(err.Error(), "must be 32 bytes") {
+		t.Errorf("Expected an error for a short key, got %v", err)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	sc := &SafeConfig{}
+	err := sc.ReloadConfig([]string{"testdata/snmp-tenants.yml"}, false)
+	if err != nil {
+		t.Fatalf("Error loading config %v: %v", "testdata/snmp-tenants.yml", err)
+	}
+	tenant, ok := sc.C.Tenants["team_a"]
+	if !ok {
+		t.Fatal("tenant team_a not loaded")
+	}
+	if _, ok := tenant.Modules["team_a_module"]; !ok {
+		t.Error("tenant module not loaded")
+	}
+	if _, ok := sc.C.Modules["team_a_module"]; ok {
+		t.Error("tenant module leaked into the global modules")
+	}
+	c, err := yaml.Marshal(sc.C)
+	if err != nil {
+		t.Fatalf("Error marshaling config: %v", err)
+	}
+	if strings.Contains(string(c), "team_a_secret") {
+		t.Fatal("config's String method reveals tenant credentials.")
+	}
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.yml":  "auths:\n  public_v2:\n    community: public\n",
+		"if_mib.yml": "modules:\n  if_mib:\n    walk: [1.3.6.1.2.1.2]\n",
+		"ucd.yml":    "modules:\n  ucd:\n    walk: [1.3.6.1.4.1.2021]\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, paths := range [][]string{{dir}, {filepath.Join(dir, "*.yml")}, {filepath.Join(dir, "*.yml"), filepath.Join(dir, "ucd.yml")}} {
+		sc := &SafeConfig{}
+		if err := sc.ReloadConfig(paths, false); err != nil {
+			t.Fatalf("Error loading configs %v: %v", paths, err)
+		}
+		if len(sc.C.Auths) != 1 || len(sc.C.Modules) != 2 {
+			t.Errorf("%v: got auths %v and modules %v", paths, sc.C.Auths, sc.C.Modules)
+		}
+	}
+
+	// A module defined in two files is rejected.
+	if err := os.WriteFile(filepath.Join(dir, "other.yml"), []byte(files["ucd.yml"]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sc := &SafeConfig{}
+	err := sc.ReloadConfig([]string{dir}, false)
+	if err == nil || !strings.Contains(err.Error(), "duplicate module 'ucd'") {
+		t.Errorf("Expected duplicate module error, got %v", err)
+	}
+}
+
+func TestLoadConfigTargetDefaults(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "snmp.yml")
+	names := "auths:\n  site_v3:\n    version: 2\nmodules:\n  if_mib:\n    walk: [1.3.6.1.2.1.2]\n  ucd:\n    walk: [1.3.6.1.4.1.2021]\n"
+	content := names + "target_defaults:\n  10.0.0.0/8:\n    auth: site_v3\n  10.1.0.0/16:\n    modules: [if_mib, ucd]\n    timeout: 20s\n    retry_policy: gentle\n" +
+		"tenants:\n  team_a:\n    auths:\n      team_a_v2:\n        version: 2\n    target_defaults:\n      10.0.0.0/8:\n        auth: team_a_v2\n"
+	if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sc := &SafeConfig{}
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err != nil {
+		t.Fatalf("Error loading config with target_defaults: %v", err)
+	}
+	for _, c := range []struct {
+		ip       string
+		expected *config.TargetDefaults
+	}{
+		{"10.2.0.1", &config.TargetDefaults{Auth: "site_v3"}},
+		{"10.1.0.1", &config.TargetDefaults{Auth: "site_v3", Modules: []string{"if_mib", "ucd"}, Timeout: 20 * time.Second, RetryPolicy: "gentle"}},
+		{"192.0.2.1", nil},
+	} {
+		if got := config.TargetDefaultsFor(sc.C.TargetDefaults, net.ParseIP(c.ip)); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.ip, c.expected, got)
+		}
+	}
+	// Tenants have their own defaults, naming their own auths.
+	if got, expected := config.TargetDefaultsFor(sc.C.Tenants["team_a"].TargetDefaults, net.ParseIP("10.1.0.1")), (&config.TargetDefaults{Auth: "team_a_v2"}); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the tenant's defaults %+v, got %+v", expected, got)
+	}
+
+	for content, msg := range map[string]string{
+		"target_defaults:\n  10.0.0.0:\n    auth: site_v3\n":               "invalid target_defaults subnet",
+		"target_defaults:\n  10.0.0.0/8:\n    retry_policy: never\n":       "unknown retry policy",
+		"target_defaults:\n  10.0.0.0/8:\n    auth: other_v3\n":            "unknown auth \"other_v3\"",
+		"target_defaults:\n  10.0.0.0/8:\n    modules: [if_mib, system]\n": "unknown module \"system\"",
+		// A tenant's defaults can't name the exporter's auths.
+		"tenants:\n  team_a:\n    target_defaults:\n      10.0.0.0/8:\n        auth: site_v3\n": "unknown auth \"site_v3\"",
+	} {
+		if err := os.WriteFile(cfgFile, []byte(names+content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := sc.ReloadConfig([]string{cfgFile}, false); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected error %q, got %v", msg, err)
+		}
+	}
+}
+
+func TestLoadConfigMappingFile(t *testing.T) {
+	dir := t.TempDir()
+	mapping := filepath.Join(dir, "circuits.csv")
+	module := "modules:\n  if_mib:\n    walk: [1.3.6.1.2.1.2]\n    metrics:\n    - name: ifInOctets\n      oid: 1.3.6.1.2.1.2.2.1.10\n      type: counter\n      indexes:\n      - labelname: ifIndex\n        type: gauge\n      lookups:\n      - labels: [ifIndex]\n        labelname: circuit\n        mapping_file: " + mapping + "\n"
+	cfgFile := filepath.Join(dir, "snmp.yml")
+	if err := os.WriteFile(cfgFile, []byte(module), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := &SafeConfig{}
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err == nil {
+		t.Error("Expected an error for a missing mapping file")
+	}
+
+	if err := os.WriteFile(mapping, []byte("1,CKT-0001\n2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := sc.ReloadConfig([]string{cfgFile}, false)
+	if err == nil || !strings.Contains(err.Error(), "rows need a key and a value") {
+		t.Errorf("Expected mapping parse error, got %v", err)
+	}
+
+	if err := os.WriteFile(mapping, []byte("1,CKT-0001\n2,CKT-0002\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err != nil {
+		t.Errorf("Error loading config with mapping file: %v", err)
+	}
+}
+
+func TestLoadConfigValueMap(t *testing.T) {
+	dir := t.TempDir()
+	for target, valid := range map[string]bool{"NaN": true, "drop": true, "-1.5": true, "n/a": false} {
+		cfgFile := filepath.Join(dir, "snmp.yml")
+		module := "modules:\n  m:\n    metrics:\n    - name: temp\n      oid: 1.3.6.1.4.1.1.1\n      type: gauge\n      value_map:\n        65535: " + target + "\n"
+		if err := os.WriteFile(cfgFile, []byte(module), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sc := &SafeConfig{}
+		err := sc.ReloadConfig([]string{cfgFile}, false)
+		if valid && err != nil {
+			t.Errorf("Error loading value_map target %q: %v", target, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected error for value_map target %q", target)
+		}
+	}
+}
+
+func TestLoadConfigIndexDisplay(t *testing.T) {
+	dir := t.TempDir()
+	for index, valid := range map[string]string{
+		"type: OctetString\n        display: auto":   "",
+		"type: DisplayString\n        display: both": "",
+		"type: OctetString\n        display: base64": "invalid display 'base64'",
+		"type: gauge\n        display: hex":          "requires type OctetString or DisplayString",
+	} {
+		cfgFile := filepath.Join(dir, "snmp.yml")
+		module := "modules:\n  m:\n    metrics:\n    - name: engine\n      oid: 1.3.6.1.4.1.1.1\n      type: gauge\n      indexes:\n      - labelname: engineID\n        " + index + "\n"
+		if err := os.WriteFile(cfgFile, []byte(module), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sc := &SafeConfig{}
+		err := sc.ReloadConfig([]string{cfgFile}, false)
+		if valid == "" && err != nil {
+			t.Errorf("Error loading index %q: %v", index, err)
+		}
+		if valid != "" && (err == nil || !strings.Contains(err.Error(), valid)) {
+			t.Errorf("Expected error %q for index %q, got %v", valid, index, err)
+		}
+	}
+}
+
+func TestLoadConfigIndexTransforms(t *testing.T) {
+	dir := t.TempDir()
+	for index, valid := range map[string]string{
+		"type: gauge\n        transforms:\n        - labelname: slot\n          divide: 256":           "",
+		"type: DisplayString\n        transforms:\n        - labelname: site\n          slice: [0, 3]": "",
+		"type: Integer32\n        transforms:\n        - labelname: slot\n          shift_right: 8":    "",
+		"type: Integer\n        transforms:\n        - labelname: slot\n          modulo: 16":          "",
+		"type: DisplayString\n        transforms:\n        - labelname: slot\n          modulo: 16":    "needs an integer index",
+		"type: gauge\n        transforms:\n        - labelname: port\n          slice: [0, 1, 2]":      "at most an end",
+		"type: gauge\n        transforms:\n        - labelname: ifIndex\n          divide: 2":          "must not replace its label",
+		"type: gauge\n        transforms:\n        - divide: 2":                                        "without labelname",
+	} {
+		cfgFile := filepath.Join(dir, "snmp.yml")
+		module := "modules:\n  m:\n    metrics:\n    - name: port\n      oid: 1.3.6.1.4.1.1.1\n      type: gauge\n      indexes:\n      - labelname: ifIndex\n        " + index + "\n"
+		if err := os.WriteFile(cfgFile, []byte(module), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sc := &SafeConfig{}
+		err := sc.ReloadConfig([]string{cfgFile}, false)
+		if valid == "" && err != nil {
+			t.Errorf("Error loading index %q: %v", index, err)
+		}
+		if valid != "" && (err == nil || !strings.Contains(err.Error(), valid)) {
+			t.Errorf("Expected error %q for index %q, got %v", valid, index, err)
+		}
+	}
+}
+
+func TestLoadConfigMIBIndex(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "snmp.yml")
+	module := "modules:\n  m:\n    walk: [1.3.6.1.4.1.9999]\n    metrics:\n    - oid: 1.3.6.1.4.1.9999.1\n      type: gauge\n    - name: vendorFans\n      oid: 1.3.6.1.4.1.9999.2\n      type: gauge\n      help: ' - 1.3.6.1.4.1.9999.2'\n    - name: vendorPsus\n      oid: 1.3.6.1.4.1.9999.3\n      type: gauge\n      help: Power supplies - 1.3.6.1.4.1.9999.3\n"
+	if err := os.WriteFile(cfgFile, []byte(module), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	index := filepath.Join(dir, "mib-index.yml")
+	content := "1.3.6.1.4.1.9999.1:\n  name: vendor-temp\n  help: Chassis temperature\n1.3.6.1.4.1.9999.2:\n  name: vendorFans\n  help: Number of fans\n1.3.6.1.4.1.9999.3:\n  name: vendorPsus\n  help: Number of PSUs\n"
+	if err := os.WriteFile(index, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := &SafeConfig{MIBIndex: index}
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err != nil {
+		t.Fatalf("Error loading config with MIB index: %v", err)
+	}
+	expected := [][2]string{
+		{"vendor_temp", "Chassis temperature - 1.3.6.1.4.1.9999.1"},
+		{"vendorFans", "Number of fans - 1.3.6.1.4.1.9999.2"},
+		{"vendorPsus", "Power supplies - 1.3.6.1.4.1.9999.3"},
+	}
+	for i, metric := range sc.C.Modules["m"].Metrics {
+		if got := [2]string{metric.Name, metric.Help}; got != expected[i] {
+			t.Errorf("Metric %d: expected %v, got %v", i, expected[i], got)
+		}
+	}
+
+	sc.MIBIndex = filepath.Join(dir, "missing.yml")
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err == nil {
+		t.Error("Expected an error for a missing MIB index")
+	}
+}
+
+func TestLoadConfigStaleCheck(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "snmp.yml")
+	module := "modules:\n  m:\n    walk: [1.3.6.1.4.1.9999]\n    metrics:\n    - name: vendorTemp\n      oid: 1.3.6.1.4.1.9999.1\n      type: gauge\n    - name: vendorModel\n      oid: 1.3.6.1.4.1.9999.2\n      type: DisplayString\n    - name: vendorErrors\n      oid: 1.3.6.1.4.1.9999.3\n      type: gauge\n    - name: vendorRemoved\n      oid: 1.3.6.1.4.1.9999.4\n      type: gauge\n" +
+		// Overridden when generated, so compared to the type the MIB gives.
+		"    - name: vendorDrops\n      oid: 1.3.6.1.4.1.9999.5\n      type: gauge\n      overridden_type: counter\n"
+	if err := os.WriteFile(cfgFile, []byte(module), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	index := filepath.Join(dir, "mib-index.yml")
+	content := "1.3.6.1.4.1.9999.1:\n  name: vendorTemp\n  type: gauge\n1.3.6.1.4.1.9999.2:\n  name: vendorModel\n  type: OctetString\n1.3.6.1.4.1.9999.3:\n  name: vendorErrors\n  type: counter\n1.3.6.1.4.1.9999.5:\n  name: vendorDrops\n  type: counter\n"
+	if err := os.WriteFile(index, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := &SafeConfig{MIBIndex: index, StaleCheck: true}
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP snmp_config_stale_metrics Metrics of a module which no longer match the MIB index, by reason, with --config.stale-check.
+# TYPE snmp_config_stale_metrics gauge
+snmp_config_stale_metrics{module="m",reason="type_changed"} 1
+snmp_config_stale_metrics{module="m",reason="unresolved"} 1
+`
+	if err := testutil.CollectAndCompare(sc, strings.NewReader(expected), "snmp_config_stale_metrics"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadConfigSecondaryAuth(t *testing.T) {
+	dir := t.TempDir()
+	for secondary, valid := range map[string]string{
+		"      community: new\n": "",
+		"      version: 3\n":     "auth username is missing",
+		"      community: new\n      secondary:\n        community: newer\n": "can't have secondary credentials",
+	} {
+		cfgFile := filepath.Join(dir, "snmp.yml")
+		content := "auths:\n  rotating:\n    community: old\n    secondary:\n" + secondary
+		if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sc := &SafeConfig{}
+		err := sc.ReloadConfig([]string{cfgFile}, false)
+		if valid == "" {
+			if err != nil {
+				t.Errorf("Error loading secondary credentials %q: %v", secondary, err)
+			} else if s := sc.C.Auths["rotating"].Secondary; s == nil || s.Community != "new" || s.Version != 2 {
+				t.Errorf("Secondary credentials not loaded: %+v", s)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), valid) {
+			t.Errorf("Expected error %q for secondary credentials %q, got %v", valid, secondary, err)
+		}
+	}
+}
+
+func TestLoadConfigUsers(t *testing.T) {
+	dir := t.TempDir()
+	for users, valid := range map[string]string{
+		"    users:\n    - username: monitor\n    - username: legacy\n      security_level: authNoPriv\n      password: old\n": "",
+		"    users:\n    - username: monitor\n    - security_level: noAuthNoPriv\n":                                            "auth username is missing",
+		"    users:\n    - username: monitor\n      priv_protocol: RC4\n":                                                      "user 'monitor': priv protocol must be DES or AES",
+		"    username: monitor\n    users:\n    - username: legacy\n":                                                          "username and users can't be used together",
+		"    users:\n    - username: monitor\n    secondary:\n      community: new\n":                                          "users and secondary credentials can't be used together",
+	} {
+		cfgFile := filepath.Join(dir, "snmp.yml")
+		content := "auths:\n  v3:\n    version: 3\n    security_level: authPriv\n    password: auth\n    auth_protocol: SHA\n    priv_protocol: AES\n    priv_password: priv\n" + users
+		if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sc := &SafeConfig{}
+		err := sc.ReloadConfig([]string{cfgFile}, false)
+		if valid == "" {
+			if err != nil {
+				t.Errorf("Error loading users %q: %v", users, err)
+				continue
+			}
+			auths := sc.C.Auths["v3"].UserAuths()
+			if len(auths) != 2 || auths[0].Username != "monitor" || auths[0].SecurityLevel != "authPriv" ||
+				auths[1].Username != "legacy" || auths[1].SecurityLevel != "authNoPriv" || auths[1].Password != "old" {
+				t.Errorf("Users not loaded: %+v", auths)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), valid) {
+			t.Errorf("Expected error %q for users %q, got %v", valid, users, err)
+		}
+	}
+}
+
+func TestLoadConfigWalkOverrides(t *testing.T) {
+	dir := t.TempDir()
+	for overrides, valid := range map[string]string{
+		"      1.3.6.1.2.1.2.2:\n        timeout: 30s\n        retries: 1\n": "",
+		"      ifTable:\n        timeout: 30s\n":                             "must be a numeric OID",
+		"      1.3.6.1.2.1.2.2:\n        retries: -1\n":                      "must not be negative",
+		"      1.3.6.1.2.1.2.2:\n        timeoutt: 30s\n":                    "not found",
+	} {
+		cfgFile := filepath.Join(dir, "snmp.yml")
+		content := "modules:\n  m:\n    walk: [1.3.6.1.2.1.2]\n    walk_overrides:\n" + overrides + "    metrics: []\n"
+		if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sc := &SafeConfig{}
+		err := sc.ReloadConfig([]string{cfgFile}, false)
+		if valid == "" {
+			if err != nil {
+				t.Errorf("Error loading walk overrides %q: %v", overrides, err)
+			} else if o := sc.C.Modules["m"].WalkOverride("1.3.6.1.2.1.2.2"); o == nil || o.Timeout != 30*time.Second || *o.Retries != 1 {
+				t.Errorf("Walk override not loaded: %+v", o)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), valid) {
+			t.Errorf("Expected error %q for walk overrides %q, got %v", valid, overrides, err)
+		}
+	}
+}
+
+func TestLoadConfigProxy(t *testing.T) {
+	dir := t.TempDir()
+	for proxy, valid := range map[string]string{
+		"      url: socks5://jump.example.com:1080\n":                                       "",
+		"      url: socks5://jump.example.com:1080\n      username: u\n      password: p\n": "",
+		"      url: http://jump.example.com:3128\n":                                         "only socks5 is supported",
+		"      url: socks5://jump.example.com\n":                                            "must have a host and port",
+	} {
+		cfgFile := filepath.Join(dir, "snmp.yml")
+		content := "auths:\n  jumped:\n    community: public\n    secondary:\n      community: new\n    proxy:\n" + proxy
+		if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sc := &SafeConfig{}
+		err := sc.ReloadConfig([]string{cfgFile}, false)
+		if valid == "" {
+			if err != nil {
+				t.Errorf("Error loading proxy %q: %v", proxy, err)
+			} else if auth := sc.C.Auths["jumped"]; auth.Proxy == nil || auth.Secondary.Proxy != auth.Proxy {
+				t.Errorf("Proxy not loaded or not inherited by the secondary credentials: %+v", auth)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), valid) {
+			t.Errorf("Expected error %q for proxy %q, got %v", valid, proxy, err)
+		}
+	}
+}
+
+func TestLoadConfigInterface(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("interfaces are only supported on Linux")
+	}
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "snmp.yml")
+	content := "auths:\n  mgmt:\n    community: public\n    interface: vrf-mgmt\n    secondary:\n      community: new\n"
+	if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sc := &SafeConfig{}
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err != nil {
+		t.Fatal(err)
+	}
+	if auth := sc.C.Auths["mgmt"]; auth.Interface != "vrf-mgmt" || auth.Secondary.Interface != "vrf-mgmt" {
+		t.Errorf("Interface not loaded or not inherited by the secondary credentials: %+v", auth)
+	}
+
+	content = "auths:\n  mgmt:\n    community: public\n    interface: vrf-mgmt\n    proxy:\n      url: socks5://jump.example.com:1080\n"
+	if err := os.WriteFile(cfgFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.ReloadConfig([]string{cfgFile}, false); err == nil || !strings.Contains(err.Error(), "can't be used together") {
+		t.Errorf("Expected an error for an interface with a proxy, got %v", err)
+	}
+}
+
+func TestConfigFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.yml", "modules: {}\n")
+	fingerprint := func() string {
+		f, err := configFingerprint([]string{dir}, filepath.Join(dir, "index.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	if _, err := configFingerprint([]string{dir}, filepath.Join(dir, "index.txt")); err == nil {
+		t.Error("Expected an error for a missing extra file")
+	}
+	write("index.txt", "")
+	initial := fingerprint()
+	if fingerprint() != initial {
+		t.Error("Fingerprint of unchanged files changed")
+	}
+	write("a.yml", "auths: {}\n")
+	changed := fingerprint()
+	if changed == initial {
+		t.Error("Fingerprint unchanged after changing a file")
+	}
+	write("b.yml", "")
+	if fingerprint() == changed {
+		t.Error("Fingerprint unchanged after adding a file")
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir, mappings := t.TempDir(), t.TempDir()
+	mapping := filepath.Join(mappings, "circuits.yml")
+	cfgFile := filepath.Join(dir, "snmp.yml")
+	for name, content := range map[string]string{
+		mapping: "\"1\": a\n",
+		cfgFile: `modules:
+  if_mib:
+    walk: [1.3.6.1.2.1.2.2.1.2]
+    metrics:
+    - name: ifDescr
+      oid: 1.3.6.1.2.1.2.2.1.2
+      type: DisplayString
+      indexes: [{labelname: ifIndex, type: gauge}]
+      lookups: [{labels: [ifIndex], labelname: circuit, mapping_file: ` + mapping + `}]
+`,
+	} {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldFiles, oldIndex, oldKey := *configFile, *mibIndexFile, *secretsKey
+	*configFile, *mibIndexFile, *secretsKey = []string{cfgFile}, "", ""
+	t.Cleanup(func() { *configFile, *mibIndexFile, *secretsKey = oldFiles, oldIndex, oldKey })
+	setTestConfig(t, sc.C)
+	if err := reloadConfig(log.NewNopLogger(), "signal"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newConfigWatcher(log.NewNopLogger(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.watcher.Close()
+	if _, ok := w.dirs[mappings]; !ok || len(w.dirs) != 2 {
+		t.Errorf("Expected the directories of the config and mapping files to be watched, got %v", w.dirs)
+	}
+	reloads := testutil.ToFloat64(configReloads.WithLabelValues("watch"))
+	w.check()
+	if got := testutil.ToFloat64(configReloads.WithLabelValues("watch")); got != reloads {
+		t.Errorf("Reloaded without changes")
+	}
+
+	// A broken mapping file fails the reload.
+	if err := os.WriteFile(mapping, []byte("- a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := w.events()
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event for the changed mapping file")
+	}
+	w.check()
+	if got := testutil.ToFloat64(configReloads.WithLabelValues("watch")); got != reloads+1 {
+		t.Errorf("Expected a reload after the mapping file changed, got %v reloads", got-reloads)
+	}
+	if testutil.ToFloat64(configLastReloadSuccessful) != 0 {
+		t.Error("Expected the reload of a broken mapping file to fail")
+	}
+}
+
+// schemaErrors checks the value against the subset of JSON Schema that
+// config.Schema uses.
+func schemaErrors(root, s map[string]interface{}, value interface{}, path string) []string {
+	if ref, ok := s["$ref"].(string); ok {
+		s = root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+	}
+	var errs []string
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == value
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+		}
+	}
+	typ := s["type"]
+	if types, ok := typ.([]interface{}); ok {
+		// The first type, unless the value is null and null is allowed.
+		typ = types[0]
+		for _, t := range types {
+			if t == "null" && value == nil {
+				return errs
+			}
+		}
+	}
+	switch typ {
+	case "object":
+		m, ok := value.(map[interface{}]interface{})
+		if !ok && value != nil {
+			return append(errs, fmt.Sprintf("%s: expected an object, got %v", path, value))
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		for k, v := range m {
+			key := fmt.Sprint(k)
+			if p, ok := properties[key]; ok {
+				errs = append(errs, schemaErrors(root, p.(map[string]interface{}), v, path+"."+key)...)
+			} else if additional, ok := s["additionalProperties"].(map[string]interface{}); ok {
+				errs = append(errs, schemaErrors(root, additional, v, path+"."+key)...)
+			} else {
+				errs = append(errs, fmt.Sprintf("%s: unknown option %s", path, key))
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok && value != nil {
+			return append(errs, fmt.Sprintf("%s: expected an array, got %v", path, value))
+		}
+		for i, v := range items {
+			errs = append(errs, schemaErrors(root, s["items"].(map[string]interface{}), v, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected a string, got %v", path, value))
+		}
+	case "integer":
+		if _, ok := value.(int); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected an integer, got %v", path, value))
+		}
+	case "number":
+		switch value.(type) {
+		case int, float64:
+		default:
+			errs = append(errs, fmt.Sprintf("%s: expected a number, got %v", path, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected a boolean, got %v", path, value))
+		}
+	}
+	return errs
+}
+
+func TestConfigSchema(t *testing.T) {
+	b, err := config.Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := map[string]interface{}{}
+	if err := json.Unmarshal(b, &root); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+	if root["$id"] != "urn:snmp-exporter:snmp.yml:v1" {
+		t.Errorf("Unexpected $id %v", root["$id"])
+	}
+	files, err := filepath.Glob("testdata/*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range append(files, "snmp.yml") {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value interface{}
+		if err := yaml.Unmarshal(content, &value); err != nil {
+			t.Fatalf("Error parsing %s: %v", f, err)
+		}
+		for _, e := range schemaErrors(root, root, value, f) {
+			t.Error(e)
+		}
+	}
+
+	var invalid interface{}
+	if err := yaml.Unmarshal([]byte("modules:\n  m:\n    strictness: loose\n    retries: three\n    unknown: true\n"), &invalid); err != nil {
+		t.Fatal(err)
+	}
+	if errs := schemaErrors(root, root, invalid, "invalid"); len(errs) != 3 {
+		t.Errorf("Expected 3 errors for an invalid module, got %v", errs)
+	}
+}
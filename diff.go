@@ -0,0 +1,237 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const diffPath = "/snmp/diff"
+
+type renamedMetric struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Oid  string `json:"oid"`
+}
+
+// diffResult describes how the series produced by two modules differ.
+type diffResult struct {
+	Target    string          `json:"target"`
+	ModuleA   string          `json:"module_a"`
+	ModuleB   string          `json:"module_b"`
+	Added     []string        `json:"added"`
+	Removed   []string        `json:"removed"`
+	Renamed   []renamedMetric `json:"renamed"`
+	Unchanged int             `json:"unchanged"`
+}
+
+// seriesKey renders a series as name{label="value",...}, ignoring the
+// module label which always differs between the two scrapes.
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l.GetName() == "module" {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// seriesByMetric groups the series of the gathered families by metric name.
+// Metrics about the scrape itself are skipped.
+func seriesByMetric(mfs []*dto.MetricFamily) map[string][]string {
+	series := map[string][]string{}
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "snmp_scrape_") {
+			continue
+		}
+		for _, m := range mf.Metric {
+			series[mf.GetName()] = append(series[mf.GetName()], seriesKey(mf.GetName(), m.Label))
+		}
+	}
+	return series
+}
+
+// diffModules compares the series produced by two modules. Metrics which only
+// exist on one side but share the OID of a metric on the other are reported
+// as renamed rather than added and removed.
+func diffModules(a, b *config.Module, seriesA, seriesB map[string][]string) diffResult {
+	result := diffResult{Added: []string{}, Removed: []string{}, Renamed: []renamedMetric{}}
+	oidsA := map[string]string{}
+	for _, m := range a.Metrics {
+		oidsA[m.Oid] = m.Name
+	}
+	renamedTo := map[string]string{}
+	for _, m := range b.Metrics {
+		from, ok := oidsA[m.Oid]
+		if !ok || from == m.Name {
+			continue
+		}
+		if _, ok := seriesB[from]; ok {
+			continue
+		}
+		if _, ok := seriesA[m.Name]; ok {
+			continue
+		}
+		renamedTo[from] = m.Name
+		result.Renamed = append(result.Renamed, renamedMetric{From: from, To: m.Name, Oid: m.Oid})
+	}
+	renamedFrom := map[string]struct{}{}
+	for _, to := range renamedTo {
+		renamedFrom[to] = struct{}{}
+	}
+
+	inA := map[string]struct{}{}
+	for name, keys := range seriesA {
+		if _, ok := renamedTo[name]; ok {
+			continue
+		}
+		for _, k := range keys {
+			inA[k] = struct{}{}
+		}
+	}
+	for name, keys := range seriesB {
+		if _, ok := renamedFrom[name]; ok {
+			continue
+		}
+		for _, k := range keys {
+			if _, ok := inA[k]; ok {
+				result.Unchanged++
+				delete(inA, k)
+			} else {
+				result.Added = append(result.Added, k)
+			}
+		}
+	}
+	for k := range inA {
+		result.Removed = append(result.Removed, k)
+	}
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	sort.Slice(result.Renamed, func(i, j int) bool {
+		return result.Renamed[i].From < result.Renamed[j].From
+	})
+	return result
+}
+
+// diffHandler scrapes a target with two modules and reports the difference.
+func diffHandler(w http.ResponseWriter, r *http.Request, logger log.Logger, exporterMetrics collector.Metrics) {
+	query := r.URL.Query()
+	target := query.Get("target")
+	if len(query["target"]) != 1 || target == "" {
+		httpError(w, collector.ErrorTypeBadRequest, "'target' parameter must be specified once")
+		snmpRequestErrors.Inc()
+		return
+	}
+	authName := query.Get("auth")
+	if authName == "" {
+		authName = "public_v2"
+	}
+	moduleNames := []string{query.Get("module_a"), query.Get("module_b")}
+	if moduleNames[0] == "" || moduleNames[1] == "" {
+		httpError(w, collector.ErrorTypeBadRequest, "'module_a' and 'module_b' parameters must be specified")
+		snmpRequestErrors.Inc()
+		return
+	}
+
+	sc.RLock()
+	auths, configModules := sc.C.Auths, sc.C.Modules
+	if tenantName := query.Get("tenant"); tenantName != "" {
+		// Tenants only see their own auths and modules.
+		tenant, ok := sc.C.Tenants[tenantName]
+		if !ok {
+			sc.RUnlock()
+			httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown tenant '%s'", tenantName))
+			snmpRequestErrors.Inc()
+			return
+		}
+		if err := checkTenantTarget(r.Context(), tenant, target); err != nil {
+			sc.RUnlock()
+			httpError(w, collector.ErrorTypeForbidden, err.Error())
+			snmpRequestErrors.Inc()
+			return
+		}
+		if !limiters.allow(tenantName, tenant, time.Now()) {
+			sc.RUnlock()
+			httpError(w, collector.ErrorTypeRateLimited, fmt.Sprintf("Rate limit exceeded for tenant '%s'", tenantName))
+			snmpRequestErrors.Inc()
+			return
+		}
+		auths, configModules = tenant.Auths, tenant.Modules
+		logger = log.With(logger, "tenant", tenantName)
+	}
+	auth, ok := auths[authName]
+	if !ok {
+		sc.RUnlock()
+		httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown auth '%s'", authName))
+		snmpRequestErrors.Inc()
+		return
+	}
+	modules := make([]*config.Module, 0, 2)
+	for _, name := range moduleNames {
+		module, ok := configModules[name]
+		if !ok {
+			sc.RUnlock()
+			httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown module '%s'", name))
+			snmpRequestErrors.Inc()
+			return
+		}
+		modules = append(modules, module)
+	}
+	sc.RUnlock()
+
+	logger = log.With(logger, "auth", authName, "target", target)
+	series := make([]map[string][]string, 0, 2)
+	for i, module := range modules {
+		registry := prometheus.NewRegistry()
+		c := collector.New(r.Context(), target, authName, query.Get("snmp_context"), auth,
+			[]*collector.NamedModule{collector.NewNamedModule(moduleNames[i], module)}, logger, exporterMetrics, 1, *debugSNMP)
+		registry.MustRegister(c)
+		mfs, err := registry.Gather()
+		errorType := c.ErrorType()
+		if errorType == "" && err != nil {
+			errorType = collector.ErrorTypeUnknown
+		}
+		if errorType != "" {
+			msg := fmt.Sprintf("error scraping module '%s'", moduleNames[i])
+			if err != nil {
+				msg += ": " + err.Error()
+			}
+			httpError(w, errorType, msg)
+			return
+		}
+		series = append(series, seriesByMetric(mfs))
+	}
+
+	result := diffModules(modules[0], modules[1], series[0], series[1])
+	result.Target, result.ModuleA, result.ModuleB = target, moduleNames[0], moduleNames[1]
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
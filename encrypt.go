@@ -0,0 +1,53 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+var encryptCommand = kingpin.Command("encrypt", "Encrypt a secret read from stdin with the key of --config.secrets-key-file, printing the value to use for it in the auths of the configuration.")
+
+// runEncrypt implements the encrypt command. Only the first line is read, so
+// that secrets can be typed or piped with or without a trailing newline.
+func runEncrypt(r io.Reader, w io.Writer) error {
+	if *secretsKey == "" {
+		return fmt.Errorf("--config.secrets-key-file is required")
+	}
+	key, err := config.ReadSecretsKey(*secretsKey)
+	if err != nil {
+		return err
+	}
+	secret, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return fmt.Errorf("no secret on stdin")
+	}
+	encrypted, err := config.EncryptSecret(key, secret)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, encrypted)
+	return err
+}
@@ -0,0 +1,229 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+const estimatePath = "/snmp/estimate"
+
+// boundedWalker walks subtrees up to a number of PDUs.
+type boundedWalker interface {
+	WalkLimit(oid string, limit int) ([]gosnmp.SnmpPDU, bool, error)
+}
+
+// walkEstimate is the estimated size of a walk of a module.
+type walkEstimate struct {
+	Oid string `json:"oid"`
+	// Whether the sample covered the whole walk, so that it is exact.
+	Complete    bool `json:"complete"`
+	SampledPdus int  `json:"sampled_pdus"`
+	// Rows of the first column and columns of the module in the walk, for
+	// walks the sample did not complete.
+	Rows    int `json:"rows,omitempty"`
+	Columns int `json:"columns,omitempty"`
+	// Whether counting the rows stopped at max_rows, so that the estimate
+	// is a lower bound.
+	Truncated     bool `json:"truncated,omitempty"`
+	EstimatedPdus int  `json:"estimated_pdus"`
+}
+
+// estimateResult is the estimated size of a scrape of a module.
+type estimateResult struct {
+	Target                   string         `json:"target"`
+	Auth                     string         `json:"auth"`
+	Module                   string         `json:"module"`
+	Walks                    []walkEstimate `json:"walks"`
+	Gets                     int            `json:"gets"`
+	SampledPdus              int            `json:"sampled_pdus"`
+	SampleDurationSeconds    float64        `json:"sample_duration_seconds"`
+	EstimatedPdus            int            `json:"estimated_pdus"`
+	EstimatedSamples         int            `json:"estimated_samples"`
+	EstimatedDurationSeconds float64        `json:"estimated_duration_seconds"`
+}
+
+// moduleColumns returns the OIDs of the metrics of the module within the
+// subtree. A metric containing the subtree counts as one column.
+func moduleColumns(module *config.Module, oid string) []string {
+	columns := []string{}
+	for _, metric := range module.Metrics {
+		switch {
+		case metric.Oid == oid || strings.HasPrefix(oid, metric.Oid+"."):
+			return []string{metric.Oid}
+		case strings.HasPrefix(metric.Oid, oid+"."):
+			columns = append(columns, metric.Oid)
+		}
+	}
+	return columns
+}
+
+// columnOf returns the column of the PDU, or "" if no metric covers it.
+func columnOf(pdu gosnmp.SnmpPDU, columns []string) string {
+	name := strings.TrimPrefix(pdu.Name, ".")
+	for _, column := range columns {
+		if strings.HasPrefix(name, column+".") {
+			return column
+		}
+	}
+	return ""
+}
+
+// estimateModule walks the first rows PDUs of each walk of the module and
+// extrapolates the size of a full scrape. The walks the sample does not
+// complete are estimated as the rows of their first column, counted up to
+// maxRows, times their columns.
+func estimateModule(client boundedWalker, module *config.Module, rows, maxRows int, logger log.Logger, metrics collector.Metrics) (estimateResult, error) {
+	result := estimateResult{Walks: []walkEstimate{}, Gets: len(module.Get)}
+	sampled := []gosnmp.SnmpPDU{}
+	start := time.Now()
+	for _, oid := range module.Walk {
+		pdus, complete, err := client.WalkLimit(oid, rows)
+		if err != nil {
+			return result, err
+		}
+		sampled = append(sampled, pdus...)
+		walk := walkEstimate{Oid: oid, Complete: complete, SampledPdus: len(pdus), EstimatedPdus: len(pdus)}
+		result.SampledPdus += len(pdus)
+		if !complete {
+			columns := moduleColumns(module, oid)
+			walk.Columns = max(len(columns), 1)
+			column := columnOf(pdus[0], columns)
+			if column == "" {
+				// Outside of the metrics, such as a walked lookup.
+				column = strings.TrimPrefix(pdus[0].Name, ".")
+				column = column[:strings.LastIndexByte(column, '.')]
+			}
+			for _, pdu := range pdus {
+				if columnOf(pdu, []string{column}) == column {
+					walk.Rows++
+				}
+			}
+			if walk.Rows == len(pdus) {
+				// The sample did not get past the first column.
+				columnPdus, complete, err := client.WalkLimit(column, maxRows)
+				if err != nil {
+					return result, err
+				}
+				walk.Rows, walk.Truncated = len(columnPdus), !complete
+				result.SampledPdus += len(columnPdus)
+			}
+			walk.EstimatedPdus = max(walk.Rows*walk.Columns, len(pdus))
+		}
+		result.Walks = append(result.Walks, walk)
+		result.EstimatedPdus += walk.EstimatedPdus
+	}
+	result.EstimatedPdus += result.Gets
+	result.SampleDurationSeconds = time.Since(start).Seconds()
+
+	if result.SampledPdus > 0 {
+		perPdu := result.SampleDurationSeconds / float64(result.SampledPdus)
+		result.EstimatedDurationSeconds = perPdu * float64(result.EstimatedPdus)
+	}
+	if len(sampled) > 0 {
+		samples := collector.PdusToMetrics(module, sampled, logger, metrics)
+		perPdu := float64(len(samples)) / float64(len(sampled))
+		result.EstimatedSamples = int(math.Round(perPdu * float64(result.EstimatedPdus)))
+	}
+	return result, nil
+}
+
+// estimateHandler serves the estimated size of scraping the target with a
+// module, sampling the first rows of its walks instead of walking them.
+func estimateHandler(w http.ResponseWriter, r *http.Request, logger log.Logger, exporterMetrics collector.Metrics) {
+	query := r.URL.Query()
+	target := query.Get("target")
+	if len(query["target"]) != 1 || target == "" {
+		httpError(w, collector.ErrorTypeBadRequest, "'target' parameter must be specified once")
+		snmpRequestErrors.Inc()
+		return
+	}
+	authName := query.Get("auth")
+	if authName == "" {
+		authName = "public_v2"
+	}
+	moduleName := query.Get("module")
+	if moduleName == "" {
+		moduleName = "if_mib"
+	}
+	limits := map[string]int{"rows": 100, "max_rows": 10000}
+	for name := range limits {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				httpError(w, collector.ErrorTypeBadRequest, fmt.Sprintf("'%s' parameter must be a positive integer", name))
+				snmpRequestErrors.Inc()
+				return
+			}
+			limits[name] = n
+		}
+	}
+
+	sc.RLock()
+	auth, ok := sc.C.Auths[authName]
+	if !ok {
+		sc.RUnlock()
+		httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown auth '%s'", authName))
+		snmpRequestErrors.Inc()
+		return
+	}
+	module, ok := sc.C.Modules[moduleName]
+	if !ok {
+		sc.RUnlock()
+		httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown module '%s'", moduleName))
+		snmpRequestErrors.Inc()
+		return
+	}
+	sc.RUnlock()
+
+	logger = log.With(logger, "auth", authName, "target", target, "module", moduleName)
+	client, err := scraper.NewGoSNMP(logger, target, "", *debugSNMP)
+	if err != nil {
+		httpError(w, collector.ErrorTypeBadRequest, err.Error())
+		return
+	}
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Context = r.Context()
+		auth.ConfigureSNMP(g, query.Get("snmp_context"))
+	})
+	setWalkParams(client, module.WalkParams)
+	if err := client.Connect(); err != nil {
+		httpError(w, collector.ClassifyError(err), fmt.Sprintf("error connecting to target: %s", err))
+		return
+	}
+	defer client.Close()
+	result, err := estimateModule(client, module, limits["rows"], limits["max_rows"], logger, exporterMetrics)
+	if err != nil {
+		httpError(w, collector.ClassifyError(err), fmt.Sprintf("error sampling module '%s': %s", moduleName, err))
+		return
+	}
+	result.Target, result.Auth, result.Module = target, authName, moduleName
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
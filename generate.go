@@ -0,0 +1,93 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var (
+	generateOnStart = kingpin.Flag("generate-on-start", "Run the generator on --generate.generator-path and the MIBs at startup, and load the config it generates instead of --config.file.").Default("false").Bool()
+	generatorBinary = kingpin.Flag("generate.command", "Path to the generator binary run by --generate-on-start.").Default("generator").String()
+	generatorYml    = kingpin.Flag("generate.generator-path", "Path to the generator.yml of --generate-on-start.").Default("generator.yml").String()
+	generatorMIBs   = kingpin.Flag("generate.mibs-dir", "Path to a MIB directory of --generate-on-start, can be repeated. Defaults to those of the generator.").Strings()
+)
+
+// removeGenerated removes the temporary directory of the config written by
+// --generate-on-start. It is called on every way the exporter exits.
+var removeGenerated = func() {}
+
+// generateOnStartup runs the generator binary, which needs net-snmp to parse
+// the MIBs and so can't be built into the exporter, and returns the path of
+// the config it wrote to a temporary directory. The directory is removed
+// when the exporter exits.
+func generateOnStartup(command, generatorPath string, mibDirs []string, logger log.Logger) (string, error) {
+	dir, err := os.MkdirTemp("", "snmp_exporter")
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(dir, "snmp.yml")
+	args := []string{"generate", "--generator-path", generatorPath, "--output-path", out}
+	for _, d := range mibDirs {
+		args = append(args, "--mibs-dir", d)
+	}
+	level.Info(logger).Log("msg", "Generating config", "command", command, "generator_path", generatorPath)
+	output, err := exec.Command(command, args...).CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		level.Debug(logger).Log("msg", "Generator output", "line", scanner.Text())
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("error running the generator: %w: %s", err, bytes.TrimSpace(output))
+	}
+	// The generator exits successfully without writing anything on MIB parse
+	// errors.
+	if _, err := os.Stat(out); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("the generator wrote no config: %s", bytes.TrimSpace(output))
+	}
+	level.Info(logger).Log("msg", "Config generated", "file", out)
+	removeGenerated = func() {
+		if err := os.RemoveAll(dir); err != nil {
+			level.Warn(logger).Log("msg", "Error removing generated config", "dir", dir, "err", err)
+		}
+	}
+	removeOnSignal(logger)
+	return out, nil
+}
+
+// removeOnSignal removes the generated config and exits when the exporter is
+// interrupted or terminated.
+func removeOnSignal(logger log.Logger) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-term
+		level.Info(logger).Log("msg", "Exiting", "signal", sig)
+		removeGenerated()
+		os.Exit(0)
+	}()
+}
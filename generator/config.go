@@ -17,13 +17,42 @@ import (
 	"fmt"
 	"github.com/prometheus/snmp_exporter/config"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// Guards against typos like {1..100000}.
+const maxMacroExpansions = 10000
+
 // The generator config.
 type Config struct {
 	Auths   map[string]*config.Auth  `yaml:"auths"`
 	Modules map[string]*ModuleConfig `yaml:"modules"`
 	Version int                      `yaml:"version,omitempty"`
+	// Tables indexed like others without declaring AUGMENTS.
+	TableJoins []*TableJoin `yaml:"table_joins,omitempty"`
+}
+
+// TableJoin declares that a table is indexed like another, as if its entry
+// augmented the entry of the other.
+type TableJoin struct {
+	Table       string `yaml:"table"`
+	IndexedLike string `yaml:"indexed_like"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *TableJoin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TableJoin
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Table == "" || c.IndexedLike == "" {
+		return fmt.Errorf("table join needs table and indexed_like")
+	}
+	if c.Table == c.IndexedLike {
+		return fmt.Errorf("table %s can't be joined with itself", c.Table)
+	}
+	return nil
 }
 
 type MetricOverrides struct {
@@ -33,6 +62,15 @@ type MetricOverrides struct {
 	Scale          float64                           `yaml:"scale,omitempty"`
 	Type           string                            `yaml:"type,omitempty"`
 	Help           string                            `yaml:"help,omitempty"`
+	ValueMap       config.ValueMap                   `yaml:"value_map,omitempty"`
+	// Labels derived from the object wherever it is used as an index.
+	IndexTransforms []*config.IndexTransform `yaml:"index_transforms,omitempty"`
+	Min             *float64                 `yaml:"min,omitempty"`
+	Max             *float64                 `yaml:"max,omitempty"`
+	OutOfRange      string                   `yaml:"out_of_range,omitempty"`
+	// How MAC addresses of the object are rendered, as a metric, an index
+	// or a lookup.
+	MACFormat string `yaml:"mac_format,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -46,16 +84,90 @@ func (c *MetricOverrides) UnmarshalYAML(unmarshal func(interface{}) error) error
 	if c.Type != "" && (!ok || typ != c.Type) {
 		return fmt.Errorf("invalid metric type override '%s'", c.Type)
 	}
+	if err := config.CheckMACFormat(c.MACFormat); err != nil {
+		return err
+	}
 
-	return nil
+	return config.CheckBounds(c.Min, c.Max, c.OutOfRange)
+}
+
+// ScopedOverride applies overrides to all objects under a subtree and/or
+// defined by a MIB module, except those with their own overrides.
+type ScopedOverride struct {
+	Under           string `yaml:"under,omitempty"`
+	MIB             string `yaml:"mib,omitempty"`
+	MetricOverrides `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ScopedOverride) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ScopedOverride
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Under == "" && c.MIB == "" {
+		return fmt.Errorf("scoped override needs under or mib")
+	}
+	typ, ok := metricType(c.Type)
+	if c.Type != "" && (!ok || typ != c.Type) {
+		return fmt.Errorf("invalid metric type override '%s'", c.Type)
+	}
+	if err := config.CheckMACFormat(c.MACFormat); err != nil {
+		return err
+	}
+	return config.CheckBounds(c.Min, c.Max, c.OutOfRange)
+}
+
+// String describes the scope in warnings.
+func (c *ScopedOverride) String() string {
+	scope := []string{}
+	if c.Under != "" {
+		scope = append(scope, "under "+c.Under)
+	}
+	if c.MIB != "" {
+		scope = append(scope, "of "+c.MIB)
+	}
+	return "scoped override " + strings.Join(scope, " ")
 }
 
 type ModuleConfig struct {
-	Walk       []string                   `yaml:"walk"`
-	Lookups    []*Lookup                  `yaml:"lookups"`
-	WalkParams config.WalkParams          `yaml:",inline"`
-	Overrides  map[string]MetricOverrides `yaml:"overrides"`
-	Filters    config.Filters             `yaml:"filters,omitempty"`
+	BaseOid              string                     `yaml:"base_oid,omitempty"`
+	Walk                 []string                   `yaml:"walk"`
+	Get                  []string                   `yaml:"get,omitempty"`
+	Exclude              []string                   `yaml:"exclude,omitempty"`
+	WalkPriority         []string                   `yaml:"walk_priority,omitempty"`
+	Lookups              []*Lookup                  `yaml:"lookups"`
+	WalkParams           config.WalkParams          `yaml:",inline"`
+	Overrides            map[string]MetricOverrides `yaml:"overrides"`
+	ScopedOverrides      []*ScopedOverride          `yaml:"scoped_overrides,omitempty"`
+	Filters              config.Filters             `yaml:"filters,omitempty"`
+	HighCapacityCounters string                     `yaml:"high_capacity_counters,omitempty"`
+	RowStatus            bool                       `yaml:"row_status,omitempty"`
+	Timestamps           bool                       `yaml:"timestamps,omitempty"`
+	IndexLabels          map[string]string          `yaml:"index_labels,omitempty"`
+	IndexDisplay         map[string]string          `yaml:"index_display,omitempty"`
+	Aggregations         []*config.Aggregation      `yaml:"aggregations,omitempty"`
+	Histograms           []*config.Histogram        `yaml:"histograms,omitempty"`
+	Rollups              []*config.Rollup           `yaml:"rollups,omitempty"`
+	Utilizations         []*config.Utilization      `yaml:"utilizations,omitempty"`
+	ScrapeInterval       time.Duration              `yaml:"scrape_interval,omitempty"`
+	LabelLimits          map[string]int             `yaml:"label_limits,omitempty"`
+	// Walk parameters of subtrees, by name or OID, overriding those of the
+	// module.
+	WalkOverrides map[string]*config.WalkOverride `yaml:"walk_overrides,omitempty"`
+	// Export the LLDP and CDP neighbors of targets.
+	Topology bool `yaml:"topology,omitempty"`
+	// Export the sensors of ENTITY-SENSOR-MIB, scaled and named by their unit.
+	EntitySensors bool `yaml:"entity_sensors,omitempty"`
+	// How metrics of different objects with the same name are told apart.
+	NameConflicts string `yaml:"name_conflicts,omitempty"`
+	// 32-bit counters exported as one metric with their 64-bit replacements.
+	CounterPairs []*config.CounterPair `yaml:"counter_pairs,omitempty"`
+	// What happens to varbinds of the wrong type.
+	Strictness string `yaml:"strictness,omitempty"`
+	// Get only the instances of lookups the instances of metrics walked need,
+	// from the source indexes of the lookups.
+	InlineLookupInstances bool `yaml:"inline_lookup_instances,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -65,6 +177,79 @@ func (c *ModuleConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if err := c.expandMacros(); err != nil {
+		return err
+	}
+
+	switch c.HighCapacityCounters {
+	case "", "include", "replace":
+	default:
+		return fmt.Errorf("invalid high_capacity_counters '%s', must be include or replace", c.HighCapacityCounters)
+	}
+
+	switch c.NameConflicts {
+	case "", "mib", "parent", "error":
+	default:
+		return fmt.Errorf("invalid name_conflicts '%s', must be mib, parent or error", c.NameConflicts)
+	}
+
+	for index, name := range c.IndexLabels {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("invalid label name '%s' for index '%s'", name, index)
+		}
+	}
+
+	if err := config.CheckRetryPolicy(c.WalkParams.RetryPolicy); err != nil {
+		return err
+	}
+	if err := config.CheckMaxMessageSize(c.WalkParams.MaxMessageSize); err != nil {
+		return err
+	}
+	if err := config.CheckStrictness(c.Strictness, c.WalkParams.TolerantDecode); err != nil {
+		return err
+	}
+	if err := config.CheckLabelLimits(c.LabelLimits); err != nil {
+		return err
+	}
+
+	for index, display := range c.IndexDisplay {
+		switch display {
+		case "hex", "ascii", "both", "auto":
+		default:
+			return fmt.Errorf("invalid display '%s' for index '%s', must be hex, ascii, both or auto", display, index)
+		}
+	}
+
+	for _, oid := range c.Get {
+		if !instanceOidRE.MatchString(oid) {
+			return fmt.Errorf("invalid oid '%s' to get, must be numeric", oid)
+		}
+	}
+
+	// Relative OIDs need something to be relative to.
+	if c.BaseOid == "" {
+		for _, oid := range c.Get {
+			if isRelativeOid(oid) {
+				return fmt.Errorf("relative oid '%s' requires base_oid to be set", oid)
+			}
+		}
+		for _, oid := range c.Walk {
+			if isRelativeOid(oid) {
+				return fmt.Errorf("relative oid '%s' requires base_oid to be set", oid)
+			}
+		}
+		for _, lookup := range c.Lookups {
+			if isRelativeOid(lookup.Lookup) {
+				return fmt.Errorf("relative lookup '%s' requires base_oid to be set", lookup.Lookup)
+			}
+			for _, fallback := range lookup.Fallback {
+				if isRelativeOid(fallback) {
+					return fmt.Errorf("relative lookup '%s' requires base_oid to be set", fallback)
+				}
+			}
+		}
+	}
+
 	// Ensure indices in static filters are integer for input validation.
 	for _, filter := range c.Filters.Static {
 		for _, index := range filter.Indices {
@@ -78,8 +263,133 @@ func (c *ModuleConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// expandMacros expands the brace macros of walk and exclude entries and of
+// override names, so families of similar objects can be listed once.
+func (c *ModuleConfig) expandMacros() error {
+	var err error
+	if c.Walk, err = expandMacroList(c.Walk); err != nil {
+		return err
+	}
+	if c.Exclude, err = expandMacroList(c.Exclude); err != nil {
+		return err
+	}
+	if c.Get, err = expandMacroList(c.Get); err != nil {
+		return err
+	}
+	if c.Overrides == nil {
+		return nil
+	}
+	overrides := make(map[string]MetricOverrides, len(c.Overrides))
+	for pattern, override := range c.Overrides {
+		names, err := expandMacro(pattern)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, ok := overrides[name]; ok {
+				return fmt.Errorf("override '%s' defined more than once", name)
+			}
+			overrides[name] = override
+		}
+	}
+	c.Overrides = overrides
+	return nil
+}
+
+func expandMacroList(patterns []string) ([]string, error) {
+	if patterns == nil {
+		return nil, nil
+	}
+	expanded := []string{}
+	for _, pattern := range patterns {
+		e, err := expandMacro(pattern)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e...)
+	}
+	return expanded, nil
+}
+
+// expandMacro expands each {a,b,c} list and {1..4} range in s, in the manner
+// of shell brace expansion. Several macros produce all their combinations.
+func expandMacro(s string) ([]string, error) {
+	start := strings.IndexByte(s, '{')
+	if start < 0 {
+		if strings.IndexByte(s, '}') >= 0 {
+			return nil, fmt.Errorf("unbalanced '}' in '%s'", s)
+		}
+		return []string{s}, nil
+	}
+	end := strings.IndexByte(s[start:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("unbalanced '{' in '%s'", s)
+	}
+	end += start
+	body := s[start+1 : end]
+	if strings.IndexByte(body, '{') >= 0 {
+		return nil, fmt.Errorf("nested macros are not supported in '%s'", s)
+	}
+	var values []string
+	if from, to, ok := strings.Cut(body, ".."); ok {
+		f, errFrom := strconv.Atoi(from)
+		t, errTo := strconv.Atoi(to)
+		if errFrom != nil || errTo != nil || f > t || t-f >= maxMacroExpansions {
+			return nil, fmt.Errorf("invalid range '{%s}' in '%s'", body, s)
+		}
+		for i := f; i <= t; i++ {
+			values = append(values, strconv.Itoa(i))
+		}
+	} else {
+		values = strings.Split(body, ",")
+	}
+	rest, err := expandMacro(s[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(values)*len(rest) > maxMacroExpansions {
+		return nil, fmt.Errorf("'%s' expands to more than %d entries", s, maxMacroExpansions)
+	}
+	expanded := make([]string, 0, len(values)*len(rest))
+	for _, v := range values {
+		for _, r := range rest {
+			expanded = append(expanded, s[:start]+v+r)
+		}
+	}
+	return expanded, nil
+}
+
 type Lookup struct {
 	SourceIndexes     []string `yaml:"source_indexes"`
 	Lookup            string   `yaml:"lookup"`
 	DropSourceIndexes bool     `yaml:"drop_source_indexes,omitempty"`
+	MappingFile       string   `yaml:"mapping_file,omitempty"`
+	Labelname         string   `yaml:"labelname,omitempty"`
+	Fallback          []string `yaml:"fallback,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Lookup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Lookup
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Fallback) > 0 {
+		if c.MappingFile != "" {
+			return fmt.Errorf("mapping_file lookup can't have a fallback")
+		}
+		if c.Labelname != "" && !labelNameRE.MatchString(c.Labelname) {
+			return fmt.Errorf("lookup '%s' has an invalid labelname '%s'", c.Lookup, c.Labelname)
+		}
+	}
+	if c.MappingFile == "" {
+		return nil
+	}
+	if c.Lookup != "" {
+		return fmt.Errorf("lookup '%s' can't also use mapping_file", c.Lookup)
+	}
+	if !labelNameRE.MatchString(c.Labelname) {
+		return fmt.Errorf("mapping_file lookup requires a valid labelname, got '%s'", c.Labelname)
+	}
+	return nil
 }
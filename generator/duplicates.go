@@ -0,0 +1,113 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// duplicateOid is an OID defined by several loaded MIBs, such as a vendor
+// MIB and a fork of it.
+type duplicateOid struct {
+	Oid string
+	// The definitions, as label (MIB module, file), in the order they were
+	// loaded.
+	Definitions []string
+	Kept        string
+}
+
+// resolveDuplicateOids keeps one node of each OID defined by several MIBs:
+// the first one from the MIB modules preferred, in their order, else the
+// first or last one loaded as the policy says. The children of the nodes
+// dropped are moved to the one kept. With the error policy, an error listing
+// the duplicates is returned instead.
+func resolveDuplicateOids(nodes *Node, policy string, preferred []string, logger log.Logger) ([]duplicateOid, error) {
+	duplicates := []duplicateOid{}
+	walkNode(nodes, func(n *Node) {
+		byOid := map[string][]*Node{}
+		for _, c := range n.Children {
+			byOid[c.Oid] = append(byOid[c.Oid], c)
+		}
+		if len(byOid) == len(n.Children) {
+			return
+		}
+		children := make([]*Node, 0, len(byOid))
+		for _, c := range n.Children {
+			defs := byOid[c.Oid]
+			if defs == nil {
+				// Already kept.
+				continue
+			}
+			delete(byOid, c.Oid)
+			if len(defs) == 1 {
+				children = append(children, c)
+				continue
+			}
+			kept := keptDefinition(defs, policy, preferred)
+			d := duplicateOid{Oid: c.Oid, Kept: describeDefinition(kept)}
+			for _, def := range defs {
+				d.Definitions = append(d.Definitions, describeDefinition(def))
+				if def != kept {
+					kept.Children = append(kept.Children, def.Children...)
+				}
+			}
+			sort.SliceStable(kept.Children, func(i, j int) bool {
+				return lastSubid(kept.Children[i].Oid) < lastSubid(kept.Children[j].Oid)
+			})
+			duplicates = append(duplicates, d)
+			children = append(children, kept)
+		}
+		n.Children = children
+	})
+	if policy == "error" && len(duplicates) > 0 {
+		oids := make([]string, 0, len(duplicates))
+		for _, d := range duplicates {
+			oids = append(oids, d.Oid+" ("+strings.Join(d.Definitions, ", ")+")")
+		}
+		return duplicates, fmt.Errorf("OIDs defined by several MIBs: %s", strings.Join(oids, "; "))
+	}
+	for _, d := range duplicates {
+		level.Warn(logger).Log("msg", "OID defined by several MIBs", "oid", d.Oid, "definitions", strings.Join(d.Definitions, ", "), "kept", d.Kept)
+	}
+	return duplicates, nil
+}
+
+func keptDefinition(defs []*Node, policy string, preferred []string) *Node {
+	for _, mib := range preferred {
+		for _, def := range defs {
+			if def.MIB == mib {
+				return def
+			}
+		}
+	}
+	if policy == "last" {
+		return defs[len(defs)-1]
+	}
+	return defs[0]
+}
+
+func describeDefinition(n *Node) string {
+	return fmt.Sprintf("%s (%s, %s)", n.Label, n.MIB, n.MIBFile)
+}
+
+func lastSubid(oid string) int {
+	subid, _ := strconv.Atoi(oid[strings.LastIndexByte(oid, '.')+1:])
+	return subid
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// lookupInstances returns the instances of the lookup OID to get for the
+// instances of a table row, as the exporter builds them from the
+// sub-identifiers of the source indexes. ok is false if a source index isn't
+// one of the row's, such as the label of another lookup, or an instance
+// can't be split into the row's indexes, in which case the lookup OID has to
+// be walked.
+func lookupInstances(instances []string, indexes []*config.Index, sourceIndexes []string) ([]string, bool) {
+	out := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		subids, ok := splitInstance(instance, indexes)
+		if !ok {
+			return nil, false
+		}
+		parts := make([]string, 0, len(sourceIndexes))
+		for _, index := range sourceIndexes {
+			s, ok := subids[index]
+			if !ok {
+				return nil, false
+			}
+			parts = append(parts, s)
+		}
+		out = append(out, "."+strings.Join(parts, "."))
+	}
+	return out, true
+}
+
+// splitInstance splits an instance such as ".2.4.101.116.104.48" into the
+// sub-identifiers of each index, by index label name.
+func splitInstance(instance string, indexes []*config.Index) (map[string]string, bool) {
+	if !strings.HasPrefix(instance, ".") || len(indexes) == 0 {
+		return nil, false
+	}
+	subids := strings.Split(instance[1:], ".")
+	out := make(map[string]string, len(indexes))
+	for i, index := range indexes {
+		implied := index.Implied && i == len(indexes)-1
+		n, ok := indexLength(subids, index.Type, index.FixedSize, implied)
+		if !ok || n == 0 || n > len(subids) {
+			return nil, false
+		}
+		out[index.Labelname] = strings.Join(subids[:n], ".")
+		subids = subids[n:]
+	}
+	return out, len(subids) == 0
+}
+
+// indexLength returns the number of sub-identifiers an index of the type
+// takes at the start of subids.
+func indexLength(subids []string, typ string, fixedSize int, implied bool) (int, bool) {
+	subid := func(i int) (int, bool) {
+		if i >= len(subids) {
+			return 0, false
+		}
+		v, err := strconv.Atoi(subids[i])
+		return v, err == nil
+	}
+	switch typ {
+	case "gauge", "counter", "EnumAsInfo":
+		return 1, true
+	case "PhysAddress48":
+		return 6, true
+	case "InetAddressIPv4":
+		return 4, true
+	case "InetAddressIPv6":
+		return 16, true
+	case "OctetString", "DisplayString":
+		if implied {
+			return len(subids), true
+		}
+		if fixedSize > 0 {
+			return fixedSize, true
+		}
+		length, ok := subid(0)
+		return length + 1, ok
+	case "InetAddress":
+		// The type of the address, its length and its sub-identifiers.
+		length, ok := subid(1)
+		return length + 2, ok
+	case "InetAddressMissingSize":
+		switch addrType, _ := subid(0); addrType {
+		case 1:
+			return 5, true
+		case 2:
+			return 17, true
+		}
+		return len(subids), true
+	}
+	return 0, false
+}
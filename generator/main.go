@@ -14,17 +14,22 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
+	"github.com/prometheus/common/version"
 	"gopkg.in/yaml.v2"
 
 	"github.com/prometheus/snmp_exporter/config"
@@ -34,13 +39,10 @@ var (
 	cannotFindModuleRE = regexp.MustCompile(`Cannot find module \((.+)\): (.+)`)
 )
 
+const generatedHeader = "# WARNING: This file was auto-generated using snmp_exporter generator, manual changes will be lost.\n"
+
 // Generate a snmp_exporter config and write it out.
 func generateConfig(nodes *Node, nameToNode map[string]*Node, logger log.Logger) error {
-	outputPath, err := filepath.Abs(*outputPath)
-	if err != nil {
-		return fmt.Errorf("unable to determine absolute path for output")
-	}
-
 	content, err := os.ReadFile(*generatorYmlPath)
 	if err != nil {
 		return fmt.Errorf("error reading yml config: %s", err)
@@ -50,10 +52,15 @@ func generateConfig(nodes *Node, nameToNode map[string]*Node, logger log.Logger)
 	if err != nil {
 		return fmt.Errorf("error parsing yml config: %s", err)
 	}
+	if err := joinTables(cfg.TableJoins, nameToNode); err != nil {
+		return err
+	}
 
 	outputConfig := config.Config{}
 	outputConfig.Auths = cfg.Auths
 	outputConfig.Modules = make(map[string]*config.Module, len(cfg.Modules))
+	reports := make(map[string]*moduleReport, len(cfg.Modules))
+	now := time.Now()
 	for name, m := range cfg.Modules {
 		level.Info(logger).Log("msg", "Generating config for module", "module", name)
 		// Give each module a copy of the tree so that it can be modified.
@@ -64,13 +71,83 @@ func generateConfig(nodes *Node, nameToNode map[string]*Node, logger log.Logger)
 			mNameToNode[n.Oid] = n
 			mNameToNode[n.Label] = n
 		})
-		out, err := generateConfigModule(m, mNodes, mNameToNode, logger)
+		out, report, err := generateConfigModule(m, mNodes, mNameToNode, logger)
 		if err != nil {
 			return err
 		}
+		if *strict && len(report.Unused) > 0 {
+			return fmt.Errorf("module %s has entries which matched nothing: %s", name, strings.Join(report.Unused, ", "))
+		}
+		if dropped := preferObjects(out, supersededMetrics(out, mNameToNode), *deprecatedPolicy); len(dropped) > 0 {
+			level.Info(logger).Log("msg", "Dropped metrics superseded according to --deprecated-objects", "module", name, "metrics", strings.Join(dropped, ","))
+			for _, metric := range dropped {
+				report.Skipped = append(report.Skipped, skippedMetric{Name: metric, Oid: mNameToNode[metric].Oid, Reason: "superseded according to --deprecated-objects"})
+			}
+		}
+		report.fill(out)
+		reports[name] = report
 		outputConfig.Modules[name] = out
 		outputConfig.Modules[name].WalkParams = m.WalkParams
+		if *suggestParams {
+			outputConfig.Modules[name].WalkParams = suggestWalkParams(m.WalkParams, out)
+			p := outputConfig.Modules[name].WalkParams
+			level.Info(logger).Log("msg", "Suggested walk parameters", "module", name, "estimated_varbinds", estimateVarbinds(out),
+				"max_repetitions", p.MaxRepetitions, "timeout", p.Timeout, "retries", *p.Retries)
+		}
+		outputConfig.Modules[name].ScrapeInterval = m.ScrapeInterval
+		outputConfig.Modules[name].LabelLimits = m.LabelLimits
+		if *provenance {
+			outputConfig.Modules[name].Provenance, err = moduleProvenance(mibSources(out, mNameToNode), now)
+			if err != nil {
+				return fmt.Errorf("error recording provenance of module %s: %s", name, err)
+			}
+		}
 		level.Info(logger).Log("msg", "Generated metrics", "module", name, "metrics", len(outputConfig.Modules[name].Metrics))
+		if *liteModules {
+			liteName := name + "_lite"
+			if _, ok := cfg.Modules[liteName]; ok {
+				return fmt.Errorf("module %s clashes with the lite variant of module %s", liteName, name)
+			}
+			outputConfig.Modules[liteName] = liteModule(outputConfig.Modules[name])
+			level.Info(logger).Log("msg", "Generated metrics", "module", liteName, "metrics", len(outputConfig.Modules[liteName].Metrics))
+		}
+	}
+
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, reports, logger); err != nil {
+			return err
+		}
+	}
+	if *outputDir != "" {
+		return writeConfigDir(*outputDir, outputConfig, logger)
+	}
+	return writeConfig(*outputPath, outputConfig, "", logger)
+}
+
+// moduleProvenance hashes the MIB files a module was generated from.
+func moduleProvenance(sources map[string]string, now time.Time) (*config.Provenance, error) {
+	p := &config.Provenance{
+		GeneratorVersion: version.Version,
+		GeneratedAt:      now.UTC().Format(time.RFC3339),
+		MIBs:             make([]config.MIBSource, 0, len(sources)),
+	}
+	for mib, file := range sources {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		p.MIBs = append(p.MIBs, config.MIBSource{Module: mib, File: file, SHA256: hex.EncodeToString(sum[:])})
+	}
+	sort.Slice(p.MIBs, func(i, j int) bool { return p.MIBs[i].Module < p.MIBs[j].Module })
+	return p, nil
+}
+
+// writeConfig writes a snmp_exporter config file.
+func writeConfig(path string, outputConfig config.Config, comment string, logger log.Logger) error {
+	outputPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("unable to determine absolute path for output")
 	}
 
 	config.DoNotHideSecrets = true
@@ -90,7 +167,8 @@ func generateConfig(nodes *Node, nameToNode map[string]*Node, logger log.Logger)
 	if err != nil {
 		return fmt.Errorf("error opening output file: %s", err)
 	}
-	out = append([]byte("# WARNING: This file was auto-generated using snmp_exporter generator, manual changes will be lost.\n"), out...)
+	defer f.Close()
+	out = append([]byte(generatedHeader+comment), out...)
 	_, err = f.Write(out)
 	if err != nil {
 		return fmt.Errorf("error writing to output file: %s", err)
@@ -99,15 +177,95 @@ func generateConfig(nodes *Node, nameToNode map[string]*Node, logger log.Logger)
 	return nil
 }
 
+func writeMIBIndex(path string, index config.MIBIndex, logger log.Logger) error {
+	out, err := yaml.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("error marshaling yml: %s", err)
+	}
+	if err := os.WriteFile(path, append([]byte(generatedHeader), out...), 0o644); err != nil {
+		return fmt.Errorf("error writing to output file: %s", err)
+	}
+	level.Info(logger).Log("msg", "MIB index written", "file", path, "objects", len(index))
+	return nil
+}
+
+// writeConfigDir writes each module to its own file, and the auths to an
+// index file listing the module files. Module files left over from modules
+// which no longer exist are removed, so the directory can be glob loaded.
+func writeConfigDir(dir string, outputConfig config.Config, logger log.Logger) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating output directory: %s", err)
+	}
+	names := make([]string, 0, len(outputConfig.Modules))
+	for name := range outputConfig.Modules {
+		if name == "index" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("module name '%s' can't be used as a file name", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	written := map[string]struct{}{}
+	comment := fmt.Sprintf("# Load all files with --config.file=%s\n# Modules:\n", filepath.Join(dir, "*.yml"))
+	for _, name := range names {
+		file := name + ".yml"
+		comment += fmt.Sprintf("#   %s: %s\n", name, file)
+		moduleConfig := config.Config{Modules: map[string]*config.Module{name: outputConfig.Modules[name]}}
+		if err := writeConfig(filepath.Join(dir, file), moduleConfig, "", logger); err != nil {
+			return err
+		}
+		written[file] = struct{}{}
+	}
+	if err := writeConfig(filepath.Join(dir, "index.yml"), config.Config{Auths: outputConfig.Auths}, comment, logger); err != nil {
+		return err
+	}
+	written["index.yml"] = struct{}{}
+
+	// Remove previously generated files of modules which no longer exist.
+	files, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if _, ok := written[filepath.Base(path)]; ok {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading output file: %s", err)
+		}
+		if !strings.HasPrefix(string(content), generatedHeader) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing stale output file: %s", err)
+		}
+		level.Info(logger).Log("msg", "Stale config removed", "file", path)
+	}
+	return nil
+}
+
 var (
 	failOnParseErrors  = kingpin.Flag("fail-on-parse-errors", "Exit with a non-zero status if there are MIB parsing errors").Default("true").Bool()
 	snmpMIBOpts        = kingpin.Flag("snmp.mibopts", "Toggle various defaults controlling MIB parsing, see snmpwalk --help").Default("e").String()
+	duplicateOids      = kingpin.Flag("duplicate-oids", "Which to keep of the nodes of an OID defined by several MIBs, such as a vendor MIB and a fork of it: the first or last MIB loaded, or fail listing them").Default("first").Enum("first", "last", "error")
+	preferMIBs         = kingpin.Flag("prefer-mib", "MIB module whose node to keep of an OID defined by several MIBs, whatever --duplicate-oids says, can be repeated in order of preference").Strings()
+	treeTransforms     = kingpin.Flag("tree-transform", "Shell command reading the parsed MIB tree as JSON on stdin and writing it back transformed on stdout, run before the tree is prepared, can be repeated").Strings()
 	generateCommand    = kingpin.Command("generate", "Generate snmp.yml from generator.yml")
 	userMibsDir        = kingpin.Flag("mibs-dir", "Paths to mibs directory").Default("").Short('m').Strings()
 	generatorYmlPath   = generateCommand.Flag("generator-path", "Path to the input generator.yml file").Default("generator.yml").Short('g').String()
 	outputPath         = generateCommand.Flag("output-path", "Path to write the snmp_exporter's config file").Default("snmp.yml").Short('o').String()
+	outputDir          = generateCommand.Flag("output-dir", "Directory to write each module to its own file, along with an index.yml holding the auths. Overrides --output-path").Default("").String()
+	strict             = generateCommand.Flag("strict", "Fail if an override or lookup in generator.yml matched nothing").Default("false").Bool()
+	suggestParams      = generateCommand.Flag("suggest-walk-params", "Set the max_repetitions, timeout and retries not given in generator.yml from the estimated size of each module").Default("false").Bool()
+	liteModules        = generateCommand.Flag("lite-modules", "Also generate a <module>_lite variant of each module with only its counters and gauges and no lookups, to be scraped more often").Default("false").Bool()
+	provenance         = generateCommand.Flag("provenance", "Record in each module the MIB files it was generated from with their SHA256, the generator version and the time").Default("false").Bool()
+	reportPath         = generateCommand.Flag("report-path", "Path to write a JSON report of each module: its metrics, the objects skipped and why, its lookups and the OIDs to walk and get. Disabled if empty").Default("").String()
+	deprecatedPolicy   = generateCommand.Flag("deprecated-objects", "Which to keep of a 32-bit counter and its 64-bit replacement, such as ifInOctets and ifHCInOctets, when a module walks both").Default("prefer-both").Enum("prefer-current", "prefer-both", "prefer-deprecated")
 	parseErrorsCommand = kingpin.Command("parse_errors", "Debug: Print the parse errors output by NetSNMP")
 	dumpCommand        = kingpin.Command("dump", "Debug: Dump the parsed and prepared MIBs")
+	indexCommand       = kingpin.Command("index", "Write an index of the parsed MIBs for the exporter's --config.mib-index")
+	indexOutputPath    = indexCommand.Flag("output-path", "Path to write the MIB index").Default("mib-index.yml").Short('o').String()
 )
 
 func main() {
@@ -127,6 +285,17 @@ func main() {
 	parseErrors := len(parseOutput)
 
 	nodes := getMIBTree()
+	if _, err := resolveDuplicateOids(nodes, *duplicateOids, *preferMIBs, logger); err != nil {
+		level.Error(logger).Log("msg", "Error resolving duplicate OIDs", "err", err, "help", "Use --prefer-mib or --duplicate-oids=first|last to pick one")
+		os.Exit(1)
+	}
+	if len(*treeTransforms) > 0 {
+		nodes, err = transformTree(nodes, *treeTransforms, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error transforming MIB tree", "err", err)
+			os.Exit(1)
+		}
+	}
 	nameToNode := prepareTree(nodes, logger)
 
 	switch command {
@@ -159,6 +328,11 @@ func main() {
 			fmt.Printf("%s %s %s %q %q %s%s %v %s\n",
 				n.Oid, n.Label, t, n.TextualConvention, n.Hint, n.Indexes, implied, n.EnumValues, n.Description)
 		})
+	case indexCommand.FullCommand():
+		if err := writeMIBIndex(*indexOutputPath, buildMIBIndex(nodes), logger); err != nil {
+			level.Error(logger).Log("msg", "Error writing MIB index", "err", err)
+			os.Exit(1)
+		}
 	}
 	if *failOnParseErrors && parseErrors > 0 {
 		os.Exit(1)
@@ -0,0 +1,148 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestWriteConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	// Stale generated and hand written files.
+	if err := os.WriteFile(filepath.Join(dir, "old.yml"), []byte(generatedHeader+"modules: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manual.yml"), []byte("modules: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputConfig := config.Config{
+		Auths: map[string]*config.Auth{"public_v2": {Community: "public", Version: 2, SecurityLevel: "noAuthNoPriv"}},
+		Modules: map[string]*config.Module{
+			"if_mib":  {Walk: []string{"1.3.6.1.2.1.2"}},
+			"ucd_cpu": {Walk: []string{"1.3.6.1.4.1.2021.11"}},
+		},
+	}
+	if err := writeConfigDir(dir, outputConfig, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.yml"))
+	want := []string{"if_mib.yml", "index.yml", "manual.yml", "ucd_cpu.yml"}
+	if len(files) != len(want) {
+		t.Fatalf("got files %v, want %v", files, want)
+	}
+	for i, f := range files {
+		if filepath.Base(f) != want[i] {
+			t.Errorf("got file %s, want %s", filepath.Base(f), want[i])
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "if_mib.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &config.Config{}
+	if err := yaml.UnmarshalStrict(content, got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Modules) != 1 || got.Modules["if_mib"] == nil || len(got.Auths) != 0 {
+		t.Errorf("unexpected module file content: %s", content)
+	}
+
+	if err := writeConfigDir(dir, config.Config{Modules: map[string]*config.Module{"../x": {}}}, log.NewNopLogger()); err == nil {
+		t.Error("expected error for module name with a path separator")
+	}
+}
+
+func TestModuleConfigMacros(t *testing.T) {
+	content := `
+walk:
+  - 1.3.6.1.4.1.9.9.{13,48}.1
+  - slot{1..3}Temp
+exclude: [slot2Temp]
+overrides:
+  slot{1..2}{Temp,Fan}:
+    type: gauge
+`
+	cfg := &ModuleConfig{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatal(err)
+	}
+	walk := []string{"1.3.6.1.4.1.9.9.13.1", "1.3.6.1.4.1.9.9.48.1", "slot1Temp", "slot2Temp", "slot3Temp"}
+	if !reflect.DeepEqual(cfg.Walk, walk) {
+		t.Errorf("Wrong walk: got %v, want %v", cfg.Walk, walk)
+	}
+	if !reflect.DeepEqual(cfg.Exclude, []string{"slot2Temp"}) {
+		t.Errorf("Wrong exclude: %v", cfg.Exclude)
+	}
+	overrides := map[string]MetricOverrides{
+		"slot1Temp": {Type: "gauge"}, "slot1Fan": {Type: "gauge"},
+		"slot2Temp": {Type: "gauge"}, "slot2Fan": {Type: "gauge"},
+	}
+	if !reflect.DeepEqual(cfg.Overrides, overrides) {
+		t.Errorf("Wrong overrides: got %v, want %v", cfg.Overrides, overrides)
+	}
+
+	for content, msg := range map[string]string{
+		"walk: ['slot{1..3']":                              "unbalanced '{'",
+		"walk: ['slot{3..1}']":                             "invalid range",
+		"walk: ['slot{a{b}}']":                             "nested macros",
+		"walk: ['{1..100}.{1..100}.{1..100}']":             "more than 10000 entries",
+		"overrides: {slot1Temp: {}, 'slot{1..2}Temp': {}}": "defined more than once",
+	} {
+		err := yaml.UnmarshalStrict([]byte(content), &ModuleConfig{})
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected error %q for %q, got %v", msg, content, err)
+		}
+	}
+}
+
+func TestModuleProvenance(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "IF-MIB.txt")
+	if err := os.WriteFile(file, []byte("IF-MIB DEFINITIONS ::= BEGIN\nEND\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	p, err := moduleProvenance(map[string]string{"IF-MIB": file}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config.Provenance{
+		GeneratedAt: "2024-05-01T10:00:00Z",
+		MIBs: []config.MIBSource{{
+			Module: "IF-MIB",
+			File:   file,
+			SHA256: "3ed53b9164faf0c3bbafff069c4685c02add46127a88daafa05d6131d98c349e",
+		}},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Wrong provenance: got %+v, want %+v", p, want)
+	}
+
+	if _, err := moduleProvenance(map[string]string{"MISSING-MIB": filepath.Join(dir, "missing")}, now); err == nil {
+		t.Error("Expected error for a missing MIB file")
+	}
+}
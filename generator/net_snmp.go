@@ -50,12 +50,7 @@ int tc_alloc;
 #endif
 
 // Return the size of a fixed, or 0 if it is not fixed.
-int get_tc_fixed_size(int tc_index) {
-  if (tc_index < 0 || tc_index >= tc_alloc) {
-    return 0;
-  }
-  struct range_list *ranges;
-  ranges = tclist[tc_index].ranges;
+int get_fixed_size(struct range_list *ranges) {
   // Look for one range with only one possible value.
   if (ranges == NULL || ranges->low != ranges->high || ranges->next != NULL) {
     return 0;
@@ -63,6 +58,13 @@ int get_tc_fixed_size(int tc_index) {
   return ranges->low;
 }
 
+int get_tc_fixed_size(int tc_index) {
+  if (tc_index < 0 || tc_index >= tc_alloc) {
+    return 0;
+  }
+  return get_fixed_size(tclist[tc_index].ranges);
+}
+
 */
 import "C"
 
@@ -95,6 +97,10 @@ type Node struct {
 
 	Indexes      []string
 	ImpliedIndex bool
+
+	// The MIB module defining the node, and the file it was loaded from.
+	MIB     string
+	MIBFile string
 }
 
 // Copy returns a deep copy of the tree underneath the current Node.
@@ -243,7 +249,16 @@ func buildMIBTree(t *C.struct_tree, n *Node, oid string) {
 	n.Hint = C.GoString(t.hint)
 	n.TextualConvention = C.GoString(C.get_tc_descriptor(t.tc_index))
 	n.FixedSize = int(C.get_tc_fixed_size(t.tc_index))
+	if n.FixedSize == 0 && n.Type == "OCTETSTR" {
+		// A size given on the object itself, as in OCTET STRING (SIZE(6)).
+		// Without one, string indexes are prefixed with their length.
+		n.FixedSize = int(C.get_fixed_size(t.ranges))
+	}
 	n.Units = C.GoString(t.units)
+	if m := C.find_module(t.modid); m != nil {
+		n.MIB = C.GoString(m.name)
+		n.MIBFile = C.GoString(m.file)
+	}
 
 	n.EnumValues = map[int]string{}
 	enum := t.enums
@@ -267,7 +282,7 @@ func buildMIBTree(t *C.struct_tree, n *Node, oid string) {
 	}
 
 	// Ensure things are consistently ordered.
-	sort.Slice(n.Children, func(i, j int) bool {
+	sort.SliceStable(n.Children, func(i, j int) bool {
 		return n.Children[i].subid < n.Children[j].subid
 	})
 
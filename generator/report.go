@@ -0,0 +1,90 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// moduleReport tells what went into a generated module and what did not,
+// for CI checks of generated configs.
+type moduleReport struct {
+	Metrics []string        `json:"metrics"`
+	Skipped []skippedMetric `json:"skipped"`
+	Lookups []reportLookup  `json:"lookups"`
+	Walk    []string        `json:"walk"`
+	Get     []string        `json:"get"`
+	// Entries of generator.yml which matched nothing.
+	Unused []string `json:"unused"`
+}
+
+// skippedMetric is an object of the walked subtrees which is not a metric
+// of the module.
+type skippedMetric struct {
+	Name   string `json:"name"`
+	Oid    string `json:"oid"`
+	Reason string `json:"reason"`
+}
+
+// reportLookup is a label a lookup adds to a metric.
+type reportLookup struct {
+	Metric    string `json:"metric"`
+	Labelname string `json:"labelname"`
+	// The OID looked up, or the mapping file.
+	Source string `json:"source"`
+}
+
+// fill records the metrics, lookups and OIDs of the generated module.
+func (r *moduleReport) fill(m *config.Module) {
+	r.Metrics, r.Lookups = []string{}, []reportLookup{}
+	for _, metric := range m.Metrics {
+		r.Metrics = append(r.Metrics, metric.Name)
+		for _, lookup := range metric.Lookups {
+			source := lookup.Oid
+			if lookup.MappingFile != "" {
+				source = lookup.MappingFile
+			}
+			if source == "" {
+				// Dropping a source index.
+				continue
+			}
+			r.Lookups = append(r.Lookups, reportLookup{Metric: metric.Name, Labelname: lookup.Labelname, Source: source})
+		}
+	}
+	r.Walk, r.Get = append([]string{}, m.Walk...), append([]string{}, m.Get...)
+	if r.Skipped == nil {
+		r.Skipped = []skippedMetric{}
+	}
+}
+
+// writeReport writes the reports of the modules as a JSON object keyed by
+// module name.
+func writeReport(path string, reports map[string]*moduleReport, logger log.Logger) error {
+	out, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling report: %s", err)
+	}
+	if err := os.WriteFile(path, append(out, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing report: %s", err)
+	}
+	level.Info(logger).Log("msg", "Generation report written", "file", path)
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// transformTree pipes the parsed tree as JSON through each of the shell
+// commands in turn, each writing the tree back transformed, such as with
+// broken vendor MIBs fixed. It runs before prepareTree, so that the
+// transformed tree is prepared as a parsed one would be. It returns the
+// transformed tree.
+func transformTree(nodes *Node, commands []string, logger log.Logger) (*Node, error) {
+	for _, command := range commands {
+		in, err := json.Marshal(nodes)
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(in)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("error running tree transform '%s': %w", command, err)
+		}
+		transformed := &Node{}
+		if err := json.Unmarshal(out, transformed); err != nil {
+			return nil, fmt.Errorf("error reading the tree written by transform '%s': %w", command, err)
+		}
+		var invalid error
+		walkNode(transformed, func(n *Node) {
+			if (n.Oid == "" || n.Label == "") && invalid == nil {
+				invalid = fmt.Errorf("tree transform '%s' wrote a node without an OID or label: %+v", command, *n)
+			}
+			// Not part of the JSON.
+			n.subid = int64(lastSubid(n.Oid))
+		})
+		if invalid != nil {
+			return nil, invalid
+		}
+		// Children may have been added out of order.
+		walkNode(transformed, func(n *Node) {
+			sort.SliceStable(n.Children, func(i, j int) bool {
+				return n.Children[i].subid < n.Children[j].subid
+			})
+		})
+		level.Info(logger).Log("msg", "Transformed MIB tree", "command", command)
+		nodes = transformed
+	}
+	return nodes, nil
+}
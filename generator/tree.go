@@ -15,10 +15,12 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -35,6 +37,38 @@ var combinedTypes = map[string]string{
 	"LldpPortId":             "LldpPortIdSubtype",
 }
 
+// 32-bit interface counters and their high capacity counterparts from the
+// ifXTable, see RFC 2863.
+var highCapacityCounters = map[string]string{
+	"ifInOctets":         "ifHCInOctets",
+	"ifInUcastPkts":      "ifHCInUcastPkts",
+	"ifInMulticastPkts":  "ifHCInMulticastPkts",
+	"ifInBroadcastPkts":  "ifHCInBroadcastPkts",
+	"ifOutOctets":        "ifHCOutOctets",
+	"ifOutUcastPkts":     "ifHCOutUcastPkts",
+	"ifOutMulticastPkts": "ifHCOutMulticastPkts",
+	"ifOutBroadcastPkts": "ifHCOutBroadcastPkts",
+}
+
+// rowStatusColumn returns the RFC 2579 RowStatus column of the table
+// containing n, if any.
+func rowStatusColumn(n *Node, nameToNode map[string]*Node) *Node {
+	i := strings.LastIndex(n.Oid, ".")
+	if i < 0 {
+		return nil
+	}
+	entry, ok := nameToNode[n.Oid[:i]]
+	if !ok || len(entry.Indexes) == 0 {
+		return nil
+	}
+	for _, c := range entry.Children {
+		if c.TextualConvention == "RowStatus" {
+			return c
+		}
+	}
+	return nil
+}
+
 // Helper to walk MIB nodes.
 func walkNode(n *Node, f func(n *Node)) {
 	f(n)
@@ -148,6 +182,103 @@ func prepareTree(nodes *Node, logger log.Logger) map[string]*Node {
 	return nameToNode
 }
 
+// displayHintRe matches RFC 2579 DISPLAY-HINTs of integers with an implied
+// decimal point, such as "d-2" for hundredths.
+var displayHintRe = regexp.MustCompile(`^d-([1-9][0-9]?)$`)
+
+// displayHintScale returns the scale turning the raw value of an integer
+// with the DISPLAY-HINT into the value displayed, or 0 if none is needed.
+// tableEntry returns the entry of a table, given the table or its entry.
+func tableEntry(n *Node) *Node {
+	if len(n.Children) == 1 && len(n.Children[0].Children) != 0 {
+		return n.Children[0]
+	}
+	return n
+}
+
+// joinTables gives the tables of the joins the indexes of the tables they
+// are indexed like, as prepareTree does for entries declaring AUGMENTS, so
+// that lookups of those indexes apply to them too. The indexes of a table
+// having as many as the other are replaced.
+func joinTables(joins []*TableJoin, nameToNode map[string]*Node) error {
+	for _, j := range joins {
+		table, ok := nameToNode[j.Table]
+		if !ok {
+			return fmt.Errorf("cannot find table %s to join", j.Table)
+		}
+		like, ok := nameToNode[j.IndexedLike]
+		if !ok {
+			return fmt.Errorf("cannot find table %s which %s is indexed like", j.IndexedLike, j.Table)
+		}
+		entry, likeEntry := tableEntry(table), tableEntry(like)
+		if len(likeEntry.Indexes) == 0 {
+			return fmt.Errorf("table %s which %s is indexed like has no indexes", j.IndexedLike, j.Table)
+		}
+		if len(entry.Indexes) != 0 && len(entry.Indexes) != len(likeEntry.Indexes) {
+			return fmt.Errorf("table %s has indexes %v, which can't be replaced by indexes %v of %s", j.Table, entry.Indexes, likeEntry.Indexes, j.IndexedLike)
+		}
+		for _, c := range entry.Children {
+			c.Indexes = likeEntry.Indexes
+			c.ImpliedIndex = likeEntry.ImpliedIndex
+		}
+		entry.Indexes = likeEntry.Indexes
+		entry.ImpliedIndex = likeEntry.ImpliedIndex
+	}
+	return nil
+}
+
+func displayHintScale(hint string) float64 {
+	m := displayHintRe.FindStringSubmatch(hint)
+	if m == nil {
+		return 0
+	}
+	digits, _ := strconv.Atoi(m[1])
+	return math.Pow10(-digits)
+}
+
+// expandScopedOverrides returns the overrides of cfg along with those of its
+// scoped overrides, keyed by the OID of each object in their scope, and the
+// OIDs each scoped override was expanded to. Overrides of an object by name
+// or OID take precedence, then the first scoped override matching it.
+func expandScopedOverrides(cfg *ModuleConfig, node *Node, nameToNode map[string]*Node) (map[string]MetricOverrides, map[*ScopedOverride]map[string]struct{}, error) {
+	overrides := make(map[string]MetricOverrides, len(cfg.Overrides))
+	for name, params := range cfg.Overrides {
+		overrides[name] = params
+	}
+	scopes := map[*ScopedOverride]map[string]struct{}{}
+	for _, scope := range cfg.ScopedOverrides {
+		under := ""
+		if scope.Under != "" {
+			n, ok := nameToNode[scope.Under]
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown subtree '%s' of scoped override", scope.Under)
+			}
+			under = n.Oid
+		}
+		scopes[scope] = map[string]struct{}{}
+		walkNode(node, func(n *Node) {
+			if len(n.Children) != 0 {
+				return
+			}
+			if under != "" && n.Oid != under && !strings.HasPrefix(n.Oid, under+".") {
+				return
+			}
+			if scope.MIB != "" && n.MIB != scope.MIB {
+				return
+			}
+			if _, ok := overrides[n.Oid]; ok {
+				return
+			}
+			if _, ok := cfg.Overrides[n.Label]; ok {
+				return
+			}
+			overrides[n.Oid] = scope.MetricOverrides
+			scopes[scope][n.Oid] = struct{}{}
+		})
+	}
+	return overrides, scopes, nil
+}
+
 func metricType(t string) (string, bool) {
 	if _, ok := combinedTypes[t]; ok {
 		return t, true
@@ -165,7 +296,7 @@ func metricType(t string) (string, bool) {
 		return "InetAddressIPv4", true
 	case "PhysAddress48", "DisplayString", "Float", "Double", "InetAddressIPv6":
 		return t, true
-	case "DateAndTime":
+	case "DateAndTime", "TimeStamp":
 		return t, true
 	case "EnumAsInfo", "EnumAsStateSet":
 		return t, true
@@ -185,6 +316,369 @@ func metricAccess(a string) bool {
 	}
 }
 
+// buildMIBIndex returns the names and descriptions of the accessible objects
+// of the tree, for the exporter to describe metrics whose MIB was not
+// available when generating.
+func buildMIBIndex(nodes *Node) config.MIBIndex {
+	index := config.MIBIndex{}
+	walkNode(nodes, func(n *Node) {
+		if n.Type == "" || !metricAccess(n.Access) {
+			return
+		}
+		typ, _ := metricType(n.Type)
+		index[n.Oid] = config.MIBObject{Name: n.Label, Help: n.Description, Type: typ}
+	})
+	return index
+}
+
+// mibSources returns the file each MIB module defining a metric or lookup of
+// the generated module was loaded from, by MIB module name.
+func mibSources(module *config.Module, nameToNode map[string]*Node) map[string]string {
+	sources := map[string]string{}
+	add := func(oid string) {
+		if n, ok := nameToNode[oid]; ok && n.MIB != "" {
+			sources[n.MIB] = n.MIBFile
+		}
+	}
+	for _, m := range module.Metrics {
+		add(m.Oid)
+		for _, l := range m.Lookups {
+			add(l.Oid)
+			for _, fallback := range l.Fallback {
+				add(fallback.Oid)
+			}
+		}
+	}
+	return sources
+}
+
+// Rows assumed for tables, as how many a device has is not known.
+const (
+	estimatedTableRows      = 100
+	estimatedMultiIndexRows = 1000
+)
+
+// estimateVarbinds estimates how many varbinds a scrape of the module returns.
+func estimateVarbinds(module *config.Module) int {
+	varbinds := 0
+	for _, m := range module.Metrics {
+		switch len(m.Indexes) {
+		case 0:
+			varbinds++
+		case 1:
+			varbinds += estimatedTableRows
+		default:
+			varbinds += estimatedMultiIndexRows
+		}
+	}
+	return varbinds
+}
+
+// suggestWalkParams fills the walk parameters which were not set with values
+// suiting the estimated size of the module. Larger modules get larger bulk
+// requests so that they need fewer round trips, a longer timeout as agents
+// take longer to answer those, and fewer retries so that an unresponsive
+// target fails within the scrape rather than retrying each request.
+func suggestWalkParams(params config.WalkParams, module *config.Module) config.WalkParams {
+	varbinds := estimateVarbinds(module)
+	maxRepetitions, timeout := uint32(25), 5*time.Second
+	switch {
+	case varbinds > 5000:
+		maxRepetitions, timeout = 100, 10*time.Second
+	case varbinds > 500:
+		maxRepetitions, timeout = 50, 7*time.Second
+	}
+	if params.MaxRepetitions == 0 {
+		params.MaxRepetitions = maxRepetitions
+	}
+	if params.Timeout == 0 {
+		params.Timeout = timeout
+	}
+	if params.Retries == nil {
+		requests := len(module.Walk) + varbinds/int(params.MaxRepetitions)
+		if len(module.Get) > 0 {
+			requests++
+		}
+		retries := 3
+		switch {
+		case requests > 100:
+			retries = 1
+		case requests > 20:
+			retries = 2
+		}
+		params.Retries = &retries
+	}
+	return params
+}
+
+// liteModule returns a copy of the module with only its counters and gauges
+// and without lookups, to be scraped more often than the full module. Only
+// the columns and instances of the kept metrics are walked.
+func liteModule(m *config.Module) *config.Module {
+	lite := &config.Module{
+		Metrics:    []*config.Metric{},
+		WalkParams: m.WalkParams,
+		Filters:    m.Filters,
+		Provenance: m.Provenance,
+		// The index labels are the same as those of the full module.
+		LabelLimits: m.LabelLimits,
+	}
+	names := map[string]struct{}{}
+	for _, metric := range m.Metrics {
+		if metric.Type != "counter" && metric.Type != "gauge" {
+			continue
+		}
+		l := *metric
+		l.Lookups = []*config.Lookup{}
+		for _, lookup := range metric.Lookups {
+			// Dropping index labels costs nothing, and keeps the labels
+			// the same as those of the full module.
+			if len(lookup.Labels) == 0 {
+				l.Lookups = append(l.Lookups, lookup)
+			}
+		}
+		lite.Metrics = append(lite.Metrics, &l)
+		names[l.Name] = struct{}{}
+	}
+
+	walks := []string{}
+	for _, walk := range m.Walk {
+		for _, metric := range lite.Metrics {
+			switch {
+			case metric.Oid == walk || strings.HasPrefix(metric.Oid, walk+"."):
+				walks = append(walks, metric.Oid)
+			case strings.HasPrefix(walk, metric.Oid+"."):
+				// An instance of a table column.
+				walks = append(walks, walk)
+			}
+		}
+	}
+	lite.Walk = minimizeOids(walks)
+	for _, get := range m.Get {
+		for _, metric := range lite.Metrics {
+			if strings.HasPrefix(get, metric.Oid+".") {
+				lite.Get = append(lite.Get, get)
+				break
+			}
+		}
+	}
+	for _, priority := range m.WalkPriority {
+		for _, walk := range lite.Walk {
+			if priority == walk || strings.HasPrefix(priority, walk+".") || strings.HasPrefix(walk, priority+".") {
+				lite.WalkPriority = append(lite.WalkPriority, priority)
+				break
+			}
+		}
+	}
+	for oid, override := range m.WalkOverrides {
+		for _, walk := range lite.Walk {
+			if oid == walk || strings.HasPrefix(oid, walk+".") || strings.HasPrefix(walk, oid+".") {
+				if lite.WalkOverrides == nil {
+					lite.WalkOverrides = map[string]*config.WalkOverride{}
+				}
+				lite.WalkOverrides[oid] = override
+				break
+			}
+		}
+	}
+	for _, aggregation := range m.Aggregations {
+		if _, ok := names[aggregation.Metric]; ok {
+			lite.Aggregations = append(lite.Aggregations, aggregation)
+		}
+	}
+	for _, histogram := range m.Histograms {
+		_, count := names[histogram.Count]
+		_, bound := names[histogram.Bound]
+		if count && bound {
+			lite.Histograms = append(lite.Histograms, histogram)
+		}
+	}
+	for _, rollup := range m.Rollups {
+		for _, metric := range lite.Metrics {
+			if strings.HasPrefix(metric.Oid+".", rollup.Oid+".") {
+				r := *rollup
+				r.Sum = nil
+				for _, name := range rollup.Sum {
+					if _, ok := names[name]; ok {
+						r.Sum = append(r.Sum, name)
+					}
+				}
+				lite.Rollups = append(lite.Rollups, &r)
+				break
+			}
+		}
+	}
+	for _, utilization := range m.Utilizations {
+		_, octets := names[utilization.Octets]
+		_, speed := names[utilization.Speed]
+		if octets && speed {
+			lite.Utilizations = append(lite.Utilizations, utilization)
+		}
+	}
+	// Pairs still merge the series of either metric alone.
+	for _, pair := range m.CounterPairs {
+		_, counter32 := names[pair.Counter32]
+		_, counter64 := names[pair.Counter64]
+		if counter32 || counter64 {
+			lite.CounterPairs = append(lite.CounterPairs, pair)
+		}
+	}
+	return lite
+}
+
+// supersededMetrics finds the 32-bit counters of the module which have a
+// high capacity counterpart with the same indexes in the module as well, such
+// as ifInOctets and ifHCInOctets or ipSystemStatsInReceives and
+// ipSystemStatsHCInReceives. It maps the names of the deprecated counters to
+// those of their replacements.
+func supersededMetrics(m *config.Module, nameToNode map[string]*Node) map[string]string {
+	byName := make(map[string]*config.Metric, len(m.Metrics))
+	for _, metric := range m.Metrics {
+		byName[metric.Name] = metric
+	}
+	indexes := func(metric *config.Metric) string {
+		labels := []string{}
+		for _, index := range metric.Indexes {
+			labels = append(labels, index.Labelname)
+		}
+		return strings.Join(labels, ",")
+	}
+	superseded := map[string]string{}
+	for _, metric := range m.Metrics {
+		if n, ok := nameToNode[metric.Oid]; !ok || n.Type != "COUNTER" {
+			continue
+		}
+		for i := 1; i < len(metric.Name); i++ {
+			if metric.Name[i] < 'A' || metric.Name[i] > 'Z' {
+				continue
+			}
+			current, ok := byName[metric.Name[:i]+"HC"+metric.Name[i:]]
+			if !ok || indexes(current) != indexes(metric) {
+				continue
+			}
+			if n, ok := nameToNode[current.Oid]; ok && n.Type == "COUNTER64" {
+				superseded[metric.Name] = current.Name
+				break
+			}
+		}
+	}
+	return superseded
+}
+
+// preferObjects drops either the deprecated or the current metric of each
+// pair, along with the walks, gets and aggregations only they needed. Pairs
+// of counter_pairs are kept, as they are already merged.
+func preferObjects(m *config.Module, superseded map[string]string, policy string) []string {
+	paired := map[string]struct{}{}
+	for _, pair := range m.CounterPairs {
+		paired[pair.Counter32] = struct{}{}
+		paired[pair.Counter64] = struct{}{}
+	}
+	drop := map[string]struct{}{}
+	for deprecated, current := range superseded {
+		if _, ok := paired[deprecated]; ok {
+			continue
+		}
+		switch policy {
+		case "prefer-current":
+			drop[deprecated] = struct{}{}
+		case "prefer-deprecated":
+			drop[current] = struct{}{}
+		}
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+	dropped := []string{}
+	metrics := []*config.Metric{}
+	oids := []string{}
+	for _, metric := range m.Metrics {
+		if _, ok := drop[metric.Name]; ok {
+			dropped = append(dropped, metric.Name)
+			oids = append(oids, metric.Oid)
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	m.Metrics = metrics
+	under := func(oid string) bool {
+		for _, o := range oids {
+			if oid == o || strings.HasPrefix(oid, o+".") {
+				return true
+			}
+		}
+		return false
+	}
+	// Walks of whole tables still cover the dropped columns.
+	walk := []string{}
+	for _, oid := range m.Walk {
+		if !under(oid) {
+			walk = append(walk, oid)
+		}
+	}
+	m.Walk = walk
+	var get []string
+	for _, oid := range m.Get {
+		if !under(oid) {
+			get = append(get, oid)
+		}
+	}
+	m.Get = get
+	var priority []string
+	for _, oid := range m.WalkPriority {
+		if !under(oid) {
+			priority = append(priority, oid)
+		}
+	}
+	m.WalkPriority = priority
+	for oid := range m.WalkOverrides {
+		if under(oid) {
+			delete(m.WalkOverrides, oid)
+		}
+	}
+	var aggregations []*config.Aggregation
+	for _, aggregation := range m.Aggregations {
+		if _, ok := drop[aggregation.Metric]; !ok {
+			aggregations = append(aggregations, aggregation)
+		}
+	}
+	m.Aggregations = aggregations
+	var histograms []*config.Histogram
+	for _, histogram := range m.Histograms {
+		_, count := drop[histogram.Count]
+		_, bound := drop[histogram.Bound]
+		if !count && !bound {
+			histograms = append(histograms, histogram)
+		}
+	}
+	m.Histograms = histograms
+	var utilizations []*config.Utilization
+	for _, utilization := range m.Utilizations {
+		_, octets := drop[utilization.Octets]
+		_, speed := drop[utilization.Speed]
+		if !octets && !speed {
+			utilizations = append(utilizations, utilization)
+		}
+	}
+	m.Utilizations = utilizations
+	// Rollups still count the rows of the other columns.
+	for i, rollup := range m.Rollups {
+		var sum []string
+		for _, name := range rollup.Sum {
+			if _, ok := drop[name]; !ok {
+				sum = append(sum, name)
+			}
+		}
+		if len(sum) != len(rollup.Sum) {
+			r := *rollup
+			r.Sum = sum
+			m.Rollups[i] = &r
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
 // Reduce a set of overlapping OID subtrees.
 func minimizeOids(oids []string) []string {
 	sort.Strings(oids)
@@ -199,6 +693,28 @@ func minimizeOids(oids []string) []string {
 	return minimized
 }
 
+// excludeFromWalk returns the subtrees of n which don't contain any of the
+// excluded OIDs, so that walking them covers n without the excluded ones.
+func excludeFromWalk(n *Node, excluded []string) []string {
+	contains := false
+	for _, oid := range excluded {
+		if strings.HasPrefix(n.Oid+".", oid+".") {
+			return nil
+		}
+		if strings.HasPrefix(oid, n.Oid+".") {
+			contains = true
+		}
+	}
+	if !contains {
+		return []string{n.Oid}
+	}
+	oids := []string{}
+	for _, child := range n.Children {
+		oids = append(oids, excludeFromWalk(child, excluded)...)
+	}
+	return oids
+}
+
 // Search node tree for the longest OID match.
 func searchNodeTree(oid string, node *Node) *Node {
 	if node == nil || !strings.HasPrefix(oid+".", node.Oid+".") {
@@ -271,13 +787,73 @@ func getIndexNode(lookup string, nameToNode map[string]*Node, metricOid string)
 	return nameToNode[lookup]
 }
 
-func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*Node, logger log.Logger) (*config.Module, error) {
+// Relative OIDs start with a period, and are appended to the module's base OID.
+func isRelativeOid(oid string) bool {
+	return strings.HasPrefix(oid, ".")
+}
+
+// Expand relative OIDs in the walk, lookups and static filters of a module.
+func expandRelativeOids(cfg *ModuleConfig, nameToNode map[string]*Node) error {
+	if cfg.BaseOid == "" {
+		return nil
+	}
+	base := cfg.BaseOid
+	if n, ok := nameToNode[base]; ok {
+		base = n.Oid
+	} else if _, err := strconv.Atoi(strings.Split(base, ".")[0]); err != nil {
+		return fmt.Errorf("cannot find base_oid '%s'", cfg.BaseOid)
+	}
+	expand := func(oid string) string {
+		if isRelativeOid(oid) {
+			return base + oid
+		}
+		return oid
+	}
+	for i, oid := range cfg.Walk {
+		cfg.Walk[i] = expand(oid)
+	}
+	for i, oid := range cfg.Exclude {
+		cfg.Exclude[i] = expand(oid)
+	}
+	for i, oid := range cfg.Get {
+		cfg.Get[i] = expand(oid)
+	}
+	for _, lookup := range cfg.Lookups {
+		lookup.Lookup = expand(lookup.Lookup)
+		for i, oid := range lookup.Fallback {
+			lookup.Fallback[i] = expand(oid)
+		}
+	}
+	for _, filter := range cfg.Filters.Static {
+		for i, oid := range filter.Targets {
+			filter.Targets[i] = expand(oid)
+		}
+	}
+	return nil
+}
+
+// generateConfigModule generates the exporter config of a module, also
+// returning the overrides and lookups of cfg which matched nothing.
+func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*Node, logger log.Logger) (*config.Module, *moduleReport, error) {
 	out := &config.Module{}
+	report := &moduleReport{}
 	needToWalk := map[string]struct{}{}
 	tableInstances := map[string][]string{}
+	usedOverrides := map[string]struct{}{}
+	usedLookups := map[int]struct{}{}
 
-	// Apply type overrides for the current module.
-	for name, params := range cfg.Overrides {
+	if err := expandRelativeOids(cfg, nameToNode); err != nil {
+		return nil, nil, err
+	}
+	overrides, scopes, err := expandScopedOverrides(cfg, node, nameToNode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Apply type overrides for the current module, remembering the types
+	// the MIBs give the objects.
+	mibTypes := map[string]string{}
+	for name, params := range overrides {
 		if params.Type == "" {
 			continue
 		}
@@ -287,6 +863,9 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 			level.Warn(logger).Log("msg", "Could not find node to override type", "node", name)
 			continue
 		}
+		if t, ok := metricType(n.Type); ok {
+			mibTypes[n.Oid] = t
+		}
 		// params.Type validated at generator configuration.
 		n.Type = params.Type
 	}
@@ -302,15 +881,71 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 			toWalk = append(toWalk, oid)
 		}
 	}
+	// Add the high capacity counterparts of any walked 32-bit counters.
+	replacedCounters := map[string]string{}
+	if cfg.HighCapacityCounters != "" {
+		for name, hcName := range highCapacityCounters {
+			n, ok := nameToNode[name]
+			if !ok {
+				continue
+			}
+			hc, ok := nameToNode[hcName]
+			if !ok {
+				continue
+			}
+			for i, oid := range toWalk {
+				if strings.HasPrefix(n.Oid+".", oid+".") {
+					if oid == n.Oid && cfg.HighCapacityCounters == "replace" {
+						// Walked on its own, so no need to walk it at all.
+						toWalk[i] = hc.Oid
+					} else {
+						toWalk = append(toWalk, hc.Oid)
+					}
+					replacedCounters[name] = hcName
+					break
+				}
+			}
+		}
+	}
 	toWalk = minimizeOids(toWalk)
 
+	// Replace walks covering excluded OIDs by the subtrees around them.
+	if len(cfg.Exclude) > 0 {
+		excluded := []string{}
+		for _, oid := range cfg.Exclude {
+			n, ok := nameToNode[oid]
+			if !ok {
+				return nil, nil, fmt.Errorf("cannot find oid '%s' to exclude", oid)
+			}
+			excluded = append(excluded, n.Oid)
+		}
+		remaining := []string{}
+		for _, oid := range toWalk {
+			if n, ok := nameToNode[oid]; ok {
+				remaining = append(remaining, excludeFromWalk(n, excluded)...)
+				continue
+			}
+			// Instances of objects.
+			keep := true
+			for _, e := range excluded {
+				if strings.HasPrefix(oid+".", e+".") {
+					keep = false
+				}
+			}
+			if keep {
+				remaining = append(remaining, oid)
+			}
+		}
+		toWalk = remaining
+	}
+
 	// Find all top-level nodes.
 	metricNodes := map[*Node]struct{}{}
 	for _, oid := range toWalk {
 		metricNode, oidType := getMetricNode(oid, node, nameToNode)
 		switch oidType {
 		case oidNotFound:
-			return nil, fmt.Errorf("cannot find oid '%s' to walk", oid)
+			return nil, nil, fmt.Errorf("cannot find oid '%s' to walk", oid)
 		case oidSubtree:
 			needToWalk[oid] = struct{}{}
 		case oidInstance:
@@ -325,6 +960,22 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 		}
 		metricNodes[metricNode] = struct{}{}
 	}
+	// Instances to get are taken as they are. Those of objects in the MIBs
+	// also produce their metrics.
+	for _, oid := range cfg.Get {
+		needToWalk[oid+"."] = struct{}{}
+		n := searchNodeTree(oid, node)
+		if n == nil || n.Oid == oid {
+			continue
+		}
+		if _, ok := metricType(n.Type); !ok || !metricAccess(n.Access) {
+			continue
+		}
+		if len(n.Indexes) != 0 {
+			tableInstances[n.Oid] = append(tableInstances[n.Oid], strings.TrimPrefix(oid, n.Oid))
+		}
+		metricNodes[n] = struct{}{}
+	}
 	// Sort the metrics by OID to make the output deterministic.
 	metrics := make([]*Node, 0, len(metricNodes))
 	for key := range metricNodes {
@@ -335,14 +986,23 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 	})
 
 	// Find all the usable metrics.
+	var transformErr error
 	for _, metricNode := range metrics {
 		walkNode(metricNode, func(n *Node) {
+			skip := func(reason string) {
+				report.Skipped = append(report.Skipped, skippedMetric{Name: n.Label, Oid: n.Oid, Reason: reason})
+			}
 			t, ok := metricType(n.Type)
 			if !ok {
-				return // Unsupported type.
+				// Unsupported type. Tables and entries have none.
+				if len(n.Children) == 0 {
+					skip(fmt.Sprintf("unsupported type %s", n.Type))
+				}
+				return
 			}
 
 			if !metricAccess(n.Access) {
+				skip("not accessible")
 				return // Inaccessible metrics.
 			}
 
@@ -355,10 +1015,36 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 				Lookups:    []*config.Lookup{},
 				EnumValues: n.EnumValues,
 			}
+			if cfg.Timestamps && n.TextualConvention == "TimeStamp" {
+				metric.Type = "TimeStamp"
+			}
+			// Only kept for the exporter's --config.stale-check, which
+			// tells types of the same kind apart.
+			if mibType, ok := mibTypes[n.Oid]; ok && config.TypeKind(mibType) != config.TypeKind(metric.Type) {
+				metric.OverriddenType = mibType
+			}
+			if t == "gauge" {
+				metric.Scale = displayHintScale(n.Hint)
+			}
 
-			if cfg.Overrides[metric.Name].Ignore {
+			if overrides[metric.Name].Ignore {
+				usedOverrides[metric.Name] = struct{}{}
+				skip("ignored by override")
 				return // Ignored metric.
 			}
+			if overrides[metric.Oid].Ignore {
+				usedOverrides[metric.Oid] = struct{}{}
+				skip("ignored by scoped override")
+				return // Ignored by a scoped override.
+			}
+
+			if hcName, ok := replacedCounters[metric.Name]; ok {
+				if cfg.HighCapacityCounters == "replace" {
+					skip(fmt.Sprintf("replaced by %s", hcName))
+					return // Superseded by the high capacity counter.
+				}
+				metric.Help = fmt.Sprintf("%s (deprecated, use %s)", metric.Help, hcName)
+			}
 
 			// Afi (Address family)
 			prevType := ""
@@ -369,11 +1055,13 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 				indexNode, ok := nameToNode[i]
 				if !ok {
 					level.Warn(logger).Log("msg", "Could not find index for node", "node", n.Label, "index", i)
+					skip(fmt.Sprintf("missing index %s", i))
 					return
 				}
 				index.Type, ok = metricType(indexNode.Type)
 				if !ok {
 					level.Warn(logger).Log("msg", "Can't handle index type on node", "node", n.Label, "index", i, "type", indexNode.Type)
+					skip(fmt.Sprintf("unsupported type %s of index %s", indexNode.Type, i))
 					return
 				}
 				index.FixedSize = indexNode.FixedSize
@@ -381,6 +1069,29 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 					index.Implied = true
 				}
 				index.EnumValues = indexNode.EnumValues
+				for _, name := range []string{i, indexNode.Oid} {
+					if format := overrides[name].MACFormat; format != "" && index.Type == "PhysAddress48" && index.MACFormat == "" {
+						usedOverrides[name] = struct{}{}
+						index.MACFormat = format
+					}
+					if transforms := overrides[name].IndexTransforms; len(transforms) != 0 && index.Transforms == nil {
+						usedOverrides[name] = struct{}{}
+						if err := config.CheckIndexTransforms(i, index.Type, transforms); err != nil {
+							transformErr = err
+							return
+						}
+						index.Transforms = transforms
+					}
+				}
+				// OctetString indexes are mostly text, yet some are opaque
+				// binary such as engine IDs, so let their content decide.
+				switch index.Type {
+				case "OctetString", "DisplayString":
+					index.Display = cfg.IndexDisplay[i]
+					if index.Display == "" && index.Type == "OctetString" {
+						index.Display = "auto"
+					}
+				}
 
 				// Convert (InetAddressType,InetAddress) to (InetAddress)
 				if subtype, ok := combinedTypes[index.Type]; ok {
@@ -390,6 +1101,7 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 						metric.Indexes = metric.Indexes[:len(metric.Indexes)-2]
 					} else {
 						level.Warn(logger).Log("msg", "Can't handle index type on node, missing preceding", "node", n.Label, "type", index.Type, "missing", subtype)
+						skip(fmt.Sprintf("index %s of type %s not preceded by one of type %s", i, index.Type, subtype))
 						return
 					}
 				}
@@ -397,9 +1109,30 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 				prevType = indexNode.TextualConvention
 				metric.Indexes = append(metric.Indexes, index)
 			}
+
+			// Label rows of tables with a RowStatus column with their status.
+			if cfg.RowStatus && len(metric.Indexes) > 0 {
+				if rs := rowStatusColumn(n, nameToNode); rs != nil && rs != n {
+					l := &config.Lookup{Labelname: "row_status", Oid: rs.Oid, Type: "RowStatus"}
+					for _, index := range metric.Indexes {
+						l.Labels = append(l.Labels, sanitizeLabelName(index.Labelname))
+					}
+					metric.Lookups = append(metric.Lookups, l)
+					if len(tableInstances[n.Oid]) > 0 {
+						for _, index := range tableInstances[n.Oid] {
+							needToWalk[rs.Oid+index+"."] = struct{}{}
+						}
+					} else {
+						needToWalk[rs.Oid] = struct{}{}
+					}
+				}
+			}
 			out.Metrics = append(out.Metrics, metric)
 		})
 	}
+	if transformErr != nil {
+		return nil, nil, transformErr
+	}
 
 	// Build an map of all oid targeted by a filter to access it easily later.
 	filterMap := map[string][]string{}
@@ -417,6 +1150,8 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 	// Apply lookups.
 	for _, metric := range out.Metrics {
 		toDelete := []string{}
+		// The indexes of the rows, without those lookups add below.
+		rowIndexes := metric.Indexes
 
 		// Build a list of lookup labels which are required as index.
 		requiredAsIndex := []string{}
@@ -424,7 +1159,7 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 			requiredAsIndex = append(requiredAsIndex, lookup.SourceIndexes...)
 		}
 
-		for _, lookup := range cfg.Lookups {
+		for i, lookup := range cfg.Lookups {
 			foundIndexes := 0
 			// See if all lookup indexes are present.
 			for _, index := range metric.Indexes {
@@ -435,13 +1170,28 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 				}
 			}
 			if foundIndexes == len(lookup.SourceIndexes) {
+				usedLookups[i] = struct{}{}
+			}
+			if foundIndexes == len(lookup.SourceIndexes) && lookup.MappingFile != "" {
+				l := &config.Lookup{
+					Labelname:   lookup.Labelname,
+					MappingFile: lookup.MappingFile,
+				}
+				for _, oldIndex := range lookup.SourceIndexes {
+					l.Labels = append(l.Labels, sanitizeLabelName(oldIndex))
+				}
+				metric.Lookups = append(metric.Lookups, l)
+				if lookup.DropSourceIndexes {
+					toDelete = append(toDelete, lookup.SourceIndexes...)
+				}
+			} else if foundIndexes == len(lookup.SourceIndexes) {
 				if _, ok := nameToNode[lookup.Lookup]; !ok {
-					return nil, fmt.Errorf("unknown index '%s'", lookup.Lookup)
+					return nil, nil, fmt.Errorf("unknown index '%s'", lookup.Lookup)
 				}
 				indexNode := getIndexNode(lookup.Lookup, nameToNode, metric.Oid)
 				typ, ok := metricType(indexNode.Type)
 				if !ok {
-					return nil, fmt.Errorf("unknown index type %s for %s", indexNode.Type, lookup.Lookup)
+					return nil, nil, fmt.Errorf("unknown index type %s for %s", indexNode.Type, lookup.Lookup)
 				}
 				l := &config.Lookup{
 					Labelname: sanitizeLabelName(indexNode.Label),
@@ -451,6 +1201,30 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 				for _, oldIndex := range lookup.SourceIndexes {
 					l.Labels = append(l.Labels, sanitizeLabelName(oldIndex))
 				}
+				if typ == "PhysAddress48" {
+					for _, name := range []string{lookup.Lookup, indexNode.Oid} {
+						if format := overrides[name].MACFormat; format != "" && l.MACFormat == "" {
+							usedOverrides[name] = struct{}{}
+							l.MACFormat = format
+						}
+					}
+				}
+				lookupOids := []string{indexNode.Oid}
+				if len(lookup.Fallback) > 0 && lookup.Labelname != "" {
+					l.Labelname = lookup.Labelname
+				}
+				for _, fallback := range lookup.Fallback {
+					if _, ok := nameToNode[fallback]; !ok {
+						return nil, nil, fmt.Errorf("unknown index '%s'", fallback)
+					}
+					fallbackNode := getIndexNode(fallback, nameToNode, metric.Oid)
+					fallbackType, ok := metricType(fallbackNode.Type)
+					if !ok {
+						return nil, nil, fmt.Errorf("unknown index type %s for %s", fallbackNode.Type, fallback)
+					}
+					l.Fallback = append(l.Fallback, &config.LookupFallback{Oid: fallbackNode.Oid, Type: fallbackType})
+					lookupOids = append(lookupOids, fallbackNode.Oid)
+				}
 				metric.Lookups = append(metric.Lookups, l)
 
 				// If lookup label is used as source index in another lookup,
@@ -464,12 +1238,21 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 				}
 
 				// Make sure we walk the lookup OID(s).
-				if len(tableInstances[metric.Oid]) > 0 {
-					for _, index := range tableInstances[metric.Oid] {
-						needToWalk[indexNode.Oid+index+"."] = struct{}{}
+				instances := tableInstances[metric.Oid]
+				if cfg.InlineLookupInstances && len(instances) > 0 {
+					var ok bool
+					if instances, ok = lookupInstances(instances, rowIndexes, lookup.SourceIndexes); !ok {
+						level.Warn(logger).Log("msg", "Can't derive the instances of a lookup from those of the metric, walking all of it", "metric", metric.Name, "lookup", lookup.Lookup)
+					}
+				}
+				for _, oid := range lookupOids {
+					if len(instances) > 0 {
+						for _, index := range instances {
+							needToWalk[oid+index+"."] = struct{}{}
+						}
+					} else {
+						needToWalk[oid] = struct{}{}
 					}
-				} else {
-					needToWalk[indexNode.Oid] = struct{}{}
 				}
 				// We apply the same filter to metric.Oid if the lookup oid is filtered.
 				indices, found := filterMap[indexNode.Oid]
@@ -492,6 +1275,33 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 		}
 	}
 
+	// Type overrides are used if their node ended up as a metric, index or lookup.
+	referenced := map[string]struct{}{}
+	for _, metric := range out.Metrics {
+		referenced[metric.Oid] = struct{}{}
+		for _, index := range metric.Indexes {
+			if n, ok := nameToNode[index.Labelname]; ok {
+				referenced[n.Oid] = struct{}{}
+			}
+		}
+		for _, lookup := range metric.Lookups {
+			referenced[lookup.Oid] = struct{}{}
+			for _, fallback := range lookup.Fallback {
+				referenced[fallback.Oid] = struct{}{}
+			}
+		}
+	}
+	for name, params := range overrides {
+		if params.Type == "" {
+			continue
+		}
+		if n, ok := nameToNode[name]; ok {
+			if _, ok := referenced[n.Oid]; ok {
+				usedOverrides[name] = struct{}{}
+			}
+		}
+	}
+
 	// Ensure index label names are sane.
 	for _, metric := range out.Metrics {
 		for _, index := range metric.Indexes {
@@ -499,6 +1309,40 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 		}
 	}
 
+	// Rename index labels, including lookups reading or replacing them.
+	if len(cfg.IndexLabels) > 0 {
+		renames := map[string]string{}
+		for index, name := range cfg.IndexLabels {
+			renames[sanitizeLabelName(index)] = name
+		}
+		rename := func(label string) string {
+			if name, ok := renames[label]; ok {
+				return name
+			}
+			return label
+		}
+		for _, metric := range out.Metrics {
+			// Two labels ending up with the same name would overwrite each other.
+			original := map[string]string{}
+			for _, label := range metricLabelNames(metric) {
+				name := rename(label)
+				if other, ok := original[name]; ok && other != label {
+					return nil, nil, fmt.Errorf("index_labels rename '%s' and '%s' to the same label '%s' on metric '%s'", other, label, name, metric.Name)
+				}
+				original[name] = label
+			}
+			for _, index := range metric.Indexes {
+				index.Labelname = rename(index.Labelname)
+			}
+			for _, lookup := range metric.Lookups {
+				lookup.Labelname = rename(lookup.Labelname)
+				for i, label := range lookup.Labels {
+					lookup.Labels[i] = rename(label)
+				}
+			}
+		}
+	}
+
 	// Check that the object before an InetAddress is an InetAddressType.
 	// If not, change it to an OctetString.
 	for _, metric := range out.Metrics {
@@ -524,12 +1368,19 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 	}
 
 	// Apply module config overrides to their corresponding metrics.
-	for name, params := range cfg.Overrides {
+	for name, params := range overrides {
 		for _, metric := range out.Metrics {
 			if name == metric.Name || name == metric.Oid {
+				usedOverrides[name] = struct{}{}
 				metric.RegexpExtracts = params.RegexpExtracts
 				metric.Offset = params.Offset
-				metric.Scale = params.Scale
+				// Keep the scale of the DISPLAY-HINT unless overridden.
+				if params.Scale != 0 {
+					metric.Scale = params.Scale
+				}
+				metric.ValueMap = params.ValueMap
+				metric.Min, metric.Max, metric.OutOfRange = params.Min, params.Max, params.OutOfRange
+				metric.MACFormat = params.MACFormat
 				if params.Help != "" {
 					metric.Help = params.Help
 				}
@@ -537,6 +1388,10 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 		}
 	}
 
+	if err := resolveNameConflicts(out.Metrics, cfg.NameConflicts, nameToNode, logger); err != nil {
+		return nil, nil, err
+	}
+
 	// Apply filters.
 	for _, filter := range cfg.Filters.Static {
 		// Delete the oid targeted by the filter, as we won't walk the whole table.
@@ -553,6 +1408,48 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 	}
 
 	out.Filters = cfg.Filters.Dynamic
+	out.Aggregations = cfg.Aggregations
+	out.Histograms = cfg.Histograms
+	// Tables of rollups are given by name or OID, the table by default.
+	for _, rollup := range cfg.Rollups {
+		r := *rollup
+		table := r.Oid
+		if table == "" {
+			table = r.Table
+		}
+		if n, ok := nameToNode[table]; ok {
+			r.Oid = n.Oid
+		} else if strings.Trim(table, "0123456789.") != "" {
+			return nil, nil, fmt.Errorf("cannot find table '%s' of rollup", table)
+		}
+		out.Rollups = append(out.Rollups, &r)
+	}
+	out.Utilizations = cfg.Utilizations
+	out.CounterPairs = cfg.CounterPairs
+	out.Strictness = cfg.Strictness
+	out.Topology = cfg.Topology
+	out.EntitySensors = cfg.EntitySensors
+	for _, name := range cfg.WalkPriority {
+		if n, ok := nameToNode[name]; ok {
+			out.WalkPriority = append(out.WalkPriority, n.Oid)
+		} else if strings.Trim(name, "0123456789.") == "" {
+			out.WalkPriority = append(out.WalkPriority, name)
+		} else {
+			return nil, nil, fmt.Errorf("cannot find oid '%s' to prioritize", name)
+		}
+	}
+	for name, override := range cfg.WalkOverrides {
+		oid := name
+		if n, ok := nameToNode[name]; ok {
+			oid = n.Oid
+		} else if strings.Trim(name, "0123456789.") != "" {
+			return nil, nil, fmt.Errorf("cannot find oid '%s' to override walk parameters of", name)
+		}
+		if out.WalkOverrides == nil {
+			out.WalkOverrides = map[string]*config.WalkOverride{}
+		}
+		out.WalkOverrides[oid] = override
+	}
 
 	oids := []string{}
 	for k := range needToWalk {
@@ -566,13 +1463,119 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 			out.Walk = append(out.Walk, k)
 		}
 	}
-	return out, nil
+
+	unused := []string{}
+	for name := range cfg.Overrides {
+		if _, ok := usedOverrides[name]; !ok {
+			unused = append(unused, fmt.Sprintf("override '%s'", name))
+		}
+	}
+	for _, scope := range cfg.ScopedOverrides {
+		used := false
+		for oid := range scopes[scope] {
+			if _, ok := usedOverrides[oid]; ok {
+				used = true
+				break
+			}
+		}
+		if !used {
+			unused = append(unused, scope.String())
+		}
+	}
+	sort.Strings(unused)
+	for i, lookup := range cfg.Lookups {
+		if _, ok := usedLookups[i]; !ok {
+			target := lookup.Lookup
+			if lookup.MappingFile != "" {
+				target = lookup.MappingFile
+			}
+			unused = append(unused, fmt.Sprintf("lookup '%s' with source_indexes %v", target, lookup.SourceIndexes))
+		}
+	}
+	for _, entry := range unused {
+		level.Warn(logger).Log("msg", "Config entry matched nothing", "entry", entry)
+	}
+	report.Unused = unused
+	return out, report, nil
 }
 
 var (
 	invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	labelNameRE        = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// Numeric OIDs of instances, possibly relative.
+	instanceOidRE = regexp.MustCompile(`^\.?[0-9]+(\.[0-9]+)*$`)
 )
 
+// metricLabelNames returns the names of the labels set by the indexes and
+// lookups of a metric.
+func metricLabelNames(metric *config.Metric) []string {
+	names := []string{}
+	for _, index := range metric.Indexes {
+		names = append(names, index.Labelname)
+	}
+	for _, lookup := range metric.Lookups {
+		names = append(names, lookup.Labelname)
+	}
+	return names
+}
+
+// resolveNameConflicts tells apart metrics of different objects which have
+// the same name, such as objects of vendor forks of a MIB, by suffixing their
+// names with the name of their MIB or of their parent node. Without a
+// strategy the conflicts are only logged.
+func resolveNameConflicts(metrics []*config.Metric, strategy string, nameToNode map[string]*Node, logger log.Logger) error {
+	conflicts := func() (map[string][]*config.Metric, []string) {
+		byName := map[string][]*config.Metric{}
+		names := []string{}
+		for _, metric := range metrics {
+			if len(byName[metric.Name]) == 1 {
+				names = append(names, metric.Name)
+			}
+			byName[metric.Name] = append(byName[metric.Name], metric)
+		}
+		return byName, names
+	}
+	oids := func(metrics []*config.Metric) string {
+		oids := []string{}
+		for _, metric := range metrics {
+			oids = append(oids, metric.Oid)
+		}
+		return strings.Join(oids, ", ")
+	}
+	byName, names := conflicts()
+	for _, name := range names {
+		switch strategy {
+		case "":
+			level.Warn(logger).Log("msg", "Metrics of different objects have the same name, set name_conflicts to tell them apart", "metric", name, "oids", oids(byName[name]))
+			continue
+		case "error":
+			return fmt.Errorf("metrics of objects %s have the same name '%s'", oids(byName[name]), name)
+		}
+		for _, metric := range byName[name] {
+			suffix := ""
+			switch strategy {
+			case "mib":
+				if n, ok := nameToNode[metric.Oid]; ok {
+					suffix = n.MIB
+				}
+			case "parent":
+				if n, ok := nameToNode[metric.Oid[:strings.LastIndexByte(metric.Oid, '.')]]; ok {
+					suffix = n.Label
+				}
+			}
+			if suffix == "" {
+				return fmt.Errorf("cannot find the %s of object %s to rename metric '%s'", strategy, metric.Oid, name)
+			}
+			metric.Name = sanitizeLabelName(name + "_" + suffix)
+			level.Info(logger).Log("msg", "Renamed metric with a conflicting name", "metric", name, "oid", metric.Oid, "name", metric.Name)
+		}
+	}
+	if byName, names = conflicts(); strategy != "" && len(names) > 0 {
+		return fmt.Errorf("metrics of objects %s still have the same name '%s' with name_conflicts %s", oids(byName[names[0]]), names[0], strategy)
+	}
+	return nil
+}
+
 func sanitizeLabelName(name string) string {
 	return invalidLabelCharRE.ReplaceAllString(name, "_")
 }
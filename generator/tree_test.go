@@ -16,7 +16,9 @@ package main
 import (
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/prometheus/snmp_exporter/config"
@@ -495,11 +497,13 @@ func TestGenerateConfigModule(t *testing.T) {
 				Children: []*Node{
 					{Oid: "1.1", Access: "ACCESS_READONLY", Type: "INTEGER", Label: "node1"},
 					{Oid: "1.2", Access: "ACCESS_READONLY", Type: "OCTETSTR", Label: "node2"},
+					{Oid: "1.3", Access: "ACCESS_READONLY", Type: "COUNTER", Label: "node3"},
 				}},
 			cfg: &ModuleConfig{
 				Walk: []string{"root"},
 				Overrides: map[string]MetricOverrides{
 					"node2": MetricOverrides{Type: "DisplayString"},
+					"node3": MetricOverrides{Type: "gauge"},
 				},
 			},
 			out: &config.Module{
@@ -517,6 +521,99 @@ func TestGenerateConfigModule(t *testing.T) {
 						Type: "DisplayString",
 						Help: " - 1.2",
 					},
+					{
+						Name:           "node3",
+						Oid:            "1.3",
+						Type:           "gauge",
+						Help:           " - 1.3",
+						OverriddenType: "counter",
+					},
+				},
+			},
+		},
+		// Scoped overrides, yielding to overrides by name.
+		{
+			node: &Node{Oid: "1", Type: "OTHER", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Access: "ACCESS_READONLY", Type: "INTEGER", Label: "node1", MIB: "VENDOR-OLD-MIB"},
+					{Oid: "1.2", Type: "OTHER", Label: "vendor",
+						Children: []*Node{
+							{Oid: "1.2.1", Access: "ACCESS_READONLY", Type: "OCTETSTR", Label: "node2", MIB: "VENDOR-MIB"},
+							{Oid: "1.2.2", Access: "ACCESS_READONLY", Type: "OCTETSTR", Label: "node3", MIB: "VENDOR-MIB"},
+						}},
+				}},
+			cfg: &ModuleConfig{
+				Walk: []string{"root"},
+				Overrides: map[string]MetricOverrides{
+					"node3": MetricOverrides{Type: "PhysAddress48"},
+				},
+				ScopedOverrides: []*ScopedOverride{
+					{Under: "vendor", MIB: "VENDOR-MIB", MetricOverrides: MetricOverrides{Type: "DisplayString"}},
+					{MIB: "VENDOR-OLD-MIB", MetricOverrides: MetricOverrides{Ignore: true}},
+				},
+			},
+			out: &config.Module{
+				Walk: []string{"1"},
+				Metrics: []*config.Metric{
+					{
+						Name: "node2",
+						Oid:  "1.2.1",
+						Type: "DisplayString",
+						Help: " - 1.2.1",
+					},
+					{
+						Name: "node3",
+						Oid:  "1.2.2",
+						Type: "PhysAddress48",
+						Help: " - 1.2.2",
+					},
+				},
+			},
+		},
+		// Scale from DISPLAY-HINT, unless overridden.
+		{
+			node: &Node{Oid: "1", Type: "OTHER", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Access: "ACCESS_READONLY", Type: "INTEGER", Label: "node1", Hint: "d-1"},
+					{Oid: "1.2", Access: "ACCESS_READONLY", Type: "GAUGE", Label: "node2", Hint: "d-2"},
+					{Oid: "1.3", Access: "ACCESS_READONLY", Type: "INTEGER", Label: "node3", Hint: "d"},
+					{Oid: "1.4", Access: "ACCESS_READONLY", Type: "OCTETSTR", Label: "node4", Hint: "d-1"},
+				}},
+			cfg: &ModuleConfig{
+				Walk: []string{"root"},
+				Overrides: map[string]MetricOverrides{
+					"node2": MetricOverrides{Scale: 0.1},
+				},
+			},
+			out: &config.Module{
+				Walk: []string{"1"},
+				Metrics: []*config.Metric{
+					{
+						Name:  "node1",
+						Oid:   "1.1",
+						Type:  "gauge",
+						Help:  " - 1.1",
+						Scale: 0.1,
+					},
+					{
+						Name:  "node2",
+						Oid:   "1.2",
+						Type:  "gauge",
+						Help:  " - 1.2",
+						Scale: 0.1,
+					},
+					{
+						Name: "node3",
+						Oid:  "1.3",
+						Type: "gauge",
+						Help: " - 1.3",
+					},
+					{
+						Name: "node4",
+						Oid:  "1.4",
+						Type: "OctetString",
+						Help: " - 1.4",
+					},
 				},
 			},
 		},
@@ -576,10 +673,11 @@ func TestGenerateConfigModule(t *testing.T) {
 				Walk: []string{"1"},
 				Metrics: []*config.Metric{
 					{
-						Name: "node1",
-						Oid:  "1.1.1.1",
-						Type: "counter",
-						Help: " - 1.1.1.1",
+						Name:           "node1",
+						Oid:            "1.1.1.1",
+						Type:           "counter",
+						Help:           " - 1.1.1.1",
+						OverriddenType: "gauge",
 						Indexes: []*config.Index{
 							{
 								Labelname: "node1",
@@ -694,6 +792,87 @@ func TestGenerateConfigModule(t *testing.T) {
 				},
 			},
 		},
+		// Labels derived from an index, wherever it is used.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "table",
+						Children: []*Node{
+							{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+								Children: []*Node{
+									{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+									{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableFoo", Type: "INTEGER"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Walk: []string{"tableFoo"},
+				Overrides: map[string]MetricOverrides{
+					"tableIndex": MetricOverrides{IndexTransforms: []*config.IndexTransform{
+						{Labelname: "slot", Divide: 256},
+						{Labelname: "port", Modulo: 256},
+					}},
+				},
+			},
+			out: &config.Module{
+				Walk: []string{"1.1.1.2"},
+				Metrics: []*config.Metric{
+					{
+						Name: "tableFoo",
+						Oid:  "1.1.1.2",
+						Type: "gauge",
+						Help: " - 1.1.1.2",
+						Indexes: []*config.Index{
+							{
+								Labelname: "tableIndex",
+								Type:      "gauge",
+								Transforms: []*config.IndexTransform{
+									{Labelname: "slot", Divide: 256},
+									{Labelname: "port", Modulo: 256},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		// Instances to get, with or without an object in the MIBs.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Access: "ACCESS_READONLY", Label: "scalar", Type: "INTEGER"},
+					{Oid: "1.2", Label: "table",
+						Children: []*Node{
+							{Oid: "1.2.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+								Children: []*Node{
+									{Oid: "1.2.1.1", Access: "ACCESS_NOACCESS", Label: "tableIndex", Type: "INTEGER"},
+									{Oid: "1.2.1.2", Access: "ACCESS_READONLY", Label: "tableFoo", Type: "INTEGER"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Get: []string{"1.1.5", "1.2.1.2.7", "1.3.1"},
+			},
+			out: &config.Module{
+				Get: []string{"1.1.5", "1.2.1.2.7", "1.3.1"},
+				Metrics: []*config.Metric{
+					{
+						Name: "scalar",
+						Oid:  "1.1",
+						Type: "gauge",
+						Help: " - 1.1",
+					},
+					{
+						Name: "tableFoo",
+						Oid:  "1.2.1.2",
+						Type: "gauge",
+						Help: " - 1.2.1.2",
+						Indexes: []*config.Index{
+							{
+								Labelname: "tableIndex",
+								Type:      "gauge",
+							},
+						},
+					},
+				},
+			},
+		},
 		// Tables with non-integer indexes.
 		{
 			node: &Node{Oid: "1", Label: "root",
@@ -768,6 +947,7 @@ func TestGenerateConfigModule(t *testing.T) {
 							{
 								Labelname: "octetIndex",
 								Type:      "OctetString",
+								Display:   "auto",
 							},
 						},
 					},
@@ -780,6 +960,7 @@ func TestGenerateConfigModule(t *testing.T) {
 							{
 								Labelname: "octetIndex",
 								Type:      "OctetString",
+								Display:   "auto",
 							},
 						},
 					},
@@ -888,6 +1069,7 @@ func TestGenerateConfigModule(t *testing.T) {
 							{
 								Labelname: "fixedSizeIndex",
 								Type:      "OctetString",
+								Display:   "auto",
 								FixedSize: 8,
 							},
 						},
@@ -901,6 +1083,7 @@ func TestGenerateConfigModule(t *testing.T) {
 							{
 								Labelname: "fixedSizeIndex",
 								Type:      "OctetString",
+								Display:   "auto",
 								FixedSize: 8,
 							},
 						},
@@ -914,6 +1097,7 @@ func TestGenerateConfigModule(t *testing.T) {
 							{
 								Labelname: "impliedSizeIndex",
 								Type:      "OctetString",
+								Display:   "auto",
 								Implied:   true,
 							},
 						},
@@ -927,6 +1111,7 @@ func TestGenerateConfigModule(t *testing.T) {
 							{
 								Labelname: "impliedSizeIndex",
 								Type:      "OctetString",
+								Display:   "auto",
 								Implied:   true,
 							},
 						},
@@ -1997,29 +2182,1258 @@ func TestGenerateConfigModule(t *testing.T) {
 				},
 			},
 		},
-	}
-	for i, c := range cases {
-		// Indexes and lookups always end up initialized.
-		for _, m := range c.out.Metrics {
-			if m.Indexes == nil {
-				m.Indexes = []*config.Index{}
-			}
-			if m.Lookups == nil {
-				m.Lookups = []*config.Lookup{}
-			}
-		}
-
-		nameToNode := prepareTree(c.node, log.NewNopLogger())
-		got, err := generateConfigModule(c.cfg, c.node, nameToNode, log.NewNopLogger())
-		if err != nil {
-			t.Errorf("Error generating config in case %d: %s", i, err)
-		}
-		if !reflect.DeepEqual(got, c.out) {
-			t.Errorf("GenerateConfigModule: difference in case %d", i)
-			out, _ := yaml.Marshal(got)
-			t.Errorf("Got: %s", out)
-			out, _ = yaml.Marshal(c.out)
-			t.Errorf("Wanted: %s", out)
-		}
+		// Walk and lookup relative to a base OID.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "vendor",
+						Children: []*Node{
+							{Oid: "1.1.1", Label: "table",
+								Children: []*Node{
+									{Oid: "1.1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+										Children: []*Node{
+											{Oid: "1.1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+											{Oid: "1.1.1.1.2", Access: "ACCESS_READONLY", Label: "tableDesc", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+											{Oid: "1.1.1.1.3", Access: "ACCESS_READONLY", Label: "tableValue", Type: "INTEGER"},
+										}}}}}}}},
+			cfg: &ModuleConfig{
+				BaseOid: "vendor",
+				Walk:    []string{".1.1.3"},
+				Lookups: []*Lookup{
+					{
+						SourceIndexes: []string{"tableIndex"},
+						Lookup:        ".1.1.2",
+					},
+				},
+			},
+			out: &config.Module{
+				Walk: []string{"1.1.1.1.2", "1.1.1.1.3"},
+				Metrics: []*config.Metric{
+					{
+						Name: "tableValue",
+						Oid:  "1.1.1.1.3",
+						Type: "gauge",
+						Help: " - 1.1.1.1.3",
+						Indexes: []*config.Index{
+							{
+								Labelname: "tableIndex",
+								Type:      "gauge",
+							},
+						},
+						Lookups: []*config.Lookup{
+							{
+								Labels:    []string{"tableIndex"},
+								Labelname: "tableDesc",
+								Oid:       "1.1.1.1.2",
+								Type:      "DisplayString",
+							},
+						},
+					},
+				},
+			},
+		},
+		// High capacity counterparts of 32-bit interface counters.
+		{
+			node: &Node{Oid: "1", Label: "interfaces",
+				Children: []*Node{
+					{Oid: "1.2", Label: "ifTable",
+						Children: []*Node{
+							{Oid: "1.2.1", Label: "ifEntry", Indexes: []string{"ifIndex"},
+								Children: []*Node{
+									{Oid: "1.2.1.1", Access: "ACCESS_READONLY", Label: "ifIndex", Type: "INTEGER"},
+									{Oid: "1.2.1.10", Access: "ACCESS_READONLY", Label: "ifInOctets", Type: "COUNTER"},
+									{Oid: "1.2.1.16", Access: "ACCESS_READONLY", Label: "ifOutOctets", Type: "COUNTER"},
+								}}}},
+					{Oid: "1.31", Label: "ifXTable",
+						Children: []*Node{
+							{Oid: "1.31.1", Label: "ifXEntry", Augments: "ifEntry",
+								Children: []*Node{
+									{Oid: "1.31.1.6", Access: "ACCESS_READONLY", Label: "ifHCInOctets", Type: "COUNTER64"},
+									{Oid: "1.31.1.10", Access: "ACCESS_READONLY", Label: "ifHCOutOctets", Type: "COUNTER64"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Walk:                 []string{"ifInOctets", "ifOutOctets"},
+				HighCapacityCounters: "replace",
+			},
+			out: &config.Module{
+				Walk: []string{"1.31.1.10", "1.31.1.6"},
+				Metrics: []*config.Metric{
+					{
+						Name: "ifHCOutOctets",
+						Oid:  "1.31.1.10",
+						Type: "counter",
+						Help: " - 1.31.1.10",
+						Indexes: []*config.Index{
+							{
+								Labelname: "ifIndex",
+								Type:      "gauge",
+							},
+						},
+					},
+					{
+						Name: "ifHCInOctets",
+						Oid:  "1.31.1.6",
+						Type: "counter",
+						Help: " - 1.31.1.6",
+						Indexes: []*config.Index{
+							{
+								Labelname: "ifIndex",
+								Type:      "gauge",
+							},
+						},
+					},
+				},
+			},
+		},
+		// Rows labelled with their RowStatus.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "sessTable",
+						Children: []*Node{
+							{Oid: "1.1.1", Label: "sessEntry", Indexes: []string{"sessIndex"},
+								Children: []*Node{
+									{Oid: "1.1.1.1", Access: "ACCESS_NOACCESS", Label: "sessIndex", Type: "INTEGER"},
+									{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "sessBytes", Type: "COUNTER"},
+									{Oid: "1.1.1.3", Access: "ACCESS_CREATE", Label: "sessRowStatus", Type: "INTEGER", TextualConvention: "RowStatus"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Walk:      []string{"sessBytes"},
+				RowStatus: true,
+			},
+			out: &config.Module{
+				Walk: []string{"1.1.1.2", "1.1.1.3"},
+				Metrics: []*config.Metric{
+					{
+						Name: "sessBytes",
+						Oid:  "1.1.1.2",
+						Type: "counter",
+						Help: " - 1.1.1.2",
+						Indexes: []*config.Index{
+							{
+								Labelname: "sessIndex",
+								Type:      "gauge",
+							},
+						},
+						Lookups: []*config.Lookup{
+							{
+								Labels:    []string{"sessIndex"},
+								Labelname: "row_status",
+								Oid:       "1.1.1.3",
+								Type:      "RowStatus",
+							},
+						},
+					},
+				},
+			},
+		},
+		// Renamed index labels.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "table",
+						Children: []*Node{
+							{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+								Children: []*Node{
+									{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+									{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableDesc", Type: "OCTETSTR", Hint: "255a"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Walk: []string{"1.1.1.1"},
+				Lookups: []*Lookup{
+					{
+						SourceIndexes: []string{"tableIndex"},
+						Lookup:        "tableDesc",
+					},
+				},
+				IndexLabels: map[string]string{"tableIndex": "index"},
+			},
+			out: &config.Module{
+				Walk: []string{"1.1.1.1", "1.1.1.2"},
+				Metrics: []*config.Metric{
+					{
+						Name: "tableIndex",
+						Oid:  "1.1.1.1",
+						Type: "gauge",
+						Help: " - 1.1.1.1",
+						Indexes: []*config.Index{
+							{
+								Labelname: "index",
+								Type:      "gauge",
+							},
+						},
+						Lookups: []*config.Lookup{
+							{
+								Labels:    []string{"index"},
+								Labelname: "tableDesc",
+								Oid:       "1.1.1.2",
+								Type:      "DisplayString",
+							},
+						},
+					},
+				},
+			},
+		},
+		// Lookup from a mapping file.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "table",
+						Children: []*Node{
+							{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+								Children: []*Node{
+									{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+									{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableValue", Type: "INTEGER"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Walk: []string{"tableValue"},
+				Lookups: []*Lookup{
+					{
+						SourceIndexes:     []string{"tableIndex"},
+						MappingFile:       "circuits.csv",
+						Labelname:         "circuit",
+						DropSourceIndexes: true,
+					},
+				},
+			},
+			out: &config.Module{
+				Walk: []string{"1.1.1.2"},
+				Metrics: []*config.Metric{
+					{
+						Name: "tableValue",
+						Oid:  "1.1.1.2",
+						Type: "gauge",
+						Help: " - 1.1.1.2",
+						Indexes: []*config.Index{
+							{
+								Labelname: "tableIndex",
+								Type:      "gauge",
+							},
+						},
+						Lookups: []*config.Lookup{
+							{
+								Labels:      []string{"tableIndex"},
+								Labelname:   "circuit",
+								MappingFile: "circuits.csv",
+							},
+							{
+								Labelname: "tableIndex",
+							},
+						},
+					},
+				},
+			},
+		},
+		// Exclude a subtree of a walk.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "group",
+						Children: []*Node{
+							{Oid: "1.1.1", Access: "ACCESS_READONLY", Label: "scalarA", Type: "INTEGER"},
+							{Oid: "1.1.2", Label: "sub",
+								Children: []*Node{
+									{Oid: "1.1.2.1", Access: "ACCESS_READONLY", Label: "scalarB", Type: "INTEGER"},
+									{Oid: "1.1.2.2", Access: "ACCESS_READONLY", Label: "scalarC", Type: "INTEGER"},
+								}},
+							{Oid: "1.1.3", Access: "ACCESS_READONLY", Label: "scalarD", Type: "INTEGER"},
+						}}}},
+			cfg: &ModuleConfig{
+				Walk:    []string{"group"},
+				Exclude: []string{"scalarC"},
+			},
+			out: &config.Module{
+				Get: []string{"1.1.1.0", "1.1.2.1.0", "1.1.3.0"},
+				Metrics: []*config.Metric{
+					{
+						Name: "scalarA",
+						Oid:  "1.1.1",
+						Type: "gauge",
+						Help: " - 1.1.1",
+					},
+					{
+						Name: "scalarB",
+						Oid:  "1.1.2.1",
+						Type: "gauge",
+						Help: " - 1.1.2.1",
+					},
+					{
+						Name: "scalarD",
+						Oid:  "1.1.3",
+						Type: "gauge",
+						Help: " - 1.1.3",
+					},
+				},
+			},
+		},
+		// Convert TimeStamp textual conventions.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Access: "ACCESS_READONLY", Label: "lastChange", Type: "TIMETICKS", TextualConvention: "TimeStamp"},
+					{Oid: "1.2", Access: "ACCESS_READONLY", Label: "upTime", Type: "TIMETICKS"},
+				}},
+			cfg: &ModuleConfig{
+				Walk:       []string{"lastChange", "upTime"},
+				Timestamps: true,
+			},
+			out: &config.Module{
+				Get: []string{"1.1.0", "1.2.0"},
+				Metrics: []*config.Metric{
+					{
+						Name: "lastChange",
+						Oid:  "1.1",
+						Type: "TimeStamp",
+						Help: " - 1.1",
+					},
+					{
+						Name: "upTime",
+						Oid:  "1.2",
+						Type: "gauge",
+						Help: " - 1.2",
+					},
+				},
+			},
+		},
+		// Display of OctetString indexes.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "table",
+						Children: []*Node{
+							{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"engineID", "userName"},
+								Children: []*Node{
+									{Oid: "1.1.1.1", Access: "ACCESS_NOACCESS", Label: "engineID", Type: "OCTETSTR"},
+									{Oid: "1.1.1.2", Access: "ACCESS_NOACCESS", Label: "userName", Type: "OCTETSTR"},
+									{Oid: "1.1.1.3", Access: "ACCESS_READONLY", Label: "userStatus", Type: "INTEGER"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Walk:         []string{"userStatus"},
+				IndexDisplay: map[string]string{"engineID": "hex"},
+			},
+			out: &config.Module{
+				Walk: []string{"1.1.1.3"},
+				Metrics: []*config.Metric{
+					{
+						Name: "userStatus",
+						Oid:  "1.1.1.3",
+						Type: "gauge",
+						Help: " - 1.1.1.3",
+						Indexes: []*config.Index{
+							{Labelname: "engineID", Type: "OctetString", Display: "hex"},
+							{Labelname: "userName", Type: "OctetString", Display: "auto"},
+						},
+					},
+				},
+			},
+		},
+	}
+	for i, c := range cases {
+		// Indexes and lookups always end up initialized.
+		for _, m := range c.out.Metrics {
+			if m.Indexes == nil {
+				m.Indexes = []*config.Index{}
+			}
+			if m.Lookups == nil {
+				m.Lookups = []*config.Lookup{}
+			}
+		}
+
+		nameToNode := prepareTree(c.node, log.NewNopLogger())
+		got, _, err := generateConfigModule(c.cfg, c.node, nameToNode, log.NewNopLogger())
+		if err != nil {
+			t.Errorf("Error generating config in case %d: %s", i, err)
+		}
+		if !reflect.DeepEqual(got, c.out) {
+			t.Errorf("GenerateConfigModule: difference in case %d", i)
+			out, _ := yaml.Marshal(got)
+			t.Errorf("Got: %s", out)
+			out, _ = yaml.Marshal(c.out)
+			t.Errorf("Wanted: %s", out)
+		}
+	}
+}
+
+func TestGenerateConfigModuleIndexLabelConflict(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "table",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex", "tableSubIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableSubIndex", Type: "INTEGER"},
+						}}}}}}
+	cfg := &ModuleConfig{
+		Walk:        []string{"table"},
+		IndexLabels: map[string]string{"tableIndex": "index", "tableSubIndex": "index"},
+	}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	if _, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger()); err == nil {
+		t.Error("Expected error for conflicting index label names")
+	}
+}
+
+func TestGenerateConfigModuleUnused(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "table",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableDesc", Type: "OCTETSTR"},
+							{Oid: "1.1.1.3", Access: "ACCESS_READONLY", Label: "tableValue", Type: "INTEGER"},
+						}}}},
+			{Oid: "1.2", Access: "ACCESS_READONLY", Label: "otherScalar", Type: "INTEGER"},
+		}}
+	cfg := &ModuleConfig{
+		Walk: []string{"tableValue"},
+		Lookups: []*Lookup{
+			{SourceIndexes: []string{"tableIndex"}, Lookup: "tableDesc"},
+			{SourceIndexes: []string{"otherIndex"}, Lookup: "tableDesc"},
+		},
+		Overrides: map[string]MetricOverrides{
+			"tableValue":  {Help: "Value."},
+			"tableDesc":   {Type: "DisplayString"},
+			"otherScalar": {Type: "gauge"},
+			"tableTypo":   {Ignore: true},
+		},
+	}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	_, report, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"override 'otherScalar'",
+		"override 'tableTypo'",
+		"lookup 'tableDesc' with source_indexes [otherIndex]",
+	}
+	if !reflect.DeepEqual(report.Unused, expected) {
+		t.Errorf("Wrong unused entries: got %v, want %v", report.Unused, expected)
+	}
+}
+
+func TestBuildMIBIndex(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "table",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER", Description: "Index"},
+							{Oid: "1.1.1.2", Access: "ACCESS_NOTIFY", Label: "tableTrap", Type: "INTEGER"},
+						}}}},
+			{Oid: "1.2", Access: "ACCESS_READONLY", Label: "scalar", Type: "COUNTER", Description: "A counter"},
+		}}
+	expected := config.MIBIndex{
+		"1.1.1.1": {Name: "tableIndex", Help: "Index", Type: "gauge"},
+		"1.2":     {Name: "scalar", Help: "A counter", Type: "counter"},
+	}
+	if got := buildMIBIndex(node); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong MIB index: got %v, want %v", got, expected)
+	}
+}
+
+func TestMIBSources(t *testing.T) {
+	nameToNode := map[string]*Node{
+		"1.1.1.1": {Oid: "1.1.1.1", Label: "ifIndex", MIB: "IF-MIB", MIBFile: "/mibs/IF-MIB"},
+		"1.1.1.2": {Oid: "1.1.1.2", Label: "ifDescr", MIB: "IF-MIB", MIBFile: "/mibs/IF-MIB"},
+		"1.2.1.1": {Oid: "1.2.1.1", Label: "ifName", MIB: "IF-MIB-EXT", MIBFile: "/mibs/IF-MIB-EXT"},
+		"1.3":     {Oid: "1.3", Label: "unused", MIB: "OTHER-MIB", MIBFile: "/mibs/OTHER-MIB"},
+		"1.4":     {Oid: "1.4", Label: "builtin"},
+	}
+	module := &config.Module{Metrics: []*config.Metric{
+		{Name: "ifDescr", Oid: "1.1.1.2", Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifName", Oid: "1.2.1.1"}}},
+		{Name: "builtin", Oid: "1.4"},
+	}}
+	expected := map[string]string{"IF-MIB": "/mibs/IF-MIB", "IF-MIB-EXT": "/mibs/IF-MIB-EXT"}
+	if got := mibSources(module, nameToNode); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong MIB sources: got %v, want %v", got, expected)
+	}
+}
+
+func TestSuggestWalkParams(t *testing.T) {
+	metrics := func(scalars, tables, multiIndexTables int) []*config.Metric {
+		m := []*config.Metric{}
+		for i := 0; i < scalars; i++ {
+			m = append(m, &config.Metric{})
+		}
+		for i := 0; i < tables; i++ {
+			m = append(m, &config.Metric{Indexes: []*config.Index{{Labelname: "ifIndex"}}})
+		}
+		for i := 0; i < multiIndexTables; i++ {
+			m = append(m, &config.Metric{Indexes: []*config.Index{{Labelname: "a"}, {Labelname: "b"}}})
+		}
+		return m
+	}
+	one, two, three := 1, 2, 3
+	cases := []struct {
+		params   config.WalkParams
+		module   *config.Module
+		expected config.WalkParams
+	}{
+		// A few scalars and a small table.
+		{
+			module:   &config.Module{Walk: []string{"1.1", "1.2"}, Get: []string{"1.3.0"}, Metrics: metrics(5, 2, 0)},
+			expected: config.WalkParams{MaxRepetitions: 25, Timeout: 5 * time.Second, Retries: &three},
+		},
+		// 1510 varbinds in 31 requests.
+		{
+			module:   &config.Module{Walk: []string{"1.1"}, Metrics: metrics(10, 5, 1)},
+			expected: config.WalkParams{MaxRepetitions: 50, Timeout: 7 * time.Second, Retries: &two},
+		},
+		// 20000 varbinds.
+		{
+			module:   &config.Module{Walk: []string{"1.1"}, Metrics: metrics(0, 100, 10)},
+			expected: config.WalkParams{MaxRepetitions: 100, Timeout: 10 * time.Second, Retries: &one},
+		},
+		// What is set in generator.yml is kept.
+		{
+			params:   config.WalkParams{MaxRepetitions: 10, Retries: &three, TolerantDecode: true},
+			module:   &config.Module{Walk: []string{"1.1"}, Metrics: metrics(0, 100, 10)},
+			expected: config.WalkParams{MaxRepetitions: 10, Timeout: 10 * time.Second, Retries: &three, TolerantDecode: true},
+		},
+	}
+	for i, c := range cases {
+		if got := suggestWalkParams(c.params, c.module); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Case %d: got %+v (retries %d), want %+v (retries %d)", i, got, *got.Retries, c.expected, *c.expected.Retries)
+		}
+	}
+}
+
+func TestLiteModule(t *testing.T) {
+	ifIndex := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	module := &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31.1.1.1.6.5", "1.3.6.1.2.1.1.5"},
+		Get:  []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.1.0"},
+		Metrics: []*config.Metric{
+			{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"},
+			{Name: "sysDescr", Oid: "1.3.6.1.2.1.1.1", Type: "DisplayString"},
+			{Name: "sysName", Oid: "1.3.6.1.2.1.1.5", Type: "DisplayString"},
+			{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString", Indexes: ifIndex},
+			{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter", Indexes: ifIndex,
+				Lookups: []*config.Lookup{
+					{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"},
+					{Labelname: "ifIndex"},
+				}},
+			{Name: "ifOperStatus", Oid: "1.3.6.1.2.1.2.2.1.8", Type: "EnumAsStateSet", Indexes: ifIndex},
+			{Name: "ifHCInOctets", Oid: "1.3.6.1.2.1.31.1.1.1.6", Type: "counter", Indexes: ifIndex},
+		},
+		WalkPriority: []string{"1.3.6.1.2.1.1.5", "1.3.6.1.2.1.31.1.1.1.6.5"},
+		WalkOverrides: map[string]*config.WalkOverride{
+			"1.3.6.1.2.1.2":       {Timeout: 30 * time.Second},
+			"1.3.6.1.2.1.2.2.1.2": {Timeout: time.Minute},
+		},
+		Aggregations: []*config.Aggregation{
+			{Metric: "ifHCInOctets", Op: "sum", Without: []string{"ifIndex"}},
+			{Metric: "ifOperStatus", Op: "max", Without: []string{"ifIndex"}},
+		},
+	}
+	expected := &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1.10", "1.3.6.1.2.1.31.1.1.1.6.5"},
+		Get:  []string{"1.3.6.1.2.1.1.3.0"},
+		Metrics: []*config.Metric{
+			{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge", Lookups: []*config.Lookup{}},
+			{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter", Indexes: ifIndex,
+				Lookups: []*config.Lookup{{Labelname: "ifIndex"}}},
+			{Name: "ifHCInOctets", Oid: "1.3.6.1.2.1.31.1.1.1.6", Type: "counter", Indexes: ifIndex, Lookups: []*config.Lookup{}},
+		},
+		WalkPriority:  []string{"1.3.6.1.2.1.31.1.1.1.6.5"},
+		WalkOverrides: map[string]*config.WalkOverride{"1.3.6.1.2.1.2": {Timeout: 30 * time.Second}},
+		Aggregations:  []*config.Aggregation{{Metric: "ifHCInOctets", Op: "sum", Without: []string{"ifIndex"}}},
+	}
+	if got := liteModule(module); !reflect.DeepEqual(got, expected) {
+		gotYaml, _ := yaml.Marshal(got)
+		expectedYaml, _ := yaml.Marshal(expected)
+		t.Errorf("Wrong lite module:\n%s\nwant:\n%s", gotYaml, expectedYaml)
+	}
+	if len(module.Metrics[4].Lookups) != 2 {
+		t.Error("The full module was modified")
+	}
+}
+
+func TestPreferObjects(t *testing.T) {
+	ifIndex := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	newModule := func() *config.Module {
+		return &config.Module{
+			Walk: []string{"1.3.6.1.2.1.2.2.1.10", "1.3.6.1.2.1.2.2.1.16", "1.3.6.1.2.1.31.1.1.1"},
+			Metrics: []*config.Metric{
+				{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter", Indexes: ifIndex},
+				{Name: "ifOutOctets", Oid: "1.3.6.1.2.1.2.2.1.16", Type: "counter", Indexes: ifIndex},
+				{Name: "ifHCInOctets", Oid: "1.3.6.1.2.1.31.1.1.1.6", Type: "counter", Indexes: ifIndex},
+				// Only the 64-bit counter is walked.
+				{Name: "ifHCOutUcastPkts", Oid: "1.3.6.1.2.1.31.1.1.1.11", Type: "counter", Indexes: ifIndex},
+				// Different indexes.
+				{Name: "fooHCOutOctets", Oid: "1.3.6.1.4.1.1.2", Type: "counter"},
+				{Name: "fooOutOctets", Oid: "1.3.6.1.4.1.1.1", Type: "counter", Indexes: ifIndex},
+			},
+			Aggregations: []*config.Aggregation{{Metric: "ifHCInOctets", Op: "sum", Without: []string{"ifIndex"}}},
+		}
+	}
+	nameToNode := map[string]*Node{}
+	for _, n := range []*Node{
+		{Oid: "1.3.6.1.2.1.2.2.1.10", Label: "ifInOctets", Type: "COUNTER"},
+		{Oid: "1.3.6.1.2.1.2.2.1.16", Label: "ifOutOctets", Type: "COUNTER"},
+		{Oid: "1.3.6.1.2.1.31.1.1.1.6", Label: "ifHCInOctets", Type: "COUNTER64"},
+		{Oid: "1.3.6.1.2.1.31.1.1.1.11", Label: "ifHCOutUcastPkts", Type: "COUNTER64"},
+		{Oid: "1.3.6.1.4.1.1.2", Label: "fooHCOutOctets", Type: "COUNTER64"},
+		{Oid: "1.3.6.1.4.1.1.1", Label: "fooOutOctets", Type: "COUNTER"},
+	} {
+		nameToNode[n.Oid] = n
+	}
+
+	superseded := supersededMetrics(newModule(), nameToNode)
+	if expected := map[string]string{"ifInOctets": "ifHCInOctets"}; !reflect.DeepEqual(superseded, expected) {
+		t.Fatalf("Wrong superseded metrics, want %v got %v", expected, superseded)
+	}
+
+	cases := []struct {
+		policy       string
+		dropped      []string
+		walk         []string
+		aggregations int
+	}{
+		{policy: "prefer-both", walk: []string{"1.3.6.1.2.1.2.2.1.10", "1.3.6.1.2.1.2.2.1.16", "1.3.6.1.2.1.31.1.1.1"}, aggregations: 1},
+		// The walk of ifInOctets on its own is not needed any more.
+		{policy: "prefer-current", dropped: []string{"ifInOctets"}, walk: []string{"1.3.6.1.2.1.2.2.1.16", "1.3.6.1.2.1.31.1.1.1"}, aggregations: 1},
+		// The ifXTable is still walked for the other metrics.
+		{policy: "prefer-deprecated", dropped: []string{"ifHCInOctets"}, walk: []string{"1.3.6.1.2.1.2.2.1.10", "1.3.6.1.2.1.2.2.1.16", "1.3.6.1.2.1.31.1.1.1"}},
+	}
+	for _, c := range cases {
+		module := newModule()
+		dropped := preferObjects(module, superseded, c.policy)
+		if !reflect.DeepEqual(dropped, c.dropped) {
+			t.Errorf("%s: wrong dropped metrics, want %v got %v", c.policy, c.dropped, dropped)
+		}
+		if len(module.Metrics) != 6-len(c.dropped) {
+			t.Errorf("%s: wrong number of metrics left: %d", c.policy, len(module.Metrics))
+		}
+		if !reflect.DeepEqual(module.Walk, c.walk) {
+			t.Errorf("%s: wrong walks, want %v got %v", c.policy, c.walk, module.Walk)
+		}
+		if len(module.Aggregations) != c.aggregations {
+			t.Errorf("%s: wrong aggregations: %v", c.policy, module.Aggregations)
+		}
+	}
+
+	// Counter pairs already merge both counters.
+	module := newModule()
+	module.CounterPairs = []*config.CounterPair{{Name: "ifHCInOctets", Counter32: "ifInOctets", Counter64: "ifHCInOctets"}}
+	if dropped := preferObjects(module, superseded, "prefer-current"); len(dropped) != 0 || len(module.Metrics) != 6 {
+		t.Errorf("Paired counters dropped: %v", dropped)
+	}
+}
+
+func TestScopedOverridesUnused(t *testing.T) {
+	node := &Node{Oid: "1", Type: "OTHER", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Access: "ACCESS_READONLY", Type: "INTEGER", Label: "node1", MIB: "VENDOR-MIB"},
+			{Oid: "1.2", Access: "ACCESS_READONLY", Type: "INTEGER", Label: "node2", MIB: "OTHER-MIB"},
+		}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	cfg := &ModuleConfig{
+		Walk: []string{"node1"},
+		ScopedOverrides: []*ScopedOverride{
+			{MIB: "VENDOR-MIB", MetricOverrides: MetricOverrides{Help: "Vendor object"}},
+			{MIB: "OTHER-MIB", MetricOverrides: MetricOverrides{Help: "Other object"}},
+		},
+	}
+	_, report, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"scoped override of OTHER-MIB"}; !reflect.DeepEqual(report.Unused, want) {
+		t.Errorf("Expected unused %v, got %v", want, report.Unused)
+	}
+
+	cfg.ScopedOverrides = []*ScopedOverride{{Under: "missing", MetricOverrides: MetricOverrides{Help: "Missing"}}}
+	if _, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger()); err == nil {
+		t.Error("Expected an error for an unknown subtree")
+	}
+}
+
+func TestIndexTransformsInvalid(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "table",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "OCTETSTR"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableFoo", Type: "INTEGER"},
+						}}}}}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	cfg := &ModuleConfig{
+		Walk: []string{"tableFoo"},
+		Overrides: map[string]MetricOverrides{
+			"tableIndex": MetricOverrides{IndexTransforms: []*config.IndexTransform{{Labelname: "slot", Divide: 256}}},
+		},
+	}
+	if _, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "needs an integer index") {
+		t.Errorf("Expected an error for arithmetic on an OctetString index, got %v", err)
+	}
+}
+
+func TestModuleReport(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "table",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableDesc", Type: "OCTETSTR"},
+							{Oid: "1.1.1.3", Access: "ACCESS_READONLY", Label: "tableValue", Type: "INTEGER"},
+							{Oid: "1.1.1.4", Access: "ACCESS_READONLY", Label: "tableOpaque", Type: "OPAQUE"},
+							{Oid: "1.1.1.5", Access: "ACCESS_NOTIFY", Label: "tableNotified", Type: "INTEGER"},
+							{Oid: "1.1.1.6", Access: "ACCESS_READONLY", Label: "tableIgnored", Type: "INTEGER"},
+						}}}},
+			{Oid: "1.2", Label: "otherTable",
+				Children: []*Node{
+					{Oid: "1.2.1", Label: "otherEntry", Indexes: []string{"missingIndex"},
+						Children: []*Node{
+							{Oid: "1.2.1.1", Access: "ACCESS_READONLY", Label: "otherValue", Type: "INTEGER"},
+						}}}},
+		}}
+	cfg := &ModuleConfig{
+		Walk:      []string{"table", "otherTable"},
+		Lookups:   []*Lookup{{SourceIndexes: []string{"tableIndex"}, Lookup: "tableDesc", DropSourceIndexes: true}},
+		Overrides: map[string]MetricOverrides{"tableIgnored": {Ignore: true}},
+	}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	out, report, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.fill(out)
+	expected := &moduleReport{
+		Metrics: []string{"tableIndex", "tableDesc", "tableValue"},
+		Skipped: []skippedMetric{
+			{Name: "tableOpaque", Oid: "1.1.1.4", Reason: "unsupported type OPAQUE"},
+			{Name: "tableNotified", Oid: "1.1.1.5", Reason: "not accessible"},
+			{Name: "tableIgnored", Oid: "1.1.1.6", Reason: "ignored by override"},
+			{Name: "otherValue", Oid: "1.2.1.1", Reason: "missing index missingIndex"},
+		},
+		Lookups: []reportLookup{
+			{Metric: "tableIndex", Labelname: "tableDesc", Source: "1.1.1.2"},
+			{Metric: "tableDesc", Labelname: "tableDesc", Source: "1.1.1.2"},
+			{Metric: "tableValue", Labelname: "tableDesc", Source: "1.1.1.2"},
+		},
+		Walk:   []string{"1.1", "1.2"},
+		Get:    []string{},
+		Unused: []string{},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Wrong report:\ngot  %+v\nwant %+v", report, expected)
+	}
+}
+
+func TestWalkOverridesByName(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "table",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+						}}}},
+			{Oid: "1.2", Access: "ACCESS_READONLY", Label: "scalar", Type: "INTEGER"},
+		}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	override := &config.WalkOverride{Timeout: 30 * time.Second}
+	cfg := &ModuleConfig{Walk: []string{"table", "scalar"}, WalkOverrides: map[string]*config.WalkOverride{"table": override, "1.3": override}}
+	out, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]*config.WalkOverride{"1.1": override, "1.3": override}; !reflect.DeepEqual(out.WalkOverrides, want) {
+		t.Errorf("Wrong walk overrides: got %v, want %v", out.WalkOverrides, want)
+	}
+	cfg = &ModuleConfig{Walk: []string{"table"}, WalkOverrides: map[string]*config.WalkOverride{"tableTypo": override}}
+	if _, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "tableTypo") {
+		t.Errorf("Expected an error for an unknown walk override, got %v", err)
+	}
+}
+
+func TestNameConflicts(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "vendorA", MIB: "VENDOR-A-MIB",
+				Children: []*Node{
+					{Oid: "1.1.1", Access: "ACCESS_READONLY", Label: "cpuLoad", Type: "INTEGER", MIB: "VENDOR-A-MIB"},
+				}},
+			{Oid: "1.2", Label: "vendorB", MIB: "VENDOR-B-MIB",
+				Children: []*Node{
+					{Oid: "1.2.1", Access: "ACCESS_READONLY", Label: "cpuLoad", Type: "INTEGER", MIB: "VENDOR-B-MIB"},
+					{Oid: "1.2.2", Access: "ACCESS_READONLY", Label: "memFree", Type: "INTEGER", MIB: "VENDOR-B-MIB"},
+				}},
+		}}
+	for _, c := range []struct {
+		strategy string
+		names    []string
+		err      string
+	}{
+		{strategy: "", names: []string{"cpuLoad", "cpuLoad", "memFree"}},
+		{strategy: "mib", names: []string{"cpuLoad_VENDOR_A_MIB", "cpuLoad_VENDOR_B_MIB", "memFree"}},
+		{strategy: "parent", names: []string{"cpuLoad_vendorA", "cpuLoad_vendorB", "memFree"}},
+		{strategy: "error", err: "metrics of objects 1.1.1, 1.2.1 have the same name 'cpuLoad'"},
+	} {
+		cfg := &ModuleConfig{Walk: []string{"1.1", "1.2"}, NameConflicts: c.strategy}
+		nameToNode := prepareTree(node.Copy(), log.NewNopLogger())
+		out, _, err := generateConfigModule(cfg, nameToNode["root"], nameToNode, log.NewNopLogger())
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("Strategy %q: expected error %q, got %v", c.strategy, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Strategy %q: %s", c.strategy, err)
+		}
+		names := []string{}
+		for _, m := range out.Metrics {
+			names = append(names, m.Name)
+		}
+		if !reflect.DeepEqual(names, c.names) {
+			t.Errorf("Strategy %q: wrong metric names, got %v want %v", c.strategy, names, c.names)
+		}
+	}
+
+	// Suffixes which conflict again are an error.
+	node.Children[1].Label = "vendorA"
+	cfg := &ModuleConfig{Walk: []string{"1.1", "1.2"}, NameConflicts: "parent"}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	if _, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "still have the same name 'cpuLoad_vendorA'") {
+		t.Errorf("Expected an error for suffixed names still conflicting, got %v", err)
+	}
+}
+
+func TestTransformTree(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.2", Label: "vendorTable", Children: []*Node{
+				{Oid: "1.2.1", Label: "vendorEntry", Indexes: []string{"vendorMissing"}, Children: []*Node{
+					{Oid: "1.2.1.1", Label: "vendorName", Access: "ACCESS_READONLY", Type: "OCTETSTR"},
+				}},
+			}},
+			{Oid: "1.10", Label: "vendorValue", Access: "ACCESS_READONLY", Type: "OCTETSTR", EnumValues: map[int]string{1: "up"}},
+		}}
+	// A broken vendor MIB declaring a counter as a string, and a table
+	// indexed by a missing column.
+	fix := `sed 's/"vendorValue"/"vendorCounter"/; s/"OCTETSTR"/"COUNTER"/2; s/"vendorMissing"/"vendorIndex"/; s/"Label":"vendorEntry","Augments":"","Children":\[/&{"Oid":"1.2.1.2","Label":"vendorIndex","Type":"INTEGER"},/'`
+	transformed, err := transformTree(node, []string{"cat", fix}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameToNode := prepareTree(transformed, log.NewNopLogger())
+	n, ok := nameToNode["1.10"]
+	if !ok || n != nameToNode["vendorCounter"] || n.Type != "COUNTER" || n.EnumValues[1] != "up" || transformed.Children[1] != n {
+		t.Fatalf("Transform not applied: %+v", n)
+	}
+	if _, ok := nameToNode["vendorValue"]; ok {
+		t.Error("The node must only be known by its new name")
+	}
+	if n := nameToNode["vendorName"]; n == nil || !reflect.DeepEqual(n.Indexes, []string{"vendorIndex"}) {
+		t.Errorf("Index added by the transform not prepared: %+v", n)
+	}
+	// The added column is ordered by its subid.
+	if entry := nameToNode["vendorEntry"]; entry.Children[0].Label != "vendorName" || entry.Children[1].subid != 2 {
+		t.Errorf("Wrong order of the transformed children: %+v", entry.Children)
+	}
+
+	for command, msg := range map[string]string{
+		"exit 1":                   "error running tree transform 'exit 1'",
+		"echo not json":            "error reading the tree written by transform 'echo not json'",
+		`echo '{"Label": "root"}'`: "wrote a node without an OID or label",
+	} {
+		if _, err := transformTree(node, []string{command}, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error %q, got %v", command, msg, err)
+		}
+	}
+}
+
+func TestJoinTables(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "ifTable",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "ifEntry", Indexes: []string{"ifIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "ifIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "ifDescr", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+						}}}},
+			// A vendor table indexed by ifIndex which declares its own index.
+			{Oid: "1.2", Label: "vendorIfTable",
+				Children: []*Node{
+					{Oid: "1.2.1", Label: "vendorIfEntry", Indexes: []string{"vendorIfIndex"},
+						Children: []*Node{
+							{Oid: "1.2.1.1", Access: "ACCESS_NOACCESS", Label: "vendorIfIndex", Type: "OCTETSTR"},
+							{Oid: "1.2.1.2", Access: "ACCESS_READONLY", Label: "vendorIfErrors", Type: "COUNTER"},
+						}}}},
+			{Oid: "1.3", Label: "vendorPairTable",
+				Children: []*Node{
+					{Oid: "1.3.1", Label: "vendorPairEntry", Indexes: []string{"vendorA", "vendorB"},
+						Children: []*Node{
+							{Oid: "1.3.1.1", Access: "ACCESS_READONLY", Label: "vendorA", Type: "INTEGER"},
+							{Oid: "1.3.1.2", Access: "ACCESS_READONLY", Label: "vendorB", Type: "INTEGER"},
+						}}}},
+		}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	if err := joinTables([]*TableJoin{{Table: "vendorIfTable", IndexedLike: "ifEntry"}}, nameToNode); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ModuleConfig{
+		Walk:    []string{"vendorIfTable"},
+		Lookups: []*Lookup{{SourceIndexes: []string{"ifIndex"}, Lookup: "ifDescr"}},
+	}
+	out, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m *config.Metric
+	for _, metric := range out.Metrics {
+		if metric.Name == "vendorIfErrors" {
+			m = metric
+		}
+	}
+	if m == nil {
+		t.Fatalf("Expected vendorIfErrors, got %+v", out.Metrics)
+	}
+	if len(m.Indexes) != 1 || m.Indexes[0].Labelname != "ifIndex" || m.Indexes[0].Type != "gauge" {
+		t.Errorf("Expected vendorIfErrors indexed by ifIndex, got %+v", m.Indexes)
+	}
+	if len(m.Lookups) != 1 || m.Lookups[0].Labelname != "ifDescr" {
+		t.Errorf("Expected the lookup of ifDescr, got %+v", m.Lookups)
+	}
+
+	for _, c := range []struct {
+		join *TableJoin
+		msg  string
+	}{
+		{&TableJoin{Table: "nonexistent", IndexedLike: "ifTable"}, "cannot find table nonexistent"},
+		{&TableJoin{Table: "vendorIfTable", IndexedLike: "nonexistent"}, "cannot find table nonexistent"},
+		{&TableJoin{Table: "vendorIfTable", IndexedLike: "root"}, "has no indexes"},
+		{&TableJoin{Table: "vendorPairTable", IndexedLike: "ifTable"}, "can't be replaced"},
+	} {
+		if err := joinTables([]*TableJoin{c.join}, nameToNode); err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%+v: expected error %q, got %v", c.join, c.msg, err)
+		}
+	}
+}
+
+func TestResolveDuplicateOids(t *testing.T) {
+	tree := func() *Node {
+		return &Node{Oid: "1", Label: "root",
+			Children: []*Node{
+				{Oid: "1.1", Label: "vendorStats", MIB: "VENDOR-MIB", MIBFile: "vendor.mib",
+					Children: []*Node{
+						{Oid: "1.1.2", Label: "vendorErrors", MIB: "VENDOR-MIB"},
+					}},
+				{Oid: "1.1", Label: "forkStats", MIB: "FORK-MIB", MIBFile: "fork.mib",
+					Children: []*Node{
+						{Oid: "1.1.1", Label: "forkPackets", MIB: "FORK-MIB"},
+					}},
+				{Oid: "1.2", Label: "vendorOther", MIB: "VENDOR-MIB"},
+			}}
+	}
+
+	for _, c := range []struct {
+		policy    string
+		preferred []string
+		kept      string
+	}{
+		{policy: "first", kept: "vendorStats"},
+		{policy: "last", kept: "forkStats"},
+		{policy: "first", preferred: []string{"OTHER-MIB", "FORK-MIB"}, kept: "forkStats"},
+		{policy: "error", preferred: []string{"VENDOR-MIB"}, kept: "vendorStats"},
+	} {
+		nodes := tree()
+		duplicates, err := resolveDuplicateOids(nodes, c.policy, c.preferred, log.NewNopLogger())
+		if c.policy == "error" {
+			if err == nil || !strings.Contains(err.Error(), "1.1 (vendorStats (VENDOR-MIB, vendor.mib), forkStats (FORK-MIB, fork.mib))") {
+				t.Errorf("%s: expected error listing the duplicates, got %v", c.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(duplicates) != 1 || duplicates[0].Oid != "1.1" || len(duplicates[0].Definitions) != 2 {
+			t.Errorf("%s: expected 1.1 reported, got %+v", c.policy, duplicates)
+		}
+		if len(nodes.Children) != 2 || nodes.Children[0].Label != c.kept || nodes.Children[1].Label != "vendorOther" {
+			t.Fatalf("%s %v: expected %s and vendorOther kept, got %+v", c.policy, c.preferred, c.kept, nodes.Children)
+		}
+		children := nodes.Children[0].Children
+		if len(children) != 2 || children[0].Label != "forkPackets" || children[1].Label != "vendorErrors" {
+			t.Errorf("%s: expected the children of both merged in order, got %+v", c.policy, children)
+		}
+	}
+}
+
+func TestLookupFallback(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "ifTable",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "ifEntry", Indexes: []string{"ifIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "ifIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "ifDescr", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+							{Oid: "1.1.1.3", Access: "ACCESS_READONLY", Label: "ifName", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+							{Oid: "1.1.1.4", Access: "ACCESS_READONLY", Label: "ifAlias", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+							{Oid: "1.1.1.5", Access: "ACCESS_READONLY", Label: "ifInOctets", Type: "COUNTER"},
+						}}}}}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	cfg := &ModuleConfig{
+		Walk: []string{"ifInOctets"},
+		Lookups: []*Lookup{{
+			SourceIndexes:     []string{"ifIndex"},
+			Lookup:            "ifAlias",
+			Fallback:          []string{"ifName", "ifDescr"},
+			Labelname:         "interface",
+			DropSourceIndexes: true,
+		}},
+	}
+	out, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config.Lookup{
+		Labels:    []string{"ifIndex"},
+		Labelname: "interface",
+		Oid:       "1.1.1.4",
+		Type:      "DisplayString",
+		Fallback: []*config.LookupFallback{
+			{Oid: "1.1.1.3", Type: "DisplayString"},
+			{Oid: "1.1.1.2", Type: "DisplayString"},
+		},
+	}
+	if len(out.Metrics) != 1 || len(out.Metrics[0].Lookups) != 2 || !reflect.DeepEqual(out.Metrics[0].Lookups[0], want) {
+		t.Fatalf("Expected lookup %+v, got %+v", want, out.Metrics)
+	}
+	if !reflect.DeepEqual(out.Walk, []string{"1.1.1.2", "1.1.1.3", "1.1.1.4", "1.1.1.5"}) {
+		t.Errorf("Expected the lookup and its fallbacks walked, got %v", out.Walk)
+	}
+
+	cfg.Lookups[0].Fallback = []string{"nonexistent"}
+	if _, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger()); err == nil {
+		t.Error("Expected an error for an unknown fallback")
+	}
+}
+
+func TestOverrideBounds(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Access: "ACCESS_READONLY", Label: "temperature", Type: "INTEGER"},
+		}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	min, max := 0.0, 150.0
+	cfg := &ModuleConfig{
+		Walk:      []string{"temperature"},
+		Overrides: map[string]MetricOverrides{"temperature": {Min: &min, Max: &max, OutOfRange: "clamp"}},
+	}
+	out, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := out.Metrics[0]
+	if m.Min == nil || *m.Min != 0 || m.Max == nil || *m.Max != 150 || m.OutOfRange != "clamp" {
+		t.Errorf("Expected the bounds of the override, got %+v", m)
+	}
+
+	for content, msg := range map[string]string{
+		"min: 10\nmax: 1\n":         "must not be greater than max",
+		"max: 1\nout_of_range: x\n": "out_of_range must be drop or clamp",
+	} {
+		var o MetricOverrides
+		if err := yaml.UnmarshalStrict([]byte(content), &o); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%q: expected error %q, got %v", content, msg, err)
+		}
+	}
+}
+
+func TestInlineLookupInstances(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "ifTable",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "ifEntry", Indexes: []string{"ifIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "ifIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "ifDescr", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+						}}}},
+			{Oid: "1.2", Label: "vlanTable",
+				Children: []*Node{
+					{Oid: "1.2.1", Label: "vlanEntry", Indexes: []string{"ifIndex", "vlanName"},
+						Children: []*Node{
+							{Oid: "1.2.1.1", Access: "ACCESS_NOACCESS", Label: "vlanName", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+							{Oid: "1.2.1.2", Access: "ACCESS_READONLY", Label: "vlanPackets", Type: "COUNTER"},
+						}}}}}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	cfg := &ModuleConfig{
+		// The foo VLAN of interface 5 and the x VLAN of interface 7.
+		Walk: []string{"1.2.1.2.5.3.102.111.111", "1.2.1.2.7.1.120"},
+		Lookups: []*Lookup{{
+			SourceIndexes: []string{"ifIndex"},
+			Lookup:        "ifDescr",
+		}},
+	}
+	for _, c := range []struct {
+		inline bool
+		walk   []string
+		get    []string
+	}{
+		{
+			get: []string{"1.1.1.2.5.3.102.111.111", "1.1.1.2.7.1.120", "1.2.1.2.5.3.102.111.111", "1.2.1.2.7.1.120"},
+		},
+		{
+			inline: true,
+			get:    []string{"1.1.1.2.5", "1.1.1.2.7", "1.2.1.2.5.3.102.111.111", "1.2.1.2.7.1.120"},
+		},
+	} {
+		cfg.InlineLookupInstances = c.inline
+		out, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out.Walk, c.walk) || !reflect.DeepEqual(out.Get, c.get) {
+			t.Errorf("inline %t: expected walk %v and get %v, got walk %v and get %v", c.inline, c.walk, c.get, out.Walk, out.Get)
+		}
+	}
+
+	// An instance not matching the indexes needs the whole lookup.
+	cfg.Walk = []string{"1.2.1.2.5.9.1"}
+	out, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out.Walk, []string{"1.1.1.2"}) {
+		t.Errorf("Expected the lookup walked, got %v", out.Walk)
+	}
+}
+
+func TestSplitInstance(t *testing.T) {
+	indexes := []*config.Index{
+		{Labelname: "ifIndex", Type: "gauge"},
+		{Labelname: "addr", Type: "InetAddress"},
+		{Labelname: "name", Type: "DisplayString", Implied: true},
+	}
+	got, ok := splitInstance(".3.1.4.10.0.0.1.102.111.111", indexes)
+	want := map[string]string{"ifIndex": "3", "addr": "1.4.10.0.0.1", "name": "102.111.111"}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for _, instance := range []string{"", ".3", ".3.1.4.10.0", ".3.1.x.10.0.0.1.102"} {
+		if got, ok := splitInstance(instance, indexes); ok {
+			t.Errorf("%q: expected no split, got %v", instance, got)
+		}
+	}
+}
+
+func TestOverrideMACFormat(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "ifTable",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "ifEntry", Indexes: []string{"ifIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "ifIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "ifPhysAddress", Type: "OCTETSTR", TextualConvention: "PhysAddress"},
+							{Oid: "1.1.1.3", Access: "ACCESS_READONLY", Label: "ifInOctets", Type: "COUNTER"},
+						}}}},
+			{Oid: "1.2", Label: "fdbTable",
+				Children: []*Node{
+					{Oid: "1.2.1", Label: "fdbEntry", Indexes: []string{"fdbAddress"},
+						Children: []*Node{
+							{Oid: "1.2.1.1", Access: "ACCESS_NOACCESS", Label: "fdbAddress", Type: "OCTETSTR", TextualConvention: "PhysAddress", FixedSize: 6},
+							{Oid: "1.2.1.2", Access: "ACCESS_READONLY", Label: "fdbPort", Type: "INTEGER"},
+						}}}}}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	cfg := &ModuleConfig{
+		Walk: []string{"ifTable", "fdbPort"},
+		Lookups: []*Lookup{{
+			SourceIndexes: []string{"ifIndex"},
+			Lookup:        "ifPhysAddress",
+		}},
+		Overrides: map[string]MetricOverrides{
+			"ifPhysAddress": {MACFormat: config.MACFormatDot},
+			"fdbAddress":    {MACFormat: config.MACFormatDash},
+		},
+	}
+	out, report, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	formats := map[string]string{}
+	for _, m := range out.Metrics {
+		formats[m.Name] = m.MACFormat
+		for _, index := range m.Indexes {
+			formats[m.Name+" index "+index.Labelname] = index.MACFormat
+		}
+		for _, l := range m.Lookups {
+			formats[m.Name+" lookup "+l.Labelname] = l.MACFormat
+		}
+	}
+	for key, expected := range map[string]string{
+		"ifPhysAddress":                   config.MACFormatDot,
+		"ifInOctets lookup ifPhysAddress": config.MACFormatDot,
+		"ifInOctets":                      "",
+		"fdbPort index fdbAddress":        config.MACFormatDash,
+	} {
+		if formats[key] != expected {
+			t.Errorf("%s: expected mac_format %q, got %q", key, expected, formats[key])
+		}
+	}
+	if len(report.Unused) != 0 {
+		t.Errorf("Expected the overrides used, got unused %v", report.Unused)
+	}
+
+	var o MetricOverrides
+	if err := yaml.UnmarshalStrict([]byte("mac_format: cisco\n"), &o); err == nil {
+		t.Error("Expected an error for an unknown mac_format")
+	}
+}
+
+func TestRollups(t *testing.T) {
+	node := &Node{Oid: "1", Label: "root",
+		Children: []*Node{
+			{Oid: "1.1", Label: "ifTable",
+				Children: []*Node{
+					{Oid: "1.1.1", Label: "ifEntry", Indexes: []string{"ifIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "ifIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "ifInOctets", Type: "COUNTER"},
+						}}}}}}
+	nameToNode := prepareTree(node, log.NewNopLogger())
+	cfg := &ModuleConfig{
+		Walk: []string{"ifTable"},
+		Rollups: []*config.Rollup{
+			{Table: "ifTable", Sum: []string{"ifInOctets"}},
+			{Table: "interfaces", Oid: "ifEntry", DropSource: true},
+			{Table: "other", Oid: "1.1"},
+		},
+	}
+	out, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*config.Rollup{
+		{Table: "ifTable", Oid: "1.1", Sum: []string{"ifInOctets"}},
+		{Table: "interfaces", Oid: "1.1.1", DropSource: true},
+		{Table: "other", Oid: "1.1"},
+	}
+	if !reflect.DeepEqual(out.Rollups, want) {
+		t.Errorf("Expected rollups %+v, got %+v", want, out.Rollups)
+	}
+	if cfg.Rollups[0].Oid != "" {
+		t.Errorf("Expected the configuration unchanged, got oid %s", cfg.Rollups[0].Oid)
+	}
+
+	cfg.Rollups = []*config.Rollup{{Table: "nonexistent"}}
+	if _, _, err := generateConfigModule(cfg, node, nameToNode, log.NewNopLogger()); err == nil {
+		t.Error("Expected an error for an unknown table")
 	}
 }
@@ -0,0 +1,112 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	influxURL     = kingpin.Flag("influxdb.url", "InfluxDB write URL, e.g. http://influxdb:8086/api/v2/write?org=example&bucket=snmp, to push the scrapes of the targets of --otlp.targets-file to as line protocol. Disabled if empty.").Default("").String()
+	influxHeaders = kingpin.Flag("influxdb.header", "Header to send with InfluxDB writes, as name=value, can be repeated.").StringMap()
+
+	influxPushes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "influxdb_pushes_total",
+			Help:      "Pushes of the scrape of a target to InfluxDB, by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// toLineProtocol converts the metrics of a scrape of the target to InfluxDB
+// line protocol, with a point per sample: the metric name as measurement,
+// the labels of the sample and of the target as tags, and the sample value
+// as the value field. InfluxDB has no NaN nor infinities, so samples with
+// them are left out, as are empty tags.
+func toLineProtocol(t otlpTarget, mfs []*dto.MetricFamily, now time.Time) []byte {
+	targetTags := map[string]string{"snmp_target": t.target, "snmp_auth": t.auth, "snmp_modules": strings.Join(t.modules, ",")}
+	if t.tenant != "" {
+		targetTags["snmp_tenant"] = t.tenant
+	}
+	for name, value := range t.attributes {
+		targetTags[name] = value
+	}
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			tags := make(map[string]string, len(targetTags)+len(m.GetLabel()))
+			for name, value := range targetTags {
+				tags[name] = value
+			}
+			for _, l := range m.GetLabel() {
+				tags[l.GetName()] = l.GetValue()
+			}
+			names := make([]string, 0, len(tags))
+			for name, value := range tags {
+				if value != "" {
+					names = append(names, name)
+				}
+			}
+			// InfluxDB parses points with sorted tags faster.
+			sort.Strings(names)
+			buf.WriteString(influxMeasurementEscaper.Replace(mf.GetName()))
+			for _, name := range names {
+				buf.WriteString("," + influxTagEscaper.Replace(name) + "=" + influxTagEscaper.Replace(tags[name]))
+			}
+			buf.WriteString(" value=" + strconv.FormatFloat(value, 'g', -1, 64) + " " + timestamp + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+func pushInflux(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	return post(ctx, client, url, "text/plain; charset=utf-8", headers, body)
+}
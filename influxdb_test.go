@@ -0,0 +1,74 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPushInflux(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ifHCInOctets", Help: "Octets."}, []string{"ifIndex", "ifAlias"})
+	counter.WithLabelValues("2", "uplink, core=1").Add(5)
+	counter.WithLabelValues("3", "").Add(1.5)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "sensor", Help: "Sensor."})
+	gauge.Set(math.NaN())
+	registry.MustRegister(counter, gauge)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := otlpTarget{target: "switch1", auth: "public_v2", modules: []string{"if_mib", "ucd_cpu"}, attributes: map[string]string{"site": "ams"}}
+	lines := toLineProtocol(target, mfs, time.Unix(1700000000, 0))
+	expected := `ifHCInOctets,ifIndex=3,site=ams,snmp_auth=public_v2,snmp_modules=if_mib\,ucd_cpu,snmp_target=switch1 value=1.5 1700000000000000000
+ifHCInOctets,ifAlias=uplink\,\ core\=1,ifIndex=2,site=ams,snmp_auth=public_v2,snmp_modules=if_mib\,ucd_cpu,snmp_target=switch1 value=5 1700000000000000000
+`
+	if string(lines) != expected {
+		t.Errorf("Wrong line protocol, got:\n%s\nwant:\n%s", lines, expected)
+	}
+
+	var body, token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, token = string(b), r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	if err := pushInflux(context.Background(), server.Client(), server.URL, map[string]string{"Authorization": "Token x"}, lines); err != nil {
+		t.Fatal(err)
+	}
+	if token != "Token x" {
+		t.Errorf("Header not sent, got %q", token)
+	}
+	if body != expected {
+		t.Errorf("Wrong pushed body %s", body)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unable to parse", http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	if err := pushInflux(context.Background(), failing.Client(), failing.URL, nil, lines); err == nil || !strings.Contains(err.Error(), "unable to parse") {
+		t.Errorf("Expected the server's error, got %v", err)
+	}
+}
@@ -14,22 +14,33 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	stdlog "log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
 	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
@@ -39,6 +50,7 @@ import (
 
 	"github.com/prometheus/snmp_exporter/collector"
 	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/snmpcollect"
 )
 
 const (
@@ -48,14 +60,27 @@ const (
 var (
 	configFile    = kingpin.Flag("config.file", "Path to configuration file.").Default("snmp.yml").Strings()
 	dryRun        = kingpin.Flag("dry-run", "Only verify configuration is valid and exit.").Default("false").Bool()
+	printSchema   = kingpin.Flag("print-schema", "Print the JSON Schema of configuration files, for editors and CI systems to validate them, and exit.").Default("false").Bool()
 	concurrency   = kingpin.Flag("snmp.module-concurrency", "The number of modules to fetch concurrently per scrape").Default("1").Int()
 	debugSNMP     = kingpin.Flag("snmp.debug-packets", "Include a full debug trace of SNMP packet traffics.").Default("false").Bool()
 	expandEnvVars = kingpin.Flag("config.expand-environment-variables", "Expand environment variables to source secrets").Default("false").Bool()
+	secretsKey    = kingpin.Flag("config.secrets-key-file", "Path to the key, 32 random bytes as base64, to decrypt the encrypted secrets of the auths with.").String()
+	mibIndexFile  = kingpin.Flag("config.mib-index", "Path to a MIB index written by the generator, to name and describe metrics of OIDs without a MIB.").String()
+	timeoutOffset = kingpin.Flag("snmp.timeout-offset", "Offset to subtract from the scrape timeout sent by Prometheus, leaving time to return what was collected.").Default("0.5").Float64()
+	hardTimeout   = kingpin.Flag("snmp.enforce-scrape-timeout", "Stop the SNMP requests of scrapes at the scrape timeout sent by Prometheus, less --snmp.timeout-offset, rather than only skipping low priority walks near it.").Default("false").Bool()
+	watchFiles    = kingpin.Flag("config.watch", "Watch the configuration files, and the mapping files, MIB index and secrets key they depend on, and reload the configuration when they change.").Default("false").Bool()
+	watchInterval = kingpin.Flag("config.watch-interval", "How often to check the configuration files and the files they depend on for changes, alone or along with --config.watch for filesystems without change notifications. 0 disables polling.").Default("0s").Duration()
+	staleCheck    = kingpin.Flag("config.stale-check", "Check the metrics of the modules against --config.mib-index when loading the configuration, reporting those whose OID is not in the index or whose type changed.").Default("false").Bool()
+	metricInfo    = kingpin.Flag("web.metric-info", "Expose a snmp_metric_info series for each metric of each module on /metrics.").Default("false").Bool()
+	compressLevel = kingpin.Flag("web.compression-level", "gzip or zstd level of /snmp responses to scrapers accepting either, from 1 (fastest) to 9 (smallest), -1 for the default level. 0 disables compression.").Default("-1").Int()
+	penRegistry   = kingpin.Flag("snmp.enterprise-numbers", "Path to the IANA enterprise-numbers registry, naming the vendors of --snmp.device-info-vendor which are not built in.").String()
+	partialStatus = kingpin.Flag("web.partial-scrape-status", "Answer scrapes which failed for only some of the modules with the status code of the failure too, rather than 200. Prometheus discards the samples of responses other than 200.").Default("false").Bool()
 	metricsPath   = kingpin.Flag(
 		"web.telemetry-path",
 		"Path under which to expose metrics.",
 	).Default("/metrics").String()
 	toolkitFlags = webflag.AddFlags(kingpin.CommandLine, ":9116")
+	_            = kingpin.Command("serve", "Run the exporter.").Default()
 
 	// Metrics about the SNMP exporter itself.
 	snmpRequestErrors = promauto.NewCounter(
@@ -65,18 +90,51 @@ var (
 			Help:      "Errors in requests to the SNMP exporter",
 		},
 	)
-	snmpCollectionDuration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
+	// The metrics of the collector, shared with the snmpcollect package.
+	exporterMetrics = snmpcollect.NewMetrics(prometheus.DefaultRegisterer)
+
+	configReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
 			Namespace: namespace,
-			Name:      "collection_duration_seconds",
-			Help:      "Duration of collections by the SNMP exporter",
+			Name:      "config_reloads_total",
+			Help:      "Configuration reloads, by what triggered them.",
 		},
-		[]string{"module"},
+		[]string{"trigger"},
+	)
+	configLastReloadSuccessful = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	configLastReloadSuccess = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		},
+	)
+	moduleInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "module_info"),
+		"Information about the configured modules.",
+		[]string{"module", "tenant", "metrics", "walk_roots", "scrape_interval"}, nil,
+	)
+	staleMetricsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "config_stale_metrics"),
+		"Metrics of a module which no longer match the MIB index, by reason, with --config.stale-check.",
+		[]string{"module", "reason"}, nil,
+	)
+	metricInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "metric_info"),
+		"Metrics the configured modules can produce.",
+		[]string{"module", "tenant", "metric_name", "oid", "type"}, nil,
 	)
 	sc = &SafeConfig{
 		C: &config.Config{},
 	}
 	reloadCh chan chan error
+	limiters = &tenantLimiters{}
 )
 
 const (
@@ -84,85 +142,306 @@ const (
 	configPath = "/config"
 )
 
-func handler(w http.ResponseWriter, r *http.Request, logger log.Logger, exporterMetrics collector.Metrics) {
-	query := r.URL.Query()
+// errorStatusCodes maps the type of a failed request or scrape to the HTTP
+// status code returned to the client.
+var errorStatusCodes = map[string]int{
+	collector.ErrorTypeBadRequest:    http.StatusBadRequest,
+	collector.ErrorTypeConfigMissing: http.StatusNotFound,
+	collector.ErrorTypeForbidden:     http.StatusForbidden,
+	collector.ErrorTypeRateLimited:   http.StatusTooManyRequests,
+	collector.ErrorTypeAuth:          http.StatusForbidden,
+	collector.ErrorTypeTimeout:       http.StatusGatewayTimeout,
+	collector.ErrorTypeUnreachable:   http.StatusServiceUnavailable,
+	collector.ErrorTypeDecode:        http.StatusBadGateway,
+	collector.ErrorTypeAgent:         http.StatusBadGateway,
+	collector.ErrorTypeUnknown:       http.StatusInternalServerError,
+}
 
-	debug := *debugSNMP
-	if query.Get("snmp_debug_packets") == "true" {
-		debug = true
-		// TODO: This doesn't work the way I want.
-		// logger = level.NewFilter(logger, level.AllowDebug())
-		level.Debug(logger).Log("msg", "Debug query param enabled")
-	}
+// errorResponse is the machine-readable body of a failed request.
+type errorResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
 
-	target := query.Get("target")
-	if len(query["target"]) != 1 || target == "" {
-		http.Error(w, "'target' parameter must be specified once", http.StatusBadRequest)
-		snmpRequestErrors.Inc()
+func httpError(w http.ResponseWriter, errorType, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(errorStatusCodes[errorType])
+	json.NewEncoder(w).Encode(errorResponse{Status: "error", ErrorType: errorType, Error: msg})
+}
+
+// scrapeStatusWriter sets the status code of a scrape response once the
+// collection has finished, so that a partial exposition can be served
+// along with a status code describing the failure.
+type scrapeStatusWriter struct {
+	http.ResponseWriter
+	status      func() int
+	wroteHeader bool
+}
+
+func (s *scrapeStatusWriter) WriteHeader(code int) {
+	if s.wroteHeader {
 		return
 	}
+	s.wroteHeader = true
+	if code == http.StatusOK {
+		code = s.status()
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
 
-	authName := query.Get("auth")
-	if len(query["auth"]) > 1 {
-		http.Error(w, "'auth' parameter must only be specified once", http.StatusBadRequest)
-		snmpRequestErrors.Inc()
-		return
+func (s *scrapeStatusWriter) Write(b []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+	return s.ResponseWriter.Write(b)
+}
+
+// compressedResponseWriter compresses the response as it is written.
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (c compressedResponseWriter) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// responseEncoding returns the content encoding of the response to a client
+// sending the Accept-Encoding header, or "" for none. Of the encodings with
+// the highest q-value zstd is preferred, as it compresses faster and
+// smaller.
+func responseEncoding(header http.Header) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "zstd" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				v = 0
+			}
+			q = v
+		}
+		if q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && coding == "zstd") {
+			best, bestQ = coding, q
+		}
 	}
-	if authName == "" {
-		authName = "public_v2"
+	return best
+}
+
+// errorRecordingGatherer remembers whether gathering returned an error, and
+// how many samples were gathered.
+type errorRecordingGatherer struct {
+	prometheus.Gatherer
+	err     error
+	samples int
+}
+
+func (g *errorRecordingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	g.err = err
+	for _, mf := range mfs {
+		g.samples += len(mf.GetMetric())
 	}
+	return mfs, err
+}
 
-	snmpContext := query.Get("snmp_context")
-	if len(query["snmp_context"]) > 1 {
-		http.Error(w, "'snmp_context' parameter must only be specified once", http.StatusBadRequest)
+func handler(w http.ResponseWriter, r *http.Request, logger log.Logger, exporterMetrics collector.Metrics) {
+	req, err := parseScrapeRequest(w, r)
+	if err != nil {
+		httpError(w, collector.ErrorTypeBadRequest, err.Error())
 		snmpRequestErrors.Inc()
 		return
 	}
-
-	queryModule := query["module"]
-	if len(queryModule) == 0 {
-		queryModule = append(queryModule, "if_mib")
+	debug := *debugSNMP
+	if req.DebugPackets {
+		debug = true
+		// TODO: This doesn't work the way I want.
+		// logger = level.NewFilter(logger, level.AllowDebug())
+		level.Debug(logger).Log("msg", "Debug query param enabled")
 	}
-	uniqueM := make(map[string]bool)
-	var modules []string
-	for _, qm := range queryModule {
-		for _, m := range strings.Split(qm, ",") {
-			if m == "" {
-				continue
-			}
-			if _, ok := uniqueM[m]; !ok {
-				uniqueM[m] = true
-				modules = append(modules, m)
-			}
+
+	target, snmpContext, tenantName := req.Target, req.SNMPContext, req.Tenant
+	if pathTenant := tenantFromPath(r.URL.Path); pathTenant != "" {
+		if tenantName != "" && tenantName != pathTenant {
+			httpError(w, collector.ErrorTypeBadRequest, "'tenant' parameter does not match the URL")
+			snmpRequestErrors.Inc()
+			return
 		}
+		tenantName = pathTenant
 	}
+
 	sc.RLock()
-	auth, authOk := sc.C.Auths[authName]
+	auths, configModules, targetDefaultsBySubnet := sc.C.Auths, sc.C.Modules, sc.C.TargetDefaults
+	notifyURL := *webhookURL
+	scrapeTarget := target
+	if tenantName != "" {
+		// Tenants only see their own auths and modules.
+		tenant, ok := sc.C.Tenants[tenantName]
+		if !ok {
+			sc.RUnlock()
+			httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown tenant '%s'", tenantName))
+			snmpRequestErrors.Inc()
+			return
+		}
+		if err := checkTenantTarget(r.Context(), tenant, target); err != nil {
+			sc.RUnlock()
+			httpError(w, collector.ErrorTypeForbidden, err.Error())
+			snmpRequestErrors.Inc()
+			return
+		}
+		if !limiters.allow(tenantName, tenant, time.Now()) {
+			sc.RUnlock()
+			httpError(w, collector.ErrorTypeRateLimited, fmt.Sprintf("Rate limit exceeded for tenant '%s'", tenantName))
+			snmpRequestErrors.Inc()
+			return
+		}
+		auths, configModules, targetDefaultsBySubnet = tenant.Auths, tenant.Modules, tenant.TargetDefaults
+		if tenant.WebhookURL != "" {
+			notifyURL = tenant.WebhookURL
+		}
+		logger = log.With(logger, "tenant", tenantName)
+	}
+	timeout, timeoutOk := scrapeTimeout(r, *timeoutOffset)
+	var defaults *config.TargetDefaults
+	if needsTargetDefaults(req, targetDefaultsBySubnet, timeoutOk) {
+		defaults, scrapeTarget = targetDefaults(r.Context(), targetDefaultsBySubnet, target)
+	}
+	req.applyDefaults(defaults)
+	authName, modules := req.Auth, req.Modules
+	auth, authOk := auths[authName]
 	if !authOk {
 		sc.RUnlock()
-		http.Error(w, fmt.Sprintf("Unknown auth '%s'", authName), http.StatusBadRequest)
+		httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown auth '%s'", authName))
 		snmpRequestErrors.Inc()
 		return
 	}
+	if req.AuthOverrides != nil {
+		auth = req.AuthOverrides.apply(auth)
+	}
 	var nmodules []*collector.NamedModule
 	for _, m := range modules {
-		module, moduleOk := sc.C.Modules[m]
+		module, moduleOk := configModules[m]
 		if !moduleOk {
 			sc.RUnlock()
-			http.Error(w, fmt.Sprintf("Unknown module '%s'", m), http.StatusBadRequest)
+			httpError(w, collector.ErrorTypeConfigMissing, fmt.Sprintf("Unknown module '%s'", m))
 			snmpRequestErrors.Inc()
 			return
 		}
+		if req.RetryPolicy != "" {
+			// The scrape's policy overrides the module's.
+			withPolicy := *module
+			withPolicy.WalkParams.RetryPolicy = req.RetryPolicy
+			module = &withPolicy
+		}
+		if req.MaxMessageSize != 0 {
+			withSize := *module
+			withSize.WalkParams.MaxMessageSize = req.MaxMessageSize
+			module = &withSize
+		}
 		nmodules = append(nmodules, collector.NewNamedModule(m, module))
 	}
 	sc.RUnlock()
 	logger = log.With(logger, "auth", authName, "target", target)
+	ctx := r.Context()
+	if !timeoutOk && defaults != nil && defaults.Timeout > 0 {
+		timeout, timeoutOk = defaults.Timeout, true
+	}
+	if timeoutOk {
+		deadline := time.Now().Add(timeout)
+		ctx = collector.WithScrapeDeadline(ctx, deadline)
+		if *hardTimeout {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+	}
+	start := time.Now()
 	registry := prometheus.NewRegistry()
-	c := collector.New(r.Context(), target, authName, snmpContext, auth, nmodules, logger, exporterMetrics, *concurrency, debug)
-	registry.MustRegister(c)
+	c := collector.New(ctx, scrapeTarget, authName, snmpContext, auth, nmodules, logger, exporterMetrics, *concurrency, debug)
+	prometheus.WrapRegistererWith(req.Labels, registry).MustRegister(c)
+	gatherer := &errorRecordingGatherer{Gatherer: registry}
 	// Delegate http serving to Prometheus client library, which will call collector.Collect.
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
+	// Whatever could be collected is served, with the status code reflecting any failure.
+	h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorLog:      stdlog.New(log.NewStdlibAdapter(level.Error(logger)), "", 0),
+		ErrorHandling: promhttp.ContinueOnError,
+		// Compressed below at the configured level.
+		DisableCompression: true,
+	})
+	out := w
+	if encoding := responseEncoding(r.Header); *compressLevel != 0 && encoding != "" {
+		var cw io.WriteCloser
+		if encoding == "zstd" {
+			zlevel := zstd.SpeedDefault
+			if *compressLevel > 0 {
+				zlevel = zstd.EncoderLevelFromZstd(*compressLevel)
+			}
+			cw, _ = zstd.NewWriter(w, zstd.WithEncoderLevel(zlevel), zstd.WithEncoderConcurrency(1))
+		} else {
+			// The level was checked at startup.
+			cw, _ = gzip.NewWriterLevel(w, *compressLevel)
+		}
+		defer cw.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+		out = compressedResponseWriter{ResponseWriter: w, w: cw}
+	}
+	h.ServeHTTP(&scrapeStatusWriter{ResponseWriter: out, status: func() int {
+		if errorType := c.ErrorType(); errorType != "" {
+			if c.Partial() && !*partialStatus {
+				return http.StatusOK
+			}
+			return errorStatusCodes[errorType]
+		}
+		if gatherer.err != nil {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	}}, r)
+
+	status := "success"
+	if errorType := c.ErrorType(); errorType != "" {
+		status = errorType
+	} else if gatherer.err != nil {
+		status = collector.ErrorTypeUnknown
+	}
+	scrape := targetStatus{
+		Target:          target,
+		Auth:            authName,
+		Modules:         modules,
+		Tenant:          tenantName,
+		LastScrape:      start,
+		DurationSeconds: time.Since(start).Seconds(),
+		Samples:         gatherer.samples,
+		Status:          status,
+	}
+	targetStats.record(scrape, gatherer.err, *targetsRetention)
+	observeScrape(scrape, notifyURL, logger)
+}
+
+// scrapeTimeout returns the timeout Prometheus gives the scrape, less the
+// offset, if it sent one.
+func scrapeTimeout(r *http.Request, offset float64) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	if seconds > offset {
+		seconds -= offset
+	}
+	return time.Duration(seconds * float64(time.Second)), true
 }
 
 func updateConfiguration(w http.ResponseWriter, r *http.Request) {
@@ -181,6 +460,14 @@ func updateConfiguration(w http.ResponseWriter, r *http.Request) {
 type SafeConfig struct {
 	sync.RWMutex
 	C *config.Config
+	// Path of a MIB index to describe metrics with, if any.
+	MIBIndex string
+	// Whether to expose snmp_metric_info for the metrics of the modules.
+	MetricInfo bool
+	// Whether to check the metrics of the modules against the MIB index.
+	StaleCheck bool
+	// Metrics no longer matching the MIB index, if checked.
+	Stale []config.StaleMetric
 }
 
 func (sc *SafeConfig) ReloadConfig(configFile []string, expandEnvVars bool) (err error) {
@@ -188,109 +475,315 @@ func (sc *SafeConfig) ReloadConfig(configFile []string, expandEnvVars bool) (err
 	if err != nil {
 		return err
 	}
+	var stale []config.StaleMetric
+	if sc.MIBIndex != "" {
+		index, err := config.LoadMIBIndex(sc.MIBIndex)
+		if err != nil {
+			return err
+		}
+		conf.ApplyMIBIndex(index)
+		if sc.StaleCheck {
+			stale = conf.StaleMetrics(index)
+		}
+	}
 	sc.Lock()
 	sc.C = conf
+	sc.Stale = stale
 	// Initialize metrics.
 	for module := range sc.C.Modules {
-		snmpCollectionDuration.WithLabelValues(module)
+		initModuleMetrics(module)
+	}
+	for _, tenant := range sc.C.Tenants {
+		for module := range tenant.Modules {
+			initModuleMetrics(module)
+		}
 	}
 	sc.Unlock()
 	return nil
 }
 
+// reloadConfig reloads the configuration, recording the outcome.
+func reloadConfig(logger log.Logger, trigger string) error {
+	configReloads.WithLabelValues(trigger).Inc()
+	if *secretsKey != "" {
+		// The key may have been rotated along with the secrets.
+		if err := config.LoadSecretsKey(*secretsKey); err != nil {
+			level.Error(logger).Log("msg", "Error reloading secrets key", "trigger", trigger, "err", err)
+			configLastReloadSuccessful.Set(0)
+			return err
+		}
+	}
+	if err := sc.ReloadConfig(*configFile, *expandEnvVars); err != nil {
+		level.Error(logger).Log("msg", "Error reloading config", "trigger", trigger, "err", err)
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+	level.Info(logger).Log("msg", "Loaded config file", "trigger", trigger)
+	logStaleMetrics(logger)
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccess.SetToCurrentTime()
+	return nil
+}
+
+// logStaleMetrics logs the metrics which no longer match the MIB index, and
+// how many there are by module.
+func logStaleMetrics(logger log.Logger) {
+	sc.RLock()
+	defer sc.RUnlock()
+	counts := map[string]int{}
+	for _, m := range sc.Stale {
+		level.Debug(logger).Log("msg", "Metric does not match the MIB index", "module", m.Module, "metric", m.Metric, "oid", m.Oid, "reason", m.Reason)
+		counts[m.Module]++
+	}
+	modules := make([]string, 0, len(counts))
+	for module := range counts {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	for _, module := range modules {
+		level.Warn(logger).Log("msg", "Module has metrics which no longer match the MIB index, it may need regenerating", "module", module, "metrics", counts[module])
+	}
+}
+
+func initModuleMetrics(module string) {
+	exporterMetrics.SNMPCollectionDuration.WithLabelValues(module)
+	exporterMetrics.SNMPModuleScrapes.WithLabelValues(module)
+	exporterMetrics.SNMPModuleScrapeErrors.WithLabelValues(module)
+	exporterMetrics.SNMPModulePdus.WithLabelValues(module)
+	exporterMetrics.SNMPCollectionCPU.WithLabelValues(module)
+	exporterMetrics.SNMPCollectionAllocs.WithLabelValues(module)
+}
+
+// Describe implements the prometheus.Collector interface. The set of
+// modules changes on reload, so this is an unchecked collector.
+func (sc *SafeConfig) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements the prometheus.Collector interface, exposing
+// snmp_module_info for each module of the loaded config, optionally
+// snmp_metric_info for each of their metrics, and with --config.stale-check
+// snmp_config_stale_metrics.
+func (sc *SafeConfig) Collect(ch chan<- prometheus.Metric) {
+	sc.RLock()
+	defer sc.RUnlock()
+	stale := map[[2]string]int{}
+	for _, m := range sc.Stale {
+		stale[[2]string{m.Module, m.Reason}]++
+	}
+	for key, n := range stale {
+		ch <- prometheus.MustNewConstMetric(staleMetricsDesc, prometheus.GaugeValue, float64(n), key[0], key[1])
+	}
+	sc.collectModules(ch, "", sc.C.Modules)
+	for name, tenant := range sc.C.Tenants {
+		sc.collectModules(ch, name, tenant.Modules)
+	}
+}
+
+// collectModules exposes snmp_module_info and snmp_metric_info for the
+// modules of a tenant, or the global modules if the tenant is empty.
+func (sc *SafeConfig) collectModules(ch chan<- prometheus.Metric, tenant string, modules map[string]*config.Module) {
+	for name, module := range modules {
+		interval := ""
+		if module.ScrapeInterval > 0 {
+			interval = module.ScrapeInterval.String()
+		}
+		ch <- prometheus.MustNewConstMetric(moduleInfoDesc, prometheus.GaugeValue, 1,
+			name, tenant, strconv.Itoa(len(module.Metrics)), strconv.Itoa(len(module.Walk)+len(module.Get)), interval)
+		if !sc.MetricInfo {
+			continue
+		}
+		// The same metric may be defined more than once, e.g. with a
+		// different regex_extracts or for other indexes.
+		seen := map[[3]string]struct{}{}
+		for _, metric := range module.Metrics {
+			key := [3]string{metric.Name, metric.Oid, metric.Type}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			ch <- prometheus.MustNewConstMetric(metricInfoDesc, prometheus.GaugeValue, 1,
+				name, tenant, metric.Name, metric.Oid, metric.Type)
+		}
+	}
+}
+
 func main() {
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("snmp_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	logger := promlog.New(promlogConfig)
+	if handled, err := runServiceCommand(command); handled {
+		if err != nil {
+			level.Error(logger).Log("msg", "Error managing the Windows service", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *printSchema {
+		schema, err := config.Schema()
+		if err != nil {
+			level.Error(logger).Log("msg", "Error generating the configuration schema", "err", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(schema))
+		return
+	}
+	if *secretsKey != "" {
+		if err := config.LoadSecretsKey(*secretsKey); err != nil {
+			level.Error(logger).Log("msg", "Error loading secrets key", "err", err)
+			os.Exit(1)
+		}
+	}
+	if command == encryptCommand.FullCommand() {
+		if err := runEncrypt(os.Stdin, os.Stdout); err != nil {
+			level.Error(logger).Log("msg", "Error encrypting secret", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == scanCommand.FullCommand() {
+		if err := runScan(logger); err != nil {
+			level.Error(logger).Log("msg", "Error scanning", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == verifyCommand.FullCommand() {
+		if err := runVerify(logger, os.Stdout); err != nil {
+			level.Error(logger).Log("msg", "Error verifying target", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == recordCommand.FullCommand() {
+		if err := runRecord(logger, os.Stdout); err != nil {
+			level.Error(logger).Log("msg", "Error recording target", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == compareCommand.FullCommand() {
+		if err := runCompare(os.Stdout); err != nil {
+			level.Error(logger).Log("msg", "Recordings differ", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if *concurrency < 1 {
 		*concurrency = 1
 	}
+	if *compressLevel < gzip.DefaultCompression || *compressLevel > gzip.BestCompression {
+		level.Error(logger).Log("msg", "--web.compression-level must be between -1 and 9", "level", *compressLevel)
+		os.Exit(1)
+	}
+	if *penRegistry != "" {
+		if err := collector.LoadEnterpriseNumbers(*penRegistry); err != nil {
+			level.Error(logger).Log("msg", "Error loading enterprise numbers", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *staleCheck && *mibIndexFile == "" {
+		level.Error(logger).Log("msg", "--config.stale-check needs --config.mib-index")
+		os.Exit(1)
+	}
+	if err := collector.CheckSourcePorts(); err != nil {
+		level.Error(logger).Log("msg", "Error in --snmp.source-port-range", "err", err)
+		os.Exit(1)
+	}
 
 	level.Info(logger).Log("msg", "Starting snmp_exporter", "version", version.Info(), "concurrency", concurrency, "debug_snmp", debugSNMP)
 	level.Info(logger).Log("build_context", version.BuildContext())
 
 	prometheus.MustRegister(versioncollector.NewCollector("snmp_exporter"))
+	prometheus.MustRegister(sc)
+	sc.MIBIndex = *mibIndexFile
+	sc.MetricInfo = *metricInfo
+	sc.StaleCheck = *staleCheck
+
+	if *generateOnStart {
+		generated, err := generateOnStartup(*generatorBinary, *generatorYml, *generatorMIBs, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error generating config", "err", err)
+			os.Exit(1)
+		}
+		// Reloads read the generated config again, without regenerating it.
+		*configFile = []string{generated}
+	}
 
 	// Bail early if the config is bad.
 	err := sc.ReloadConfig(*configFile, *expandEnvVars)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error parsing config file", "err", err)
 		level.Error(logger).Log("msg", "Possible old config file, see https://github.com/prometheus/snmp_exporter/blob/main/auth-split-migration.md")
+		removeGenerated()
 		os.Exit(1)
 	}
 
+	logStaleMetrics(logger)
+
 	// Exit if in dry-run mode.
 	if *dryRun {
 		level.Info(logger).Log("msg", "Configuration parsed successfully")
 		return
 	}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccess.SetToCurrentTime()
+	runAsService(logger)
 
 	hup := make(chan os.Signal, 1)
 	reloadCh = make(chan chan error)
 	signal.Notify(hup, syscall.SIGHUP)
+	// The channels of watching never fire if it is disabled.
+	var watcher *configWatcher
+	var watchTick, settle <-chan time.Time
+	var watchEvents <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if *watchFiles || *watchInterval > 0 {
+		var err error
+		if watcher, err = newConfigWatcher(logger, *watchFiles); err != nil {
+			level.Error(logger).Log("msg", "Error watching config files", "err", err)
+			removeGenerated()
+			os.Exit(1)
+		}
+		watchEvents, watchErrors = watcher.events()
+	}
+	if *watchInterval > 0 {
+		ticker := time.NewTicker(*watchInterval)
+		defer ticker.Stop()
+		watchTick = ticker.C
+	}
 	go func() {
 		for {
 			select {
 			case <-hup:
-				if err := sc.ReloadConfig(*configFile, *expandEnvVars); err != nil {
-					level.Error(logger).Log("msg", "Error reloading config", "err", err)
-				} else {
-					level.Info(logger).Log("msg", "Loaded config file")
-				}
+				reloadConfig(logger, "signal")
+				watcher.update()
 			case rc := <-reloadCh:
-				if err := sc.ReloadConfig(*configFile, *expandEnvVars); err != nil {
-					level.Error(logger).Log("msg", "Error reloading config", "err", err)
-					rc <- err
-				} else {
-					level.Info(logger).Log("msg", "Loaded config file")
-					rc <- nil
+				rc <- reloadConfig(logger, "http")
+				watcher.update()
+			case <-watchEvents:
+				if settle == nil {
+					settle = time.After(watchSettle)
 				}
+			case err := <-watchErrors:
+				level.Warn(logger).Log("msg", "Error watching config files", "err", err)
+			case <-settle:
+				settle = nil
+				watcher.check()
+			case <-watchTick:
+				watcher.check()
 			}
 		}
 	}()
 
-	buckets := prometheus.ExponentialBuckets(0.0001, 2, 15)
-	exporterMetrics := collector.Metrics{
-		SNMPCollectionDuration: snmpCollectionDuration,
-		SNMPUnexpectedPduType: promauto.NewCounter(
-			prometheus.CounterOpts{
-				Namespace: namespace,
-				Name:      "unexpected_pdu_type_total",
-				Help:      "Unexpected Go types in a PDU.",
-			},
-		),
-		SNMPDuration: promauto.NewHistogram(
-			prometheus.HistogramOpts{
-				Namespace: namespace,
-				Name:      "packet_duration_seconds",
-				Help:      "A histogram of latencies for SNMP packets.",
-				Buckets:   buckets,
-			},
-		),
-		SNMPPackets: promauto.NewCounter(
-			prometheus.CounterOpts{
-				Namespace: namespace,
-				Name:      "packets_total",
-				Help:      "Number of SNMP packet sent, including retries.",
-			},
-		),
-		SNMPRetries: promauto.NewCounter(
-			prometheus.CounterOpts{
-				Namespace: namespace,
-				Name:      "packet_retries_total",
-				Help:      "Number of SNMP packet retries.",
-			},
-		),
-		SNMPInflight: promauto.NewGauge(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "request_in_flight",
-				Help:      "Current number of SNMP scrapes being requested.",
-			},
-		),
+	if *otlpEndpoint != "" || *influxURL != "" {
+		if *otlpTargetsFile == "" {
+			level.Error(logger).Log("msg", "--otlp.targets-file is required to push to an OTLP endpoint or InfluxDB")
+			removeGenerated()
+			os.Exit(1)
+		}
+		go runOTLP(context.Background(), logger, exporterMetrics)
 	}
 
 	http.Handle(*metricsPath, promhttp.Handler()) // Normal metrics endpoint for SNMP exporter itself.
@@ -298,7 +791,24 @@ func main() {
 	http.HandleFunc(proberPath, func(w http.ResponseWriter, r *http.Request) {
 		handler(w, r, logger, exporterMetrics)
 	})
+	// Endpoint to compare the output of two modules for a target.
+	http.HandleFunc(diffPath, func(w http.ResponseWriter, r *http.Request) {
+		diffHandler(w, r, logger, exporterMetrics)
+	})
+	// Endpoint to estimate the size of a scrape of a module from a sample.
+	http.HandleFunc(estimatePath, func(w http.ResponseWriter, r *http.Request) {
+		estimateHandler(w, r, logger, exporterMetrics)
+	})
+	// Endpoint to do SNMP scrapes on behalf of a tenant, as /tenant/<name>/snmp.
+	http.HandleFunc(tenantPathPrefix, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tenantPathPrefix+tenantFromPath(r.URL.Path)+proberPath {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r, logger, exporterMetrics)
+	})
 	http.HandleFunc("/-/reload", updateConfiguration) // Endpoint to reload configuration.
+	http.HandleFunc(targetsPath, targetsHandler)      // Endpoint listing the recently scraped targets.
 
 	if *metricsPath != "/" && *metricsPath != "" {
 		landingConfig := web.LandingConfig{
@@ -336,6 +846,10 @@ func main() {
 					Address: configPath,
 					Text:    "Config",
 				},
+				{
+					Address: targetsPath,
+					Text:    "Targets",
+				},
 				{
 					Address: *metricsPath,
 					Text:    "Metrics",
@@ -345,6 +859,7 @@ func main() {
 		landingPage, err := web.NewLandingPage(landingConfig)
 		if err != nil {
 			level.Error(logger).Log("err", err)
+			removeGenerated()
 			os.Exit(1)
 		}
 		http.Handle("/", landingPage)
@@ -362,9 +877,11 @@ func main() {
 		w.Write(c)
 	})
 
+	go runWatchdog(logger)
 	srv := &http.Server{}
-	if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
+	if err := listenAndServe(srv, toolkitFlags, logger); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
+		removeGenerated()
 		os.Exit(1)
 	}
 }
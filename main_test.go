@@ -0,0 +1,986 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gosnmp/gosnmp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func testExporterMetrics() collector.Metrics {
+	return collector.Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPPduTypeMismatches:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tm"}, []string{"metric"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+		SNMPModuleScrapes:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ms"}, []string{"module"}),
+		SNMPModuleScrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "me"}, []string{"module"}),
+		SNMPModulePdus:         prometheus.NewCounterVec(prometheus.CounterOpts{Name: "mp"}, []string{"module"}),
+		SNMPResyncs:            prometheus.NewCounter(prometheus.CounterOpts{Name: "rs"}),
+		SNMPWalkAnomalies:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "wa"}, []string{"type"}),
+		SNMPScrapesAbandoned:   prometheus.NewCounter(prometheus.CounterOpts{Name: "sa"}),
+		SNMPUnexpectedVarbinds: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "uv"}, []string{"module", "subtree"}),
+		SNMPOutOfRangeSamples:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "or"}, []string{"metric", "action"}),
+		SNMPLabelLimitSamples:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ll"}, []string{"module", "label"}),
+		SNMPCollectionCPU:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cc"}, []string{"module"}),
+		SNMPCollectionAllocs:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ca"}, []string{"module"}),
+	}
+}
+
+func setTestConfig(t *testing.T, c *config.Config) {
+	sc.Lock()
+	old := sc.C
+	sc.C = c
+	sc.Unlock()
+	t.Cleanup(func() {
+		sc.Lock()
+		sc.C = old
+		sc.Unlock()
+	})
+}
+
+func TestHandlerFormatNegotiation(t *testing.T) {
+	setTestConfig(t, &config.Config{
+		Auths:   map[string]*config.Auth{"public_v2": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"empty": &config.DefaultModule},
+	})
+
+	cases := []struct {
+		accept      string
+		contentType expfmt.Format
+	}{
+		{accept: "", contentType: expfmt.NewFormat(expfmt.TypeTextPlain)},
+		{accept: string(expfmt.NewFormat(expfmt.TypeProtoDelim)), contentType: expfmt.NewFormat(expfmt.TypeProtoDelim)},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/snmp?target=127.0.0.1&module=empty", nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req, log.NewNopLogger(), testExporterMetrics())
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Accept %q: unexpected status %d: %s", c.accept, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, string(c.contentType)) {
+			t.Errorf("Accept %q: got content type %q, want %q", c.accept, got, c.contentType)
+		}
+	}
+}
+
+func TestHandlerCompression(t *testing.T) {
+	setTestConfig(t, &config.Config{
+		Auths:   map[string]*config.Auth{"public_v2": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"empty": &config.DefaultModule},
+	})
+	level := *compressLevel
+	t.Cleanup(func() { *compressLevel = level })
+
+	cases := []struct {
+		acceptEncoding string
+		level          int
+		encoding       string
+	}{
+		{acceptEncoding: "", level: -1, encoding: ""},
+		{acceptEncoding: "gzip", level: -1, encoding: "gzip"},
+		{acceptEncoding: "deflate, gzip;q=1.0", level: 1, encoding: "gzip"},
+		{acceptEncoding: "gzip", level: 0, encoding: ""},
+		{acceptEncoding: "gzip;q=0", level: -1, encoding: ""},
+		{acceptEncoding: "gzip; q=0.000, deflate", level: -1, encoding: ""},
+		{acceptEncoding: "zstd", level: -1, encoding: "zstd"},
+		{acceptEncoding: "gzip, zstd", level: 9, encoding: "zstd"},
+		{acceptEncoding: "gzip;q=1, zstd;q=0.5", level: 3, encoding: "gzip"},
+		{acceptEncoding: "GZIP, zstd;q=0", level: -1, encoding: "gzip"},
+	}
+	for _, c := range cases {
+		*compressLevel = c.level
+		req := httptest.NewRequest("GET", "/snmp?target=127.0.0.1&module=empty", nil)
+		req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		rec := httptest.NewRecorder()
+		handler(rec, req, log.NewNopLogger(), testExporterMetrics())
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q at level %d: unexpected status %d", c.acceptEncoding, c.level, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != c.encoding {
+			t.Errorf("%q at level %d: got encoding %q, want %q", c.acceptEncoding, c.level, got, c.encoding)
+		}
+		var body io.Reader = rec.Body
+		switch c.encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		case "zstd":
+			zr, err := zstd.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			body = zr
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%q at level %d: %s", c.acceptEncoding, c.level, err)
+		}
+		if !strings.Contains(string(b), "snmp_scrape_duration_seconds") {
+			t.Errorf("%q at level %d: unexpected body %q", c.acceptEncoding, c.level, b)
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	setTestConfig(t, &config.Config{
+		Auths:   map[string]*config.Auth{"public_v2": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"empty": &config.DefaultModule},
+	})
+
+	cases := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{query: "", status: http.StatusBadRequest, body: `"errorType":"bad_request"`},
+		{query: "target=127.0.0.1&module=missing", status: http.StatusNotFound, body: `"errorType":"config_missing"`},
+		{query: "target=127.0.0.1&module=empty&auth=missing", status: http.StatusNotFound, body: `"errorType":"config_missing"`},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/snmp?"+c.query, nil), log.NewNopLogger(), testExporterMetrics())
+		if rec.Code != c.status {
+			t.Errorf("%q: got status %d, want %d", c.query, rec.Code, c.status)
+		}
+		if !strings.Contains(rec.Body.String(), c.body) {
+			t.Errorf("%q: body %q does not contain %q", c.query, rec.Body, c.body)
+		}
+	}
+}
+
+func TestHandlerTenants(t *testing.T) {
+	tenant := &config.Tenant{
+		Auths:   map[string]*config.Auth{"team_auth": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"team_module": &config.DefaultModule},
+	}
+	if err := yaml.Unmarshal([]byte("allowed_targets: [127.0.0.0/8]"), tenant); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, &config.Config{
+		Auths:   map[string]*config.Auth{"public_v2": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"empty": &config.DefaultModule},
+		Tenants: map[string]*config.Tenant{"team": tenant},
+	})
+
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{url: "/snmp?target=127.0.0.1&module=team_module&auth=team_auth", status: http.StatusNotFound},
+		{url: "/snmp?target=127.0.0.1&module=team_module&auth=team_auth&tenant=team", status: http.StatusOK},
+		{url: "/tenant/team/snmp?target=127.0.0.1&module=team_module&auth=team_auth", status: http.StatusOK},
+		{url: "/tenant/team/snmp?target=127.0.0.1&module=empty&auth=team_auth", status: http.StatusNotFound},
+		{url: "/tenant/team/snmp?target=127.0.0.1&module=team_module&auth=team_auth&tenant=other", status: http.StatusBadRequest},
+		{url: "/tenant/other/snmp?target=127.0.0.1&module=team_module&auth=team_auth", status: http.StatusNotFound},
+		{url: "/tenant/team/snmp?target=192.0.2.1&module=team_module&auth=team_auth", status: http.StatusForbidden},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", c.url, nil), log.NewNopLogger(), testExporterMetrics())
+		if rec.Code != c.status {
+			t.Errorf("%s: got status %d, want %d: %s", c.url, rec.Code, c.status, rec.Body)
+		}
+	}
+}
+
+func TestCheckTenantTarget(t *testing.T) {
+	tenant := &config.Tenant{}
+	if err := yaml.Unmarshal([]byte("allowed_targets: [127.0.0.0/8, '::1/128']"), tenant); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		target    string
+		shouldErr bool
+	}{
+		{target: "127.0.0.1"},
+		{target: "tcp://127.0.0.1:1161"},
+		{target: "192.0.2.1", shouldErr: true},
+		{target: "localhost.invalid", shouldErr: true},
+	}
+	for _, c := range cases {
+		err := checkTenantTarget(context.Background(), tenant, c.target)
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%q: unexpected error %v", c.target, err)
+		}
+	}
+}
+
+func TestWithTargetHost(t *testing.T) {
+	cases := []struct {
+		target, host, want string
+	}{
+		{target: "switch.local", host: "10.0.0.1", want: "10.0.0.1"},
+		{target: "switch.local:1161", host: "10.0.0.1", want: "10.0.0.1:1161"},
+		{target: "tcp://switch.local:1161", host: "2001:db8::1", want: "tcp://[2001:db8::1]:1161"},
+		{target: "udp6://switch.local", host: "2001:db8::1", want: "udp6://2001:db8::1"},
+	}
+	for _, c := range cases {
+		if got := withTargetHost(c.target, c.host); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.target, got, c.want)
+		}
+	}
+}
+
+func TestTenantLimiters(t *testing.T) {
+	l := &tenantLimiters{}
+	tenant := &config.Tenant{RateLimit: 1, RateLimitBurst: 2}
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow("team", tenant, now); got != want {
+			t.Errorf("request %d: got %v, want %v", i, got, want)
+		}
+	}
+	if !l.allow("team", tenant, now.Add(time.Second)) {
+		t.Error("token was not refilled after one second")
+	}
+	if !l.allow("other", tenant, now) {
+		t.Error("tenants must not share a rate limit")
+	}
+}
+
+func TestDiffModules(t *testing.T) {
+	a := &config.Module{Metrics: []*config.Metric{
+		{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10"},
+		{Name: "ifOutOctets", Oid: "1.3.6.1.2.1.2.2.1.16"},
+		{Name: "ifMtu", Oid: "1.3.6.1.2.1.2.2.1.4"},
+	}}
+	b := &config.Module{Metrics: []*config.Metric{
+		{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10"},
+		{Name: "ifOutOctetsTotal", Oid: "1.3.6.1.2.1.2.2.1.16"},
+		{Name: "ifSpeed", Oid: "1.3.6.1.2.1.2.2.1.5"},
+	}}
+	seriesA := map[string][]string{
+		"ifInOctets":  {`ifInOctets{ifIndex="1"}`, `ifInOctets{ifIndex="2"}`},
+		"ifOutOctets": {`ifOutOctets{ifIndex="1"}`},
+		"ifMtu":       {`ifMtu{ifIndex="1"}`},
+	}
+	seriesB := map[string][]string{
+		"ifInOctets":       {`ifInOctets{ifIndex="1"}`, `ifInOctets{ifDescr="eth1",ifIndex="2"}`},
+		"ifOutOctetsTotal": {`ifOutOctetsTotal{ifIndex="1"}`},
+		"ifSpeed":          {`ifSpeed{ifIndex="1"}`},
+	}
+	got := diffModules(a, b, seriesA, seriesB)
+	want := diffResult{
+		Added:     []string{`ifInOctets{ifDescr="eth1",ifIndex="2"}`, `ifSpeed{ifIndex="1"}`},
+		Removed:   []string{`ifInOctets{ifIndex="2"}`, `ifMtu{ifIndex="1"}`},
+		Renamed:   []renamedMetric{{From: "ifOutOctets", To: "ifOutOctetsTotal", Oid: "1.3.6.1.2.1.2.2.1.16"}},
+		Unchanged: 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffRecordings(t *testing.T) {
+	record := func(text string) *recording {
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mfs := []*dto.MetricFamily{}
+		for _, mf := range families {
+			mfs = append(mfs, mf)
+		}
+		module := &config.Module{Metrics: []*config.Metric{
+			{Name: "ifInOctets", Type: "counter"},
+			{Name: "ifAlias", Type: "DisplayString"},
+		}}
+		return newRecording(mfs, []*config.Module{module})
+	}
+	before := record(`# TYPE ifInOctets counter
+ifInOctets{ifIndex="1",module="if_mib"} 10
+ifInOctets{ifIndex="2",module="if_mib"} 20
+# TYPE ifAlias gauge
+ifAlias{ifAlias="uplink",ifIndex="1",module="if_mib"} 1
+# TYPE ifMtu gauge
+ifMtu{ifIndex="1",module="if_mib"} 1500
+# TYPE snmp_scrape_duration_seconds gauge
+snmp_scrape_duration_seconds{module="if_mib"} 1
+`)
+	if m := before.Metrics["ifAlias"]; m == nil || m.Type != "DisplayString" || !reflect.DeepEqual(m.Series, []string{`ifAlias{ifAlias="uplink",ifIndex="1"}`}) {
+		t.Errorf("Unexpected recording of ifAlias: %+v", m)
+	}
+	if _, ok := before.Metrics["snmp_scrape_duration_seconds"]; ok {
+		t.Error("Metrics about the scrape must not be recorded")
+	}
+
+	after := record(`# TYPE ifInOctets counter
+ifInOctets{ifIndex="1",module="if_mib"} 30
+ifInOctets{ifIndex="3",module="if_mib"} 40
+# TYPE ifMtu counter
+ifMtu{ifIndex="1",module="if_mib"} 1500
+# TYPE ifSpeed gauge
+ifSpeed{ifIndex="1",module="if_mib"} 1e9
+`)
+	got := diffRecordings(before, after)
+	want := recordingDiff{
+		AppearedMetrics:    []string{"ifSpeed"},
+		DisappearedMetrics: []string{"ifAlias"},
+		ChangedTypes:       []typeChange{{Metric: "ifMtu", Before: "gauge", After: "counter"}},
+		AppearedSeries:     []string{`ifInOctets{ifIndex="3"}`},
+		DisappearedSeries:  []string{`ifInOctets{ifIndex="2"}`},
+		UnchangedSeries:    2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffHandlerErrors(t *testing.T) {
+	tenant := &config.Tenant{
+		Auths:   map[string]*config.Auth{"team_auth": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"team_module": &config.DefaultModule},
+	}
+	if err := yaml.Unmarshal([]byte("allowed_targets: [127.0.0.0/8]"), tenant); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, &config.Config{
+		Auths:   map[string]*config.Auth{"public_v2": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"empty": &config.DefaultModule},
+		Tenants: map[string]*config.Tenant{"team": tenant},
+	})
+
+	cases := []struct {
+		query  string
+		status int
+	}{
+		{query: "module_a=empty&module_b=empty", status: http.StatusBadRequest},
+		{query: "target=127.0.0.1&module_a=empty", status: http.StatusBadRequest},
+		{query: "target=127.0.0.1&module_a=empty&module_b=missing", status: http.StatusNotFound},
+		{query: "target=127.0.0.1&module_a=empty&module_b=empty", status: http.StatusOK},
+		{query: "target=127.0.0.1&module_a=team_module&module_b=team_module&auth=team_auth", status: http.StatusNotFound},
+		{query: "target=127.0.0.1&module_a=team_module&module_b=team_module&auth=team_auth&tenant=team", status: http.StatusOK},
+		{query: "target=192.0.2.1&module_a=team_module&module_b=team_module&auth=team_auth&tenant=team", status: http.StatusForbidden},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		diffHandler(rec, httptest.NewRequest("GET", diffPath+"?"+c.query, nil), log.NewNopLogger(), testExporterMetrics())
+		if rec.Code != c.status {
+			t.Errorf("%q: got status %d, want %d: %s", c.query, rec.Code, c.status, rec.Body)
+		}
+	}
+}
+
+func TestScanHosts(t *testing.T) {
+	cases := []struct {
+		cidrs     []string
+		hosts     []string
+		shouldErr bool
+	}{
+		{cidrs: []string{"192.0.2.0/30"}, hosts: []string{"192.0.2.1", "192.0.2.2"}},
+		{cidrs: []string{"192.0.2.0/31"}, hosts: []string{"192.0.2.0", "192.0.2.1"}},
+		{cidrs: []string{"192.0.2.7/32", "192.0.2.7", "192.0.2.8"}, hosts: []string{"192.0.2.7", "192.0.2.8"}},
+		{cidrs: []string{"2001:db8::/127"}, hosts: []string{"2001:db8::", "2001:db8::1"}},
+		{cidrs: []string{"10.0.0.0/8"}, shouldErr: true},
+		{cidrs: []string{"foo"}, shouldErr: true},
+	}
+	for _, c := range cases {
+		got, err := scanHosts(c.cidrs)
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%v: unexpected error %v", c.cidrs, err)
+			continue
+		}
+		if !c.shouldErr && !reflect.DeepEqual(got, c.hosts) {
+			t.Errorf("%v: got %v, want %v", c.cidrs, got, c.hosts)
+		}
+	}
+}
+
+func TestSuggestModules(t *testing.T) {
+	modules := map[string]*config.Module{
+		"if_mib":    {Walk: []string{"1.3.6.1.2.1.2"}},
+		"cisco_wlc": {Walk: []string{"1.3.6.1.4.1.14179.2.1"}},
+		"cisco_env": {Get: []string{"1.3.6.1.4.1.9.9.13.1.3.1.3.1"}},
+		"cisco_cpu": {Walk: []string{"1.3.6.1.4.1.9.9.109"}},
+	}
+	cases := []struct {
+		sysObjectID string
+		modules     []string
+	}{
+		{sysObjectID: "1.3.6.1.4.1.9.1.1208", modules: []string{"if_mib", "cisco_cpu", "cisco_env"}},
+		{sysObjectID: "1.3.6.1.4.1.8072.3.2.10", modules: []string{"if_mib"}},
+		{sysObjectID: "", modules: []string{"if_mib"}},
+	}
+	for _, c := range cases {
+		if got := suggestModules(c.sysObjectID, modules); !reflect.DeepEqual(got, c.modules) {
+			t.Errorf("%q: got %v, want %v", c.sysObjectID, got, c.modules)
+		}
+	}
+}
+
+func TestModuleInfo(t *testing.T) {
+	c := &SafeConfig{C: &config.Config{
+		Modules: map[string]*config.Module{
+			"if_mib": {
+				Walk:           []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31"},
+				Get:            []string{"1.3.6.1.2.1.1.3.0"},
+				Metrics:        []*config.Metric{{Name: "ifInOctets"}, {Name: "ifOutOctets"}},
+				ScrapeInterval: time.Minute,
+			},
+			"empty": {},
+		},
+		Tenants: map[string]*config.Tenant{
+			"team_a": {Modules: map[string]*config.Module{"empty": {}}},
+		},
+	}}
+	expected := `# HELP snmp_module_info Information about the configured modules.
+# TYPE snmp_module_info gauge
+snmp_module_info{metrics="0",module="empty",scrape_interval="",tenant="",walk_roots="0"} 1
+snmp_module_info{metrics="0",module="empty",scrape_interval="",tenant="team_a",walk_roots="0"} 1
+snmp_module_info{metrics="2",module="if_mib",scrape_interval="1m0s",tenant="",walk_roots="3"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	c.MetricInfo = true
+	c.C.Modules["if_mib"].Metrics = []*config.Metric{
+		{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter"},
+		{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"},
+		{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"},
+	}
+	expected = `# HELP snmp_metric_info Metrics the configured modules can produce.
+# TYPE snmp_metric_info gauge
+snmp_metric_info{metric_name="ifDescr",module="if_mib",oid="1.3.6.1.2.1.2.2.1.2",tenant="",type="DisplayString"} 1
+snmp_metric_info{metric_name="ifInOctets",module="if_mib",oid="1.3.6.1.2.1.2.2.1.10",tenant="",type="counter"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "snmp_metric_info"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrapeRequestDefaults(t *testing.T) {
+	defaults := &config.TargetDefaults{Auth: "site_v3", Modules: []string{"if_mib,ucd"}, RetryPolicy: "gentle"}
+	req := &scrapeRequest{Target: "10.1.0.1"}
+	req.applyDefaults(defaults)
+	if expected := (&scrapeRequest{Target: "10.1.0.1", Auth: "site_v3", Modules: []string{"if_mib", "ucd"}, RetryPolicy: "gentle"}); !reflect.DeepEqual(req, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, req)
+	}
+
+	// The request's own parameters win.
+	req = &scrapeRequest{Target: "10.1.0.1", Auth: "public_v2", Modules: []string{"system"}, RetryPolicy: "aggressive"}
+	req.applyDefaults(defaults)
+	if expected := (&scrapeRequest{Target: "10.1.0.1", Auth: "public_v2", Modules: []string{"system"}, RetryPolicy: "aggressive"}); !reflect.DeepEqual(req, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, req)
+	}
+
+	cfg := &config.Config{}
+	if err := yaml.UnmarshalStrict([]byte("tenants:\n  team_a:\n    target_defaults:\n      10.0.0.0/8:\n        retry_policy: gentle\n      127.0.0.0/8:\n        retry_policy: gentle\n      ::1/128:\n        retry_policy: gentle\n"), cfg); err != nil {
+		t.Fatal(err)
+	}
+	byNet := cfg.Tenants["team_a"].TargetDefaults
+	expected := &config.TargetDefaults{RetryPolicy: "gentle"}
+	for _, c := range []struct {
+		target, scrapeTarget string
+		expected             *config.TargetDefaults
+	}{
+		{"10.1.0.1", "10.1.0.1", expected},
+		{"udp://10.1.0.1:161", "udp://10.1.0.1:161", expected},
+		{"192.0.2.1", "192.0.2.1", nil},
+	} {
+		got, scrapeTarget := targetDefaults(context.Background(), byNet, c.target)
+		if !reflect.DeepEqual(got, c.expected) || scrapeTarget != c.scrapeTarget {
+			t.Errorf("%s: expected %+v and %s, got %+v and %s", c.target, c.expected, c.scrapeTarget, got, scrapeTarget)
+		}
+	}
+	// Names are replaced by the address the defaults were chosen for.
+	if got, scrapeTarget := targetDefaults(context.Background(), byNet, "localhost:1161"); !reflect.DeepEqual(got, expected) ||
+		(scrapeTarget != "127.0.0.1:1161" && scrapeTarget != "[::1]:1161") {
+		t.Errorf("Expected the defaults of localhost and its address, got %+v and %s", got, scrapeTarget)
+	}
+
+	// Names are only resolved when the defaults give the request something.
+	for _, c := range []struct {
+		req          *scrapeRequest
+		timeoutGiven bool
+		expected     bool
+	}{
+		{&scrapeRequest{Auth: "public_v2", Modules: []string{"if_mib"}}, true, true},
+		{&scrapeRequest{Auth: "public_v2", Modules: []string{"if_mib"}, RetryPolicy: "aggressive"}, true, false},
+		{&scrapeRequest{Auth: "public_v2", Modules: []string{"if_mib"}, RetryPolicy: "aggressive"}, false, false},
+	} {
+		if got := needsTargetDefaults(c.req, byNet, c.timeoutGiven); got != c.expected {
+			t.Errorf("%+v with timeout given %v: expected %v, got %v", c.req, c.timeoutGiven, c.expected, got)
+		}
+	}
+	withTimeout := map[string]*config.TargetDefaults{"10.0.0.0/8": {Timeout: time.Second}}
+	if !needsTargetDefaults(&scrapeRequest{Auth: "public_v2", Modules: []string{"if_mib"}}, withTimeout, false) {
+		t.Error("Expected the defaults to be needed for their timeout")
+	}
+}
+
+func TestParseScrapeRequest(t *testing.T) {
+	community := "secret"
+	cases := []struct {
+		method string
+		url    string
+		body   string
+		req    *scrapeRequest
+		err    string
+	}{
+		{
+			method: "GET",
+			url:    "/snmp?target=192.0.2.1&module=if_mib,ucd&module=ucd&auth=v3",
+			req:    &scrapeRequest{Target: "192.0.2.1", Auth: "v3", Modules: []string{"if_mib", "ucd"}},
+		},
+		{
+			method: "GET",
+			url:    "/snmp?target=192.0.2.1&auth=a&auth=b",
+			err:    "'auth' parameter must only be specified once",
+		},
+		{
+			method: "POST",
+			url:    "/snmp",
+			body:   `{"target": "192.0.2.1", "modules": ["if_mib", "ucd"], "labels": {"site": "ams1"}, "auth_overrides": {"community": "secret"}}`,
+			req: &scrapeRequest{Target: "192.0.2.1", Auth: "public_v2", Modules: []string{"if_mib", "ucd"},
+				Labels: map[string]string{"site": "ams1"}, AuthOverrides: &authOverrides{Community: &community}},
+		},
+		{
+			method: "POST",
+			url:    "/snmp",
+			body:   `{"target": "192.0.2.1"}`,
+			req:    &scrapeRequest{Target: "192.0.2.1", Auth: "public_v2", Modules: []string{"if_mib"}},
+		},
+		{
+			method: "POST",
+			url:    "/snmp",
+			body:   `{"target": "192.0.2.1", "module": "if_mib"}`,
+			err:    `invalid request body: json: unknown field "module"`,
+		},
+		{
+			method: "POST",
+			url:    "/snmp",
+			body:   `{"target": "192.0.2.1", "labels": {"__name__": "x"}}`,
+			err:    "invalid label name '__name__'",
+		},
+		{
+			method: "POST",
+			url:    "/snmp",
+			body:   `{"modules": ["if_mib"]}`,
+			err:    "'target' must be specified",
+		},
+		{
+			method: "GET",
+			url:    "/snmp?target=192.0.2.1&retry_policy=gentle",
+			req:    &scrapeRequest{Target: "192.0.2.1", Auth: "public_v2", Modules: []string{"if_mib"}, RetryPolicy: "gentle"},
+		},
+		{
+			method: "POST",
+			url:    "/snmp",
+			body:   `{"target": "192.0.2.1", "retry_policy": "reckless"}`,
+			err:    "unknown retry policy 'reckless', must be aggressive, standard or gentle",
+		},
+		{
+			method: "GET",
+			url:    "/snmp?target=192.0.2.1&max_message_size=1400",
+			req:    &scrapeRequest{Target: "192.0.2.1", Auth: "public_v2", Modules: []string{"if_mib"}, MaxMessageSize: 1400},
+		},
+		{
+			method: "GET",
+			url:    "/snmp?target=192.0.2.1&max_message_size=mtu",
+			err:    "invalid max_message_size 'mtu'",
+		},
+		{
+			method: "POST",
+			url:    "/snmp",
+			body:   `{"target": "192.0.2.1", "max_message_size": 100}`,
+			err:    "max_message_size 100 must be between 484 and 65535 bytes",
+		},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.url, strings.NewReader(c.body))
+		req, err := parseScrapeRequest(httptest.NewRecorder(), r)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s %s %s: expected error %q, got %v", c.method, c.url, c.body, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s %s: unexpected error %v", c.method, c.url, c.body, err)
+			continue
+		}
+		req.applyDefaults(nil)
+		if !reflect.DeepEqual(req, c.req) {
+			t.Errorf("%s %s %s: got %+v, want %+v", c.method, c.url, c.body, req, c.req)
+		}
+	}
+
+	auth := (&authOverrides{Community: &community}).apply(&config.DefaultAuth)
+	if auth.Community != "secret" || config.DefaultAuth.Community != "public" {
+		t.Errorf("Overrides not applied to a copy: got %q, default is %q", auth.Community, config.DefaultAuth.Community)
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	for header, expected := range map[string]time.Duration{
+		"":     0,
+		"junk": 0,
+		"10":   9500 * time.Millisecond,
+		"0.25": 250 * time.Millisecond,
+	} {
+		r := httptest.NewRequest("GET", "/snmp", nil)
+		if header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", header)
+		}
+		got, ok := scrapeTimeout(r, 0.5)
+		if got != expected || ok != (expected != 0) {
+			t.Errorf("Timeout header %q: expected %v, got %v (%v)", header, expected, got, ok)
+		}
+	}
+}
+
+func TestTargetRegistry(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := newTargetRegistry()
+	scrape := func(target, status string, err error, at time.Time) {
+		r.record(targetStatus{Target: target, Auth: "public_v2", Modules: []string{"if_mib"}, LastScrape: at, Status: status, Samples: 10}, err, time.Hour)
+	}
+	scrape("switch1", "timeout", errors.New("request timeout"), start)
+	scrape("switch1", "success", nil, start.Add(time.Minute))
+	scrape("switch2", "success", nil, start.Add(2*time.Minute))
+
+	got := r.list(start.Add(3*time.Minute), time.Hour)
+	want := []targetStatus{
+		{Target: "switch1", Auth: "public_v2", Modules: []string{"if_mib"}, LastScrape: start.Add(time.Minute), Samples: 10, Status: "success",
+			LastError: "request timeout", LastErrorTime: start, Scrapes: 2, Failures: 1},
+		{Target: "switch2", Auth: "public_v2", Modules: []string{"if_mib"}, LastScrape: start.Add(2 * time.Minute), Samples: 10, Status: "success", Scrapes: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong targets: got %+v, want %+v", got, want)
+	}
+
+	// switch1 is forgotten once not scraped for the retention.
+	got = r.list(start.Add(time.Hour+90*time.Second), time.Hour)
+	if len(got) != 1 || got[0].Target != "switch2" {
+		t.Errorf("Expected only switch2 to be kept, got %+v", got)
+	}
+	// Scrapes forget them too, without waiting for the page.
+	scrape("switch3", "success", nil, start.Add(3*time.Hour))
+	if _, ok := r.targets[targetStatus{Target: "switch2", Auth: "public_v2", Modules: []string{"if_mib"}}.key()]; ok || len(r.targets) != 1 {
+		t.Errorf("Expected only switch3 to be kept, got %v", r.targets)
+	}
+
+	old, oldRetention := targetStats, *targetsRetention
+	targetStats, *targetsRetention = r, time.Hour
+	defer func() { targetStats, *targetsRetention = old, oldRetention }()
+	scrape("switch2", "success", nil, time.Now())
+	for _, c := range []struct {
+		url, contentType, body string
+	}{
+		{"/targets", "text/html", "<td>switch2</td>"},
+		{"/targets?format=json", "application/json", `"target":"switch2"`},
+	} {
+		rec := httptest.NewRecorder()
+		targetsHandler(rec, httptest.NewRequest("GET", c.url, nil))
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, c.contentType) {
+			t.Errorf("%s: got content type %q, want %q", c.url, got, c.contentType)
+		}
+		if !strings.Contains(rec.Body.String(), c.body) {
+			t.Errorf("%s: body %q does not contain %q", c.url, rec.Body, c.body)
+		}
+	}
+}
+
+func TestUncoveredPDUs(t *testing.T) {
+	modules := []*config.Module{
+		{
+			Walk: []string{"1.3.6.1.2.1.2"},
+			Metrics: []*config.Metric{
+				{
+					Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter",
+					Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+					Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"}},
+				},
+			},
+			Strictness: config.StrictnessStrict,
+		},
+		{
+			Get:     []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.2.1.0"},
+			Metrics: []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+		},
+	}
+	if got, want := verifySubtreesOf(modules), []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected subtrees %v, got %v", want, got)
+	}
+
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(100)},
+		{Name: ".1.3.6.1.2.1.2.1.0", Type: gosnmp.Integer, Value: 2},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")},
+		// Not looked up, as no ifInOctets has its index.
+		{Name: ".1.3.6.1.2.1.2.2.1.2.2", Type: gosnmp.OctetString, Value: []byte("eth1")},
+		{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(10)},
+		// Under the metric, but with a type the strict module drops.
+		{Name: ".1.3.6.1.2.1.2.2.1.10.3", Type: gosnmp.OctetString, Value: []byte("10")},
+		{Name: ".1.3.6.1.2.1.2.2.1.100.1", Type: gosnmp.Integer, Value: 1},
+		{Name: ".1.3.6.1.2.1.2.2.1.11.1", Type: gosnmp.Counter32, Value: uint(5)},
+	}
+	got := []string{}
+	for _, pdu := range uncoveredPDUs(modules, pdus, log.NewNopLogger(), testExporterMetrics()) {
+		got = append(got, pdu.Name)
+	}
+	// Numeric order, as agents return OIDs.
+	want := []string{".1.3.6.1.2.1.2.1.0", ".1.3.6.1.2.1.2.2.1.2.2", ".1.3.6.1.2.1.2.2.1.10.3", ".1.3.6.1.2.1.2.2.1.11.1", ".1.3.6.1.2.1.2.2.1.100.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected uncovered OIDs %v, got %v", want, got)
+	}
+}
+
+func TestWebhookMonitor(t *testing.T) {
+	m := newWebhookMonitor()
+	thresholds := webhookThresholds{window: 4, errorRatio: 0.5, maxDuration: 5 * time.Second, sampleChange: 0.5}
+	start := time.Now()
+	scrape := func(i int, status string, duration float64, samples int) []string {
+		events := m.observe(targetStatus{
+			Target: "192.0.2.1", Auth: "public_v2", Modules: []string{"if_mib"},
+			LastScrape: start.Add(time.Duration(i) * time.Minute), DurationSeconds: duration, Samples: samples, Status: status,
+		}, thresholds, time.Hour)
+		got := []string{}
+		for _, e := range events {
+			got = append(got, e.Status+" "+e.Anomaly)
+		}
+		return got
+	}
+	steps := []struct {
+		status   string
+		duration float64
+		samples  int
+		want     []string
+	}{
+		{"success", 1, 100, []string{}},
+		{"success", 1, 110, []string{}},
+		{"success", 6, 105, []string{"firing duration"}},
+		{"success", 1, 20, []string{"resolved duration", "firing samples"}},
+		{"timeout", 1, 0, []string{}},
+		{"timeout", 1, 0, []string{}},
+		// 3 of the last 4 scrapes failed.
+		{"timeout", 1, 0, []string{"firing error_ratio"}},
+		// Still far from the 20 samples of the last successful scrape.
+		{"success", 1, 100, []string{}},
+		{"success", 1, 100, []string{"resolved error_ratio", "resolved samples"}},
+	}
+	for i, step := range steps {
+		if got := scrape(i, step.status, step.duration, step.samples); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("Scrape %d: expected events %v, got %v", i, step.want, got)
+		}
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	var got webhookEvent
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	event := webhookEvent{Status: "firing", Anomaly: anomalyDuration, Target: "192.0.2.1", Auth: "public_v2", Modules: []string{"if_mib"}, Value: 12, Threshold: 10, Time: time.Unix(0, 0).UTC()}
+	if err := postWebhook(context.Background(), server.Client(), server.URL, map[string]string{"Authorization": "Bearer token"}, event); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, event) || header != "Bearer token" {
+		t.Errorf("Expected %+v with the header, got %+v and %q", event, got, header)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	if err := postWebhook(context.Background(), failing.Client(), failing.URL, nil, event); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("Expected an error with the status, got %v", err)
+	}
+}
+
+func TestWebhookSenders(t *testing.T) {
+	var mu sync.Mutex
+	got := []string{}
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, event.Status+" "+event.Anomaly)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	s := newWebhookSenders(server.Client())
+	s.send(server.URL, []webhookEvent{{Status: "firing", Anomaly: anomalyDuration}}, log.NewNopLogger())
+	s.send(server.URL, []webhookEvent{{Status: "resolved", Anomaly: anomalyDuration}, {Status: "firing", Anomaly: anomalySamples}}, log.NewNopLogger())
+	close(release)
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		_, running := s.queues[server.URL]
+		s.mu.Unlock()
+		if !running {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Notifications not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Posted one at a time, in order.
+	if want := []string{"firing duration", "resolved duration", "firing samples"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected notifications %v, got %v", want, got)
+	}
+}
+
+// fakeWalker walks the sorted PDUs it holds.
+type fakeWalker []gosnmp.SnmpPDU
+
+func (f fakeWalker) WalkLimit(oid string, limit int) ([]gosnmp.SnmpPDU, bool, error) {
+	pdus := []gosnmp.SnmpPDU{}
+	for _, pdu := range f {
+		if !strings.HasPrefix(pdu.Name, "."+oid+".") {
+			continue
+		}
+		if len(pdus) == limit {
+			return pdus, false, nil
+		}
+		pdus = append(pdus, pdu)
+	}
+	return pdus, true, nil
+}
+
+func TestEstimateModule(t *testing.T) {
+	var walker fakeWalker
+	// A table of 50 rows and 3 columns, and a scalar.
+	for column := 1; column <= 3; column++ {
+		for row := 1; row <= 50; row++ {
+			walker = append(walker, gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.2.1.%d.%d", column, row), Type: gosnmp.Integer, Value: row})
+		}
+	}
+	walker = append(walker, gosnmp.SnmpPDU{Name: ".1.3.0", Type: gosnmp.Integer, Value: 1})
+	index := []*config.Index{{Labelname: "row", Type: "gauge"}}
+	module := &config.Module{
+		Walk: []string{"1.2", "1.3"},
+		Get:  []string{"1.4.0"},
+		Metrics: []*config.Metric{
+			{Name: "a", Oid: "1.2.1.1", Type: "gauge", Indexes: index},
+			{Name: "b", Oid: "1.2.1.2", Type: "gauge", Indexes: index},
+			{Name: "c", Oid: "1.2.1.3", Type: "gauge", Indexes: index},
+			{Name: "d", Oid: "1.3", Type: "gauge"},
+		},
+	}
+	result, err := estimateModule(walker, module, 10, 1000, log.NewNopLogger(), testExporterMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []walkEstimate{
+		{Oid: "1.2", SampledPdus: 10, Rows: 50, Columns: 3, EstimatedPdus: 150},
+		{Oid: "1.3", Complete: true, SampledPdus: 1, EstimatedPdus: 1},
+	}
+	if !reflect.DeepEqual(result.Walks, want) {
+		t.Errorf("Expected walks %+v, got %+v", want, result.Walks)
+	}
+	// Sampled rows, the column counted and the scalar.
+	if result.SampledPdus != 61 || result.EstimatedPdus != 152 || result.EstimatedSamples != 152 {
+		t.Errorf("Expected 61 PDUs sampled and 152 PDUs and samples estimated, got %+v", result)
+	}
+
+	result, err = estimateModule(walker, module, 10, 20, log.NewNopLogger(), testExporterMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := result.Walks[0]; !w.Truncated || w.EstimatedPdus != 60 {
+		t.Errorf("Expected a truncated estimate of 60 PDUs, got %+v", w)
+	}
+}
+
+func TestGenerateOnStartup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake generator is a shell script")
+	}
+	dir := t.TempDir()
+	generator := filepath.Join(dir, "generator")
+	// Writes the arguments it was run with to the output path.
+	script := `#!/bin/sh
+for arg; do [ "$prev" = "--output-path" ] && out="$arg"; prev="$arg"; done
+echo "modules: {}  # $*" > "$out"
+`
+	if err := os.WriteFile(generator, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path, err := generateOnStartup(generator, "gen.yml", []string{"mibs", "vendor"}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(path))
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("modules: {}  # generate --generator-path gen.yml --output-path %s --mibs-dir mibs --mibs-dir vendor\n", path)
+	if string(content) != expected {
+		t.Errorf("Unexpected generator arguments:\ngot  %q\nwant %q", content, expected)
+	}
+
+	if err := os.WriteFile(generator, []byte("#!/bin/sh\necho parse error\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generateOnStartup(generator, "gen.yml", nil, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "wrote no config: parse error") {
+		t.Errorf("Expected an error for a generator writing nothing, got %v", err)
+	}
+	if err := os.WriteFile(generator, []byte("#!/bin/sh\necho bad yaml; exit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generateOnStartup(generator, "gen.yml", nil, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "bad yaml") {
+		t.Errorf("Expected an error for a failing generator, got %v", err)
+	}
+}
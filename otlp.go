@@ -0,0 +1,739 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+var (
+	otlpEndpoint    = kingpin.Flag("otlp.endpoint", "OTLP/HTTP metrics URL, e.g. http://otel-collector:4318/v1/metrics, to push the scrapes of the targets of --otlp.targets-file to. Disabled if empty.").Default("").String()
+	otlpTargetsFile = kingpin.Flag("otlp.targets-file", "Prometheus file_sd file of the targets to scrape and push, such as written by the scan command.").Default("").String()
+	otlpInterval    = kingpin.Flag("otlp.interval", "How often to scrape and push the targets.").Default("1m").Duration()
+	otlpHeaders     = kingpin.Flag("otlp.header", "Header to send with pushes, as name=value, can be repeated.").StringMap()
+	otlpConcurrency = kingpin.Flag("otlp.concurrency", "Number of targets to scrape and push concurrently.").Default("16").Int()
+	otlpStaleRows   = kingpin.Flag("otlp.stale-rows", "Push the series of table rows which disappeared since the last successful scrape of a target as stale, rather than leaving them to linger until the lookback of the backend.").Default("true").Bool()
+	otlpRowDeleted  = kingpin.Flag("otlp.row-deleted-metric", "Also push snmp_row_deleted_total, the rows of each table of a target which disappeared, by the OID of the table entry. Needs --otlp.stale-rows.").Default("false").Bool()
+	otlpSpread      = kingpin.Flag("otlp.spread", "Spread the scrapes of the targets over the interval, each at a phase derived from the target, rather than starting them all at once.").Default("true").Bool()
+	otlpPhaseSeed   = kingpin.Flag("otlp.phase-seed", "Seed of the phases of the targets, to set exporters scraping the same targets apart.").Default("0").Uint64()
+	otlpJitter      = kingpin.Flag("otlp.jitter", "Random delay up to which to add to each scrape of a target, on top of its phase.").Default("0s").Duration()
+	otlpRates       = kingpin.Flag("otlp.rates", "Also push the rate per second of each counter since the previous scrape of the target, as a <name>_per_second gauge, for backends without counter semantics.").Default("false").Bool()
+
+	otlpPushes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "otlp_pushes_total",
+			Help:      "Pushes of the scrape of a target to the OTLP endpoint, by result.",
+		},
+		[]string{"result"},
+	)
+	otlpLateness = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "otlp_schedule_lateness_seconds",
+			Help:      "How late scrapes of targets to push started after their scheduled time, such as waiting for --otlp.concurrency.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+	)
+	otlpSkipped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "otlp_scrapes_skipped_total",
+			Help:      "Scheduled scrapes of targets to push skipped, as the previous scrape of the target was still running.",
+		},
+	)
+)
+
+// otlpTarget is a target to scrape and push.
+type otlpTarget struct {
+	target  string
+	auth    string
+	modules []string
+	// The tenant whose auths and modules are used, if any.
+	tenant string
+	// The labels of the target group, as resource attributes.
+	attributes map[string]string
+}
+
+func (t otlpTarget) key() string {
+	key := t.target + "\xff" + t.auth + "\xff" + strings.Join(t.modules, ",")
+	if t.tenant != "" {
+		key += "\xff" + t.tenant
+	}
+	return key
+}
+
+// otlpTargets returns the targets of file_sd target groups. The auth,
+// modules and tenant are taken from the __param_auth, __param_module and
+// __param_tenant labels, other labels starting with __ are dropped.
+func otlpTargets(groups []targetGroup) []otlpTarget {
+	targets := []otlpTarget{}
+	for _, group := range groups {
+		auth, modules, tenant := "public_v2", []string{"if_mib"}, ""
+		attributes := map[string]string{}
+		for name, value := range group.Labels {
+			switch {
+			case name == "__param_auth":
+				auth = value
+			case name == "__param_module":
+				modules = strings.Split(value, ",")
+			case name == "__param_tenant":
+				tenant = value
+			case !strings.HasPrefix(name, "__"):
+				attributes[name] = value
+			}
+		}
+		for _, target := range group.Targets {
+			targets = append(targets, otlpTarget{target: target, auth: auth, modules: modules, tenant: tenant, attributes: attributes})
+		}
+	}
+	return targets
+}
+
+// phase returns when in the interval the target is scraped. It is derived
+// from the target, so that each target is scraped every interval while the
+// targets are spread over it.
+func (t otlpTarget) phase(interval time.Duration, seed uint64) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.BigEndian, seed)
+	h.Write([]byte(t.key()))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// The OTLP/HTTP JSON encoding of an ExportMetricsServiceRequest, covering
+// gauges and cumulative sums which is all scrapes produce.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+	// Always cumulative.
+	AggregationTemporality int  `json:"aggregationTemporality"`
+	IsMonotonic            bool `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsDouble     otlpDouble      `json:"asDouble"`
+	// otlpNoRecordedValue for stale series.
+	Flags int `json:"flags,omitempty"`
+}
+
+// The FLAG_NO_RECORDED_VALUE of data points, which Prometheus stores as a
+// staleness marker.
+const otlpNoRecordedValue = 1
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpDouble encodes NaN and infinities as the protobuf JSON mapping does.
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return []byte(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(labels))
+	for name, value := range labels {
+		attributes = append(attributes, otlpAttribute{Key: name, Value: otlpValue{StringValue: value}})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Key < attributes[j].Key })
+	return attributes
+}
+
+// toOTLP converts the metrics of a scrape of the target to an OTLP request.
+// Counters become cumulative sums and everything else gauges.
+func toOTLP(t otlpTarget, mfs []*dto.MetricFamily, now time.Time) otlpRequest {
+	resource := map[string]string{"snmp.target": t.target, "snmp.auth": t.auth, "snmp.modules": strings.Join(t.modules, ",")}
+	if t.tenant != "" {
+		resource["snmp.tenant"] = t.tenant
+	}
+	for name, value := range t.attributes {
+		resource[name] = value
+	}
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	metrics := []otlpMetric{}
+	for _, mf := range mfs {
+		points := []otlpDataPoint{}
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			points = append(points, otlpDataPoint{Attributes: otlpAttributes(labels), TimeUnixNano: timestamp, AsDouble: otlpDouble(value)})
+		}
+		if len(points) == 0 {
+			continue
+		}
+		metric := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		if mf.GetType() == dto.MetricType_COUNTER {
+			metric.Sum = &otlpSum{DataPoints: points, AggregationTemporality: 2, IsMonotonic: true}
+		} else {
+			metric.Gauge = &otlpGauge{DataPoints: points}
+		}
+		metrics = append(metrics, metric)
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: otlpAttributes(resource)},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "snmp_exporter", Version: version.Version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+func pushOTLP(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, req otlpRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return post(ctx, client, endpoint, "application/json", headers, body)
+}
+
+// post posts the body to the URL, failing unless the server accepted it.
+func post(ctx context.Context, client *http.Client, url, contentType string, headers map[string]string, body []byte) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		httpReq.Header.Set(name, value)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// scrapeForOTLP scrapes the target as the /snmp endpoint would, with the
+// auths and modules of its tenant if it has one, returning the tables of its
+// modules along with the metrics.
+func scrapeForOTLP(ctx context.Context, t otlpTarget, logger log.Logger, exporterMetrics collector.Metrics) ([]*dto.MetricFamily, map[string]otlpTable, error) {
+	sc.RLock()
+	auths, configModules := sc.C.Auths, sc.C.Modules
+	var tenant *config.Tenant
+	if t.tenant != "" {
+		var ok bool
+		if tenant, ok = sc.C.Tenants[t.tenant]; !ok {
+			sc.RUnlock()
+			return nil, nil, fmt.Errorf("unknown tenant '%s'", t.tenant)
+		}
+		auths, configModules = tenant.Auths, tenant.Modules
+	}
+	auth, ok := auths[t.auth]
+	if !ok {
+		sc.RUnlock()
+		return nil, nil, fmt.Errorf("unknown auth '%s'", t.auth)
+	}
+	var nmodules []*collector.NamedModule
+	var modules []*config.Module
+	for _, m := range t.modules {
+		module, ok := configModules[m]
+		if !ok {
+			sc.RUnlock()
+			return nil, nil, fmt.Errorf("unknown module '%s'", m)
+		}
+		nmodules = append(nmodules, collector.NewNamedModule(m, module))
+		modules = append(modules, module)
+	}
+	sc.RUnlock()
+	target := t.target
+	if tenant != nil {
+		// The loaded config is never modified, only replaced.
+		if err := checkTenantTarget(ctx, tenant, target); err != nil {
+			return nil, nil, err
+		}
+	}
+	registry := prometheus.NewRegistry()
+	c := collector.New(ctx, target, t.auth, "", auth, nmodules, logger, exporterMetrics, *concurrency, false)
+	registry.MustRegister(c)
+	mfs, err := registry.Gather()
+	if err == nil && c.ErrorType() != "" {
+		err = fmt.Errorf("scrape failed with error type %s", c.ErrorType())
+	}
+	return mfs, otlpTables(modules), err
+}
+
+// otlpTable is the table a metric is a column of, identified by the OID of
+// its entry, and the labels of its indexes.
+type otlpTable struct {
+	oid     string
+	indexes []string
+}
+
+// otlpTables returns the tables of the metrics of the modules, by metric
+// name.
+func otlpTables(modules []*config.Module) map[string]otlpTable {
+	tables := map[string]otlpTable{}
+	for _, module := range modules {
+		for _, metric := range module.Metrics {
+			i := strings.LastIndexByte(metric.Oid, '.')
+			if _, ok := tables[metric.Name]; ok || len(metric.Indexes) == 0 || i < 0 {
+				continue
+			}
+			table := otlpTable{oid: metric.Oid[:i]}
+			for _, index := range metric.Indexes {
+				table.indexes = append(table.indexes, index.Labelname)
+			}
+			tables[metric.Name] = table
+		}
+	}
+	return tables
+}
+
+// otlpSeries is a pushed series of a table.
+type otlpSeries struct {
+	metric  string
+	counter bool
+	labels  map[string]string
+	table   string
+	// The table and the values of its indexes.
+	row string
+}
+
+// otlpRows remembers the series of tables pushed for each target, to push
+// those of rows which disappeared as stale.
+type otlpRows struct {
+	mu      sync.Mutex
+	targets map[string]*otlpTargetRows
+}
+
+type otlpTargetRows struct {
+	series map[string]otlpSeries
+	// Rows which disappeared, by table.
+	deleted map[string]float64
+}
+
+var pushedRows = &otlpRows{targets: map[string]*otlpTargetRows{}}
+
+// update records the series of the tables in a successful scrape of the
+// target. It returns the series of the rows which disappeared since the
+// previous one, and the rows deleted from each table so far. Series which
+// disappeared from rows still present, such as after a lookup changed a
+// label, are not returned.
+func (r *otlpRows) update(key string, mfs []*dto.MetricFamily, tables map[string]otlpTable) ([]otlpSeries, map[string]float64) {
+	current := map[string]otlpSeries{}
+	rows := map[string]bool{}
+	for _, mf := range mfs {
+		table, ok := tables[mf.GetName()]
+		if !ok {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			s := otlpSeries{metric: mf.GetName(), counter: mf.GetType() == dto.MetricType_COUNTER, labels: map[string]string{}, table: table.oid}
+			for _, l := range m.GetLabel() {
+				s.labels[l.GetName()] = l.GetValue()
+			}
+			s.row = table.oid
+			for _, index := range table.indexes {
+				s.row += "\xff" + s.labels[index]
+			}
+			seriesKey := s.metric
+			for _, a := range otlpAttributes(s.labels) {
+				seriesKey += "\xff" + a.Key + "\xff" + a.Value.StringValue
+			}
+			current[seriesKey] = s
+			rows[s.row] = true
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous, ok := r.targets[key]
+	if !ok {
+		previous = &otlpTargetRows{deleted: map[string]float64{}}
+		r.targets[key] = previous
+	}
+	stale := []otlpSeries{}
+	deletedRows := map[string]bool{}
+	for seriesKey, s := range previous.series {
+		if _, ok := current[seriesKey]; ok || rows[s.row] {
+			continue
+		}
+		stale = append(stale, s)
+		if !deletedRows[s.row] {
+			deletedRows[s.row] = true
+			previous.deleted[s.table]++
+		}
+	}
+	previous.series = current
+	sort.Slice(stale, func(i, j int) bool { return stale[i].row+stale[i].metric < stale[j].row+stale[j].metric })
+	deleted := make(map[string]float64, len(previous.deleted))
+	for table, n := range previous.deleted {
+		deleted[table] = n
+	}
+	return stale, deleted
+}
+
+// retain forgets the targets not in keys, such as those removed from the
+// targets file.
+func (r *otlpRows) retain(keys map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.targets {
+		if !keys[key] {
+			delete(r.targets, key)
+		}
+	}
+}
+
+// addStaleRows adds the stale series to the request, and the deleted rows
+// as snmp_row_deleted_total unless deleted is nil.
+func addStaleRows(req otlpRequest, stale []otlpSeries, deleted map[string]float64, now time.Time) otlpRequest {
+	scope := &req.ResourceMetrics[0].ScopeMetrics[0]
+	metrics := map[string]int{}
+	for i, m := range scope.Metrics {
+		metrics[m.Name] = i
+	}
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	for _, s := range stale {
+		i, ok := metrics[s.metric]
+		if !ok {
+			metric := otlpMetric{Name: s.metric}
+			if s.counter {
+				metric.Sum = &otlpSum{AggregationTemporality: 2, IsMonotonic: true}
+			} else {
+				metric.Gauge = &otlpGauge{}
+			}
+			i = len(scope.Metrics)
+			metrics[s.metric] = i
+			scope.Metrics = append(scope.Metrics, metric)
+		}
+		point := otlpDataPoint{Attributes: otlpAttributes(s.labels), TimeUnixNano: timestamp, Flags: otlpNoRecordedValue}
+		if m := &scope.Metrics[i]; m.Sum != nil {
+			m.Sum.DataPoints = append(m.Sum.DataPoints, point)
+		} else {
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, point)
+		}
+	}
+	if len(deleted) > 0 {
+		tables := make([]string, 0, len(deleted))
+		for table := range deleted {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		points := []otlpDataPoint{}
+		for _, table := range tables {
+			points = append(points, otlpDataPoint{Attributes: otlpAttributes(map[string]string{"table": table}), TimeUnixNano: timestamp, AsDouble: otlpDouble(deleted[table])})
+		}
+		scope.Metrics = append(scope.Metrics, otlpMetric{
+			Name:        "snmp_row_deleted_total",
+			Description: "Rows which disappeared from each table of the target, by the OID of the table entry.",
+			Sum:         &otlpSum{DataPoints: points, AggregationTemporality: 2, IsMonotonic: true},
+		})
+	}
+	return req
+}
+
+// otlpCounterSample is the value of a counter in a scrape of a target.
+type otlpCounterSample struct {
+	value float64
+	time  time.Time
+}
+
+// otlpCounters remembers the counters pushed for each target, to push their
+// rate since the previous scrape.
+type otlpCounters struct {
+	mu      sync.Mutex
+	targets map[string]map[string]otlpCounterSample
+}
+
+var pushedCounters = &otlpCounters{targets: map[string]map[string]otlpCounterSample{}}
+
+// update records the counters of a successful scrape of the target at now.
+// It returns the rate per second of each of them since the previous scrape
+// as <name>_per_second gauges. Counters seen for the first time or which
+// went backwards, such as after the agent restarted, are left out.
+func (r *otlpCounters) update(key string, mfs []*dto.MetricFamily, now time.Time) []*dto.MetricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.targets[key]
+	current := map[string]otlpCounterSample{}
+	rates := []*dto.MetricFamily{}
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		var metrics []*dto.Metric
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			seriesKey := mf.GetName()
+			for _, a := range otlpAttributes(labels) {
+				seriesKey += "\xff" + a.Key + "\xff" + a.Value.StringValue
+			}
+			value := m.GetCounter().GetValue()
+			current[seriesKey] = otlpCounterSample{value: value, time: now}
+			p, ok := previous[seriesKey]
+			elapsed := now.Sub(p.time).Seconds()
+			if !ok || elapsed <= 0 || value < p.value {
+				continue
+			}
+			rate := (value - p.value) / elapsed
+			metrics = append(metrics, &dto.Metric{Label: m.GetLabel(), Gauge: &dto.Gauge{Value: &rate}})
+		}
+		if len(metrics) > 0 {
+			name, help := mf.GetName()+"_per_second", mf.GetHelp()+" (per second)"
+			rates = append(rates, &dto.MetricFamily{Name: &name, Help: &help, Type: dto.MetricType_GAUGE.Enum(), Metric: metrics})
+		}
+	}
+	r.targets[key] = current
+	return rates
+}
+
+// retain forgets the targets not in keys.
+func (r *otlpCounters) retain(keys map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.targets {
+		if !keys[key] {
+			delete(r.targets, key)
+		}
+	}
+}
+
+// runOTLP scrapes the targets of the targets file and pushes the results to
+// the OTLP endpoint and InfluxDB, whichever are enabled, every interval.
+func runOTLP(ctx context.Context, logger log.Logger, exporterMetrics collector.Metrics) {
+	client := &http.Client{Timeout: *otlpInterval}
+	ticker := time.NewTicker(*otlpInterval)
+	defer ticker.Stop()
+	// The scrapes of targets running past the next interval are left to
+	// finish, sharing the concurrency with those of the next interval.
+	sem := make(chan struct{}, *otlpConcurrency)
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	running := map[string]bool{}
+	runningMtx := sync.Mutex{}
+	scheduled := time.Now()
+	for {
+		content, err := os.ReadFile(*otlpTargetsFile)
+		groups := []targetGroup{}
+		if err == nil {
+			err = yaml.Unmarshal(content, &groups)
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Error reading OTLP targets file", "file", *otlpTargetsFile, "err", err)
+		}
+
+		targets := otlpTargets(groups)
+		keys := map[string]bool{}
+		for _, t := range targets {
+			keys[t.key()] = true
+		}
+		pushedRows.retain(keys)
+		pushedCounters.retain(keys)
+		for _, t := range targets {
+			due := scheduled
+			if *otlpSpread {
+				due = due.Add(t.phase(*otlpInterval, *otlpPhaseSeed))
+			}
+			if *otlpJitter > 0 {
+				due = due.Add(time.Duration(rand.Int63n(int64(*otlpJitter))))
+			}
+			runningMtx.Lock()
+			if running[t.key()] {
+				runningMtx.Unlock()
+				otlpSkipped.Inc()
+				level.Debug(logger).Log("msg", "Skipping scrape of target for OTLP, as the previous one is still running", "target", t.target, "auth", t.auth)
+				continue
+			}
+			running[t.key()] = true
+			runningMtx.Unlock()
+			wg.Add(1)
+			go func(t otlpTarget) {
+				defer func() {
+					runningMtx.Lock()
+					delete(running, t.key())
+					runningMtx.Unlock()
+					wg.Done()
+				}()
+				timer := time.NewTimer(time.Until(due))
+				defer timer.Stop()
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case sem <- struct{}{}:
+				}
+				defer func() { <-sem }()
+				otlpLateness.Observe(time.Since(due).Seconds())
+				scrapeCtx, cancel := context.WithTimeout(ctx, *otlpInterval)
+				defer cancel()
+				logger := log.With(logger, "target", t.target, "auth", t.auth)
+				if t.tenant != "" {
+					logger = log.With(logger, "tenant", t.tenant)
+				}
+				mfs, tables, err := scrapeForOTLP(scrapeCtx, t, logger, exporterMetrics)
+				if err != nil {
+					// Nothing is pushed, so that rows missing from the
+					// failed scrape are not taken as deleted nor rates
+					// computed from partial results.
+					level.Warn(logger).Log("msg", "Error scraping target for OTLP", "err", err)
+					if *influxURL != "" {
+						influxPushes.WithLabelValues("error").Inc()
+					}
+					if *otlpEndpoint != "" {
+						otlpPushes.WithLabelValues("error").Inc()
+					}
+					return
+				}
+				now := time.Now()
+				if *otlpRates {
+					rates := pushedCounters.update(t.key(), mfs, now)
+					for _, mf := range rates {
+						// Rates of rows which disappeared are stale too.
+						if table, ok := tables[strings.TrimSuffix(mf.GetName(), "_per_second")]; ok {
+							tables[mf.GetName()] = table
+						}
+					}
+					mfs = append(mfs, rates...)
+				}
+				if *influxURL != "" {
+					if err := pushInflux(scrapeCtx, client, *influxURL, *influxHeaders, toLineProtocol(t, mfs, now)); err != nil {
+						level.Error(logger).Log("msg", "Error pushing to InfluxDB", "err", err)
+						influxPushes.WithLabelValues("error").Inc()
+					} else {
+						influxPushes.WithLabelValues("success").Inc()
+					}
+				}
+				if *otlpEndpoint == "" {
+					return
+				}
+				req := toOTLP(t, mfs, now)
+				if *otlpStaleRows {
+					stale, deleted := pushedRows.update(t.key(), mfs, tables)
+					if !*otlpRowDeleted {
+						deleted = nil
+					}
+					req = addStaleRows(req, stale, deleted, now)
+				}
+				if err := pushOTLP(scrapeCtx, client, *otlpEndpoint, *otlpHeaders, req); err != nil {
+					level.Error(logger).Log("msg", "Error pushing to OTLP endpoint", "err", err)
+					otlpPushes.WithLabelValues("error").Inc()
+					return
+				}
+				otlpPushes.WithLabelValues("success").Inc()
+			}(t)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case scheduled = <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestOTLPTargets(t *testing.T) {
+	groups := []targetGroup{
+		{Targets: []string{"192.168.1.2", "192.168.1.3"}, Labels: map[string]string{"__param_auth": "v3", "__param_module": "if_mib,ucd_cpu", "__meta_sys_descr": "Linux", "site": "ams"}},
+		{Targets: []string{"switch1"}},
+		{Targets: []string{"10.0.0.1"}, Labels: map[string]string{"__param_tenant": "team_a"}},
+	}
+	expected := []otlpTarget{
+		{target: "192.168.1.2", auth: "v3", modules: []string{"if_mib", "ucd_cpu"}, attributes: map[string]string{"site": "ams"}},
+		{target: "192.168.1.3", auth: "v3", modules: []string{"if_mib", "ucd_cpu"}, attributes: map[string]string{"site": "ams"}},
+		{target: "switch1", auth: "public_v2", modules: []string{"if_mib"}, attributes: map[string]string{}},
+		{target: "10.0.0.1", auth: "public_v2", modules: []string{"if_mib"}, tenant: "team_a", attributes: map[string]string{}},
+	}
+	if got := otlpTargets(groups); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong targets: got %+v, want %+v", got, expected)
+	}
+}
+
+func TestPushOTLP(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ifHCInOctets", Help: "Octets."}, []string{"ifIndex"})
+	counter.WithLabelValues("2").Add(5)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "sensor", Help: "Sensor."})
+	gauge.Set(math.NaN())
+	registry.MustRegister(counter, gauge)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := otlpTarget{target: "switch1", auth: "public_v2", modules: []string{"if_mib"}, attributes: map[string]string{"site": "ams"}}
+	req := toOTLP(target, mfs, time.Unix(1700000000, 0))
+
+	var body, token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, token = string(b), r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	if err := pushOTLP(context.Background(), server.Client(), server.URL, map[string]string{"Authorization": "Bearer x"}, req); err != nil {
+		t.Fatal(err)
+	}
+	if token != "Bearer x" {
+		t.Errorf("Header not sent, got %q", token)
+	}
+	for _, s := range []string{
+		`{"key":"site","value":{"stringValue":"ams"}}`,
+		`{"key":"snmp.target","value":{"stringValue":"switch1"}}`,
+		`{"name":"ifHCInOctets","description":"Octets.","sum":{"dataPoints":[{"attributes":[{"key":"ifIndex","value":{"stringValue":"2"}}],"timeUnixNano":"1700000000000000000","asDouble":5}],"aggregationTemporality":2,"isMonotonic":true}}`,
+		`{"name":"sensor","description":"Sensor.","gauge":{"dataPoints":[{"timeUnixNano":"1700000000000000000","asDouble":"NaN"}]}}`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Expected %s in pushed body %s", s, body)
+		}
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad data", http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	if err := pushOTLP(context.Background(), failing.Client(), failing.URL, nil, req); err == nil || !strings.Contains(err.Error(), "bad data") {
+		t.Errorf("Expected the server's error, got %v", err)
+	}
+}
+
+func TestOTLPStaleRows(t *testing.T) {
+	tables := otlpTables([]*config.Module{{Metrics: []*config.Metric{
+		{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Indexes: []*config.Index{{Labelname: "ifIndex"}}},
+		{Name: "ifOperStatus", Oid: "1.3.6.1.2.1.2.2.1.8", Indexes: []*config.Index{{Labelname: "ifIndex"}}},
+		{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3"},
+	}}})
+	scrape := func(rows map[string]string) []*dto.MetricFamily {
+		registry := prometheus.NewRegistry()
+		octets := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ifInOctets", Help: "Octets."}, []string{"ifIndex", "ifDescr"})
+		status := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ifOperStatus", Help: "Status."}, []string{"ifIndex"})
+		registry.MustRegister(octets, status)
+		for index, descr := range rows {
+			octets.WithLabelValues(index, descr).Add(5)
+			status.WithLabelValues(index).Set(1)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfs
+	}
+
+	r := &otlpRows{targets: map[string]*otlpTargetRows{}}
+	if stale, deleted := r.update("switch1", scrape(map[string]string{"1": "lo", "2": "eth0", "3": "eth1"}), tables); len(stale) != 0 || len(deleted) != 0 {
+		t.Errorf("Expected nothing stale after the first scrape, got %v and %v", stale, deleted)
+	}
+	// Row 1 only changed its description.
+	mfs := scrape(map[string]string{"1": "loopback", "3": "eth1"})
+	stale, deleted := r.update("switch1", mfs, tables)
+	if len(stale) != 2 || stale[0].metric != "ifInOctets" || stale[1].metric != "ifOperStatus" || stale[0].labels["ifIndex"] != "2" || stale[1].labels["ifIndex"] != "2" {
+		t.Errorf("Expected the series of row 2 to be stale, got %+v", stale)
+	}
+	if want := map[string]float64{"1.3.6.1.2.1.2.2.1": 1}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("Expected deleted rows %v, got %v", want, deleted)
+	}
+
+	req := addStaleRows(toOTLP(otlpTarget{target: "switch1"}, mfs, time.Unix(1700000000, 0)), stale, deleted, time.Unix(1700000000, 0))
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`{"attributes":[{"key":"ifDescr","value":{"stringValue":"eth0"}},{"key":"ifIndex","value":{"stringValue":"2"}}],"timeUnixNano":"1700000000000000000","asDouble":0,"flags":1}`,
+		`{"name":"snmp_row_deleted_total","description":"Rows which disappeared from each table of the target, by the OID of the table entry.","sum":{"dataPoints":[{"attributes":[{"key":"table","value":{"stringValue":"1.3.6.1.2.1.2.2.1"}}],"timeUnixNano":"1700000000000000000","asDouble":1}],"aggregationTemporality":2,"isMonotonic":true}}`,
+	} {
+		if !strings.Contains(string(body), s) {
+			t.Errorf("Expected %s in request %s", s, body)
+		}
+	}
+
+	r.retain(map[string]bool{})
+	if len(r.targets) != 0 {
+		t.Errorf("Removed target not forgotten: %v", r.targets)
+	}
+}
+
+func TestOTLPRates(t *testing.T) {
+	scrape := func(octets float64) []*dto.MetricFamily {
+		registry := prometheus.NewRegistry()
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ifInOctets", Help: "Octets."}, []string{"ifIndex"})
+		status := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ifOperStatus", Help: "Status."})
+		registry.MustRegister(counter, status)
+		counter.WithLabelValues("1").Add(octets)
+		status.Set(1)
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfs
+	}
+	r := &otlpCounters{targets: map[string]map[string]otlpCounterSample{}}
+	start := time.Unix(1700000000, 0)
+	if rates := r.update("switch1", scrape(1000), start); len(rates) != 0 {
+		t.Errorf("Expected no rates after the first scrape, got %v", rates)
+	}
+	rates := r.update("switch1", scrape(7000), start.Add(time.Minute))
+	if len(rates) != 1 || rates[0].GetName() != "ifInOctets_per_second" || rates[0].GetType() != dto.MetricType_GAUGE {
+		t.Fatalf("Expected the rate of ifInOctets, got %v", rates)
+	}
+	m := rates[0].GetMetric()[0]
+	if m.GetGauge().GetValue() != 100 || m.GetLabel()[0].GetValue() != "1" {
+		t.Errorf("Expected 100 per second for ifIndex 1, got %v", m)
+	}
+	// The counter went backwards.
+	if rates := r.update("switch1", scrape(10), start.Add(2*time.Minute)); len(rates) != 0 {
+		t.Errorf("Expected no rates after a reset, got %v", rates)
+	}
+	r.retain(map[string]bool{})
+	if len(r.targets) != 0 {
+		t.Errorf("Removed target not forgotten: %v", r.targets)
+	}
+}
+
+func TestOTLPPhase(t *testing.T) {
+	targets := otlpTargets([]targetGroup{{Targets: []string{"switch1", "switch2", "switch3", "switch4"}}})
+	seen := map[time.Duration]bool{}
+	for _, target := range targets {
+		phase := target.phase(time.Minute, 0)
+		if phase < 0 || phase >= time.Minute {
+			t.Errorf("Phase %s of %s not within the interval", phase, target.target)
+		}
+		if again := target.phase(time.Minute, 0); again != phase {
+			t.Errorf("Phase of %s changed from %s to %s", target.target, phase, again)
+		}
+		seen[phase] = true
+	}
+	if len(seen) != len(targets) {
+		t.Errorf("Targets not spread, phases %v", seen)
+	}
+	if targets[0].phase(time.Minute, 0) == targets[0].phase(time.Minute, 1) {
+		t.Errorf("Seed did not change the phase of %s", targets[0].target)
+	}
+	if phase := targets[0].phase(0, 0); phase != 0 {
+		t.Errorf("Expected no phase without an interval, got %s", phase)
+	}
+}
+
+func TestScrapeForOTLPTenant(t *testing.T) {
+	tenant := &config.Tenant{
+		Auths:   map[string]*config.Auth{"team_auth": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"team_module": &config.DefaultModule},
+	}
+	if err := yaml.Unmarshal([]byte("allowed_targets: [127.0.0.0/8]"), tenant); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, &config.Config{
+		Auths:   map[string]*config.Auth{"public_v2": &config.DefaultAuth},
+		Modules: map[string]*config.Module{"if_mib": &config.DefaultModule},
+		Tenants: map[string]*config.Tenant{"team": tenant},
+	})
+	cases := []struct {
+		target otlpTarget
+		err    string
+	}{
+		{otlpTarget{target: "127.0.0.1", auth: "team_auth", modules: []string{"team_module"}, tenant: "team"}, ""},
+		{otlpTarget{target: "127.0.0.1", auth: "team_auth", modules: []string{"team_module"}}, "unknown auth"},
+		{otlpTarget{target: "127.0.0.1", auth: "team_auth", modules: []string{"if_mib"}, tenant: "team"}, "unknown module"},
+		{otlpTarget{target: "127.0.0.1", auth: "team_auth", modules: []string{"team_module"}, tenant: "other"}, "unknown tenant"},
+		{otlpTarget{target: "192.0.2.1", auth: "team_auth", modules: []string{"team_module"}, tenant: "team"}, "not allowed"},
+	}
+	for _, c := range cases {
+		_, _, err := scrapeForOTLP(context.Background(), c.target, log.NewNopLogger(), testExporterMetrics())
+		if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+			t.Errorf("%+v: expected error %q, got %v", c.target, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/snmpcollect"
+)
+
+var (
+	recordCommand = kingpin.Command("record", "Scrape a target with modules and write its metrics to a file, such as before and after a firmware upgrade to compare them.")
+	recordTarget  = recordCommand.Flag("target", "Target to record, as in the target URL parameter.").Required().String()
+	recordAuth    = recordCommand.Flag("auth", "Auth to scrape with.").Default("public_v2").String()
+	recordModules = recordCommand.Flag("module", "Module to scrape, can be repeated.").Default("if_mib").Strings()
+	recordOutput  = recordCommand.Flag("output", "File to write the recording to, standard output if empty.").Default("").String()
+
+	compareCommand = kingpin.Command("compare", "Compare two recordings of a target, reporting the metrics and series which appeared, disappeared or changed type as JSON. Fails if metrics disappeared or changed type.")
+	compareBefore  = compareCommand.Arg("before", "Recording before the change.").Required().String()
+	compareAfter   = compareCommand.Arg("after", "Recording after the change.").Required().String()
+)
+
+// recording is a scrape of a target, with the series of each metric but not
+// their values, which change anyway.
+type recording struct {
+	Target  string                     `json:"target"`
+	Auth    string                     `json:"auth"`
+	Modules []string                   `json:"modules"`
+	Time    time.Time                  `json:"time"`
+	Metrics map[string]*recordedMetric `json:"metrics"`
+}
+
+type recordedMetric struct {
+	// The type of the metric in the module, such as counter or
+	// DisplayString, or its Prometheus type for metrics not in the modules.
+	Type   string   `json:"type"`
+	Series []string `json:"series"`
+}
+
+// typeChange is a metric whose type differs between two recordings, such as
+// a gauge becoming a counter or a DisplayString becoming a number.
+type typeChange struct {
+	Metric string `json:"metric"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// recordingDiff is how the metrics of a target differ between recordings.
+type recordingDiff struct {
+	Target             string       `json:"target"`
+	Before             time.Time    `json:"before"`
+	After              time.Time    `json:"after"`
+	AppearedMetrics    []string     `json:"appeared_metrics"`
+	DisappearedMetrics []string     `json:"disappeared_metrics"`
+	ChangedTypes       []typeChange `json:"changed_types"`
+	AppearedSeries     []string     `json:"appeared_series"`
+	DisappearedSeries  []string     `json:"disappeared_series"`
+	UnchangedSeries    int          `json:"unchanged_series"`
+}
+
+// newRecording records the metric families of a scrape of the modules.
+// Metrics about the scrape itself are left out.
+func newRecording(mfs []*dto.MetricFamily, modules []*config.Module) *recording {
+	types := map[string]string{}
+	for _, module := range modules {
+		for _, metric := range module.Metrics {
+			types[metric.Name] = metric.Type
+		}
+	}
+	r := &recording{Metrics: map[string]*recordedMetric{}}
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "snmp_scrape_") {
+			continue
+		}
+		typ, ok := types[mf.GetName()]
+		if !ok {
+			typ = strings.ToLower(mf.GetType().String())
+		}
+		m := &recordedMetric{Type: typ, Series: []string{}}
+		for _, metric := range mf.GetMetric() {
+			m.Series = append(m.Series, seriesKey(mf.GetName(), metric.GetLabel()))
+		}
+		sort.Strings(m.Series)
+		r.Metrics[mf.GetName()] = m
+	}
+	return r
+}
+
+// diffRecordings compares two recordings. Series of metrics which appeared or
+// disappeared are only reported as such metrics.
+func diffRecordings(before, after *recording) recordingDiff {
+	d := recordingDiff{
+		Target:             after.Target,
+		Before:             before.Time,
+		After:              after.Time,
+		AppearedMetrics:    []string{},
+		DisappearedMetrics: []string{},
+		ChangedTypes:       []typeChange{},
+		AppearedSeries:     []string{},
+		DisappearedSeries:  []string{},
+	}
+	for name, b := range before.Metrics {
+		a, ok := after.Metrics[name]
+		if !ok {
+			d.DisappearedMetrics = append(d.DisappearedMetrics, name)
+			continue
+		}
+		if a.Type != b.Type {
+			d.ChangedTypes = append(d.ChangedTypes, typeChange{Metric: name, Before: b.Type, After: a.Type})
+		}
+		series := map[string]struct{}{}
+		for _, s := range b.Series {
+			series[s] = struct{}{}
+		}
+		for _, s := range a.Series {
+			if _, ok := series[s]; ok {
+				d.UnchangedSeries++
+				delete(series, s)
+			} else {
+				d.AppearedSeries = append(d.AppearedSeries, s)
+			}
+		}
+		for s := range series {
+			d.DisappearedSeries = append(d.DisappearedSeries, s)
+		}
+	}
+	for name := range after.Metrics {
+		if _, ok := before.Metrics[name]; !ok {
+			d.AppearedMetrics = append(d.AppearedMetrics, name)
+		}
+	}
+	sort.Strings(d.AppearedMetrics)
+	sort.Strings(d.DisappearedMetrics)
+	sort.Slice(d.ChangedTypes, func(i, j int) bool { return d.ChangedTypes[i].Metric < d.ChangedTypes[j].Metric })
+	sort.Strings(d.AppearedSeries)
+	sort.Strings(d.DisappearedSeries)
+	return d
+}
+
+// runRecord implements the record command.
+func runRecord(logger log.Logger, w io.Writer) error {
+	cfg, err := config.LoadFile(*configFile, *expandEnvVars)
+	if err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+	c := snmpcollect.New(cfg, snmpcollect.Options{Logger: logger})
+	mfs, err := c.Scrape(context.Background(), *recordTarget, *recordAuth, *recordModules...)
+	if err != nil {
+		// A partial recording would report what's missing as disappeared.
+		return fmt.Errorf("error scraping target: %w", err)
+	}
+	modules := make([]*config.Module, 0, len(*recordModules))
+	for _, name := range *recordModules {
+		modules = append(modules, cfg.Modules[name])
+	}
+	r := newRecording(mfs, modules)
+	r.Target, r.Auth, r.Modules, r.Time = *recordTarget, *recordAuth, *recordModules, time.Now().UTC()
+	if *recordOutput != "" {
+		f, err := os.Create(*recordOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// runCompare implements the compare command.
+func runCompare(w io.Writer) error {
+	recordings := make([]*recording, 0, 2)
+	for _, path := range []string{*compareBefore, *compareAfter} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		r := &recording{}
+		if err := json.Unmarshal(content, r); err != nil {
+			return fmt.Errorf("error parsing recording %s: %w", path, err)
+		}
+		recordings = append(recordings, r)
+	}
+	d := diffRecordings(recordings[0], recordings[1])
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+	if len(d.DisappearedMetrics) > 0 || len(d.ChangedTypes) > 0 {
+		return fmt.Errorf("%d metrics disappeared and %d changed type", len(d.DisappearedMetrics), len(d.ChangedTypes))
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// Larger bodies are certainly not scrape requests.
+const maxRequestBodySize = 1 << 20
+
+// scrapeRequest holds the parameters of a scrape, either from the URL or
+// from a POSTed JSON body.
+type scrapeRequest struct {
+	Target        string            `json:"target"`
+	Auth          string            `json:"auth"`
+	Modules       []string          `json:"modules"`
+	SNMPContext   string            `json:"snmp_context"`
+	Tenant        string            `json:"tenant"`
+	DebugPackets  bool              `json:"snmp_debug_packets"`
+	AuthOverrides *authOverrides    `json:"auth_overrides"`
+	Labels        map[string]string `json:"labels"`
+	RetryPolicy   string            `json:"retry_policy"`
+	// Overrides the max_message_size of the modules, e.g. for targets
+	// behind a link with a small MTU.
+	MaxMessageSize int `json:"max_message_size"`
+}
+
+// authOverrides replaces the credentials of the requested auth.
+type authOverrides struct {
+	Community    *string `json:"community"`
+	Username     *string `json:"username"`
+	Password     *string `json:"password"`
+	PrivPassword *string `json:"priv_password"`
+	ContextName  *string `json:"context_name"`
+}
+
+// apply returns a copy of auth with the overrides applied.
+func (o *authOverrides) apply(auth *config.Auth) *config.Auth {
+	a := *auth
+	if o.Community != nil {
+		a.Community = config.Secret(*o.Community)
+	}
+	if o.Username != nil {
+		a.Username = *o.Username
+	}
+	if o.Password != nil {
+		a.Password = config.Secret(*o.Password)
+	}
+	if o.PrivPassword != nil {
+		a.PrivPassword = config.Secret(*o.PrivPassword)
+	}
+	if o.ContextName != nil {
+		a.ContextName = *o.ContextName
+	}
+	return &a
+}
+
+// parseScrapeRequest reads the parameters of a scrape from a JSON body for
+// POST requests, and from the URL otherwise.
+func parseScrapeRequest(w http.ResponseWriter, r *http.Request) (*scrapeRequest, error) {
+	req := &scrapeRequest{}
+	if r.Method == http.MethodPost {
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(req); err != nil {
+			return nil, fmt.Errorf("invalid request body: %w", err)
+		}
+		if req.Target == "" {
+			return nil, errors.New("'target' must be specified")
+		}
+		for name := range req.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				return nil, fmt.Errorf("invalid label name '%s'", name)
+			}
+		}
+	} else {
+		query := r.URL.Query()
+		req.Target = query.Get("target")
+		if len(query["target"]) != 1 || req.Target == "" {
+			return nil, errors.New("'target' parameter must be specified once")
+		}
+		for _, param := range []string{"auth", "snmp_context", "tenant", "retry_policy", "max_message_size"} {
+			if len(query[param]) > 1 {
+				return nil, fmt.Errorf("'%s' parameter must only be specified once", param)
+			}
+		}
+		req.Auth = query.Get("auth")
+		req.SNMPContext = query.Get("snmp_context")
+		req.Tenant = query.Get("tenant")
+		req.Modules = query["module"]
+		req.DebugPackets = query.Get("snmp_debug_packets") == "true"
+		req.RetryPolicy = query.Get("retry_policy")
+		if size := query.Get("max_message_size"); size != "" {
+			n, err := strconv.Atoi(size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_message_size '%s'", size)
+			}
+			req.MaxMessageSize = n
+		}
+	}
+	if err := config.CheckRetryPolicy(req.RetryPolicy); err != nil {
+		return nil, err
+	}
+	if err := config.CheckMaxMessageSize(req.MaxMessageSize); err != nil {
+		return nil, err
+	}
+
+	req.Modules = splitModules(req.Modules)
+	return req, nil
+}
+
+// applyDefaults sets the auth, modules and retry policy the request doesn't
+// give from the target_defaults of the target's subnet, if any, and the
+// auth and modules from the exporter's defaults otherwise.
+func (req *scrapeRequest) applyDefaults(defaults *config.TargetDefaults) {
+	if defaults != nil {
+		if req.Auth == "" {
+			req.Auth = defaults.Auth
+		}
+		if len(req.Modules) == 0 {
+			req.Modules = splitModules(defaults.Modules)
+		}
+		if req.RetryPolicy == "" {
+			req.RetryPolicy = defaults.RetryPolicy
+		}
+	}
+	if req.Auth == "" {
+		req.Auth = "public_v2"
+	}
+	if len(req.Modules) == 0 {
+		req.Modules = []string{"if_mib"}
+	}
+}
+
+// needsTargetDefaults reports whether any of the target_defaults sets
+// something the request doesn't give, so that targets are only resolved when
+// their defaults are used.
+func needsTargetDefaults(req *scrapeRequest, defaults map[string]*config.TargetDefaults, timeoutGiven bool) bool {
+	for _, d := range defaults {
+		if (d.Auth != "" && req.Auth == "") || (len(d.Modules) > 0 && len(req.Modules) == 0) ||
+			(d.RetryPolicy != "" && req.RetryPolicy == "") || (d.Timeout > 0 && !timeoutGiven) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetDefaults returns the target_defaults of the subnet of the target, or
+// nil if there are none, along with the target to scrape. The defaults of a
+// name are those of the first of its addresses within a subnet, and the name
+// is replaced by that address so that it is not resolved again, possibly to
+// another subnet, by the time it is scraped.
+func targetDefaults(ctx context.Context, defaults map[string]*config.TargetDefaults, target string) (*config.TargetDefaults, string) {
+	if len(defaults) == 0 {
+		return nil, target
+	}
+	host := targetHost(target)
+	if ip := net.ParseIP(host); ip != nil {
+		return config.TargetDefaultsFor(defaults, ip), target
+	}
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, target
+	}
+	for _, addr := range addrs {
+		if d := config.TargetDefaultsFor(defaults, addr); d != nil {
+			return d, withTargetHost(target, addr.String())
+		}
+	}
+	return nil, target
+}
+
+// splitModules splits comma separated modules, dropping duplicates.
+func splitModules(names []string) []string {
+	uniqueM := make(map[string]bool)
+	var modules []string
+	for _, qm := range names {
+		for _, m := range strings.Split(qm, ",") {
+			if m == "" {
+				continue
+			}
+			if _, ok := uniqueM[m]; !ok {
+				uniqueM[m] = true
+				modules = append(modules, m)
+			}
+		}
+	}
+	return modules
+}
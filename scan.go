@@ -0,0 +1,270 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gosnmp/gosnmp"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+const (
+	sysDescrOid    = "1.3.6.1.2.1.1.1.0"
+	sysObjectIDOid = "1.3.6.1.2.1.1.2.0"
+	enterprisesOid = "1.3.6.1.4.1"
+	// Larger networks are almost certainly a mistake.
+	maxScanHosts = 65536
+)
+
+var (
+	scanCommand     = kingpin.Command("scan", "Scan networks for SNMP agents and write a Prometheus file_sd target file.")
+	scanCIDRs       = scanCommand.Flag("cidr", "Network to scan, can be repeated.").Required().Strings()
+	scanAuths       = scanCommand.Flag("auth", "Auth to try, in order, can be repeated.").Default("public_v2").Strings()
+	scanOutput      = scanCommand.Flag("output", "File to write the targets to, - for stdout.").Default("-").String()
+	scanConcurrency = scanCommand.Flag("concurrency", "Number of hosts to scan concurrently.").Default("64").Int()
+	scanTimeout     = scanCommand.Flag("timeout", "Timeout for each SNMP request.").Default("1s").Duration()
+)
+
+// scanResult is an SNMP agent found by a scan.
+type scanResult struct {
+	Target      string
+	Auth        string
+	SysDescr    string
+	SysObjectID string
+	Modules     []string
+}
+
+// targetGroup is a Prometheus file_sd target group.
+type targetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// scanHosts returns the addresses of the hosts in the networks.
+func scanHosts(cidrs []string) ([]string, error) {
+	hosts := []string{}
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			if ip = net.ParseIP(cidr); ip == nil {
+				return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+			}
+			hosts = append(hosts, ip.String())
+			continue
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits-ones > 16 || len(hosts)+1<<(bits-ones) > maxScanHosts {
+			return nil, fmt.Errorf("network %q is too large to scan, at most %d hosts are allowed", cidr, maxScanHosts)
+		}
+		first := len(hosts)
+		for ip := ip.Mask(ipNet.Mask); ipNet.Contains(ip); ip = nextIP(ip) {
+			hosts = append(hosts, ip.String())
+		}
+		if bits == 32 && ones < 31 {
+			// Skip the network and broadcast addresses.
+			hosts = append(hosts[:first], hosts[first+1:len(hosts)-1]...)
+		}
+	}
+	// Overlapping networks.
+	seen := make(map[string]struct{}, len(hosts))
+	unique := hosts[:0]
+	for _, host := range hosts {
+		if _, ok := seen[host]; !ok {
+			seen[host] = struct{}{}
+			unique = append(unique, host)
+		}
+	}
+	return unique, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// suggestModules returns the modules which walk the enterprise subtree of
+// the device's sysObjectID, along with if_mib which applies to most devices.
+func suggestModules(sysObjectID string, modules map[string]*config.Module) []string {
+	suggested := []string{}
+	if _, ok := modules["if_mib"]; ok {
+		suggested = append(suggested, "if_mib")
+	}
+	generic := len(suggested)
+	parts := strings.Split(sysObjectID, ".")
+	if !strings.HasPrefix(sysObjectID, enterprisesOid+".") || len(parts) < 7 {
+		return suggested
+	}
+	enterprise := strings.Join(parts[:7], ".")
+	for name, module := range modules {
+		for _, oid := range append(append([]string{}, module.Walk...), module.Get...) {
+			if oid == enterprise || strings.HasPrefix(oid, enterprise+".") {
+				suggested = append(suggested, name)
+				break
+			}
+		}
+	}
+	sort.Strings(suggested[generic:])
+	return suggested
+}
+
+// scanTarget tries each auth in turn until the target answers.
+func scanTarget(ctx context.Context, logger log.Logger, target string, authNames []string, cfg *config.Config, timeout time.Duration) *scanResult {
+	for _, authName := range authNames {
+		client, err := scraper.NewGoSNMP(logger, target, "", false)
+		if err != nil {
+			level.Debug(logger).Log("msg", "Error creating client", "target", target, "err", err)
+			return nil
+		}
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.Context = ctx
+			g.Timeout = timeout
+			g.Retries = 0
+			cfg.Auths[authName].ConfigureSNMP(g, "")
+		})
+		if err := client.Connect(); err != nil {
+			level.Debug(logger).Log("msg", "Error connecting to target", "target", target, "err", err)
+			return nil
+		}
+		packet, err := client.Get([]string{sysDescrOid, sysObjectIDOid})
+		client.Close()
+		if err != nil || packet.Error != gosnmp.NoError {
+			level.Debug(logger).Log("msg", "No answer from target", "target", target, "auth", authName, "err", err)
+			continue
+		}
+		result := &scanResult{Target: target, Auth: authName}
+		for _, pdu := range packet.Variables {
+			switch strings.TrimPrefix(pdu.Name, ".") {
+			case sysDescrOid:
+				if b, ok := pdu.Value.([]byte); ok {
+					result.SysDescr = strings.ToValidUTF8(string(b), "�")
+				}
+			case sysObjectIDOid:
+				if s, ok := pdu.Value.(string); ok {
+					result.SysObjectID = strings.TrimPrefix(s, ".")
+				}
+			}
+		}
+		result.Modules = suggestModules(result.SysObjectID, cfg.Modules)
+		return result
+	}
+	return nil
+}
+
+// writeTargets writes the results as file_sd target groups, which set the
+// auth and module URL parameters of each target.
+func writeTargets(w io.Writer, results []*scanResult) error {
+	groups := make([]targetGroup, 0, len(results))
+	for _, r := range results {
+		groups = append(groups, targetGroup{
+			Targets: []string{r.Target},
+			Labels: map[string]string{
+				"__param_auth":         r.Auth,
+				"__param_module":       strings.Join(r.Modules, ","),
+				"__meta_sys_descr":     r.SysDescr,
+				"__meta_sys_object_id": r.SysObjectID,
+			},
+		})
+	}
+	out, err := yaml.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// runScan implements the scan command.
+func runScan(logger log.Logger) error {
+	cfg, err := config.LoadFile(*configFile, *expandEnvVars)
+	if err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+	for _, authName := range *scanAuths {
+		if _, ok := cfg.Auths[authName]; !ok {
+			return fmt.Errorf("unknown auth '%s'", authName)
+		}
+	}
+	hosts, err := scanHosts(*scanCIDRs)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Starting scan", "hosts", len(hosts), "auths", strings.Join(*scanAuths, ","))
+
+	ctx := context.Background()
+	hostCh := make(chan string)
+	results := make([]*scanResult, len(hosts))
+	index := make(map[string]int, len(hosts))
+	for i, host := range hosts {
+		index[host] = i
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < *scanConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range hostCh {
+				if r := scanTarget(ctx, logger, host, *scanAuths, cfg, *scanTimeout); r != nil {
+					level.Info(logger).Log("msg", "Found SNMP agent", "target", host, "auth", r.Auth, "sys_object_id", r.SysObjectID, "modules", strings.Join(r.Modules, ","))
+					results[index[host]] = r
+				}
+			}
+		}()
+	}
+	for _, host := range hosts {
+		hostCh <- host
+	}
+	close(hostCh)
+	wg.Wait()
+
+	found := []*scanResult{}
+	for _, r := range results {
+		if r != nil {
+			found = append(found, r)
+		}
+	}
+	level.Info(logger).Log("msg", "Scan finished", "hosts", len(hosts), "found", len(found))
+
+	w := io.Writer(os.Stdout)
+	if *scanOutput != "-" {
+		f, err := os.Create(*scanOutput)
+		if err != nil {
+			return fmt.Errorf("error opening output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeTargets(w, found)
+}
@@ -0,0 +1,464 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// The codec below encodes the requests and decodes the responses of SNMPv1
+// and SNMPv2c gets and walks, which make up most of the traffic of the
+// exporter. Unlike gosnmp it works on pooled buffers and decodes all the
+// OIDs and octet strings of a response into one allocation each, rather
+// than several allocations per varbind. Responses it does not handle, such
+// as ones with Opaque values, are decoded by gosnmp instead, which yields
+// the same PDUs.
+
+// errNotFast is returned for responses left to gosnmp.
+var errNotFast = errors.New("not decoded by the fast codec")
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	// The largest datagram read, as gosnmp.
+	maxMessageSize = 65535
+)
+
+var messagePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, maxMessageSize+1)
+		return &b
+	},
+}
+
+// berLengthSize returns the size of the encoding of length n.
+func berLengthSize(n int) int {
+	size := 1
+	if n > 127 {
+		for ; n > 0; n >>= 8 {
+			size++
+		}
+	}
+	return size
+}
+
+func appendBERLength(b []byte, n int) []byte {
+	if n <= 127 {
+		return append(b, byte(n))
+	}
+	size := berLengthSize(n) - 1
+	b = append(b, 0x80|byte(size))
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return b
+}
+
+// berUintSize returns the size of the contents of the INTEGER v.
+func berUintSize(v uint32) int {
+	size := 1
+	for ; v > 0x7f; v >>= 8 {
+		size++
+	}
+	return size
+}
+
+func appendBERUint(b []byte, v uint32) []byte {
+	size := berUintSize(v)
+	b = append(b, berInteger, byte(size))
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(uint64(v)>>(8*i)))
+	}
+	return b
+}
+
+// appendOID appends the contents of the encoding of the dotted OID, which
+// may start with a dot.
+func appendOID(b []byte, oid string) ([]byte, error) {
+	full := oid
+	if len(oid) > 0 && oid[0] == '.' {
+		oid = oid[1:]
+	}
+	var arcs int
+	var first uint64
+	for len(oid) > 0 {
+		i := 0
+		var v uint64
+		for ; i < len(oid) && oid[i] != '.'; i++ {
+			c := oid[i]
+			if c < '0' || c > '9' || v > gosnmp.MaxObjectSubIdentifierValue {
+				return nil, fmt.Errorf("invalid OID %q", full)
+			}
+			v = v*10 + uint64(c-'0')
+		}
+		if i == 0 || v > gosnmp.MaxObjectSubIdentifierValue {
+			return nil, fmt.Errorf("invalid OID %q", full)
+		}
+		switch arcs {
+		case 0:
+			if v > 2 {
+				return nil, fmt.Errorf("invalid OID %q", full)
+			}
+			first = v
+		case 1:
+			// Only the arcs under 2 are not limited to 39.
+			if first < 2 && v >= 40 {
+				return nil, fmt.Errorf("invalid OID %q", full)
+			}
+			b = appendBase128(b, first*40+v)
+		default:
+			b = appendBase128(b, v)
+		}
+		arcs++
+		if i < len(oid) {
+			i++
+		}
+		oid = oid[i:]
+	}
+	if arcs < 2 || arcs > 128 {
+		return nil, fmt.Errorf("invalid OID %q", full)
+	}
+	return b, nil
+}
+
+// appendBase128 appends a subidentifier of an OID, in base 128 with the
+// high bit set on all bytes but the last.
+func appendBase128(b []byte, v uint64) []byte {
+	size := 1
+	for w := v >> 7; w > 0; w >>= 7 {
+		size++
+	}
+	for j := size - 1; j > 0; j-- {
+		b = append(b, 0x80|byte(v>>(7*j)))
+	}
+	return append(b, byte(v&0x7f))
+}
+
+// appendRequest appends the message of a request for oids. For GetBulk
+// requests a and b are the non-repeaters and max-repetitions, otherwise the
+// error status and index.
+func appendRequest(b []byte, version gosnmp.SnmpVersion, community string, pduType gosnmp.PDUType, requestID, a, b2 uint32, oids []string) ([]byte, error) {
+	// The sizes of the OIDs make up the lengths preceding them, so they are
+	// encoded first, into the pooled scratch buffer.
+	scratch := messagePool.Get().(*[]byte)
+	defer messagePool.Put(scratch)
+	encoded := (*scratch)[:0]
+	var endsBuf [16]int
+	ends := endsBuf[:0]
+	var err error
+	for _, oid := range oids {
+		if encoded, err = appendOID(encoded, oid); err != nil {
+			return nil, err
+		}
+		ends = append(ends, len(encoded))
+	}
+	varbindSize := func(oidSize int) int {
+		return 1 + berLengthSize(oidSize) + oidSize + 2
+	}
+	vblSize, start := 0, 0
+	for _, end := range ends {
+		n := varbindSize(end - start)
+		vblSize += 1 + berLengthSize(n) + n
+		start = end
+	}
+	pduSize := 2 + berUintSize(requestID) + 2 + berUintSize(a) + 2 + berUintSize(b2) + 1 + berLengthSize(vblSize) + vblSize
+	msgSize := 2 + berUintSize(uint32(version)) + 1 + berLengthSize(len(community)) + len(community) + 1 + berLengthSize(pduSize) + pduSize
+
+	b = append(b, berSequence)
+	b = appendBERLength(b, msgSize)
+	b = appendBERUint(b, uint32(version))
+	b = append(b, berOctetString)
+	b = appendBERLength(b, len(community))
+	b = append(b, community...)
+	b = append(b, byte(pduType))
+	b = appendBERLength(b, pduSize)
+	b = appendBERUint(b, requestID)
+	b = appendBERUint(b, a)
+	b = appendBERUint(b, b2)
+	b = append(b, berSequence)
+	b = appendBERLength(b, vblSize)
+	start = 0
+	for _, end := range ends {
+		oid := encoded[start:end]
+		b = append(b, berSequence)
+		b = appendBERLength(b, varbindSize(len(oid)))
+		b = append(b, berOID)
+		b = appendBERLength(b, len(oid))
+		b = append(b, oid...)
+		b = append(b, berNull, 0)
+		start = end
+	}
+	*scratch = encoded[:0]
+	return b, nil
+}
+
+// readTLV splits the first TLV off b.
+func readTLV(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errNotFast
+	}
+	tag, n, i := b[0], int(b[1]), 2
+	if n > 127 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < 2+size {
+			return 0, nil, nil, errNotFast
+		}
+		n = 0
+		for _, c := range b[2 : 2+size] {
+			n = n<<8 | int(c)
+		}
+		i += size
+	}
+	if len(b)-i < n {
+		return 0, nil, nil, errNotFast
+	}
+	return tag, b[i : i+n], b[i+n:], nil
+}
+
+// parseBERInt parses the contents of a signed INTEGER.
+func parseBERInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, false
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, true
+}
+
+// parseBERUint parses the contents of an unsigned value.
+func parseBERUint(b []byte) (uint64, bool) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, false
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, true
+}
+
+// appendOIDString appends the dotted form of the encoded OID, with a leading
+// dot.
+func appendOIDString(dst, b []byte) ([]byte, bool) {
+	if len(b) == 0 {
+		return dst, false
+	}
+	var v uint64
+	n := 0
+	first := true
+	for _, c := range b {
+		v = v<<7 | uint64(c&0x7f)
+		n++
+		if c&0x80 != 0 {
+			if n == 5 {
+				return dst, false
+			}
+			continue
+		}
+		if first {
+			// The first subidentifier holds the first two arcs, the
+			// second of which is only limited to 39 under 0 and 1.
+			arc := min(v/40, 2)
+			dst = append(dst, '.')
+			dst = strconv.AppendUint(dst, arc, 10)
+			v -= arc * 40
+			first = false
+		}
+		dst = append(dst, '.')
+		dst = strconv.AppendUint(dst, v, 10)
+		v, n = 0, 0
+	}
+	return dst, n == 0
+}
+
+// The kinds of the text decoded into the shared buffers of a response.
+const (
+	spanName = iota
+	spanOIDValue
+	spanIPValue
+	spanOctets
+)
+
+type textSpan struct {
+	pdu, kind, start, end int
+}
+
+// responseDecoder holds the scratch buffers of decoding one response.
+type responseDecoder struct {
+	text   []byte
+	octets []byte
+	spans  []textSpan
+}
+
+var decoderPool = sync.Pool{New: func() any { return &responseDecoder{} }}
+
+// decodeResponse decodes the GetResponse message b of a SNMPv1 or SNMPv2c
+// request into p. It returns errNotFast for anything it leaves to gosnmp.
+func decodeResponse(b []byte, p *gosnmp.SnmpPacket) error {
+	tag, msg, rest, err := readTLV(b)
+	if err != nil || tag != berSequence || len(rest) != 0 {
+		return errNotFast
+	}
+	tag, content, msg, err := readTLV(msg)
+	if err != nil || tag != berInteger {
+		return errNotFast
+	}
+	version, ok := parseBERInt(content)
+	if !ok || (version != int64(gosnmp.Version1) && version != int64(gosnmp.Version2c)) {
+		return errNotFast
+	}
+	tag, community, msg, err := readTLV(msg)
+	if err != nil || tag != berOctetString {
+		return errNotFast
+	}
+	tag, pdu, _, err := readTLV(msg)
+	if err != nil || tag != byte(gosnmp.GetResponse) {
+		return errNotFast
+	}
+	var fields [3]int64
+	for i := range fields {
+		tag, content, pdu, err = readTLV(pdu)
+		if err != nil || tag != berInteger {
+			return errNotFast
+		}
+		if fields[i], ok = parseBERInt(content); !ok {
+			return errNotFast
+		}
+	}
+	tag, vbl, _, err := readTLV(pdu)
+	if err != nil || tag != berSequence {
+		return errNotFast
+	}
+
+	count := 0
+	for r := vbl; len(r) > 0; count++ {
+		if _, _, r, err = readTLV(r); err != nil {
+			return errNotFast
+		}
+	}
+	d := decoderPool.Get().(*responseDecoder)
+	defer decoderPool.Put(d)
+	d.text, d.octets, d.spans = d.text[:0], d.octets[:0], d.spans[:0]
+	pdus := make([]gosnmp.SnmpPDU, count)
+	for i := range pdus {
+		var varbind []byte
+		_, varbind, vbl, _ = readTLV(vbl)
+		tag, name, varbind, err := readTLV(varbind)
+		if err != nil || tag != berOID {
+			return errNotFast
+		}
+		start := len(d.text)
+		if d.text, ok = appendOIDString(d.text, name); !ok {
+			return errNotFast
+		}
+		d.spans = append(d.spans, textSpan{i, spanName, start, len(d.text)})
+		tag, value, _, err := readTLV(varbind)
+		if err != nil {
+			return errNotFast
+		}
+		pdus[i].Type = gosnmp.Asn1BER(tag)
+		switch gosnmp.Asn1BER(tag) {
+		case gosnmp.Integer:
+			v, ok := parseBERInt(value)
+			if !ok {
+				return errNotFast
+			}
+			pdus[i].Value = int(v)
+		case gosnmp.Uinteger32:
+			v, ok := parseBERInt(value)
+			if !ok {
+				return errNotFast
+			}
+			pdus[i].Value = uint32(v)
+		case gosnmp.OctetString:
+			start := len(d.octets)
+			d.octets = append(d.octets, value...)
+			d.spans = append(d.spans, textSpan{i, spanOctets, start, len(d.octets)})
+		case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		case gosnmp.ObjectIdentifier:
+			start := len(d.text)
+			if d.text, ok = appendOIDString(d.text, value); !ok {
+				return errNotFast
+			}
+			d.spans = append(d.spans, textSpan{i, spanOIDValue, start, len(d.text)})
+		case gosnmp.IPAddress:
+			switch len(value) {
+			case 0:
+			case 4:
+				start := len(d.text)
+				for j, c := range value {
+					if j > 0 {
+						d.text = append(d.text, '.')
+					}
+					d.text = strconv.AppendUint(d.text, uint64(c), 10)
+				}
+				d.spans = append(d.spans, textSpan{i, spanIPValue, start, len(d.text)})
+			default:
+				return errNotFast
+			}
+		case gosnmp.Counter32, gosnmp.Gauge32:
+			v, ok := parseBERUint(value)
+			if !ok {
+				return errNotFast
+			}
+			pdus[i].Value = uint(v)
+		case gosnmp.TimeTicks:
+			v, ok := parseBERUint(value)
+			if !ok {
+				return errNotFast
+			}
+			pdus[i].Value = uint32(v)
+		case gosnmp.Counter64:
+			v, ok := parseBERUint(value)
+			if !ok {
+				return errNotFast
+			}
+			pdus[i].Value = v
+		default:
+			return errNotFast
+		}
+	}
+
+	text := string(d.text)
+	octets := make([]byte, len(d.octets))
+	copy(octets, d.octets)
+	for _, s := range d.spans {
+		switch s.kind {
+		case spanName:
+			pdus[s.pdu].Name = text[s.start:s.end]
+		case spanOIDValue, spanIPValue:
+			pdus[s.pdu].Value = text[s.start:s.end]
+		case spanOctets:
+			pdus[s.pdu].Value = octets[s.start:s.end:s.end]
+		}
+	}
+	p.Version = gosnmp.SnmpVersion(version)
+	p.Community = string(community)
+	p.PDUType = gosnmp.GetResponse
+	p.RequestID = uint32(fields[0])
+	p.Error = gosnmp.SNMPError(fields[1])
+	p.ErrorIndex = uint8(fields[2])
+	p.Variables = pdus
+	return nil
+}
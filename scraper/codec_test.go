@@ -0,0 +1,431 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestAppendRequest(t *testing.T) {
+	long := make([]string, 40)
+	for i := range long {
+		long[i] = fmt.Sprintf(".1.3.6.1.4.1.%d.2.%d.4294967295", 1<<i%4000000000, i)
+	}
+	for _, tc := range []struct {
+		version   gosnmp.SnmpVersion
+		community string
+		pduType   gosnmp.PDUType
+		requestID uint32
+		oids      []string
+	}{
+		{gosnmp.Version2c, "public", gosnmp.GetBulkRequest, 1, []string{".1.3.6.1.2.1.2.2.1.2"}},
+		{gosnmp.Version2c, strings.Repeat("c", 200), gosnmp.GetRequest, 0x7fffffff, []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.5.0"}},
+		{gosnmp.Version1, "private", gosnmp.GetNextRequest, 128, []string{".1.3.6.1.4.1.9.9.13.1.3.1.3.128.16384"}},
+		{gosnmp.Version2c, "public", gosnmp.GetRequest, 255, long},
+	} {
+		msg, err := appendRequest(nil, tc.version, tc.community, tc.pduType, tc.requestID, 0, 25, tc.oids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := &gosnmp.GoSNMP{Version: tc.version}
+		got, err := x.SnmpDecodePacket(msg)
+		if err != nil {
+			t.Fatalf("gosnmp failed to decode the %s request: %v", tc.pduType, err)
+		}
+		names := []string{}
+		for _, pdu := range got.Variables {
+			names = append(names, pdu.Name)
+			if pdu.Type != gosnmp.Null {
+				t.Errorf("Expected a null value for %s, got %s", pdu.Name, pdu.Type)
+			}
+		}
+		for i, oid := range tc.oids {
+			tc.oids[i] = "." + strings.TrimPrefix(oid, ".")
+		}
+		if got.Version != tc.version || got.Community != tc.community || got.PDUType != tc.pduType || got.RequestID != tc.requestID || !reflect.DeepEqual(names, tc.oids) {
+			t.Errorf("Wrong request: got %s %q %s %d %v", got.Version, got.Community, got.PDUType, got.RequestID, names)
+		}
+		if tc.pduType == gosnmp.GetBulkRequest && (got.NonRepeaters != 0 || got.MaxRepetitions != 25) {
+			t.Errorf("Wrong GetBulk parameters: got %d %d", got.NonRepeaters, got.MaxRepetitions)
+		}
+	}
+
+	for _, oid := range []string{"", ".1", "1.3.x", "1..3", "3.1", "6.1", "7.1", "1.40.1", "1.3.4294967296"} {
+		if _, err := appendRequest(nil, gosnmp.Version2c, "public", gosnmp.GetRequest, 1, 0, 0, []string{oid}); err == nil {
+			t.Errorf("Expected an error for OID %q", oid)
+		}
+	}
+}
+
+func TestOIDEncoding(t *testing.T) {
+	for _, oid := range []string{".0.0", ".0.39.1", ".1.3.6.1.2.1.1.3.0", ".2.40", ".2.100.3", ".2.999.1.4294967295", ".2.4294967295.1"} {
+		encoded, err := appendOID(nil, oid)
+		if err != nil {
+			t.Fatalf("Error encoding OID %s: %v", oid, err)
+		}
+		got, ok := appendOIDString(nil, encoded)
+		if !ok || string(got) != oid {
+			t.Errorf("OID %s decoded as %q, ok %v", oid, got, ok)
+		}
+	}
+	// 2.100 is a first subidentifier of two bytes.
+	if got, _ := appendOID(nil, "2.100.3"); !reflect.DeepEqual(got, []byte{0x81, 0x34, 0x03}) {
+		t.Errorf("Wrong encoding of 2.100.3: %x", got)
+	}
+}
+
+// testPDUs holds a value of every type the fast codec decodes.
+var testPDUs = []gosnmp.SnmpPDU{
+	{Name: ".1.3.6.1.2.1.1.1.0", Type: gosnmp.OctetString, Value: []byte("Linux router 5.10")},
+	{Name: ".1.3.6.1.2.1.1.2.0", Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.8072.3.2.10"},
+	{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(4294967295)},
+	{Name: ".1.3.6.1.2.1.1.4.0", Type: gosnmp.OctetString, Value: []byte{}},
+	{Name: ".1.3.6.1.2.1.2.2.1.7.1", Type: gosnmp.Integer, Value: -129},
+	{Name: ".1.3.6.1.2.1.2.2.1.7.2", Type: gosnmp.Integer, Value: 2147483647},
+	{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(4294967295)},
+	{Name: ".1.3.6.1.2.1.2.2.1.5.1", Type: gosnmp.Gauge32, Value: uint(128)},
+	{Name: ".1.3.6.1.2.1.4.20.1.1.10.0.0.1", Type: gosnmp.IPAddress, Value: "10.0.0.1"},
+	{Name: ".1.3.6.1.2.1.31.1.1.1.6.1", Type: gosnmp.Counter64, Value: uint64(18446744073709551615)},
+	{Name: ".1.3.6.1.4.1.2021.4.5.0", Type: gosnmp.Uinteger32, Value: uint32(1 << 31)},
+	{Name: ".1.3.6.1.4.1.9.9.13.1.3.1.3.4294967295", Type: gosnmp.Null},
+	{Name: ".1.3.6.1.2.1.1.9.0", Type: gosnmp.NoSuchObject},
+	{Name: ".1.3.6.1.2.1.1.9.1.2.1", Type: gosnmp.NoSuchInstance},
+	{Name: ".1.3.6.1.6", Type: gosnmp.EndOfMibView},
+}
+
+func encodeResponse(t testing.TB, pdus []gosnmp.SnmpPDU, requestID uint32, snmpErr gosnmp.SNMPError) []byte {
+	packet := &gosnmp.SnmpPacket{
+		Version:   gosnmp.Version2c,
+		Community: "public",
+		PDUType:   gosnmp.GetResponse,
+		RequestID: requestID,
+		Error:     snmpErr,
+		Variables: pdus,
+	}
+	msg, err := packet.MarshalMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDecodeResponse(t *testing.T) {
+	x := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+	for _, pdus := range [][]gosnmp.SnmpPDU{testPDUs, testPDUs[:1], {}} {
+		msg := encodeResponse(t, pdus, 42, gosnmp.NoError)
+		want, err := x.SnmpDecodePacket(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &gosnmp.SnmpPacket{}
+		if err := decodeResponse(msg, got); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if got.Version != want.Version || got.Community != want.Community || got.PDUType != want.PDUType || got.RequestID != want.RequestID || got.Error != want.Error {
+			t.Errorf("Wrong header: got %s %q %s %d %s, want %s %q %s %d %s", got.Version, got.Community, got.PDUType, got.RequestID, got.Error,
+				want.Version, want.Community, want.PDUType, want.RequestID, want.Error)
+		}
+		if len(got.Variables) != len(want.Variables) {
+			t.Fatalf("Wrong number of PDUs: got %d, want %d", len(got.Variables), len(want.Variables))
+		}
+		for i := range want.Variables {
+			if !reflect.DeepEqual(got.Variables[i], want.Variables[i]) {
+				t.Errorf("Wrong PDU: got %#v, want %#v", got.Variables[i], want.Variables[i])
+			}
+		}
+	}
+
+	got := &gosnmp.SnmpPacket{}
+	if err := decodeResponse(encodeResponse(t, nil, 7, gosnmp.NoSuchName), got); err != nil || got.Error != gosnmp.NoSuchName || got.RequestID != 7 {
+		t.Errorf("Wrong error response: got %v %s %d", err, got.Error, got.RequestID)
+	}
+
+	// Appending to one octet string must not overwrite the next one.
+	if err := decodeResponse(encodeResponse(t, testPDUs, 1, gosnmp.NoError), got); err != nil {
+		t.Fatal(err)
+	}
+	_ = append(got.Variables[0].Value.([]byte), 'x')
+	if v := got.Variables[3].Value.([]byte); len(v) != 0 {
+		t.Errorf("Octet strings share their backing array: %q", v)
+	}
+
+	msg := encodeResponse(t, testPDUs, 1, gosnmp.NoError)
+	for _, b := range [][]byte{
+		encodeResponse(t, []gosnmp.SnmpPDU{{Name: ".1.3.6.1.4.1.2021.10.1.6.1", Type: gosnmp.OpaqueFloat, Value: float32(0.5)}}, 1, gosnmp.NoError),
+		msg[:len(msg)-1],
+		append(msg, 0),
+		{},
+	} {
+		if err := decodeResponse(b, got); err != errNotFast {
+			t.Errorf("Expected the response % x to be left to gosnmp, got %v", b, err)
+		}
+	}
+}
+
+// fakeAgent answers gets, get-nexts and get-bulks for the PDUs over UDP.
+// Before each response it sends one with a wrong request ID, which must be
+// skipped.
+func fakeAgent(t *testing.T, pdus []gosnmp.SnmpPDU) string {
+	sorted := append([]gosnmp.SnmpPDU(nil), pdus...)
+	sort.Slice(sorted, func(i, j int) bool { return compareOids(sorted[i].Name, sorted[j].Name) < 0 })
+	next := func(oid string) gosnmp.SnmpPDU {
+		for _, pdu := range sorted {
+			if compareOids(pdu.Name, oid) > 0 {
+				return pdu
+			}
+		}
+		return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		x := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request, err := x.SnmpDecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			var vars []gosnmp.SnmpPDU
+			for _, v := range request.Variables {
+				switch request.PDUType {
+				case gosnmp.GetRequest:
+					pdu := gosnmp.SnmpPDU{Name: v.Name, Type: gosnmp.NoSuchObject}
+					for _, p := range sorted {
+						if p.Name == v.Name {
+							pdu = p
+						}
+					}
+					vars = append(vars, pdu)
+				case gosnmp.GetNextRequest:
+					vars = append(vars, next(v.Name))
+				case gosnmp.GetBulkRequest:
+					oid := v.Name
+					for i := uint32(0); i < request.MaxRepetitions; i++ {
+						pdu := next(oid)
+						vars = append(vars, pdu)
+						if pdu.Type == gosnmp.EndOfMibView {
+							break
+						}
+						oid = pdu.Name
+					}
+				}
+			}
+			conn.WriteTo(encodeResponse(t, vars[:1], request.RequestID+1000, gosnmp.NoError), from)
+			conn.WriteTo(encodeResponse(t, vars, request.RequestID, gosnmp.NoError), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestFastCodec(t *testing.T) {
+	pdus := append([]gosnmp.SnmpPDU(nil), testPDUs[:11]...)
+	pdus = append(pdus, gosnmp.SnmpPDU{Name: ".1.3.6.1.4.1.2021.10.1.6.1", Type: gosnmp.OpaqueFloat, Value: float32(0.5)})
+	for i := 1; i <= 100; i++ {
+		pdus = append(pdus, gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.2.%d", i), Type: gosnmp.OctetString, Value: []byte(fmt.Sprintf("eth%d", i))})
+	}
+	target := fakeAgent(t, pdus)
+	scrape := func(version gosnmp.SnmpVersion, fast bool) ([][]gosnmp.SnmpPDU, *gosnmp.SnmpPacket) {
+		client, err := NewGoSNMP(log.NewNopLogger(), target, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fast {
+			client.UseFastCodec()
+		}
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.Version = version
+			g.Community = "public"
+			g.MaxRepetitions = 7
+			g.Timeout = time.Second
+			g.Context = context.Background()
+		})
+		if err := client.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if client.fast() != fast {
+			t.Fatalf("Expected the fast codec to be used: %t", fast)
+		}
+		var walks [][]gosnmp.SnmpPDU
+		for _, oid := range []string{"1.3.6.1.2.1", "1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.1.3.0", "1.3.6.1.4.1", "1.3.6.1.2.1.99"} {
+			results, err := client.WalkAll(oid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			walks = append(walks, results)
+		}
+		packet, err := client.Get([]string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.9.0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return walks, packet
+	}
+	for _, version := range []gosnmp.SnmpVersion{gosnmp.Version1, gosnmp.Version2c} {
+		wantWalks, wantGet := scrape(version, false)
+		gotWalks, gotGet := scrape(version, true)
+		// All but the two PDUs under enterprises.
+		if len(wantWalks[0]) != len(pdus)-2 {
+			t.Errorf("Expected gosnmp to walk %d PDUs, got %d", len(pdus)-2, len(wantWalks[0]))
+		}
+		if !reflect.DeepEqual(gotWalks, wantWalks) {
+			t.Errorf("Walks differ from gosnmp for %s: got %v, want %v", version, gotWalks, wantWalks)
+		}
+		if !reflect.DeepEqual(gotGet.Variables, wantGet.Variables) {
+			t.Errorf("Get differs from gosnmp for %s: got %v, want %v", version, gotGet.Variables, wantGet.Variables)
+		}
+	}
+
+	// An agent which never answers times out after the retries.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	client, err := NewGoSNMP(log.NewNopLogger(), silent.LocalAddr().String(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.UseFastCodec()
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Version = gosnmp.Version2c
+		g.Community = "public"
+		g.Retries = 1
+		g.Timeout = 10 * time.Millisecond
+		g.Context = context.Background()
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Get([]string{"1.3.6.1.2.1.1.1.0"}); err == nil || !strings.Contains(err.Error(), "request timeout (after 1 retries)") {
+		t.Errorf("Expected a timeout after the retries, got %v", err)
+	}
+}
+
+func TestWalkPage(t *testing.T) {
+	var pdus []gosnmp.SnmpPDU
+	for i := 1; i <= 100; i++ {
+		pdus = append(pdus, gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.2.%d", i), Type: gosnmp.OctetString, Value: []byte(fmt.Sprintf("eth%d", i))})
+	}
+	pdus = append(pdus, gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.3.1", Type: gosnmp.Integer, Value: 6})
+	client, err := NewGoSNMP(log.NewNopLogger(), fakeAgent(t, pdus), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Version = gosnmp.Version2c
+		g.Community = "public"
+		g.MaxRepetitions = 7
+		g.Timeout = time.Second
+		g.Context = context.Background()
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var walked []gosnmp.SnmpPDU
+	from := ""
+	for page := 1; ; page++ {
+		results, complete, err := client.WalkPage("1.3.6.1.2.1.2.2.1.2", from, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		walked = append(walked, results...)
+		if complete {
+			if page != 4 {
+				t.Errorf("Expected 4 pages, got %d", page)
+			}
+			break
+		}
+		if len(results) != 30 {
+			t.Fatalf("Expected a page of 30 PDUs, got %d", len(results))
+		}
+		from = results[len(results)-1].Name
+	}
+	all, err := client.WalkAll("1.3.6.1.2.1.2.2.1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 100 || !reflect.DeepEqual(walked, all) {
+		t.Errorf("Pages differ from the walk: got %d PDUs, want %d", len(walked), len(all))
+	}
+}
+
+func BenchmarkDecodeResponse(b *testing.B) {
+	var pdus []gosnmp.SnmpPDU
+	for i := 1; i <= 25; i++ {
+		pdus = append(pdus,
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.31.1.1.1.6.%d", i), Type: gosnmp.Counter64, Value: uint64(i) << 40},
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.31.1.1.1.1.%d", i), Type: gosnmp.OctetString, Value: []byte(fmt.Sprintf("GigabitEthernet0/%d", i))})
+	}
+	msg := encodeResponse(b, pdus, 1, gosnmp.NoError)
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := decodeResponse(msg, &gosnmp.SnmpPacket{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("gosnmp", func(b *testing.B) {
+		x := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := x.SnmpDecodePacket(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkAppendRequest(b *testing.B) {
+	oids := []string{".1.3.6.1.2.1.31.1.1.1.6.25"}
+	b.Run("fast", func(b *testing.B) {
+		buf := make([]byte, 0, maxMessageSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := appendRequest(buf, gosnmp.Version2c, "public", gosnmp.GetBulkRequest, 1, 0, 25, oids); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("gosnmp", func(b *testing.B) {
+		x := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"}
+		pdus := []gosnmp.SnmpPDU{{Name: oids[0], Type: gosnmp.Null}}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := x.SnmpEncodePacket(gosnmp.GetBulkRequest, pdus, 0, 25); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -15,9 +15,13 @@ package scraper
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	stdlog "log"
+	"math/rand"
 	"net"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -27,9 +31,38 @@ import (
 	"github.com/gosnmp/gosnmp"
 )
 
+// Reported by SNMPv3 agents when the engine boots or time of a request are
+// outside of their time window, e.g. after the agent restarted.
+const usmStatsNotInTimeWindows = "1.3.6.1.6.3.15.1.1.2.0"
+
+// Defaults of gosnmp's walks.
+const (
+	baseOid               = ".1.3.6.1.2.1"
+	defaultMaxRepetitions = 50
+)
+
 type GoSNMPWrapper struct {
-	c      *gosnmp.GoSNMP
-	logger log.Logger
+	c         *gosnmp.GoSNMP
+	logger    log.Logger
+	onResync  func()
+	onAnomaly func(string)
+	// Interval of progress logs of walks, and the fraction of walks logged.
+	progressInterval time.Duration
+	progressSample   float64
+	// The host requests are for, which differs from the host of c when
+	// they are relayed through a proxy.
+	target string
+	proxy  *proxyOptions
+	relay  *socksRelay
+	// Whether requests are encoded and decoded by the codec of this
+	// package, and the ID of its last request.
+	fastCodec bool
+	debug     bool
+	requestID uint32
+}
+
+type proxyOptions struct {
+	address, username, password string
 }
 
 func NewGoSNMP(logger log.Logger, target, srcAddress string, debug bool) (*GoSNMPWrapper, error) {
@@ -56,7 +89,25 @@ func NewGoSNMP(logger log.Logger, target, srcAddress string, debug bool) (*GoSNM
 	if debug {
 		g.Logger = gosnmp.NewLogger(stdlog.New(log.NewStdlibAdapter(level.Debug(logger)), "", 0))
 	}
-	return &GoSNMPWrapper{c: g, logger: logger}, nil
+	return &GoSNMPWrapper{c: g, logger: logger, target: target, debug: debug, requestID: rand.Uint32()}, nil
+}
+
+// BindToDevice sends requests from the network interface or VRF device.
+func (g *GoSNMPWrapper) BindToDevice(device string) {
+	g.c.Control = bindToDevice(device)
+}
+
+// UseSOCKS5 relays requests through the SOCKS5 proxy at the address, which
+// must support UDP ASSOCIATE. Only UDP targets can be relayed.
+func (g *GoSNMPWrapper) UseSOCKS5(address, username, password string) {
+	g.proxy = &proxyOptions{address: address, username: username, password: password}
+}
+
+// UseFastCodec encodes and decodes the requests of SNMPv1 and SNMPv2c
+// targets with the pooled codec of this package rather than gosnmp's. It is
+// not used with packet debugging, which needs the traces of gosnmp.
+func (g *GoSNMPWrapper) UseFastCodec() {
+	g.fastCodec = true
 }
 
 func (g *GoSNMPWrapper) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
@@ -67,31 +118,321 @@ func (g *GoSNMPWrapper) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
 
 func (g *GoSNMPWrapper) Connect() error {
 	st := time.Now()
-	err := g.c.Connect()
+	err := g.connectProxy()
+	if err == nil {
+		err = g.c.Connect()
+		if g.relay != nil {
+			if err != nil {
+				g.relay.Close()
+			} else {
+				g.relay.Pin(g.c.Conn.LocalAddr())
+			}
+		}
+	}
 	if err != nil {
 		if err == context.Canceled {
-			return fmt.Errorf("scrape cancelled after %s (possible timeout) connecting to target %s",
-				time.Since(st), g.c.Target)
+			return fmt.Errorf("scrape cancelled after %s (possible timeout) connecting to target %s: %w",
+				time.Since(st), g.target, err)
 		}
-		return fmt.Errorf("error connecting to target %s: %s", g.c.Target, err)
+		return fmt.Errorf("error connecting to target %s: %w", g.target, err)
 	}
 	return nil
 }
 
+// connectProxy starts relaying through the proxy if one is used, and points
+// gosnmp at the relay.
+func (g *GoSNMPWrapper) connectProxy() error {
+	if g.proxy == nil {
+		return nil
+	}
+	if g.c.Transport != "udp" {
+		return fmt.Errorf("only udp targets can be reached through a SOCKS5 proxy, not %s", g.c.Transport)
+	}
+	ctx := g.c.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	relay, err := newSOCKSRelay(ctx, g.proxy.address, g.proxy.username, g.proxy.password, g.c.Target, g.c.Port, g.c.Timeout)
+	if err != nil {
+		return err
+	}
+	g.relay = relay
+	addr := relay.Addr()
+	g.c.Target, g.c.Port = addr.IP.String(), uint16(addr.Port)
+	// The source address applies to the connection to the proxy, which the
+	// operating system picks.
+	g.c.LocalAddr = ""
+	return nil
+}
+
 func (g *GoSNMPWrapper) Close() error {
+	if g.relay != nil {
+		g.relay.Close()
+	}
 	return g.c.Conn.Close()
 }
 
+// OnResync sets a function called whenever the SNMPv3 engine time of the
+// target is resynchronized.
+func (g *GoSNMPWrapper) OnResync(fn func()) {
+	g.onResync = fn
+}
+
+// OnAnomaly sets a function called with the kind of each anomaly of the
+// agent detected during walks, such as duplicate OIDs.
+func (g *GoSNMPWrapper) OnAnomaly(fn func(string)) {
+	g.onAnomaly = fn
+}
+
+// LogWalkProgress logs the current OID, rows and bytes of walks every
+// interval at debug level while they run, for the fraction sample of walks.
+func (g *GoSNMPWrapper) LogWalkProgress(interval time.Duration, sample float64) {
+	g.progressInterval = interval
+	g.progressSample = sample
+}
+
+// notInTimeWindow reports whether a request failed because the engine boots
+// or time of the target changed. gosnmp retries such a request once, but
+// gives up if the agent rejects that as well.
+func notInTimeWindow(packet *gosnmp.SnmpPacket, err error) bool {
+	if errors.Is(err, gosnmp.ErrNotInTimeWindow) {
+		return true
+	}
+	return err == nil && packet != nil && packet.PDUType == gosnmp.Report && len(packet.Variables) == 1 &&
+		strings.TrimPrefix(packet.Variables[0].Name, ".") == usmStatsNotInTimeWindows
+}
+
+// resync forgets the engine ID, boots and time of an SNMPv3 target, so that
+// they are discovered again by the next request.
+func (g *GoSNMPWrapper) resync() {
+	sp, ok := g.c.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return
+	}
+	level.Info(g.logger).Log("msg", "Resynchronizing SNMPv3 engine time", "target", g.target, "engine_boots", sp.AuthoritativeEngineBoots)
+	sp.AuthoritativeEngineID = ""
+	sp.AuthoritativeEngineBoots = 0
+	sp.AuthoritativeEngineTime = 0
+	if g.onResync != nil {
+		g.onResync()
+	}
+}
+
+// LocalAddr returns the local address of the connection to the target.
+func (g *GoSNMPWrapper) LocalAddr() string {
+	if g.c.Conn == nil {
+		return ""
+	}
+	return g.c.Conn.LocalAddr().String()
+}
+
+// fast reports whether requests go through the codec of this package,
+// which handles SNMPv1 and SNMPv2c over connected UDP sockets.
+func (g *GoSNMPWrapper) fast() bool {
+	return g.fastCodec && !g.debug && (g.c.Version == gosnmp.Version1 || g.c.Version == gosnmp.Version2c) &&
+		strings.HasPrefix(g.c.Transport, "udp") && !g.c.UseUnconnectedUDPSocket && g.c.Conn != nil
+}
+
+func (g *GoSNMPWrapper) maxRepetitions() uint32 {
+	if g.c.MaxRepetitions == 0 {
+		return defaultMaxRepetitions
+	}
+	return g.c.MaxRepetitions
+}
+
+// request sends a request of the type for the OIDs and returns the
+// response.
+func (g *GoSNMPWrapper) request(pduType gosnmp.PDUType, oids []string) (*gosnmp.SnmpPacket, error) {
+	if !g.fast() {
+		switch pduType {
+		case gosnmp.GetBulkRequest:
+			return g.c.GetBulk(oids, uint8(g.c.NonRepeaters), g.maxRepetitions())
+		case gosnmp.GetNextRequest:
+			return g.c.GetNext(oids)
+		}
+		return g.c.Get(oids)
+	}
+	if len(oids) > g.c.MaxOids {
+		return nil, fmt.Errorf("oid count (%d) is greater than MaxOids (%d)", len(oids), g.c.MaxOids)
+	}
+	var nonRepeaters, maxRepetitions uint32
+	if pduType == gosnmp.GetBulkRequest {
+		nonRepeaters, maxRepetitions = uint32(uint8(g.c.NonRepeaters)), g.maxRepetitions()
+	}
+	out := messagePool.Get().(*[]byte)
+	defer messagePool.Put(out)
+	in := messagePool.Get().(*[]byte)
+	defer messagePool.Put(in)
+
+	// Retries, timeouts and callbacks follow gosnmp.
+	x := g.c
+	if x.Retries < 0 {
+		x.Retries = 0
+	}
+	var sentBuf [8]uint32
+	sent := sentBuf[:0]
+	timeout := x.Timeout
+	withContextDeadline := false
+	var err error
+	for retries := 0; ; retries++ {
+		if retries > 0 {
+			if x.OnRetry != nil {
+				x.OnRetry(x)
+			}
+			if withContextDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, context.DeadlineExceeded
+			}
+			if retries > x.Retries {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					err = fmt.Errorf("request timeout (after %d retries)", retries-1)
+				}
+				return nil, err
+			}
+			if x.ExponentialTimeout {
+				timeout *= 2
+			}
+			withContextDeadline = false
+		}
+		if err := x.Context.Err(); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := x.Context.Deadline(); ok && d.Before(deadline) {
+			deadline, withContextDeadline = d, true
+		}
+		if err := x.Conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		g.requestID = (g.requestID + 1) & 0x7fffffff
+		sent = append(sent, g.requestID)
+		var msg []byte
+		if msg, err = appendRequest((*out)[:0], x.Version, x.Community, pduType, g.requestID, nonRepeaters, maxRepetitions, oids); err != nil {
+			return nil, fmt.Errorf("marshal: %w", err)
+		}
+		if x.PreSend != nil {
+			x.PreSend(x)
+		}
+		if _, err = x.Conn.Write(msg); err != nil {
+			continue
+		}
+		if x.OnSent != nil {
+			x.OnSent(x)
+		}
+		var result *gosnmp.SnmpPacket
+		if result, err = g.receive((*in)[:cap(*in)], sent); err != nil {
+			continue
+		}
+		if x.OnFinish != nil {
+			x.OnFinish(x)
+		}
+		return result, nil
+	}
+}
+
+// receive reads datagrams into buf until the response to one of the sent
+// request IDs arrives.
+func (g *GoSNMPWrapper) receive(buf []byte, sent []uint32) (*gosnmp.SnmpPacket, error) {
+	for {
+		n, err := g.c.Conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading from socket: %w", err)
+		}
+		if n == len(buf) {
+			return nil, errors.New("response buffer too small")
+		}
+		if g.c.OnRecv != nil {
+			g.c.OnRecv(g.c)
+		}
+		result := &gosnmp.SnmpPacket{Logger: g.c.Logger}
+		err = decodeResponse(buf[:n], result)
+		if errors.Is(err, errNotFast) {
+			// The PDUs gosnmp decodes refer to the message, which must not
+			// be the pooled buffer.
+			result, err = g.c.SnmpDecodePacket(append([]byte(nil), buf[:n]...))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if result.Error == gosnmp.NoError && len(result.Variables) == 0 {
+			return result, nil
+		}
+		if result.RequestID == 0 || slices.Contains(sent, result.RequestID) {
+			return result, nil
+		}
+	}
+}
+
+// walk walks the subtree of root like gosnmp's BulkWalk, or Walk for
+// SNMPv1, calling fn for each PDU. The walk starts after the OID from if it
+// is set, rather than at the start of the subtree.
+func (g *GoSNMPWrapper) walk(root, from string, fn gosnmp.WalkFunc) error {
+	if root == "" || root == "." {
+		root = baseOid
+	}
+	if !strings.HasPrefix(root, ".") {
+		root = "." + root
+	}
+	pduType := gosnmp.GetBulkRequest
+	if g.c.Version == gosnmp.Version1 {
+		pduType = gosnmp.GetNextRequest
+	}
+	// AppOpt 'c': do not check returned OIDs are increasing.
+	_, noCheck := g.c.AppOpts["c"]
+	oid := root
+	if from != "" {
+		oid = "." + strings.TrimPrefix(from, ".")
+	}
+request:
+	for requests := 1; ; requests++ {
+		response, err := g.request(pduType, []string{oid})
+		if err != nil {
+			return err
+		}
+		// Errors other than those known to gosnmp do not end its walks.
+		if len(response.Variables) == 0 || (response.Error != gosnmp.NoError && response.Error <= gosnmp.InconsistentName) {
+			return nil
+		}
+		for i, pdu := range response.Variables {
+			switch pdu.Type {
+			case gosnmp.EndOfMibView, gosnmp.NoSuchObject, gosnmp.NoSuchInstance:
+				return nil
+			}
+			if !strings.HasPrefix(pdu.Name, root+".") {
+				switch {
+				case requests == 1 && i == 0 && from == "":
+					// The root is a leaf, which only a get returns.
+					pduType = gosnmp.GetRequest
+					continue request
+				case pdu.Name == root:
+					return fn(pdu)
+				}
+				return nil
+			}
+			if !noCheck && pdu.Name == oid {
+				return fmt.Errorf("OID not increasing: %s", pdu.Name)
+			}
+			if err := fn(pdu); err != nil {
+				return err
+			}
+		}
+		oid = response.Variables[len(response.Variables)-1].Name
+	}
+}
+
 func (g *GoSNMPWrapper) Get(oids []string) (results *gosnmp.SnmpPacket, err error) {
 	level.Debug(g.logger).Log("msg", "Getting OIDs", "oids", oids)
 	st := time.Now()
-	results, err = g.c.Get(oids)
+	results, err = g.request(gosnmp.GetRequest, oids)
+	if g.c.Version == gosnmp.Version3 && notInTimeWindow(results, err) {
+		g.resync()
+		results, err = g.request(gosnmp.GetRequest, oids)
+	}
 	if err != nil {
 		if err == context.Canceled {
-			err = fmt.Errorf("scrape cancelled after %s (possible timeout) getting target %s",
-				time.Since(st), g.c.Target)
+			err = fmt.Errorf("scrape cancelled after %s (possible timeout) getting target %s: %w",
+				time.Since(st), g.target, err)
 		} else {
-			err = fmt.Errorf("error getting target %s: %s", g.c.Target, err)
+			err = fmt.Errorf("error getting target %s: %w", g.target, err)
 		}
 		return
 	}
@@ -101,21 +442,88 @@ func (g *GoSNMPWrapper) Get(oids []string) (results *gosnmp.SnmpPacket, err erro
 
 func (g *GoSNMPWrapper) WalkAll(oid string) (results []gosnmp.SnmpPDU, err error) {
 	level.Debug(g.logger).Log("msg", "Walking subtree", "oid", oid)
+	results, _, err = g.walkFrom(oid, "", 0)
+	return
+}
+
+var errWalkLimit = errors.New("walk limit reached")
+
+// WalkLimit walks the subtree like WalkAll, but stops once limit PDUs were
+// returned. It reports whether the walk completed.
+func (g *GoSNMPWrapper) WalkLimit(oid string, limit int) ([]gosnmp.SnmpPDU, bool, error) {
+	level.Debug(g.logger).Log("msg", "Walking subtree", "oid", oid, "limit", limit)
+	return g.walkFrom(oid, "", limit)
+}
+
+// WalkPage walks the subtree from the OID after from, or from its start if
+// from is empty, stopping once limit PDUs were returned. It reports whether
+// the walk reached the end of the subtree, so that the next page starts
+// over.
+func (g *GoSNMPWrapper) WalkPage(oid, from string, limit int) ([]gosnmp.SnmpPDU, bool, error) {
+	level.Debug(g.logger).Log("msg", "Walking page of subtree", "oid", oid, "from", from, "limit", limit)
+	return g.walkFrom(oid, from, limit)
+}
+
+// walkFrom walks the subtree after the OID from, stopping once limit PDUs
+// were returned if limit is positive. Duplicates are dropped, an SNMPv3
+// walk failing on the engine time is retried once resynchronized, and it
+// reports whether the walk completed. Walks from the start of the subtree
+// are gosnmp's, unless requests go through the codec of this package.
+func (g *GoSNMPWrapper) walkFrom(oid, from string, limit int) ([]gosnmp.SnmpPDU, bool, error) {
 	st := time.Now()
+	// Each request returns up to MaxRepetitions OIDs, so that many duplicates
+	// in a row mean the next request would start from a known OID again.
+	walkFunc, maxDuplicates := g.c.BulkWalk, int(g.c.MaxRepetitions)
 	if g.c.Version == gosnmp.Version1 {
-		results, err = g.c.WalkAll(oid)
-	} else {
-		results, err = g.c.BulkWalkAll(oid)
+		walkFunc, maxDuplicates = g.c.Walk, 1
+	}
+	if g.fast() || from != "" {
+		walkFunc = func(oid string, fn gosnmp.WalkFunc) error {
+			return g.walk(oid, from, fn)
+		}
+	}
+	walk := func() ([]gosnmp.SnmpPDU, bool, error) {
+		guard := newWalkGuard(maxDuplicates, g.onAnomaly)
+		add := guard.add
+		if g.progressInterval > 0 && rand.Float64() < g.progressSample {
+			progress := &walkProgress{}
+			stop := make(chan struct{})
+			defer close(stop)
+			go progress.log(g.logger, oid, g.progressInterval, stop)
+			add = func(pdu gosnmp.SnmpPDU) error {
+				progress.add(pdu)
+				return guard.add(pdu)
+			}
+		}
+		err := walkFunc(oid, func(pdu gosnmp.SnmpPDU) error {
+			if limit > 0 && len(guard.results) >= limit {
+				return errWalkLimit
+			}
+			return add(pdu)
+		})
+		switch {
+		case errors.Is(err, errWalkLimit):
+			return guard.results, false, nil
+		case errors.Is(err, errWalkLoop):
+			level.Debug(g.logger).Log("msg", "Agent returned only duplicates, ending walk", "oid", oid)
+			return guard.results, true, nil
+		}
+		return guard.results, err == nil, err
+	}
+	results, complete, err := walk()
+	if g.c.Version == gosnmp.Version3 && notInTimeWindow(nil, err) {
+		g.resync()
+		results, complete, err = walk()
 	}
 	if err != nil {
 		if err == context.Canceled {
-			err = fmt.Errorf("scrape canceled after %s (possible timeout) walking target %s",
-				time.Since(st), g.c.Target)
+			err = fmt.Errorf("scrape canceled after %s (possible timeout) walking target %s: %w",
+				time.Since(st), g.target, err)
 		} else {
-			err = fmt.Errorf("error walking target %s: %s", g.c.Target, err)
+			err = fmt.Errorf("error walking target %s: %w", g.target, err)
 		}
-		return
+		return results, false, err
 	}
-	level.Debug(g.logger).Log("msg", "Walk of subtree completed", "oid", oid, "duration_seconds", time.Since(st))
-	return
+	level.Debug(g.logger).Log("msg", "Walk of subtree completed", "oid", oid, "complete", complete, "duration_seconds", time.Since(st))
+	return results, complete, nil
 }
@@ -72,6 +72,25 @@ func (m *mockSNMPScraper) WalkAll(baseOID string) ([]gosnmp.SnmpPDU, error) {
 	return nil, nil
 }
 
+func (m *mockSNMPScraper) WalkPage(baseOID, from string, limit int) ([]gosnmp.SnmpPDU, bool, error) {
+	m.callWalk = append(m.callWalk, baseOID)
+	pdus := m.WalkResponses[baseOID]
+	start := 0
+	if from != "" {
+		for start < len(pdus) && pdus[start].Name != from {
+			start++
+		}
+		start++
+	}
+	if start+limit < len(pdus) {
+		return pdus[start : start+limit], false, nil
+	}
+	if start > len(pdus) {
+		start = len(pdus)
+	}
+	return pdus[start:], true, nil
+}
+
 func (m *mockSNMPScraper) Connect() error {
 	return m.ConnectError
 }
@@ -82,3 +101,7 @@ func (m *mockSNMPScraper) Close() error {
 
 func (m *mockSNMPScraper) SetOptions(...func(*gosnmp.GoSNMP)) {
 }
+
+func (m *mockSNMPScraper) LocalAddr() string {
+	return ""
+}
@@ -23,4 +23,5 @@ type SNMPScraper interface {
 	Connect() error
 	Close() error
 	SetOptions(...func(*gosnmp.GoSNMP))
+	LocalAddr() string
 }
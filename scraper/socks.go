@@ -0,0 +1,294 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion          = 0x05
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+	socksCmdUDPAssociate  = 0x03
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+)
+
+// socksAddr encodes the address and port as ATYP, DST.ADDR and DST.PORT.
+// Hostnames are left for the proxy to resolve, as the exporter may not be
+// able to resolve names of the network behind it.
+func socksAddr(host string, port uint16) ([]byte, error) {
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname %q too long for SOCKS5", host)
+		}
+		b = append([]byte{socksAtypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAtypIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksAtypIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, port), nil
+}
+
+// readSocksAddr reads an address as encoded by socksAddr.
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		host = make([]byte, net.IPv4len)
+	case socksAtypIPv6:
+		host = make([]byte, net.IPv6len)
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", err
+		}
+		host = make([]byte, l[0])
+	default:
+		return "", fmt.Errorf("unknown SOCKS5 address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	if atyp[0] != socksAtypDomain {
+		host = []byte(net.IP(host).String())
+	}
+	return net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksUDPPayload returns the data of a datagram received from the relay,
+// stripping the RSV, FRAG and address header.
+func socksUDPPayload(b []byte) ([]byte, error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return nil, errors.New("invalid SOCKS5 UDP header")
+	}
+	if b[2] != 0 {
+		return nil, errors.New("fragmented SOCKS5 UDP datagrams are not supported")
+	}
+	r := bytes.NewReader(b[3:])
+	if _, err := readSocksAddr(r); err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 UDP header: %w", err)
+	}
+	return b[len(b)-r.Len():], nil
+}
+
+// socksAssociate authenticates on the control connection to the proxy and
+// requests a UDP association, returning the address of the relay.
+func socksAssociate(conn net.Conn, username, password string) (*net.UDPAddr, error) {
+	methods := []byte{socksAuthNone}
+	if username != "" {
+		methods = append(methods, socksAuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != socksVersion {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if username == "" {
+			return nil, errors.New("SOCKS5 proxy requires a username and password")
+		}
+		req := append([]byte{0x01, byte(len(username))}, username...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0 {
+			return nil, errors.New("SOCKS5 proxy rejected the username and password")
+		}
+	case socksAuthNoAcceptable:
+		return nil, errors.New("SOCKS5 proxy accepts none of the authentication methods")
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy selected unsupported authentication method %d", reply[1])
+	}
+
+	// The address datagrams will be sent from is not known yet.
+	if _, err := conn.Write([]byte{socksVersion, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	if header[1] != 0 {
+		return nil, fmt.Errorf("SOCKS5 proxy refused UDP associate with reply code %d", header[1])
+	}
+	addr, err := readSocksAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	// The relay address is hardly ever a name, but is allowed to be.
+	relay, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Proxies commonly answer with an unspecified address, meaning their own.
+	if relay.IP.IsUnspecified() {
+		relay.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return relay, nil
+}
+
+// socksRelay forwards datagrams sent to a local address to the target
+// through a SOCKS5 proxy and back, so that gosnmp can talk to the local
+// address as if it was the target.
+type socksRelay struct {
+	control  net.Conn
+	upstream *net.UDPConn
+	local    *net.UDPConn
+	// Prepended to datagrams to the target.
+	header []byte
+
+	mu sync.Mutex
+	// The socket of gosnmp, the only one relayed for.
+	client net.Addr
+}
+
+// newSOCKSRelay associates with the proxy and starts relaying datagrams to
+// the target.
+func newSOCKSRelay(ctx context.Context, proxy, username, password, host string, port uint16, timeout time.Duration) (*socksRelay, error) {
+	header, err := socksAddr(host, port)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	control, err := dialer.DialContext(ctx, "tcp", proxy)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SOCKS5 proxy %s: %w", proxy, err)
+	}
+	r := &socksRelay{control: control, header: append([]byte{0, 0, 0}, header...)}
+	if deadline, ok := ctx.Deadline(); ok {
+		control.SetDeadline(deadline)
+	} else if timeout > 0 {
+		control.SetDeadline(time.Now().Add(timeout))
+	}
+	relay, err := socksAssociate(control, username, password)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("error associating with SOCKS5 proxy %s: %w", proxy, err)
+	}
+	control.SetDeadline(time.Time{})
+	if r.upstream, err = net.DialUDP("udp", nil, relay); err != nil {
+		control.Close()
+		return nil, err
+	}
+	if r.local, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		r.upstream.Close()
+		control.Close()
+		return nil, err
+	}
+	go r.toTarget()
+	go r.fromTarget()
+	// The association ends when the control connection is closed, by either
+	// side.
+	go func() {
+		io.Copy(io.Discard, control)
+		r.Close()
+	}()
+	return r, nil
+}
+
+// Addr returns the local address gosnmp should send requests to.
+func (r *socksRelay) Addr() *net.UDPAddr {
+	return r.local.LocalAddr().(*net.UDPAddr)
+}
+
+// Pin sets the local address of the socket of gosnmp. Datagrams from any
+// other local process are dropped, as they would otherwise reach the target
+// with the exporter's association.
+func (r *socksRelay) Pin(client net.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.client = client
+}
+
+func (r *socksRelay) toTarget() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := r.local.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		client := r.client
+		r.mu.Unlock()
+		if client == nil || addr.String() != client.String() {
+			continue
+		}
+		r.upstream.Write(append(append([]byte{}, r.header...), buf[:n]...))
+	}
+}
+
+func (r *socksRelay) fromTarget() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := r.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		payload, err := socksUDPPayload(buf[:n])
+		if err != nil {
+			continue
+		}
+		r.mu.Lock()
+		client := r.client
+		r.mu.Unlock()
+		if client != nil {
+			r.local.WriteTo(payload, client)
+		}
+	}
+}
+
+// Close ends the association and stops relaying.
+func (r *socksRelay) Close() error {
+	r.local.Close()
+	r.upstream.Close()
+	return r.control.Close()
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSOCKS5 serves a single UDP association, authenticating with the
+// username and password if set, and relays datagrams for any destination.
+func fakeSOCKS5(t *testing.T, username, password string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		methods := make([]byte, greeting[1])
+		io.ReadFull(conn, methods)
+		method := byte(socksAuthNone)
+		if username != "" {
+			method = socksAuthPassword
+		}
+		if !bytes.Contains(methods, []byte{method}) {
+			conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+			return
+		}
+		conn.Write([]byte{socksVersion, method})
+		if method == socksAuthPassword {
+			b := make([]byte, 2)
+			io.ReadFull(conn, b)
+			user := make([]byte, b[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, b[:1])
+			pass := make([]byte, b[0])
+			io.ReadFull(conn, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+		req := make([]byte, 10)
+		if _, err := io.ReadFull(conn, req); err != nil || req[1] != socksCmdUDPAssociate {
+			return
+		}
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply, _ := socksAddr("0.0.0.0", uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+		conn.Write(append([]byte{socksVersion, 0, 0}, reply...))
+		go func() {
+			buf := make([]byte, 65535)
+			var client net.Addr
+			for {
+				n, from, err := relay.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if client != nil && from.String() != client.String() {
+					// A reply from the destination.
+					header, _ := socksAddr(from.(*net.UDPAddr).IP.String(), uint16(from.(*net.UDPAddr).Port))
+					relay.WriteTo(append(append([]byte{0, 0, 0}, header...), buf[:n]...), client)
+					continue
+				}
+				client = from
+				r := bytes.NewReader(buf[3:n])
+				addr, err := readSocksAddr(r)
+				if err != nil {
+					return
+				}
+				dst, err := net.ResolveUDPAddr("udp", addr)
+				if err != nil {
+					return
+				}
+				relay.WriteTo(buf[n-r.Len():n], dst)
+			}
+		}()
+		io.Copy(io.Discard, conn)
+	}()
+	return l.Addr().String()
+}
+
+// udpEcho answers each datagram with its content reversed.
+func udpEcho(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply := make([]byte, n)
+			for i := range reply {
+				reply[i] = buf[n-1-i]
+			}
+			conn.WriteTo(reply, from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestSOCKSRelay(t *testing.T) {
+	cases := []struct {
+		name               string
+		serverUser         string
+		serverPassword     string
+		username, password string
+		err                string
+	}{
+		{name: "no auth"},
+		{name: "password", serverUser: "jump", serverPassword: "secret", username: "jump", password: "secret"},
+		{name: "wrong password", serverUser: "jump", serverPassword: "secret", username: "jump", password: "wrong", err: "rejected the username and password"},
+		{name: "missing password", serverUser: "jump", serverPassword: "secret", err: "accepts none of the authentication methods"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := fakeSOCKS5(t, c.serverUser, c.serverPassword)
+			agent := udpEcho(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			relay, err := newSOCKSRelay(ctx, proxy, c.username, c.password, agent.IP.String(), uint16(agent.Port), time.Second)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("Expected error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer relay.Close()
+
+			// Other local sockets are not relayed for.
+			other, err := net.DialUDP("udp", nil, relay.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Close()
+			conn, err := net.DialUDP("udp", nil, relay.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			relay.Pin(conn.LocalAddr())
+			other.SetDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := other.Write([]byte("intruder")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := other.Read(make([]byte, 100)); err == nil {
+				t.Error("Expected datagrams from another socket to be dropped")
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 100)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != "tseuqer" {
+				t.Errorf("Expected reply %q through the proxy, got %q", "tseuqer", got)
+			}
+		})
+	}
+}
+
+func TestSOCKSUDPPayload(t *testing.T) {
+	for _, host := range []string{"192.0.2.1", "2001:db8::1", "switch1.example.com"} {
+		header, err := socksAddr(host, 161)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := socksUDPPayload(append(append([]byte{0, 0, 0}, header...), "pdu"...))
+		if err != nil || string(payload) != "pdu" {
+			t.Errorf("Expected payload %q for %s, got %q: %v", "pdu", host, payload, err)
+		}
+	}
+	if _, err := socksUDPPayload([]byte{0, 0, 1, socksAtypIPv4, 192, 0, 2, 1, 0, 161}); err == nil {
+		t.Error("Expected an error for a fragmented datagram")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gosnmp/gosnmp"
+)
+
+// Anomalies of walks seen with buggy agents.
+const (
+	// An OID returned more than once. Only the first value is kept.
+	AnomalyDuplicate = "duplicate"
+	// An OID returned after a greater one.
+	AnomalyOutOfOrder = "out_of_order"
+	// Nothing but duplicates were returned, the walk would never end.
+	AnomalyLoop = "loop"
+)
+
+var errWalkLoop = errors.New("walk loop")
+
+// walkGuard collects the PDUs of a walk, dropping duplicates and stopping
+// the walk once the agent keeps repeating itself.
+type walkGuard struct {
+	results []gosnmp.SnmpPDU
+	seen    map[string]struct{}
+	last    string
+	// Duplicates in a row, and how many mean the agent is looping.
+	duplicates    int
+	maxDuplicates int
+	onAnomaly     func(string)
+}
+
+func newWalkGuard(maxDuplicates int, onAnomaly func(string)) *walkGuard {
+	if maxDuplicates < 1 {
+		maxDuplicates = 1
+	}
+	if onAnomaly == nil {
+		onAnomaly = func(string) {}
+	}
+	return &walkGuard{seen: map[string]struct{}{}, maxDuplicates: maxDuplicates, onAnomaly: onAnomaly}
+}
+
+// add is a gosnmp.WalkFunc.
+func (w *walkGuard) add(pdu gosnmp.SnmpPDU) error {
+	if _, ok := w.seen[pdu.Name]; ok {
+		w.onAnomaly(AnomalyDuplicate)
+		w.duplicates++
+		if w.duplicates >= w.maxDuplicates {
+			w.onAnomaly(AnomalyLoop)
+			return errWalkLoop
+		}
+		return nil
+	}
+	w.duplicates = 0
+	w.seen[pdu.Name] = struct{}{}
+	if w.last != "" && compareOids(pdu.Name, w.last) < 0 {
+		w.onAnomaly(AnomalyOutOfOrder)
+	}
+	w.last = pdu.Name
+	w.results = append(w.results, pdu)
+	return nil
+}
+
+// compareOids compares the dotted OIDs a and b arc by arc, without
+// allocating as it runs for every PDU walked.
+func compareOids(a, b string) int {
+	a, b = strings.TrimPrefix(a, "."), strings.TrimPrefix(b, ".")
+	for a != "" && b != "" {
+		var x, y int
+		x, a = nextArc(a)
+		y, b = nextArc(b)
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case a != "":
+		return 1
+	case b != "":
+		return -1
+	}
+	return 0
+}
+
+// nextArc splits the first arc off the dotted OID.
+func nextArc(oid string) (int, string) {
+	arc, rest, _ := strings.Cut(oid, ".")
+	v, _ := strconv.Atoi(arc)
+	return v, rest
+}
+
+// walkProgress tracks a running walk for periodic progress logs.
+type walkProgress struct {
+	mu    sync.Mutex
+	last  string
+	rows  int
+	bytes int
+}
+
+// add is a gosnmp.WalkFunc, counting the PDU and the bytes of its OID and
+// value.
+func (p *walkProgress) add(pdu gosnmp.SnmpPDU) {
+	size := len(pdu.Name)
+	switch v := pdu.Value.(type) {
+	case []byte:
+		size += len(v)
+	case string:
+		size += len(v)
+	case nil:
+	default:
+		size += 8
+	}
+	p.mu.Lock()
+	p.last = pdu.Name
+	p.rows++
+	p.bytes += size
+	p.mu.Unlock()
+}
+
+// log logs the progress of the walk of oid every interval at debug level,
+// until stop is closed.
+func (p *walkProgress) log(logger log.Logger, oid string, interval time.Duration, stop <-chan struct{}) {
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			last, rows, bytes := p.last, p.rows, p.bytes
+			p.mu.Unlock()
+			level.Debug(logger).Log("msg", "Walk in progress", "oid", oid, "current_oid", last, "rows", rows, "bytes", bytes, "duration_seconds", time.Since(start).Seconds())
+		}
+	}
+}
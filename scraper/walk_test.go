@@ -0,0 +1,95 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestWalkGuard(t *testing.T) {
+	anomalies := map[string]int{}
+	guard := newWalkGuard(2, func(kind string) { anomalies[kind]++ })
+	names := []string{".1.1.1", ".1.1.10", ".1.1.2", ".1.1.1", ".1.1.3", ".1.1.2", ".1.1.3"}
+	var err error
+	added := 0
+	for _, name := range names {
+		if err = guard.add(gosnmp.SnmpPDU{Name: name}); err != nil {
+			break
+		}
+		added++
+	}
+	if err != errWalkLoop || added != len(names)-1 {
+		t.Errorf("Expected the walk to be cut at the last PDU, got %v after %d PDUs", err, added)
+	}
+	got := []string{}
+	for _, pdu := range guard.results {
+		got = append(got, pdu.Name)
+	}
+	if expected := []string{".1.1.1", ".1.1.10", ".1.1.2", ".1.1.3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong results: got %v, want %v", got, expected)
+	}
+	if expected := map[string]int{AnomalyDuplicate: 3, AnomalyOutOfOrder: 1, AnomalyLoop: 1}; !reflect.DeepEqual(anomalies, expected) {
+		t.Errorf("Wrong anomalies: got %v, want %v", anomalies, expected)
+	}
+}
+
+func TestWalkProgress(t *testing.T) {
+	var buf syncBuffer
+	progress := &walkProgress{}
+	progress.add(gosnmp.SnmpPDU{Name: ".1.1.1", Value: []byte("eth0")})
+	progress.add(gosnmp.SnmpPDU{Name: ".1.1.2", Value: uint(1)})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		progress.log(log.NewLogfmtLogger(&buf), "1.1", time.Millisecond, stop)
+		close(done)
+	}()
+	for i := 0; i < 1000 && !strings.Contains(buf.String(), "Walk in progress"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	line := buf.String()
+	for _, want := range []string{"oid=1.1", "current_oid=.1.1.2", "rows=2", "bytes=24"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %q in progress log, got %q", want, line)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
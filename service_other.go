@@ -0,0 +1,28 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import "github.com/go-kit/log"
+
+// runServiceCommand handles the commands managing the Windows service, which
+// only exist on Windows.
+func runServiceCommand(command string) (bool, error) {
+	return false, nil
+}
+
+// runAsService reports the state of the exporter to the Windows service
+// manager, if it was started by it.
+func runAsService(logger log.Logger) {}
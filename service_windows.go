@@ -0,0 +1,179 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "snmp_exporter"
+
+var (
+	serviceCommand   = kingpin.Command("service", "Manage the snmp_exporter Windows service.")
+	serviceInstall   = serviceCommand.Command("install", "Install the service, running the exporter with the other flags given, and start it at boot.")
+	serviceUninstall = serviceCommand.Command("uninstall", "Remove the service.")
+	serviceStart     = serviceCommand.Command("start", "Start the service.")
+	serviceStop      = serviceCommand.Command("stop", "Stop the service.")
+)
+
+// runServiceCommand handles the commands managing the Windows service,
+// returning false for other commands.
+func runServiceCommand(command string) (bool, error) {
+	var action func(*mgr.Mgr) error
+	switch command {
+	case serviceInstall.FullCommand():
+		action = installService
+	case serviceUninstall.FullCommand():
+		action = func(m *mgr.Mgr) error {
+			return withService(m, func(s *mgr.Service) error { return s.Delete() })
+		}
+	case serviceStart.FullCommand():
+		action = func(m *mgr.Mgr) error {
+			return withService(m, func(s *mgr.Service) error { return s.Start() })
+		}
+	case serviceStop.FullCommand():
+		action = func(m *mgr.Mgr) error {
+			return withService(m, func(s *mgr.Service) error {
+				_, err := s.Control(svc.Stop)
+				return err
+			})
+		}
+	default:
+		return false, nil
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return true, fmt.Errorf("error connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	return true, action(m)
+}
+
+func withService(m *mgr.Mgr, fn func(*mgr.Service) error) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("error opening service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+// serviceArgs returns the arguments without the words of the install
+// command, leaving the flags the service should run the exporter with. Flag
+// values which happen to be "service" or "install" are kept.
+func serviceArgs(args []string) []string {
+	words := []string{"service", "install"}
+	kept := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return append(kept, args[i:]...)
+		case strings.HasPrefix(arg, "-"):
+			kept = append(kept, arg)
+			if flagTakesValue(arg) && i+1 < len(args) {
+				i++
+				kept = append(kept, args[i])
+			}
+		case len(words) > 0 && arg == words[0]:
+			words = words[1:]
+		default:
+			kept = append(kept, arg)
+		}
+	}
+	return kept
+}
+
+// flagTakesValue returns whether the flag arg is followed by its value as the
+// next argument.
+func flagTakesValue(arg string) bool {
+	if !strings.HasPrefix(arg, "--") || strings.Contains(arg, "=") {
+		return false
+	}
+	flag := kingpin.CommandLine.GetFlag(arg[2:])
+	return flag != nil && !flag.Model().IsBoolFlag()
+}
+
+func installService(m *mgr.Mgr) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "SNMP Exporter",
+		Description: "Prometheus exporter for SNMP targets",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs(os.Args[1:])...)
+	if err != nil {
+		return fmt.Errorf("error creating service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+	return s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, uint32((24 * time.Hour).Seconds()))
+}
+
+type exporterService struct{}
+
+// Execute implements svc.Handler, reporting the exporter as running until
+// the service manager stops it.
+func (exporterService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runAsService reports the state of the exporter to the Windows service
+// manager, if it was started by it, and exits when it stops the service.
+func runAsService(logger log.Logger) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error checking whether running as a Windows service", "err", err)
+		return
+	}
+	if !isService {
+		return
+	}
+	go func() {
+		err := svc.Run(serviceName, exporterService{})
+		removeGenerated()
+		if err != nil {
+			level.Error(logger).Log("msg", "Error running as a Windows service", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Stopped by the Windows service manager")
+		os.Exit(0)
+	}()
+}
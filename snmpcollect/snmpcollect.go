@@ -0,0 +1,223 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snmpcollect scrapes SNMP targets with the auths and modules of an
+// snmp.yml, as the exporter's /snmp endpoint does, for Go programs which
+// want MIB-aware collection without running the exporter:
+//
+//	cfg, err := snmpcollect.LoadConfig("snmp.yml")
+//	...
+//	c := snmpcollect.New(cfg, snmpcollect.Options{})
+//	mfs, err := c.Scrape(ctx, "192.0.2.1", "public_v2", "if_mib")
+//
+// Settings of the exporter's --snmp.* flags keep their zero values unless the
+// program parses them with kingpin, so for example Counter64 values are not
+// wrapped at 2^53.
+package snmpcollect
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// LoadConfig loads and merges snmp.yml files, which may be glob patterns.
+func LoadConfig(paths ...string) (*config.Config, error) {
+	return config.LoadFile(paths, false)
+}
+
+// Options of a Collector. The zero value is usable.
+type Options struct {
+	// Defaults to discarding logs.
+	Logger log.Logger
+	// The exporter's own metrics, such as packet durations. Defaults to
+	// metrics which are not registered anywhere.
+	Metrics *collector.Metrics
+	// Number of modules of a target scraped at the same time. Defaults to 1.
+	Concurrency int
+	// Log the SNMP packets at debug level.
+	DebugSNMP bool
+}
+
+// Collector scrapes targets with the auths and modules of a config. It is
+// safe for concurrent use.
+type Collector struct {
+	config  *config.Config
+	options Options
+}
+
+// New returns a Collector for the config, which must not be modified
+// afterwards.
+func New(cfg *config.Config, options Options) *Collector {
+	if options.Logger == nil {
+		options.Logger = log.NewNopLogger()
+	}
+	if options.Metrics == nil {
+		metrics := NewMetrics(nil)
+		options.Metrics = &metrics
+	}
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+	return &Collector{config: cfg, options: options}
+}
+
+// Target returns a prometheus.Collector scraping the target with the auth and
+// modules whenever it is collected, for registering with a registry.
+func (c *Collector) Target(ctx context.Context, target, auth string, modules ...string) (prometheus.Collector, error) {
+	a, ok := c.config.Auths[auth]
+	if !ok {
+		return nil, fmt.Errorf("unknown auth '%s'", auth)
+	}
+	if len(modules) == 0 {
+		return nil, fmt.Errorf("no modules given")
+	}
+	nmodules := make([]*collector.NamedModule, 0, len(modules))
+	for _, name := range modules {
+		module, ok := c.config.Modules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown module '%s'", name)
+		}
+		nmodules = append(nmodules, collector.NewNamedModule(name, module))
+	}
+	logger := log.With(c.options.Logger, "target", target, "auth", auth)
+	return collector.New(ctx, target, auth, "", a, nmodules, logger, *c.options.Metrics, c.options.Concurrency, c.options.DebugSNMP), nil
+}
+
+// Scrape scrapes the target with the auth and modules. The error reports
+// what failed, in which case the metric families collected anyway are still
+// returned, including snmp_scrape_error.
+func (c *Collector) Scrape(ctx context.Context, target, auth string, modules ...string) ([]*dto.MetricFamily, error) {
+	t, err := c.Target(ctx, target, auth, modules...)
+	if err != nil {
+		return nil, err
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(t)
+	return registry.Gather()
+}
+
+// NewMetrics returns the metrics the exporter keeps about its own requests,
+// registered with reg unless it is nil.
+func NewMetrics(reg prometheus.Registerer) collector.Metrics {
+	const namespace = "snmp"
+	metrics := collector.Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "collection_duration_seconds",
+			Help:      "Duration of collections by the SNMP exporter",
+		}, []string{"module"}),
+		SNMPUnexpectedPduType: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "unexpected_pdu_type_total",
+			Help:      "Unexpected Go types in a PDU.",
+		}),
+		SNMPPduTypeMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pdu_type_mismatches_total",
+			Help:      "Values whose type contradicts the configured metric type, checked with --snmp.strict-types.",
+		}, []string{"metric"}),
+		SNMPDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "packet_duration_seconds",
+			Help:      "A histogram of latencies for SNMP packets.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 15),
+		}),
+		SNMPPackets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "packets_total",
+			Help:      "Number of SNMP packet sent, including retries.",
+		}),
+		SNMPRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "packet_retries_total",
+			Help:      "Number of SNMP packet retries.",
+		}),
+		SNMPInflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "request_in_flight",
+			Help:      "Current number of SNMP scrapes being requested.",
+		}),
+		SNMPModuleScrapes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "module_scrapes_total",
+			Help:      "Scrapes of each module, across all targets.",
+		}, []string{"module"}),
+		SNMPModuleScrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "module_scrape_errors_total",
+			Help:      "Failed scrapes of each module, across all targets.",
+		}, []string{"module"}),
+		SNMPModulePdus: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "module_pdus_returned_total",
+			Help:      "PDUs returned for each module, across all targets.",
+		}, []string{"module"}),
+		SNMPResyncs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "engine_time_resyncs_total",
+			Help:      "Number of times the SNMPv3 engine boots and time of a target were resynchronized after a notInTimeWindow report.",
+		}),
+		SNMPWalkAnomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "walk_anomalies_total",
+			Help:      "Anomalies of agents detected during walks: duplicate or out of order OIDs, and loops which were cut.",
+		}, []string{"type"}),
+		SNMPScrapesAbandoned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrapes_abandoned_total",
+			Help:      "Scrapes abandoned by the watchdog, as they were still running --snmp.watchdog-grace after their deadline.",
+		}),
+		SNMPUnexpectedVarbinds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "unexpected_varbinds_total",
+			Help:      "Varbinds returned which no metric of the module covers, by walked subtree, with --snmp.unexpected-varbinds.",
+		}, []string{"module", "subtree"}),
+		SNMPOutOfRangeSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "out_of_range_samples_total",
+			Help:      "Samples out of the min and max of their metric, by whether they were dropped or clamped.",
+		}, []string{"metric", "action"}),
+		SNMPLabelLimitSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "label_limit_aggregated_samples_total",
+			Help:      "Samples with values of a label beyond its limit in label_limits, aggregated rather than exported, across all targets.",
+		}, []string{"module", "label"}),
+		SNMPCollectionCPU: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "collection_cpu_seconds_total",
+			Help:      "CPU time of processing the PDUs of each module into samples, across all targets. Linux only.",
+		}, []string{"module"}),
+		SNMPCollectionAllocs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "collection_allocated_bytes_total",
+			Help:      "Bytes the exporter allocated while processing the PDUs of each module into samples, across all targets. Collections running at the same time are included.",
+		}, []string{"module"}),
+	}
+	if reg != nil {
+		reg.MustRegister(
+			metrics.SNMPCollectionDuration, metrics.SNMPUnexpectedPduType, metrics.SNMPPduTypeMismatches, metrics.SNMPDuration,
+			metrics.SNMPPackets, metrics.SNMPRetries, metrics.SNMPInflight, metrics.SNMPModuleScrapes,
+			metrics.SNMPModuleScrapeErrors, metrics.SNMPModulePdus, metrics.SNMPResyncs, metrics.SNMPWalkAnomalies,
+			metrics.SNMPScrapesAbandoned, metrics.SNMPUnexpectedVarbinds, metrics.SNMPOutOfRangeSamples,
+			metrics.SNMPLabelLimitSamples, metrics.SNMPCollectionCPU, metrics.SNMPCollectionAllocs,
+		)
+	}
+	return metrics
+}
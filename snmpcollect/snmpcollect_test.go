@@ -0,0 +1,96 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snmpcollect
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const snmpYml = `
+auths:
+  public_v2:
+    community: public
+modules:
+  system:
+    get:
+      - 1.3.6.1.2.1.1.3.0
+    metrics:
+      - name: sysUpTime
+        oid: 1.3.6.1.2.1.1.3
+        type: gauge
+    retries: 0
+    timeout: 500ms
+`
+
+func TestScrape(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snmp.yml")
+	if err := os.WriteFile(path, []byte(snmpYml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	c := New(cfg, Options{Metrics: &metrics})
+
+	for _, bad := range []struct{ auth, module, err string }{
+		{"nope", "system", "unknown auth 'nope'"},
+		{"public_v2", "nope", "unknown module 'nope'"},
+	} {
+		if _, err := c.Scrape(context.Background(), "192.0.2.1", bad.auth, bad.module); err == nil || err.Error() != bad.err {
+			t.Errorf("Expected error %q, got %v", bad.err, err)
+		}
+	}
+
+	// Nothing listens on the port of a closed socket.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := conn.LocalAddr().String()
+	conn.Close()
+	mfs, err := c.Scrape(context.Background(), target, "public_v2", "system")
+	if err == nil {
+		t.Fatal("Expected the scrape of a target which doesn't answer to fail")
+	}
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() == "snmp_scrape_error" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected snmp_scrape_error to be returned along with the error, got %v", mfs)
+	}
+	gathered, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, mf := range gathered {
+		names = append(names, mf.GetName())
+	}
+	if !strings.Contains(strings.Join(names, ","), "snmp_module_scrape_errors_total") {
+		t.Errorf("Expected the exporter metrics to be registered and updated, got %v", names)
+	}
+}
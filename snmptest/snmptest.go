@@ -0,0 +1,192 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snmptest runs modules against canned PDUs, so that the metrics a
+// module produces for a device can be covered by regression tests:
+//
+//	pdus, err := snmptest.LoadPDUs("testdata/switch1.yml")
+//	...
+//	c := snmptest.NewCollector(cfg.Modules["if_mib"], pdus)
+//	err = testutil.CollectAndCompare(c, expected, "ifHCInOctets")
+package snmptest
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/snmpcollect"
+)
+
+// PDU is a varbind in a fixture file.
+type PDU struct {
+	Oid  string `yaml:"oid"`
+	Type string `yaml:"type"`
+	// The value, or for OctetString its bytes in hex if Hex is set.
+	Value string `yaml:"value,omitempty"`
+	Hex   bool   `yaml:"hex,omitempty"`
+}
+
+var pduTypes = map[string]gosnmp.Asn1BER{}
+
+func init() {
+	for _, t := range []gosnmp.Asn1BER{
+		gosnmp.Integer, gosnmp.OctetString, gosnmp.Null, gosnmp.ObjectIdentifier,
+		gosnmp.IPAddress, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks,
+		gosnmp.Counter64, gosnmp.Uinteger32, gosnmp.OpaqueFloat, gosnmp.OpaqueDouble,
+		gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView,
+	} {
+		pduTypes[t.String()] = t
+	}
+}
+
+// ToSnmpPDU converts the fixture entry to the PDU gosnmp would return.
+func (p PDU) ToSnmpPDU() (gosnmp.SnmpPDU, error) {
+	typ, ok := pduTypes[p.Type]
+	if !ok {
+		return gosnmp.SnmpPDU{}, fmt.Errorf("unknown type '%s' of %s", p.Type, p.Oid)
+	}
+	pdu := gosnmp.SnmpPDU{Name: "." + strings.TrimPrefix(p.Oid, "."), Type: typ}
+	var err error
+	switch typ {
+	case gosnmp.Integer:
+		pdu.Value, err = strconv.Atoi(p.Value)
+	case gosnmp.OctetString:
+		if p.Hex {
+			pdu.Value, err = hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(p.Value))
+		} else {
+			pdu.Value = []byte(p.Value)
+		}
+	case gosnmp.ObjectIdentifier:
+		pdu.Value = "." + strings.TrimPrefix(p.Value, ".")
+	case gosnmp.IPAddress:
+		pdu.Value = p.Value
+	case gosnmp.Counter32, gosnmp.Gauge32:
+		var v uint64
+		v, err = strconv.ParseUint(p.Value, 10, 32)
+		pdu.Value = uint(v)
+	case gosnmp.TimeTicks, gosnmp.Uinteger32:
+		var v uint64
+		v, err = strconv.ParseUint(p.Value, 10, 32)
+		pdu.Value = uint32(v)
+	case gosnmp.Counter64:
+		pdu.Value, err = strconv.ParseUint(p.Value, 10, 64)
+	case gosnmp.OpaqueFloat:
+		var v float64
+		v, err = strconv.ParseFloat(p.Value, 32)
+		pdu.Value = float32(v)
+	case gosnmp.OpaqueDouble:
+		pdu.Value, err = strconv.ParseFloat(p.Value, 64)
+	}
+	if err != nil {
+		return gosnmp.SnmpPDU{}, fmt.Errorf("invalid %s value '%s' of %s: %w", p.Type, p.Value, p.Oid, err)
+	}
+	return pdu, nil
+}
+
+// ParsePDUs parses a YAML list of PDUs.
+func ParsePDUs(content []byte) ([]gosnmp.SnmpPDU, error) {
+	fixture := []PDU{}
+	if err := yaml.UnmarshalStrict(content, &fixture); err != nil {
+		return nil, err
+	}
+	pdus := make([]gosnmp.SnmpPDU, 0, len(fixture))
+	for _, p := range fixture {
+		pdu, err := p.ToSnmpPDU()
+		if err != nil {
+			return nil, err
+		}
+		pdus = append(pdus, pdu)
+	}
+	return pdus, nil
+}
+
+// LoadPDUs reads a fixture file of PDUs.
+func LoadPDUs(path string) ([]gosnmp.SnmpPDU, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pdus, err := ParsePDUs(content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return pdus, nil
+}
+
+// NewMetrics returns exporter metrics which are not registered anywhere.
+func NewMetrics() collector.Metrics {
+	return snmpcollect.NewMetrics(nil)
+}
+
+// NewScraper returns a scraper answering gets and walks from the PDUs, as a
+// device holding exactly those OIDs would.
+func NewScraper(module *config.Module, pdus []gosnmp.SnmpPDU) scraper.SNMPScraper {
+	get := make(map[string]gosnmp.SnmpPDU, len(pdus))
+	for _, pdu := range pdus {
+		get[strings.TrimPrefix(pdu.Name, ".")] = pdu
+	}
+	roots := append([]string{}, module.Walk...)
+	for _, filter := range module.Filters {
+		roots = append(roots, filter.Oid)
+	}
+	walk := make(map[string][]gosnmp.SnmpPDU, len(roots))
+	for _, root := range roots {
+		walk[root] = []gosnmp.SnmpPDU{}
+		for _, pdu := range pdus {
+			if strings.HasPrefix(pdu.Name, "."+root+".") {
+				walk[root] = append(walk[root], pdu)
+			}
+		}
+	}
+	return scraper.NewMockSNMPScraper(get, walk)
+}
+
+type moduleCollector struct {
+	module *config.Module
+	pdus   []gosnmp.SnmpPDU
+}
+
+// NewCollector returns a collector exposing the metrics the module produces
+// for a device holding the PDUs. The snmp_scrape_* metrics are not included.
+func NewCollector(module *config.Module, pdus []gosnmp.SnmpPDU) prometheus.Collector {
+	return moduleCollector{module: module, pdus: pdus}
+}
+
+// Describe implements prometheus.Collector.
+func (c moduleCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c moduleCollector) Collect(ch chan<- prometheus.Metric) {
+	logger := log.NewNopLogger()
+	metrics := NewMetrics()
+	results, err := collector.ScrapeTarget(context.Background(), NewScraper(c.module, c.pdus), "snmptest", &config.DefaultAuth, c.module, logger, metrics)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error scraping target", nil, nil), err)
+		return
+	}
+	for _, sample := range collector.PdusToMetrics(c.module, results.PDUs(), logger, metrics) {
+		ch <- sample
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snmptest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const fixture = `
+- oid: 1.3.6.1.2.1.1.3.0
+  type: TimeTicks
+  value: "12345"
+- oid: 1.3.6.1.2.1.2.2.1.2.1
+  type: OctetString
+  value: eth0
+- oid: 1.3.6.1.2.1.2.2.1.6.1
+  type: OctetString
+  value: "00:1a:2b:3c:4d:5e"
+  hex: true
+- oid: 1.3.6.1.2.1.31.1.1.1.6.1
+  type: Counter64
+  value: "1000"
+- oid: 1.3.6.1.4.1.9.1
+  type: Integer
+  value: "1"
+`
+
+func TestCollector(t *testing.T) {
+	pdus, err := ParsePDUs([]byte(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	module := &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31.1.1.1.6"},
+		Get:  []string{"1.3.6.1.2.1.1.3.0"},
+		Metrics: []*config.Metric{
+			{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge", Help: "Uptime."},
+			{Name: "ifPhysAddress", Oid: "1.3.6.1.2.1.2.2.1.6", Type: "PhysAddress48", Help: "MAC address.",
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+			{Name: "ifHCInOctets", Oid: "1.3.6.1.2.1.31.1.1.1.6", Type: "counter", Help: "Octets in.",
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+		},
+		WalkParams: config.DefaultWalkParams,
+	}
+	expected := `# HELP ifHCInOctets Octets in.
+# TYPE ifHCInOctets counter
+ifHCInOctets{ifIndex="1"} 1000
+# HELP ifPhysAddress MAC address.
+# TYPE ifPhysAddress gauge
+ifPhysAddress{ifIndex="1",ifPhysAddress="00:1A:2B:3C:4D:5E"} 1
+# HELP sysUpTime Uptime.
+# TYPE sysUpTime gauge
+sysUpTime 12345
+`
+	if err := testutil.CollectAndCompare(NewCollector(module, pdus), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParsePDUsErrors(t *testing.T) {
+	for _, fixture := range []string{
+		"- {oid: 1.3.6.1.2.1.1.3.0, type: Timeticks, value: '1'}",
+		"- {oid: 1.3.6.1.2.1.1.3.0, type: Integer, value: one}",
+		"- {oid: 1.3.6.1.2.1.1.3.0, type: OctetString, value: zz, hex: true}",
+		"- {oid: 1.3.6.1.2.1.1.3.0, type: Integer, valeu: '1'}",
+	} {
+		if _, err := ParsePDUs([]byte(fixture)); err == nil {
+			t.Errorf("Expected error parsing %q", fixture)
+		}
+	}
+}
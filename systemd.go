@@ -0,0 +1,88 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// notifySystemd sends the state to systemd, if the exporter was started by a
+// unit of Type=notify. It does nothing otherwise.
+func notifySystemd(logger log.Logger, state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		level.Warn(logger).Log("msg", "Error notifying systemd", "state", state, "err", err)
+	}
+}
+
+// runWatchdog pings the systemd watchdog at half its interval, if the unit
+// sets WatchdogSec, for as long as the configuration can be read. A reload
+// which never finishes thus gets the exporter restarted.
+func runWatchdog(logger log.Logger) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error reading the systemd watchdog interval", "err", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	level.Info(logger).Log("msg", "Pinging the systemd watchdog", "interval", interval/2)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		sc.RLock()
+		sc.RUnlock()
+		notifySystemd(logger, daemon.SdNotifyWatchdog)
+	}
+}
+
+// listenAndServe serves srv as web.ListenAndServe does, but binds the
+// listeners itself so that systemd is only told the exporter is ready once
+// they accept connections.
+func listenAndServe(srv *http.Server, flags *web.FlagConfig, logger log.Logger) error {
+	var listeners []net.Listener
+	if flags.WebSystemdSocket != nil && *flags.WebSystemdSocket {
+		level.Info(logger).Log("msg", "Listening on systemd activated listeners instead of port listeners.")
+		var err error
+		if listeners, err = activation.Listeners(); err != nil {
+			return err
+		}
+		if len(listeners) < 1 {
+			return errors.New("no socket activation file descriptors found")
+		}
+	} else {
+		if flags.WebListenAddresses == nil || len(*flags.WebListenAddresses) == 0 {
+			return web.ErrNoListeners
+		}
+		for _, address := range *flags.WebListenAddresses {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			defer listener.Close()
+			listeners = append(listeners, listener)
+		}
+	}
+	notifySystemd(logger, daemon.SdNotifyReady)
+	return web.ServeMultiple(listeners, srv, flags, logger)
+}
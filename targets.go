@@ -0,0 +1,169 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+const targetsPath = "/targets"
+
+var targetsRetention = kingpin.Flag("web.targets-retention", "How long a target which is no longer scraped is kept on the /targets page.").Default("1h").Duration()
+
+// targetStatus holds the statistics of a target scraped with an auth and
+// modules.
+type targetStatus struct {
+	Target     string    `json:"target"`
+	Auth       string    `json:"auth"`
+	Modules    []string  `json:"modules"`
+	Tenant     string    `json:"tenant,omitempty"`
+	LastScrape time.Time `json:"last_scrape"`
+	// Of the last scrape.
+	DurationSeconds float64 `json:"duration_seconds"`
+	Samples         int     `json:"samples"`
+	// "success", or the type of error which made the last scrape fail.
+	Status        string    `json:"status"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	Scrapes       uint64    `json:"scrapes"`
+	Failures      uint64    `json:"failures"`
+}
+
+func (s targetStatus) key() string {
+	return strings.Join([]string{s.Tenant, s.Target, s.Auth, strings.Join(s.Modules, ",")}, "\xff")
+}
+
+// targetRegistry remembers the targets scraped recently.
+type targetRegistry struct {
+	mu        sync.Mutex
+	targets   map[string]*targetStatus
+	lastSweep time.Time
+}
+
+var targetStats = newTargetRegistry()
+
+func newTargetRegistry() *targetRegistry {
+	return &targetRegistry{targets: map[string]*targetStatus{}}
+}
+
+// record adds the outcome of a scrape, with the error it failed with if any,
+// and forgets targets which were not scraped within the retention, checking
+// them at most once a minute.
+func (t *targetRegistry) record(scrape targetStatus, scrapeErr error, retention time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := scrape.key()
+	s, ok := t.targets[key]
+	if !ok {
+		s = &scrape
+		t.targets[key] = s
+	} else {
+		scrapes, failures, lastError, lastErrorTime := s.Scrapes, s.Failures, s.LastError, s.LastErrorTime
+		*s = scrape
+		s.Scrapes, s.Failures, s.LastError, s.LastErrorTime = scrapes, failures, lastError, lastErrorTime
+	}
+	s.Scrapes++
+	if s.Status != "success" {
+		s.Failures++
+		s.LastError = s.Status
+		if scrapeErr != nil {
+			s.LastError = scrapeErr.Error()
+		}
+		s.LastErrorTime = s.LastScrape
+	}
+	if scrape.LastScrape.Sub(t.lastSweep) > time.Minute {
+		t.prune(scrape.LastScrape.Add(-retention))
+		t.lastSweep = scrape.LastScrape
+	}
+}
+
+func (t *targetRegistry) prune(before time.Time) {
+	for key, s := range t.targets {
+		if s.LastScrape.Before(before) {
+			delete(t.targets, key)
+		}
+	}
+}
+
+// list returns the targets scraped within the retention, sorted.
+func (t *targetRegistry) list(now time.Time, retention time.Duration) []targetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now.Add(-retention))
+	targets := make([]targetStatus, 0, len(t.targets))
+	for _, s := range t.targets {
+		targets = append(targets, *s)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].key() < targets[j].key() })
+	return targets
+}
+
+var targetsTemplate = template.Must(template.New("targets").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"ago": func(now, t time.Time) string {
+		return now.Sub(t).Truncate(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>SNMP Exporter Targets</title>
+<style>
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+.success { color: #080; }
+.failure { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Targets</h1>
+<p>{{len .Targets}} targets scraped in the last {{.Retention}}. Also available as <a href="?format=json">JSON</a>.</p>
+<table>
+<tr><th>Target</th><th>Auth</th><th>Modules</th><th>Tenant</th><th>Status</th><th>Last scrape</th><th>Duration</th><th>Samples</th><th>Failures</th><th>Last error</th></tr>
+{{range .Targets}}<tr>
+<td>{{.Target}}</td><td>{{.Auth}}</td><td>{{join .Modules ","}}</td><td>{{.Tenant}}</td>
+<td class="{{if eq .Status "success"}}success{{else}}failure{{end}}">{{.Status}}</td>
+<td>{{ago $.Now .LastScrape}} ago</td><td>{{printf "%.3fs" .DurationSeconds}}</td><td>{{.Samples}}</td>
+<td>{{.Failures}}/{{.Scrapes}}</td><td>{{if .LastError}}{{ago $.Now .LastErrorTime}} ago: {{.LastError}}{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// targetsHandler serves the recently scraped targets as HTML, or as JSON if
+// requested with format=json or an Accept header.
+func targetsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	targets := targetStats.list(now, *targetsRetention)
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(targets)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	targetsTemplate.Execute(w, struct {
+		Targets   []targetStatus
+		Now       time.Time
+		Retention time.Duration
+	}{targets, now, *targetsRetention})
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const tenantPathPrefix = "/tenant/"
+
+// tenantFromPath extracts the tenant from a /tenant/<name>/snmp URL.
+func tenantFromPath(path string) string {
+	if !strings.HasPrefix(path, tenantPathPrefix) {
+		return ""
+	}
+	name, _, _ := strings.Cut(strings.TrimPrefix(path, tenantPathPrefix), "/")
+	return name
+}
+
+// targetHost returns the host part of a [transport://]host[:port] target.
+func targetHost(target string) string {
+	if s := strings.SplitN(target, "://", 2); len(s) == 2 {
+		target = s[1]
+	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return strings.Trim(target, "[]")
+}
+
+// checkTenantTarget verifies that every address of the target is allowed for
+// the tenant. A hostname is left for the scrape to resolve, so all of its
+// addresses must be allowed whichever one is scraped.
+func checkTenantTarget(ctx context.Context, tenant *config.Tenant, target string) error {
+	if len(tenant.AllowedTargets) == 0 {
+		return nil
+	}
+	host := targetHost(target)
+	if ip := net.ParseIP(host); ip != nil {
+		if !tenant.AllowsIP(ip) {
+			return fmt.Errorf("target %q (%s) is not allowed", target, ip)
+		}
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve target %q: %w", host, err)
+	}
+	for _, ip := range ips {
+		if !tenant.AllowsIP(ip) {
+			return fmt.Errorf("target %q (%s) is not allowed", target, ip)
+		}
+	}
+	return nil
+}
+
+// withTargetHost replaces the host of a [transport://]host[:port] target,
+// keeping its transport and port.
+func withTargetHost(target, host string) string {
+	prefix := ""
+	if s := strings.SplitN(target, "://", 2); len(s) == 2 {
+		prefix, target = s[0]+"://", s[1]
+	}
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		return prefix + net.JoinHostPort(host, port)
+	}
+	return prefix + host
+}
+
+// tokenBucket is a simple rate limiter.
+type tokenBucket struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// tenantLimiters tracks the rate limit of each tenant across config reloads.
+type tenantLimiters struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow reports whether the tenant may perform another scrape now.
+func (l *tenantLimiters) allow(name string, tenant *config.Tenant, now time.Time) bool {
+	if tenant.RateLimit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	b, ok := l.buckets[name]
+	if !ok || b.rate != tenant.RateLimit || b.burst != tenant.RateLimitBurst {
+		// New tenant or changed limits, start with a full bucket.
+		b = &tokenBucket{rate: tenant.RateLimit, burst: tenant.RateLimitBurst, tokens: float64(tenant.RateLimitBurst), last: now}
+		l.buckets[name] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
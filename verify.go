@@ -0,0 +1,173 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/snmpcollect"
+)
+
+var (
+	verifyCommand  = kingpin.Command("verify", "Scrape a target with modules and walk their subtrees, reporting the OIDs the target returns which no metric of the modules covers.")
+	verifyTarget   = verifyCommand.Flag("target", "Target to verify, as in the target URL parameter.").Required().String()
+	verifyAuth     = verifyCommand.Flag("auth", "Auth to scrape with.").Default("public_v2").String()
+	verifyModules  = verifyCommand.Flag("module", "Module to verify, can be repeated.").Default("if_mib").Strings()
+	verifySubtrees = verifyCommand.Flag("subtree", "Subtree to walk instead of those of the modules, can be repeated, such as 1.3.6.1.4.1 to find vendor objects the modules miss.").Strings()
+)
+
+// oidLess orders OIDs numerically, as agents return them.
+func oidLess(a, b string) bool {
+	as, bs := strings.Split(strings.TrimPrefix(a, "."), "."), strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// uncoveredPDUs returns the PDUs of the walk which no module turns into
+// samples, either as the value of a metric or through a lookup, sorted by
+// OID. PDUs under the OID of a metric but dropped, such as ones whose type
+// can't be decoded, are uncovered.
+func uncoveredPDUs(modules []*config.Module, pdus []gosnmp.SnmpPDU, logger log.Logger, metrics collector.Metrics) []gosnmp.SnmpPDU {
+	covered := map[string]struct{}{}
+	for _, module := range modules {
+		for oid := range collector.CoveredOIDs(module, pdus, logger, metrics) {
+			covered[oid] = struct{}{}
+		}
+	}
+	uncovered := []gosnmp.SnmpPDU{}
+	for _, pdu := range pdus {
+		if _, ok := covered[strings.TrimPrefix(pdu.Name, ".")]; !ok {
+			uncovered = append(uncovered, pdu)
+		}
+	}
+	sort.Slice(uncovered, func(i, j int) bool {
+		return oidLess(uncovered[i].Name, uncovered[j].Name)
+	})
+	return uncovered
+}
+
+// verifySubtreesOf returns the walks and gets of the modules, without those
+// within another one.
+func verifySubtreesOf(modules []*config.Module) []string {
+	roots := []string{}
+	for _, module := range modules {
+		roots = append(roots, module.Walk...)
+		roots = append(roots, module.Get...)
+	}
+	sort.Strings(roots)
+	minimal := []string{}
+	for _, root := range roots {
+		if n := len(minimal); n > 0 && (root == minimal[n-1] || strings.HasPrefix(root, minimal[n-1]+".")) {
+			continue
+		}
+		minimal = append(minimal, root)
+	}
+	return minimal
+}
+
+// runVerify implements the verify command.
+func runVerify(logger log.Logger, w io.Writer) error {
+	cfg, err := config.LoadFile(*configFile, *expandEnvVars)
+	if err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+	auth, ok := cfg.Auths[*verifyAuth]
+	if !ok {
+		return fmt.Errorf("unknown auth '%s'", *verifyAuth)
+	}
+	modules := []*config.Module{}
+	for _, name := range *verifyModules {
+		module, ok := cfg.Modules[name]
+		if !ok {
+			return fmt.Errorf("unknown module '%s'", name)
+		}
+		modules = append(modules, module)
+	}
+
+	ctx := context.Background()
+	client, err := scraper.NewGoSNMP(logger, *verifyTarget, "", false)
+	if err != nil {
+		return err
+	}
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Context = ctx
+		auth.ConfigureSNMP(g, "")
+	})
+	if err := client.Connect(); err != nil {
+		return fmt.Errorf("error connecting to target: %w", err)
+	}
+	defer client.Close()
+
+	metrics := snmpcollect.NewMetrics(nil)
+	for i, module := range modules {
+		setWalkParams(client, module.WalkParams)
+		results, err := collector.ScrapeTarget(ctx, client, *verifyTarget, auth, module, logger, metrics)
+		if err != nil {
+			return fmt.Errorf("error scraping module '%s': %w", (*verifyModules)[i], err)
+		}
+		samples := collector.PdusToMetrics(module, results.PDUs(), logger, metrics)
+		fmt.Fprintf(w, "Module %s: %d PDUs scraped, %d samples\n", (*verifyModules)[i], len(results.PDUs()), len(samples))
+	}
+
+	subtrees := *verifySubtrees
+	if len(subtrees) == 0 {
+		subtrees = verifySubtreesOf(modules)
+	}
+	setWalkParams(client, modules[0].WalkParams)
+	walked := []gosnmp.SnmpPDU{}
+	for _, subtree := range subtrees {
+		level.Debug(logger).Log("msg", "Walking subtree", "oid", subtree)
+		pdus, err := client.WalkAll(subtree)
+		if err != nil {
+			return fmt.Errorf("error walking %s: %w", subtree, err)
+		}
+		walked = append(walked, pdus...)
+	}
+	uncovered := uncoveredPDUs(modules, walked, logger, metrics)
+	for _, pdu := range uncovered {
+		fmt.Fprintf(w, "%s = %s: %v\n", pdu.Name, pdu.Type, pdu.Value)
+	}
+	fmt.Fprintf(w, "%d of %d OIDs walked are not covered by any metric\n", len(uncovered), len(walked))
+	if len(uncovered) > 0 {
+		return fmt.Errorf("%d OIDs not covered", len(uncovered))
+	}
+	return nil
+}
+
+func setWalkParams(client scraper.SNMPScraper, params config.WalkParams) {
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Retries = *params.Retries
+		g.Timeout = params.Timeout
+		g.MaxRepetitions = params.MaxRepetitions
+	})
+}
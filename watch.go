@@ -0,0 +1,172 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// How long the watcher waits after a change for more, as updates such as a
+// Kubernetes symlink swap come as bursts of events.
+const watchSettle = time.Second
+
+// configFingerprint hashes the names and contents of the files the config is
+// loaded from, and of the extra files such as the MIB index. Contents are
+// compared rather than modification times, as Kubernetes updates mounted
+// ConfigMaps and Secrets by swapping a symlink to a new directory.
+func configFingerprint(paths []string, extra ...string) (string, error) {
+	files, err := config.Files(paths)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, f := range append(files, extra...) {
+		if f == "" {
+			continue
+		}
+		io.WriteString(h, f+"\x00")
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		h.Write(content)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// configWatcher reloads the configuration when a file it depends on
+// changes: the config files, the mapping files of lookups, the MIB index and
+// the secrets key. The directories of the files are watched rather than the
+// files, so that symlink swaps replacing them are seen, and changes are
+// confirmed by comparing fingerprints, so that events of other files of the
+// directories don't reload the configuration.
+type configWatcher struct {
+	logger log.Logger
+	// Nil if the files are only polled.
+	watcher     *fsnotify.Watcher
+	dirs        map[string]struct{}
+	fingerprint string
+}
+
+// newConfigWatcher returns a watcher of the files of the loaded
+// configuration, notified of their changes by the OS if notify is set.
+func newConfigWatcher(logger log.Logger, notify bool) (*configWatcher, error) {
+	w := &configWatcher{logger: logger, dirs: map[string]struct{}{}}
+	if notify {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		w.watcher = watcher
+	}
+	w.update()
+	return w, nil
+}
+
+// events returns the events and errors of the watched directories, nil
+// channels if the files are only polled.
+func (w *configWatcher) events() (<-chan fsnotify.Event, <-chan error) {
+	if w.watcher == nil {
+		return nil, nil
+	}
+	return w.watcher.Events, w.watcher.Errors
+}
+
+// extraFiles returns the files the loaded configuration depends on besides
+// the config files.
+func extraFiles() []string {
+	sc.RLock()
+	defer sc.RUnlock()
+	extra := []string{*mibIndexFile, *secretsKey}
+	if sc.C != nil {
+		extra = append(extra, sc.C.MappingFiles()...)
+	}
+	return extra
+}
+
+// update fingerprints the files of the loaded configuration, and watches
+// their directories. It is called after each reload, as the mapping files
+// may have changed. It does nothing on a nil watcher.
+func (w *configWatcher) update() {
+	if w == nil {
+		return
+	}
+	extra := extraFiles()
+	if f, err := configFingerprint(*configFile, extra...); err == nil {
+		w.fingerprint = f
+	} else {
+		// Likely caught mid-update, the next check reloads.
+		level.Debug(w.logger).Log("msg", "Error reading config files", "err", err)
+	}
+	if w.watcher == nil {
+		return
+	}
+	dirs := map[string]struct{}{}
+	for _, p := range *configFile {
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			dirs[p] = struct{}{}
+		} else {
+			dirs[filepath.Dir(p)] = struct{}{}
+		}
+	}
+	for _, f := range extra {
+		if f != "" {
+			dirs[filepath.Dir(f)] = struct{}{}
+		}
+	}
+	for dir := range w.dirs {
+		if _, ok := dirs[dir]; !ok {
+			w.watcher.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+	for dir := range dirs {
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			level.Warn(w.logger).Log("msg", "Error watching config directory", "dir", dir, "err", err)
+			continue
+		}
+		w.dirs[dir] = struct{}{}
+	}
+}
+
+// check reloads the configuration if its files changed since the last
+// update.
+func (w *configWatcher) check() {
+	f, err := configFingerprint(*configFile, extraFiles()...)
+	if err != nil {
+		// Likely caught mid-update, try again next time.
+		level.Debug(w.logger).Log("msg", "Error reading config files", "err", err)
+		return
+	}
+	if f == w.fingerprint {
+		return
+	}
+	reloadConfig(w.logger, "watch")
+	w.update()
+}
@@ -0,0 +1,286 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webhookURL          = kingpin.Flag("webhook.url", "URL to POST a JSON notification to when the scrapes of a target become anomalous, and when they recover. Tenants can set their own webhook_url. Disabled if empty.").Default("").String()
+	webhookHeaders      = kingpin.Flag("webhook.header", "Header to send with notifications, as name=value, can be repeated.").StringMap()
+	webhookWindow       = kingpin.Flag("webhook.window", "Number of recent scrapes of a target the thresholds are evaluated over.").Default("10").Int()
+	webhookErrorRatio   = kingpin.Flag("webhook.error-ratio", "Notify when more than this fraction of the recent scrapes of a target failed. 0 disables this.").Default("0.5").Float64()
+	webhookMaxDuration  = kingpin.Flag("webhook.max-duration", "Notify when a scrape of a target takes longer than this. 0 disables this.").Default("0s").Duration()
+	webhookSampleChange = kingpin.Flag("webhook.sample-change", "Notify when the samples of a scrape differ from the average of the recent successful scrapes of the target by more than this fraction. 0 disables this.").Default("0.5").Float64()
+
+	webhookNotifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_notifications_total",
+			Help:      "Notifications of scrape anomalies sent to webhooks, by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+// Anomalies of the scrapes of a target.
+const (
+	anomalyErrorRatio = "error_ratio"
+	anomalyDuration   = "duration"
+	anomalySamples    = "samples"
+)
+
+// webhookThresholds are the deviations of scrapes which are notified.
+type webhookThresholds struct {
+	window       int
+	errorRatio   float64
+	maxDuration  time.Duration
+	sampleChange float64
+}
+
+// webhookEvent is the JSON body of a notification.
+type webhookEvent struct {
+	// "firing" when the anomaly starts, "resolved" when it ends.
+	Status    string    `json:"status"`
+	Anomaly   string    `json:"anomaly"`
+	Target    string    `json:"target"`
+	Auth      string    `json:"auth"`
+	Modules   []string  `json:"modules"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+// scrapeHistory holds the recent scrapes of a target, and its anomalies
+// which were notified as firing.
+type scrapeHistory struct {
+	scrapes []targetStatus
+	firing  map[string]bool
+}
+
+// webhookMonitor detects anomalies in the scrapes of targets.
+type webhookMonitor struct {
+	mu        sync.Mutex
+	targets   map[string]*scrapeHistory
+	lastSweep time.Time
+}
+
+var webhooks = newWebhookMonitor()
+
+func newWebhookMonitor() *webhookMonitor {
+	return &webhookMonitor{targets: map[string]*scrapeHistory{}}
+}
+
+// observe adds a scrape to the history of its target, returning the
+// anomalies which started or ended with it. Targets which were not scraped
+// within the retention are forgotten.
+func (m *webhookMonitor) observe(scrape targetStatus, t webhookThresholds, retention time.Duration) []webhookEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if scrape.LastScrape.Sub(m.lastSweep) > time.Minute {
+		for key, h := range m.targets {
+			if last := h.scrapes[len(h.scrapes)-1]; last.LastScrape.Before(scrape.LastScrape.Add(-retention)) {
+				delete(m.targets, key)
+			}
+		}
+		m.lastSweep = scrape.LastScrape
+	}
+	key := scrape.key()
+	h, ok := m.targets[key]
+	if !ok {
+		h = &scrapeHistory{firing: map[string]bool{}}
+		m.targets[key] = h
+	}
+	// The samples of this scrape are compared to those before it.
+	previous := h.scrapes
+	h.scrapes = append(h.scrapes, scrape)
+	if len(h.scrapes) > t.window {
+		h.scrapes = h.scrapes[len(h.scrapes)-t.window:]
+	}
+
+	events := []webhookEvent{}
+	check := func(anomaly string, enabled, firing bool, value, threshold float64) {
+		if !enabled || firing == h.firing[anomaly] {
+			return
+		}
+		h.firing[anomaly] = firing
+		status := "firing"
+		if !firing {
+			status = "resolved"
+		}
+		events = append(events, webhookEvent{
+			Status:    status,
+			Anomaly:   anomaly,
+			Target:    scrape.Target,
+			Auth:      scrape.Auth,
+			Modules:   scrape.Modules,
+			Tenant:    scrape.Tenant,
+			Value:     value,
+			Threshold: threshold,
+			Time:      scrape.LastScrape,
+		})
+	}
+
+	// Error ratios of fewer scrapes than the window would be too noisy.
+	if len(h.scrapes) == t.window {
+		failures := 0
+		for _, s := range h.scrapes {
+			if s.Status != "success" {
+				failures++
+			}
+		}
+		ratio := float64(failures) / float64(len(h.scrapes))
+		check(anomalyErrorRatio, t.errorRatio > 0, ratio > t.errorRatio, ratio, t.errorRatio)
+	}
+	check(anomalyDuration, t.maxDuration > 0, scrape.DurationSeconds > t.maxDuration.Seconds(), scrape.DurationSeconds, t.maxDuration.Seconds())
+	if scrape.Status == "success" {
+		sum, n := 0, 0
+		for _, s := range previous {
+			if s.Status == "success" {
+				sum += s.Samples
+				n++
+			}
+		}
+		if n > 0 && sum > 0 {
+			average := float64(sum) / float64(n)
+			change := math.Abs(float64(scrape.Samples)-average) / average
+			check(anomalySamples, t.sampleChange > 0, change > t.sampleChange, change, t.sampleChange)
+		}
+	}
+	return events
+}
+
+// Notifications queued for a webhook beyond this are dropped, such as while
+// it's down.
+const maxQueuedNotifications = 1000
+
+// webhookSenders posts the notifications of each webhook URL one at a time,
+// in the order the anomalies were detected, so that a resolved notification
+// never overtakes the firing one.
+type webhookSenders struct {
+	mu sync.Mutex
+	// The notifications waiting to be posted to each URL. A URL is present
+	// while its sender runs.
+	queues map[string][]webhookEvent
+	client *http.Client
+}
+
+var senders = newWebhookSenders(http.DefaultClient)
+
+func newWebhookSenders(client *http.Client) *webhookSenders {
+	return &webhookSenders{queues: map[string][]webhookEvent{}, client: client}
+}
+
+// send queues the events for the URL, starting its sender if it isn't
+// running.
+func (s *webhookSenders) send(url string, events []webhookEvent, logger log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue, running := s.queues[url]
+	if dropped := len(queue) + len(events) - maxQueuedNotifications; dropped > 0 {
+		level.Warn(logger).Log("msg", "Too many webhook notifications queued, dropping", "dropped", dropped)
+		webhookNotifications.WithLabelValues("dropped").Add(float64(dropped))
+		events = events[:len(events)-dropped]
+	}
+	s.queues[url] = append(queue, events...)
+	if !running {
+		go s.run(url, logger)
+	}
+}
+
+// run posts the notifications queued for the URL until there are none left.
+func (s *webhookSenders) run(url string, logger log.Logger) {
+	for {
+		s.mu.Lock()
+		queue := s.queues[url]
+		if len(queue) == 0 {
+			delete(s.queues, url)
+			s.mu.Unlock()
+			return
+		}
+		event := queue[0]
+		s.queues[url] = queue[1:]
+		s.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := postWebhook(ctx, s.client, url, *webhookHeaders, event)
+		cancel()
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error notifying webhook", "anomaly", event.Anomaly, "status", event.Status, "err", err)
+			webhookNotifications.WithLabelValues("failure").Inc()
+			continue
+		}
+		webhookNotifications.WithLabelValues("success").Inc()
+	}
+}
+
+func postWebhook(ctx context.Context, client *http.Client, url string, headers map[string]string, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// observeScrape notifies the anomalies started or ended by a scrape to the
+// URL, in the background so as not to delay the scrape.
+func observeScrape(scrape targetStatus, url string, logger log.Logger) {
+	if url == "" {
+		return
+	}
+	events := webhooks.observe(scrape, webhookThresholds{
+		window:       max(*webhookWindow, 1),
+		errorRatio:   *webhookErrorRatio,
+		maxDuration:  *webhookMaxDuration,
+		sampleChange: *webhookSampleChange,
+	}, *targetsRetention)
+	if len(events) == 0 {
+		return
+	}
+	senders.send(url, events, logger)
+}